@@ -0,0 +1,209 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ADMIN_USAGE_CACHE_TTL         time.Duration = time.Duration(10) * time.Minute // the bucket is scanned at most once per TTL
+	ADMIN_USAGE_PAGE_SIZE_DEFAULT int           = 100
+	ADMIN_USAGE_PAGE_SIZE_MAX     int           = 1000
+)
+
+var _adminToken = "" // admin endpoints are disabled when not set
+
+type adminHeaderData struct {
+	XAdminToken string `header:"x-admin-token"`
+}
+
+type getUsageDataIn struct {
+	PageSize          int    `form:"pageSize"`
+	ContinuationToken string `form:"continuationToken"`
+}
+
+type getUsageDataOut struct {
+	Users                 []*userUsageDataOut `json:"users"`
+	HasMore               bool                `json:"hasMore"`
+	NextContinuationToken string              `json:"nextContinuationToken"`
+	ComputedAt            time.Time           `json:"computedAt"`
+}
+
+type userUsageDataOut struct {
+	UserId      string `json:"userId"`
+	ObjectCount int    `json:"objectCount"`
+	TotalBytes  int64  `json:"totalBytes"`
+}
+
+type usageSnapshot struct {
+	users      []*UsageData // sorted by size, descending
+	computedAt time.Time
+}
+
+var usageCache *usageSnapshot
+var usageCacheLock sync.Mutex
+var isUsageBeingComputed = false
+
+func SetAdminToken(token string) {
+	_adminToken = token
+}
+
+func SetAdminUsageCacheTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid admin usage cache TTL %v, should be positive", ttl)
+	}
+	ADMIN_USAGE_CACHE_TTL = ttl
+	return nil
+}
+
+func withAdminToken(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _adminToken == "" {
+			log.Printf("admin token is not configured")
+			toUnauthorized(c)
+			return
+		}
+
+		adminHeader := adminHeaderData{}
+		if err := c.ShouldBindHeader(&adminHeader); err != nil {
+			log.Printf("%v", err)
+			toUnauthorized(c)
+			return
+		}
+
+		// compare in constant time, so the token can't be guessed by timing the responses
+		if subtle.ConstantTimeCompare([]byte(adminHeader.XAdminToken), []byte(_adminToken)) != 1 {
+			log.Printf("invalid 'x-admin-token' header")
+			toUnauthorized(c)
+			return
+		}
+
+		handler(c)
+	}
+}
+
+// Reports the number of objects and the total size per user, the biggest first.
+// The numbers come from scanning the whole bucket, so they are cached and can be up to ADMIN_USAGE_CACHE_TTL old.
+// While the bucket is being scanned, the other requests are rejected with 429, to make sure only one scan runs at a time.
+func handleGetUsage(c *gin.Context) {
+	// get params from query string
+	var getUsageIn getUsageDataIn
+	if err := c.ShouldBindQuery(&getUsageIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// sanitize
+	if getUsageIn.PageSize < 0 || getUsageIn.PageSize > ADMIN_USAGE_PAGE_SIZE_MAX {
+		err := fmt.Errorf("invalid pageSize '%d', should be between 0 and %d", getUsageIn.PageSize, ADMIN_USAGE_PAGE_SIZE_MAX)
+		toBadRequest(c, err)
+		return
+	}
+	pageSize := getUsageIn.PageSize
+	if pageSize == 0 {
+		pageSize = ADMIN_USAGE_PAGE_SIZE_DEFAULT
+	}
+	offset := 0
+	if getUsageIn.ContinuationToken != "" {
+		var err error
+		offset, err = strconv.Atoi(getUsageIn.ContinuationToken)
+		if err != nil || offset < 0 {
+			err := fmt.Errorf("invalid continuationToken '%s'", getUsageIn.ContinuationToken)
+			toBadRequest(c, err)
+			return
+		}
+	}
+
+	// get usage
+	snapshot, err := getUsageSnapshot(c.Request.Context())
+	if err != nil {
+		if errors.Is(err, errUsageBeingComputed) {
+			c.Header("Retry-After", "10")
+			toJSON(c, http.StatusTooManyRequests, gin.H{"err": err.Error()})
+			return
+		}
+
+		toInternalServerError(c, err.Error())
+		return
+	}
+
+	// pack result
+	users := make([]*userUsageDataOut, 0, pageSize)
+	for i := offset; i < len(snapshot.users) && i < offset+pageSize; i++ {
+		users = append(users, &userUsageDataOut{
+			UserId:      snapshot.users[i].UserId,
+			ObjectCount: snapshot.users[i].ObjectCount,
+			TotalBytes:  snapshot.users[i].TotalBytes,
+		})
+	}
+	getUsageDataOut := &getUsageDataOut{
+		Users:      users,
+		HasMore:    offset+pageSize < len(snapshot.users),
+		ComputedAt: snapshot.computedAt,
+	}
+	if getUsageDataOut.HasMore {
+		getUsageDataOut.NextContinuationToken = strconv.Itoa(offset + pageSize)
+	}
+
+	// create response
+	toSuccess(c, getUsageDataOut)
+}
+
+var errUsageBeingComputed = errors.New("usage is being computed, retry later")
+
+func getUsageSnapshot(ctx context.Context) (*usageSnapshot, error) {
+	usageCacheLock.Lock()
+	if usageCache != nil && time.Since(usageCache.computedAt) < ADMIN_USAGE_CACHE_TTL {
+		snapshot := usageCache
+		usageCacheLock.Unlock()
+		return snapshot, nil
+	}
+	if isUsageBeingComputed {
+		usageCacheLock.Unlock()
+		return nil, errUsageBeingComputed
+	}
+	isUsageBeingComputed = true
+	usageCacheLock.Unlock()
+
+	defer func() {
+		usageCacheLock.Lock()
+		isUsageBeingComputed = false
+		usageCacheLock.Unlock()
+	}()
+
+	usage, err := getBucketUsage(ctx, getBucket())
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]*UsageData, 0, len(usage))
+	for _, userUsage := range usage {
+		users = append(users, userUsage)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].TotalBytes != users[j].TotalBytes {
+			return users[i].TotalBytes > users[j].TotalBytes
+		}
+		return users[i].UserId < users[j].UserId
+	})
+	snapshot := &usageSnapshot{
+		users:      users,
+		computedAt: time.Now(),
+	}
+
+	usageCacheLock.Lock()
+	usageCache = snapshot
+	usageCacheLock.Unlock()
+
+	return snapshot, nil
+}
@@ -0,0 +1,171 @@
+package app
+
+import (
+	"fmt"
+	"testing"
+)
+
+func useAdminToken(t *testing.T, token string) {
+	original := _adminToken
+	t.Cleanup(func() {
+		_adminToken = original
+		resetUsageCache()
+	})
+
+	SetAdminToken(token)
+	resetUsageCache()
+}
+
+func resetUsageCache() {
+	usageCacheLock.Lock()
+	defer usageCacheLock.Unlock()
+
+	usageCache = nil
+	isUsageBeingComputed = false
+}
+
+func TestGetUsageWithoutAdminToken(t *testing.T) {
+	useFakeS3(t)
+	useAdminToken(t, "secret")
+
+	c, w := newTestContext("GET", "/admin/usage", "")
+	withAdminToken(handleGetUsage)(c)
+
+	if w.Code != 401 {
+		t.Fatalf("Expected 401, actual: %d", w.Code)
+	}
+}
+
+func TestGetUsageWithWrongAdminToken(t *testing.T) {
+	useFakeS3(t)
+	useAdminToken(t, "secret")
+
+	c, w := newTestContext("GET", "/admin/usage", "")
+	c.Request.Header.Set("X-Admin-Token", "guess")
+	withAdminToken(handleGetUsage)(c)
+
+	if w.Code != 401 {
+		t.Fatalf("Expected 401, actual: %d", w.Code)
+	}
+}
+
+func TestGetUsageWhenAdminTokenNotConfigured(t *testing.T) {
+	useFakeS3(t)
+	useAdminToken(t, "")
+
+	c, w := newTestContext("GET", "/admin/usage", "")
+	c.Request.Header.Set("X-Admin-Token", "")
+	withAdminToken(handleGetUsage)(c)
+
+	if w.Code != 401 {
+		t.Fatalf("Expected 401, actual: %d", w.Code)
+	}
+}
+
+func TestGetUsageSortedBySizeAndPaginated(t *testing.T) {
+	fake := useFakeS3(t)
+	useAdminToken(t, "secret")
+	fake.seed("small/note.md", "1")
+	fake.seed("big/note 1.md", "1234567890")
+	fake.seed("big/note 2.md", "1234567890")
+	fake.seed("medium/note.md", "12345")
+	fake.seed("medium/"+TRASH_FOLDER+"deleted.md", "12345")
+	fake.seed("not a user", "123")
+
+	c, w := newTestContext("GET", "/admin/usage?pageSize=2", "")
+	c.Request.Header.Set("X-Admin-Token", "secret")
+	withAdminToken(handleGetUsage)(c)
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getUsageDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Users) != 2 {
+		t.Fatalf("Expected 2 users, actual: %d", len(out.Users))
+	}
+	if out.Users[0].UserId != "big" || out.Users[0].ObjectCount != 2 || out.Users[0].TotalBytes != 20 {
+		t.Errorf("Expected big with 2 objects and 20 bytes, actual: %+v", out.Users[0])
+	}
+	if out.Users[1].UserId != "medium" || out.Users[1].ObjectCount != 2 || out.Users[1].TotalBytes != 10 {
+		t.Errorf("Expected medium with 2 objects and 10 bytes, actual: %+v", out.Users[1])
+	}
+	if !out.HasMore {
+		t.Fatalf("Expected more users")
+	}
+
+	c, w = newTestContext("GET", fmt.Sprintf("/admin/usage?pageSize=2&continuationToken=%s", out.NextContinuationToken), "")
+	c.Request.Header.Set("X-Admin-Token", "secret")
+	withAdminToken(handleGetUsage)(c)
+
+	out = getUsageDataOut{}
+	parseDataResponse(t, w, &out)
+	if len(out.Users) != 1 || out.Users[0].UserId != "small" {
+		t.Errorf("Expected only small, actual: %+v", out.Users)
+	}
+	if out.HasMore {
+		t.Errorf("Expected no more users")
+	}
+}
+
+func TestGetUsageIsCached(t *testing.T) {
+	fake := useFakeS3(t)
+	useAdminToken(t, "secret")
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("GET", "/admin/usage", "")
+	c.Request.Header.Set("X-Admin-Token", "secret")
+	withAdminToken(handleGetUsage)(c)
+
+	fake.seed("user2/note.md", "content")
+	c, w = newTestContext("GET", "/admin/usage", "")
+	c.Request.Header.Set("X-Admin-Token", "secret")
+	withAdminToken(handleGetUsage)(c)
+
+	var out getUsageDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Users) != 1 {
+		t.Errorf("Expected cached usage with 1 user, actual: %d", len(out.Users))
+	}
+}
+
+func TestGetUsageWhileBeingComputed(t *testing.T) {
+	useFakeS3(t)
+	useAdminToken(t, "secret")
+	isUsageBeingComputed = true
+
+	c, w := newTestContext("GET", "/admin/usage", "")
+	c.Request.Header.Set("X-Admin-Token", "secret")
+	withAdminToken(handleGetUsage)(c)
+
+	if w.Code != 429 {
+		t.Fatalf("Expected 429, actual: %d", w.Code)
+	}
+}
+
+func TestGetUsagePerTenant(t *testing.T) {
+	fake := useFakeS3(t)
+	useAdminToken(t, "secret")
+	fake.seed("tenants/acme/user1/note.md", "12345")
+	fake.seed("tenants/acme/user2/note.md", "12345")
+	fake.seed("acme/note.md", "1")
+
+	c, w := newTestContext("GET", "/admin/usage", "")
+	c.Request.Header.Set("X-Admin-Token", "secret")
+	withAdminToken(handleGetUsage)(c)
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getUsageDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Users) != 2 {
+		t.Fatalf("Expected the tenant and the user, actual: %+v", out.Users)
+	}
+	if out.Users[0].UserId != "tenants/acme" || out.Users[0].ObjectCount != 2 || out.Users[0].TotalBytes != 10 {
+		t.Errorf("Expected tenants/acme with 2 objects and 10 bytes, actual: %+v", out.Users[0])
+	}
+	if out.Users[1].UserId != "acme" || out.Users[1].ObjectCount != 1 {
+		t.Errorf("Expected the user acme apart from the tenant, actual: %+v", out.Users[1])
+	}
+}
@@ -1,71 +1,193 @@
 package app
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"artemkv.net/notedok/health"
+	"artemkv.net/notedok/internal/fanout"
 	"artemkv.net/notedok/reststats"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
+var FAVICON_PATH = "./resources/favicon.ico" // relative to the working directory
+
+func SetFaviconPath(path string) {
+	FAVICON_PATH = path
+}
+
+// The path the service is mounted at, when behind the reverse proxy that routes by path, e.g. "/notes", empty for the root
+var BASE_PATH = ""
+
+func SetBasePath(basePath string) error {
+	if basePath != "" && (!strings.HasPrefix(basePath, "/") || strings.HasSuffix(basePath, "/") || strings.ContainsAny(basePath, " ?#")) {
+		return fmt.Errorf("invalid base path '%s', should start with '/', and neither end with '/' nor contain spaces, '?' or '#'", basePath)
+	}
+	BASE_PATH = basePath
+	return nil
+}
+
+// Off by default, the JSON responses are indented, to read them easily when exploring the API by hand.
+// Any single response can also be indented with "?pretty=true".
+var PRETTY_JSON = false
+
+func SetPrettyJson(enabled bool) {
+	PRETTY_JSON = enabled
+}
+
 func SetupRouter(router *gin.Engine, allowedOrigin string) {
 	// setup logger and recover
 	router.Use(requestLogger(log.StandardLogger()))
 	router.Use(gin.CustomRecovery(recover))
 
+	// shed the load, rather than run out of memory
+	router.Use(limitInflightRequests())
+
 	// setup CORS
 	allowedOrigins := strings.Split(allowedOrigin, ",")
 	router.Use(cors.New(getCorsConfig(allowedOrigins)))
 
-	// favicon
-	router.StaticFile("/favicon.ico", "./resources/favicon.ico")
+	// nothing changes during the maintenance
+	router.Use(rejectWritesWhenReadOnly())
+
+	// favicon, when missing, browsers still ask for it, so answer with no content rather than fill the logs with errors
+	base := router.Group(BASE_PATH)
+	if _, err := os.Stat(FAVICON_PATH); err == nil {
+		base.StaticFile("/favicon.ico", FAVICON_PATH)
+	} else {
+		log.Printf("favicon not found at '%s', serving none", FAVICON_PATH)
+		base.GET("/favicon.ico", toNoContent)
+	}
 
 	// update stats
 	router.Use(reststats.RequestCounter())
+	routes := router.Group(BASE_PATH)
 
 	// used for testing / health checks
-	router.GET("/health", health.HandleHealthCheck)
-	router.GET("/liveness", health.HandleLivenessCheck)
-	router.GET("/readiness", health.HandleReadinessCheck)
-	router.GET("/error", handleError)
+	routes.GET("/health", health.HandleHealthCheck)
+	routes.GET("/liveness", health.HandleLivenessCheck)
+	routes.GET("/readiness", health.HandleReadinessCheck)
+	routes.GET("/version", handleGetVersion)
+	routes.GET("/error", handleError)
 
 	// stats
-	router.GET("/stats", reststats.HandleEndpointWithStats(reststats.HandleGetStats))
+	routes.GET("/stats", reststats.HandleEndpointWithStats(reststats.HandleGetStats))
 
 	// sign-in
-	router.POST("/signin", reststats.HandleEndpointWithStats(handleSignIn))
+	routes.POST("/signin", reststats.HandleEndpointWithStats(handleSignIn))
+	routes.GET("/me", reststats.HandleEndpointWithStats(handleMe))
+
+	// public notes, no authentication
+	routes.GET("/public/:userId/:filename", reststats.HandleEndpointWithStats(withS3Storage(handleGetPublicFile)))
 
 	// do business
-	router.GET("/files", reststats.HandleEndpointWithStats(withAuthentication(handleGetFiles)))
-	router.GET("/files/:filename", reststats.HandleEndpointWithStats(withAuthentication(handleGetFile)))
-	router.PUT("/files/:filename", reststats.HandleEndpointWithStats(withAuthentication(handlePutFile)))
-	router.POST("/files/:filename", reststats.HandleEndpointWithStats(withAuthentication(handlePostFile)))
-	router.DELETE("/files/:filename", reststats.HandleEndpointWithStats(withAuthentication(handleDeleteFile)))
-	router.POST("/rename", reststats.HandleEndpointWithStats(withAuthentication(handleRenameFile)))
-	router.POST("/deleteall", reststats.HandleEndpointWithStats(withAuthentication(handleDeleteAllFiles)))
-
-	// handle 404
+	routes.GET("/files", reststats.HandleEndpointWithStats(withAuthentication(handleGetFiles)))
+	routes.GET("/manifest", reststats.HandleEndpointWithStats(withAuthentication(handleGetManifest)))
+	routes.GET("/files/index", reststats.HandleEndpointWithStats(withAuthentication(handleGetIndex)))
+	routes.POST("/files", reststats.HandleEndpointWithStats(withAuthentication(handleCreateUntitled)))
+	routes.GET("/files/:filename", reststats.HandleEndpointWithStats(withAuthentication(handleGetFile)))
+	routes.PUT("/files/:filename", reststats.HandleEndpointWithStats(withAuthentication(handlePutFile)))
+	routes.POST("/files/:filename", reststats.HandleEndpointWithStats(withAuthentication(handlePostFile)))
+	routes.DELETE("/files/:filename", reststats.HandleEndpointWithStats(withAuthentication(handleDeleteFile)))
+	routes.POST("/files/batch/delete", reststats.HandleEndpointWithStats(withS3Storage(withAuthentication(handleBatchDeleteFiles))))
+	routes.GET("/files/:filename/exists", reststats.HandleEndpointWithStats(withAuthentication(handleFileExists)))
+	routes.GET("/files/:filename/checksum", reststats.HandleEndpointWithStats(withS3Storage(withAuthentication(handleGetChecksum))))
+	routes.PUT("/files/:filename/sharing", reststats.HandleEndpointWithStats(withS3Storage(withAuthentication(handleSetSharing))))
+	routes.POST("/files/:filename/pin", reststats.HandleEndpointWithStats(withS3Storage(withAuthentication(handlePinFile))))
+	routes.DELETE("/files/:filename/pin", reststats.HandleEndpointWithStats(withS3Storage(withAuthentication(handleUnpinFile))))
+	routes.POST("/files/:filename/renameAndSave", reststats.HandleEndpointWithStats(withS3Storage(withAuthentication(handleRenameAndSaveFile))))
+	routes.POST("/files/:filename/convert", reststats.HandleEndpointWithStats(withAuthentication(handleConvertFile)))
+	routes.POST("/rename", reststats.HandleEndpointWithStats(withAuthentication(handleRenameFile)))
+	routes.POST("/rename/bulk", reststats.HandleEndpointWithStats(withAuthentication(handleBulkRename)))
+	routes.GET("/folders", reststats.HandleEndpointWithStats(withS3Storage(withAuthentication(handleListFolders))))
+	routes.POST("/move", reststats.HandleEndpointWithStats(withS3Storage(withAuthentication(handleMoveFile))))
+	routes.POST("/deleteall", reststats.HandleEndpointWithStats(withAuthentication(handleDeleteAllFiles)))
+	routes.GET("/trash", reststats.HandleEndpointWithStats(withS3Storage(withAuthentication(handleListTrash))))
+	routes.POST("/trash/empty", reststats.HandleEndpointWithStats(withS3Storage(withAuthentication(handleEmptyTrash))))
+	routes.GET("/export.ndjson", reststats.HandleEndpointWithStats(withS3Storage(withAuthentication(handleExportNdjson))))
+	routes.GET("/search", reststats.HandleEndpointWithStats(withS3Storage(withAuthentication(handleSearch))))
+	routes.POST("/tags/apply", reststats.HandleEndpointWithStats(withS3Storage(withAuthentication(handleApplyTags))))
+	routes.GET("/audit", reststats.HandleEndpointWithStats(withAuthentication(handleGetAudit)))
+	routes.GET("/changes", reststats.HandleEndpointWithStats(withAuthentication(handleGetChanges)))
+
+	// admin
+	routes.GET("/admin/usage", reststats.HandleEndpointWithStats(withS3Storage(withAdminToken(handleGetUsage))))
+	routes.POST("/admin/readonly", reststats.HandleEndpointWithStats(withAdminToken(handleSetReadOnly)))
+
+	// handle 405, for the known paths, and 404
+	router.HandleMethodNotAllowed = true
+	router.NoMethod(reststats.HandleWithStats(methodNotAllowedHandler(router)))
 	router.NoRoute(reststats.HandleWithStats(notFoundHandler()))
 }
 
+// The allowed origins are either exact, e.g. "https://notedok.example.com",
+// or wildcard subdomain patterns, e.g. "https://*.example.com", for the preview environments.
 func getCorsConfig(allowedOrigins []string) cors.Config {
-	return cors.Config{
-		AllowOrigins:  allowedOrigins,
+	exactOrigins := []string{}
+	patterns := []*regexp.Regexp{}
+	for _, origin := range allowedOrigins {
+		origin = strings.TrimSpace(origin)
+		if pattern, ok := compileOriginPattern(origin); ok {
+			patterns = append(patterns, pattern)
+		} else if origin != "" {
+			exactOrigins = append(exactOrigins, origin)
+		}
+	}
+
+	config := cors.Config{
+		AllowOrigins:  exactOrigins,
 		AllowHeaders:  []string{"*"},
 		AllowMethods:  []string{"*"},
 		ExposeHeaders: []string{"*"},
+		// the browsers only send the session cookie with the cross-origin requests when the credentials are allowed
+		AllowCredentials: SESSION_COOKIE_ENABLED,
 	}
+	if len(patterns) > 0 {
+		config.AllowOriginFunc = func(origin string) bool {
+			origin = strings.ToLower(origin)
+			for _, pattern := range patterns {
+				if pattern.MatchString(origin) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return config
+}
+
+// The wildcard stands for a single subdomain, the same as in DNS and TLS certificates,
+// so "https://*.example.com" allows "https://preview-1.example.com", but neither "https://example.com" nor "https://a.b.example.com".
+// Returns false when the origin is not a pattern.
+func compileOriginPattern(origin string) (*regexp.Regexp, bool) {
+	scheme, host, found := strings.Cut(origin, "://")
+	if !found || !strings.HasPrefix(host, "*.") || strings.Count(host, "*") != 1 {
+		return nil, false
+	}
+
+	pattern := "^" + regexp.QuoteMeta(strings.ToLower(scheme)+"://") +
+		"[a-z0-9]([a-z0-9-]*[a-z0-9])?" +
+		regexp.QuoteMeta(strings.ToLower(host[1:])) + "$"
+	return regexp.MustCompile(pattern), true
 }
 
-func toPlainTextWithEtag(c *gin.Context, content string, etag string) {
+func toTextWithEtag(c *gin.Context, content string, contentType string, etag string) {
 	c.Header("ETag", etag)
-	c.String(http.StatusOK, content)
+	c.Data(http.StatusOK, contentType, []byte(content))
 }
 
 func toNoContentWithEtag(c *gin.Context, etag string) {
@@ -73,12 +195,30 @@ func toNoContentWithEtag(c *gin.Context, etag string) {
 	c.Status(http.StatusNoContent)
 }
 
+func isPrettyJson(c *gin.Context) bool {
+	return PRETTY_JSON || c.Query("pretty") == "true"
+}
+
+// All the JSON responses go through here, so they can be indented
+func toJSON(c *gin.Context, code int, obj interface{}) {
+	if isPrettyJson(c) {
+		c.IndentedJSON(code, obj)
+		return
+	}
+	c.JSON(code, obj)
+}
+
 func toSuccess(c *gin.Context, data interface{}) {
-	c.JSON(http.StatusOK, gin.H{"data": data})
+	toJSON(c, http.StatusOK, gin.H{"data": data})
+}
+
+func toCreatedWithEtag(c *gin.Context, data interface{}, etag string) {
+	c.Header("ETag", etag)
+	toCreated(c, data)
 }
 
 func toCreated(c *gin.Context, data interface{}) {
-	c.JSON(http.StatusCreated, gin.H{"data": data})
+	toJSON(c, http.StatusCreated, gin.H{"data": data})
 }
 
 func toNoContent(c *gin.Context) {
@@ -86,28 +226,50 @@ func toNoContent(c *gin.Context) {
 }
 
 func toUnauthorized(c *gin.Context) {
-	c.JSON(http.StatusUnauthorized, gin.H{"err": "Unauthorized"})
+	toJSON(c, http.StatusUnauthorized, gin.H{"err": "Unauthorized"})
 }
 
 func toBadRequest(c *gin.Context, err error) {
-	c.JSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+	toJSON(c, http.StatusBadRequest, gin.H{"err": err.Error()})
+}
+
+// When there is something the client can use to resolve the conflict, it comes as data
+func toConflict(c *gin.Context, err error, data interface{}) {
+	if data == nil {
+		toJSON(c, http.StatusConflict, gin.H{"err": err.Error()})
+		return
+	}
+	toJSON(c, http.StatusConflict, gin.H{"err": err.Error(), "data": data})
 }
 
-func toConflict(c *gin.Context, err error) {
-	c.JSON(http.StatusConflict, gin.H{"err": err.Error()})
+// When there is something the client can use to resolve the conflict, it comes as data
+func toPreconditionFailed(c *gin.Context, err error, data interface{}) {
+	if data == nil {
+		toJSON(c, http.StatusPreconditionFailed, gin.H{"err": err.Error()})
+		return
+	}
+	toJSON(c, http.StatusPreconditionFailed, gin.H{"err": err.Error(), "data": data})
 }
 
+// The code tells the client whether the path is wrong, or the path is fine, but the note (or other resource) doesn't exist
+var (
+	ERROR_CODE_ROUTE_NOT_FOUND    = "ROUTE_NOT_FOUND"
+	ERROR_CODE_RESOURCE_NOT_FOUND = "RESOURCE_NOT_FOUND"
+)
+
 func toNotFound(c *gin.Context) {
-	c.JSON(http.StatusNotFound, gin.H{"err": "Not Found"})
+	toJSON(c, http.StatusNotFound, gin.H{"err": "Not found", "code": ERROR_CODE_RESOURCE_NOT_FOUND})
 }
 
-func toNotModified(c *gin.Context) {
-	c.JSON(http.StatusNotModified, gin.H{"err": "Not Modified"})
+// No body, as HTTP requires, only the ETag the client already has, so the caches can refresh their copy
+func toNotModified(c *gin.Context, etag string) {
+	c.Header("ETag", etag)
+	c.Status(http.StatusNotModified)
 }
 
 func toInternalServerError(c *gin.Context, errText string) {
 	// TODO: when too many internal server errors, set liveness to false and exit
-	c.JSON(http.StatusInternalServerError, gin.H{"err": errText})
+	toJSON(c, http.StatusInternalServerError, gin.H{"err": errText})
 }
 
 func recover(c *gin.Context, err interface{}) {
@@ -117,25 +279,246 @@ func recover(c *gin.Context, err interface{}) {
 	c.AbortWithStatus(http.StatusInternalServerError)
 
 	reststats.UpdateResponseStatsOnRecover(
-		time.Now(), c.Request.RequestURI, http.StatusInternalServerError)
+		time.Now(), c.Request.RequestURI, c.FullPath(), http.StatusInternalServerError)
+}
+
+var MAX_INFLIGHT = 256 // max requests handled at the same time, the rest get 503
+
+// Always served, so the orchestrator doesn't restart the instance that is simply busy.
+// The long-polls are held for up to a minute, so instead of taking up the slots of all the other requests, they have their own limit.
+var LOAD_SHEDDING_EXEMPT_PATHS = []string{"/health", "/liveness", "/readiness", "/changes"}
+
+var _inflightLimiter, _ = fanout.NewLimiter(MAX_INFLIGHT)
+
+func SetMaxInflight(limit int) error {
+	limiter, err := fanout.NewLimiter(limit)
+	if err != nil {
+		return err
+	}
+	MAX_INFLIGHT = limit
+	_inflightLimiter = limiter
+	return nil
+}
+
+// Rejects the request with 503 right away when MAX_INFLIGHT requests are already being handled,
+// instead of queuing it, so the client can retry later or with another instance.
+func limitInflightRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if slices.Contains(LOAD_SHEDDING_EXEMPT_PATHS, strings.TrimPrefix(c.Request.URL.Path, BASE_PATH)) {
+			c.Next()
+			return
+		}
+
+		limiter := _inflightLimiter
+		if !limiter.TryAcquire() {
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"err": "too many requests in progress, retry later"})
+			return
+		}
+		defer limiter.Release()
+
+		c.Next()
+	}
+}
+
+// The load balancers in front of the service, as IPs or CIDRs, none by default, so X-Forwarded-For is never believed.
+// Gin can only be told about them when it runs the server itself, which it doesn't, so the client IP is resolved here.
+var TRUSTED_PROXIES = []string{}
+
+var _trustedProxies []*net.IPNet
+
+func SetTrustedProxies(proxies []string) error {
+	trustedProxies := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		cidr := proxy
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy '%s', should be IP or CIDR", proxy)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy '%s', should be IP or CIDR", proxy)
+		}
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+
+	TRUSTED_PROXIES = proxies
+	_trustedProxies = trustedProxies
+	return nil
 }
 
+func isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range _trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// X-Forwarded-For is only believed when the request comes from the trusted proxy, and it is read from the right,
+// skipping the trusted proxies, since everything to the left of the closest untrusted address could be made up by the client.
+func getClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		return ""
+	}
+	clientIP := net.ParseIP(host)
+	if clientIP == nil {
+		return ""
+	}
+
+	forwardedFor := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwardedFor) - 1; i >= 0 && isTrustedProxy(clientIP); i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+		if ip == nil {
+			break
+		}
+		clientIP = ip
+	}
+	return clientIP.String()
+}
+
+var REQUEST_ID_HEADER = "X-Request-Id"
+var USER_ID_KEY = "user_id"     // set by withAuthentication, so the logger can report who made the request
+var TENANT_ID_KEY = "tenant_id" // set by withAuthentication, when the user signed in with the tenant
+var REQUEST_ID_KEY = "request_id"
+
+// Every request is logged by default. With N, only 1 of every N successful (or not modified) requests is logged per route,
+// e.g. the polling GET /files, while the 4xx and 5xx are always logged.
+var LOG_SAMPLE_N = 1
+
+func SetLogSampleN(n int) error {
+	if n < 1 {
+		return fmt.Errorf("invalid log sample rate %d, should be 1 or more", n)
+	}
+	LOG_SAMPLE_N = n
+	return nil
+}
+
+// Counts the successful requests per route, the routes are known in advance, so the counters never grow beyond them
+type logSampler struct {
+	counters sync.Map // route -> *atomic.Uint64
+}
+
+// The first request of the route is always logged, then every N-th
+func (sampler *logSampler) shouldLog(route string, status int, n int) bool {
+	if n <= 1 || status >= http.StatusBadRequest {
+		return true
+	}
+	counter, _ := sampler.counters.LoadOrStore(route, &atomic.Uint64{})
+	return (counter.(*atomic.Uint64).Add(1)-1)%uint64(n) == 0
+}
+
+// Logs every request once it's handled, as a structured entry, so the logs can be queried by any of the fields.
+// The request id is taken from the X-Request-Id header, when provided by the load balancer, otherwise it is generated.
+// In both cases, it is returned back in the same header.
 func requestLogger(logger *log.Logger) gin.HandlerFunc {
-	// TODO: logs 4XX as 200
+	sampler := &logSampler{}
 	return func(c *gin.Context) {
-		message := fmt.Sprintf("%d %s %s",
+		start := time.Now()
+
+		requestId := c.GetHeader(REQUEST_ID_HEADER)
+		if requestId == "" || len(requestId) > 100 {
+			requestId = newRequestId()
+		}
+		c.Header(REQUEST_ID_HEADER, requestId)
+		c.Set(REQUEST_ID_KEY, requestId)
+		c.Request = c.Request.WithContext(withRequestId(c.Request.Context(), requestId))
+
+		c.Next()
+
+		// the route, not the path, so all the notes count together; the unknown paths all give 404, which are always logged
+		sampleN := LOG_SAMPLE_N
+		if !sampler.shouldLog(c.Request.Method+" "+c.FullPath(), c.Writer.Status(), sampleN) {
+			return
+		}
+
+		fields := log.Fields{
+			"request_id": requestId,
+			"method":     c.Request.Method,
+			"path":       c.Request.URL.Path,
+			"status":     c.Writer.Status(),
+			"latency_ms": time.Since(start).Milliseconds(),
+			"bytes_out":  max(c.Writer.Size(), 0), // -1 when nothing was written
+			"client_ip":  getClientIP(c.Request),
+		}
+		if userId := c.GetString(USER_ID_KEY); userId != "" {
+			fields["user_id"] = userId
+		}
+		if tenantId := c.GetString(TENANT_ID_KEY); tenantId != "" {
+			fields["tenant_id"] = tenantId
+		}
+		if sampleN > 1 && c.Writer.Status() < http.StatusBadRequest {
+			fields["sample_n"] = sampleN // stands for that many requests
+		}
+
+		logger.WithFields(fields).Info(fmt.Sprintf("%d %s %s",
 			c.Writer.Status(),
 			c.Request.Method,
-			c.Request.URL.Path)
+			c.Request.URL.Path))
+	}
+}
 
-		logger.Info(message)
+func newRequestId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
 	}
+	return hex.EncodeToString(id)
 }
 
 func notFoundHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.JSON(http.StatusNotFound, gin.H{"err": "Not found"})
+		toJSON(c, http.StatusNotFound, gin.H{"err": "Not found", "code": ERROR_CODE_ROUTE_NOT_FOUND})
+	}
+}
+
+// Gin only tells the path is known for another method, so the allowed methods are found by matching the routes
+func methodNotAllowedHandler(router *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed := []string{}
+		for _, route := range router.Routes() {
+			if isRouteMatching(route.Path, c.Request.URL.Path) && !slices.Contains(allowed, route.Method) {
+				allowed = append(allowed, route.Method)
+			}
+		}
+		sort.Strings(allowed)
+
+		c.Header("Allow", strings.Join(allowed, ", "))
+		toJSON(c, http.StatusMethodNotAllowed, gin.H{"err": "Method Not Allowed"})
+	}
+}
+
+// Good enough for the routes of the app, ":param" matches a single segment, "*param" matches the rest of the path
+func isRouteMatching(routePath string, path string) bool {
+	routeSegments := strings.Split(strings.Trim(routePath, "/"), "/")
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, routeSegment := range routeSegments {
+		if strings.HasPrefix(routeSegment, "*") {
+			return true
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if strings.HasPrefix(routeSegment, ":") {
+			if segments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if routeSegment != segments[i] {
+			return false
+		}
 	}
+	return len(routeSegments) == len(segments)
 }
 
 func handleError(c *gin.Context) {
@@ -0,0 +1,601 @@
+package app
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"artemkv.net/notedok/reststats"
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+func newLoggedRouter() (*gin.Engine, *bytes.Buffer) {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+
+	router := gin.New()
+	router.Use(requestLogger(logger))
+	return router, &buf
+}
+
+func useLogSampleN(t *testing.T, n int) {
+	original := LOG_SAMPLE_N
+	if err := SetLogSampleN(n); err != nil {
+		t.Fatalf("Expected no error, actual: %v", err)
+	}
+	t.Cleanup(func() {
+		LOG_SAMPLE_N = original
+	})
+}
+
+func parseLogEntry(t *testing.T, buf *bytes.Buffer) map[string]interface{} {
+	var entry map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatalf("Could not parse log entry '%s': %v", buf.String(), err)
+	}
+	return entry
+}
+
+func TestRequestLoggerReportsAllFields(t *testing.T) {
+	router, buf := newLoggedRouter()
+	router.GET("/files", withAuthentication(func(c *gin.Context, userId string, email string) {
+		c.String(http.StatusNotFound, "not here")
+	}))
+
+	SetEncryptionPassphrase("test passphrase")
+	session, err := generateSession("user1", "user1@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/files", nil)
+	req.Header.Set("x-session", base64.StdEncoding.EncodeToString(session))
+	req.Header.Set("X-Request-Id", "request-1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	entry := parseLogEntry(t, buf)
+	expected := map[string]interface{}{
+		"request_id": "request-1",
+		"method":     "GET",
+		"path":       "/files",
+		"status":     float64(404),
+		"bytes_out":  float64(len("not here")),
+		"user_id":    "user1",
+		"client_ip":  "192.0.2.1",
+	}
+	for field, value := range expected {
+		if entry[field] != value {
+			t.Errorf("Expected %s to be %v, actual: %v", field, value, entry[field])
+		}
+	}
+	if _, ok := entry["latency_ms"]; !ok {
+		t.Errorf("Expected latency_ms to be present")
+	}
+	if w.Header().Get("X-Request-Id") != "request-1" {
+		t.Errorf("Expected request id to be returned, actual: '%s'", w.Header().Get("X-Request-Id"))
+	}
+}
+
+func TestRequestLoggerGeneratesRequestIdAndSkipsAnonymousUser(t *testing.T) {
+	router, buf := newLoggedRouter()
+	router.GET("/health", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	entry := parseLogEntry(t, buf)
+	if entry["request_id"] == "" || entry["request_id"] != w.Header().Get("X-Request-Id") {
+		t.Errorf("Expected generated request id to be logged and returned, actual: %v", entry["request_id"])
+	}
+	if _, ok := entry["user_id"]; ok {
+		t.Errorf("Expected no user_id, actual: %v", entry["user_id"])
+	}
+	if entry["bytes_out"] != float64(0) {
+		t.Errorf("Expected bytes_out to be 0, actual: %v", entry["bytes_out"])
+	}
+}
+
+func useMaxInflight(t *testing.T, limit int) {
+	maxInflight, inflightLimiter := MAX_INFLIGHT, _inflightLimiter
+	t.Cleanup(func() {
+		MAX_INFLIGHT, _inflightLimiter = maxInflight, inflightLimiter
+	})
+	err := SetMaxInflight(limit)
+	if err != nil {
+		t.Fatalf("Error setting max inflight: %s", err)
+	}
+}
+
+func TestLimitInflightRequestsShedsOverflow(t *testing.T) {
+	useMaxInflight(t, 2)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	router := gin.New()
+	router.Use(limitInflightRequests())
+	router.GET("/slow", func(c *gin.Context) {
+		entered <- struct{}{}
+		<-release
+		c.Status(http.StatusOK)
+	})
+	router.GET("/readiness", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	// saturate the limiter
+	done := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+			done <- w.Code
+		}()
+		<-entered
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+	if w.Code != 503 {
+		t.Errorf("Expected 503 on overflow, actual: %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected Retry-After")
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/readiness", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected readiness to be served, actual: %d", w.Code)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-done; code != 200 {
+			t.Errorf("Expected 200 for the admitted requests, actual: %d", code)
+		}
+	}
+
+	// the slots are released once the requests are handled
+	go func() { <-entered }()
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected 200 after the load is gone, actual: %d", w.Code)
+	}
+}
+
+func requestWithOrigin(router *gin.Engine, origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "http://api.notedok.test/files", nil)
+	req.Header.Set("Origin", origin)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestCorsAllowsExactAndWildcardOrigins(t *testing.T) {
+	router := gin.New()
+	router.Use(cors.New(getCorsConfig([]string{"http://localhost:5173", " https://*.example.com"})))
+	router.GET("/files", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	cases := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"http://localhost:5173", true},
+		{"https://preview-1.example.com", true},
+		{"https://Preview-2.Example.com", true},
+		{"https://example.com", false},
+		{"https://a.b.example.com", false},
+		{"http://preview-1.example.com", false},
+		{"https://preview-1.example.com.evil.com", false},
+		{"https://evilexample.com", false},
+		{"http://localhost:5174", false},
+	}
+
+	for _, tc := range cases {
+		w := requestWithOrigin(router, tc.origin)
+		allowOrigin := w.Header().Get("Access-Control-Allow-Origin")
+		if tc.allowed && (w.Code != http.StatusOK || allowOrigin != tc.origin) {
+			t.Errorf("Expected %s to be allowed, actual: %d '%s'", tc.origin, w.Code, allowOrigin)
+		}
+		if !tc.allowed && (w.Code != http.StatusForbidden || allowOrigin != "") {
+			t.Errorf("Expected %s to be forbidden, actual: %d '%s'", tc.origin, w.Code, allowOrigin)
+		}
+	}
+}
+
+var initStatsOnce sync.Once
+
+func newAppRouter() *gin.Engine {
+	initStatsOnce.Do(func() {
+		reststats.Initialize("test")
+	})
+
+	router := gin.New()
+	SetupRouter(router, "http://localhost:5173")
+	return router
+}
+
+func TestUnsupportedMethodOnKnownPathIsNotAllowed(t *testing.T) {
+	router := newAppRouter()
+
+	req := httptest.NewRequest(http.MethodPatch, "/files/x.md", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected 405, actual: %d", w.Code)
+	}
+	if allow := w.Header().Get("Allow"); allow != "DELETE, GET, POST, PUT" {
+		t.Errorf("Expected 'DELETE, GET, POST, PUT', actual: '%s'", allow)
+	}
+}
+
+func TestUnknownPathIsNotFound(t *testing.T) {
+	router := newAppRouter()
+
+	req := httptest.NewRequest(http.MethodGet, "/nope", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404, actual: %d", w.Code)
+	}
+	if w.Header().Get("Allow") != "" {
+		t.Errorf("Expected no Allow header, actual: '%s'", w.Header().Get("Allow"))
+	}
+	if response := parseNotFoundResponse(t, w); response.Code != ERROR_CODE_ROUTE_NOT_FOUND || response.Err != "Not found" {
+		t.Errorf("Expected 'Not found' with %s, actual: '%s' with %s", ERROR_CODE_ROUTE_NOT_FOUND, response.Err, response.Code)
+	}
+}
+
+func TestMissingNoteIsNotFound(t *testing.T) {
+	useFakeS3(t)
+
+	c, w := newTestContext("GET", "/files/missing.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "missing.md"}}
+	runAsUser(c, handleGetFile, "user1")
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404, actual: %d", w.Code)
+	}
+	if response := parseNotFoundResponse(t, w); response.Code != ERROR_CODE_RESOURCE_NOT_FOUND || response.Err != "Not found" {
+		t.Errorf("Expected 'Not found' with %s, actual: '%s' with %s", ERROR_CODE_RESOURCE_NOT_FOUND, response.Err, response.Code)
+	}
+}
+
+type notFoundResponse struct {
+	Err  string `json:"err"`
+	Code string `json:"code"`
+}
+
+func parseNotFoundResponse(t *testing.T, w *httptest.ResponseRecorder) *notFoundResponse {
+	var response notFoundResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Could not parse the response: %v", err)
+	}
+	return &response
+}
+
+func TestIsRouteMatching(t *testing.T) {
+	cases := []struct {
+		routePath string
+		path      string
+		matching  bool
+	}{
+		{"/files/:filename", "/files/x.md", true},
+		{"/files/:filename", "/files", false},
+		{"/files/:filename", "/files/x.md/exists", false},
+		{"/files/:filename/exists", "/files/x.md/exists", true},
+		{"/public/:userId/:filename", "/public/user1/x.md", true},
+		{"/static/*filepath", "/static/a/b.css", true},
+		{"/files", "/files", true},
+		{"/files", "/folders", false},
+	}
+
+	for _, tc := range cases {
+		if isRouteMatching(tc.routePath, tc.path) != tc.matching {
+			t.Errorf("Expected matching of '%s' and '%s' to be %v", tc.routePath, tc.path, tc.matching)
+		}
+	}
+}
+
+func useFaviconPath(t *testing.T, path string) {
+	original := FAVICON_PATH
+	FAVICON_PATH = path
+	t.Cleanup(func() {
+		FAVICON_PATH = original
+	})
+}
+
+func TestFaviconIsServed(t *testing.T) {
+	useFaviconPath(t, "../resources/favicon.ico")
+	router := newAppRouter()
+
+	req := httptest.NewRequest(http.MethodGet, "/favicon.ico", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	if w.Body.Len() == 0 {
+		t.Errorf("Expected the favicon")
+	}
+}
+
+func TestMissingFaviconGivesNoContent(t *testing.T) {
+	useFaviconPath(t, "./no/such/favicon.ico")
+	router := newAppRouter()
+
+	req := httptest.NewRequest(http.MethodGet, "/favicon.ico", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+}
+
+func useBasePath(t *testing.T, basePath string) {
+	original := BASE_PATH
+	BASE_PATH = basePath
+	t.Cleanup(func() {
+		BASE_PATH = original
+	})
+}
+
+func TestRoutesAreMountedUnderBasePath(t *testing.T) {
+	useBasePath(t, "/notes")
+	router := newAppRouter()
+
+	cases := []struct {
+		method   string
+		path     string
+		expected int
+	}{
+		{http.MethodGet, "/notes/liveness", http.StatusOK},
+		{http.MethodGet, "/liveness", http.StatusNotFound},
+		{http.MethodGet, "/notes/files", http.StatusUnauthorized},
+		{http.MethodPatch, "/notes/files/x.md", http.StatusMethodNotAllowed},
+	}
+
+	for _, tc := range cases {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != tc.expected {
+			t.Errorf("%s %s: expected %d, actual: %d", tc.method, tc.path, tc.expected, w.Code)
+		}
+	}
+}
+
+func TestSetBasePath(t *testing.T) {
+	useBasePath(t, "")
+
+	for _, basePath := range []string{"", "/notes", "/api/notes"} {
+		if err := SetBasePath(basePath); err != nil {
+			t.Errorf("Expected '%s' to be accepted, actual: '%v'", basePath, err)
+		}
+	}
+	for _, basePath := range []string{"notes", "/notes/", "/", "/my notes", "/notes?x"} {
+		if err := SetBasePath(basePath); err == nil {
+			t.Errorf("Expected '%s' to be rejected", basePath)
+		}
+	}
+}
+
+func useTrustedProxies(t *testing.T, proxies []string) {
+	original := TRUSTED_PROXIES
+	if err := SetTrustedProxies(proxies); err != nil {
+		t.Fatalf("Expected no error, actual: '%v'", err)
+	}
+	t.Cleanup(func() {
+		SetTrustedProxies(original)
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	useTrustedProxies(t, []string{"10.0.0.0/8", "192.168.1.10"})
+
+	cases := []struct {
+		remoteAddr   string
+		forwardedFor string
+		expected     string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		{"203.0.113.5:1234", "1.2.3.4", "203.0.113.5"}, // spoofed, not from the proxy
+		{"10.1.2.3:1234", "198.51.100.7", "198.51.100.7"},
+		{"192.168.1.10:1234", "1.2.3.4, 198.51.100.7, 10.1.2.3", "198.51.100.7"}, // the client made up the first one
+		{"10.1.2.3:1234", "10.4.5.6", "10.4.5.6"},
+		{"10.1.2.3:1234", "garbage", "10.1.2.3"},
+		{"[2001:db8::1]:1234", "1.2.3.4", "2001:db8::1"},
+	}
+
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/files", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+
+		clientIP := getClientIP(req)
+		if clientIP != tc.expected {
+			t.Errorf("%s via %s: expected '%s', actual: '%s'", tc.forwardedFor, tc.remoteAddr, tc.expected, clientIP)
+		}
+	}
+}
+
+func TestClientIPTrustsNoProxyByDefault(t *testing.T) {
+	useTrustedProxies(t, []string{})
+
+	req := httptest.NewRequest(http.MethodGet, "/files", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+	if clientIP := getClientIP(req); clientIP != "10.1.2.3" {
+		t.Errorf("Expected '10.1.2.3', actual: '%s'", clientIP)
+	}
+}
+
+func TestSetTrustedProxiesRejectsInvalidEntries(t *testing.T) {
+	useTrustedProxies(t, []string{})
+
+	for _, proxy := range []string{"10.0.0.0/33", "not an ip", "10.0.0"} {
+		if err := SetTrustedProxies([]string{proxy}); err == nil {
+			t.Errorf("Expected '%s' to be rejected", proxy)
+		}
+	}
+}
+
+func usePrettyJson(t *testing.T, enabled bool) {
+	original := PRETTY_JSON
+	SetPrettyJson(enabled)
+	t.Cleanup(func() {
+		PRETTY_JSON = original
+	})
+}
+
+func TestJsonIsCompactByDefault(t *testing.T) {
+	c, w := newTestContext("GET", "/test", "")
+	toSuccess(c, gin.H{"a": 1})
+
+	if w.Body.String() != `{"data":{"a":1}}` {
+		t.Errorf("Expected compact JSON, actual: %s", w.Body.String())
+	}
+}
+
+func TestJsonIsIndentedWhenEnabled(t *testing.T) {
+	usePrettyJson(t, true)
+
+	c, w := newTestContext("GET", "/test", "")
+	toSuccess(c, gin.H{"a": 1})
+
+	expected := "{\n    \"data\": {\n        \"a\": 1\n    }\n}"
+	if w.Body.String() != expected {
+		t.Errorf("Expected indented JSON, actual: %s", w.Body.String())
+	}
+}
+
+func TestJsonIsIndentedWhenAskedInQuery(t *testing.T) {
+	c, w := newTestContext("GET", "/test?pretty=true", "")
+	toBadRequest(c, fmt.Errorf("some error"))
+
+	expected := "{\n    \"err\": \"some error\"\n}"
+	if w.Body.String() != expected {
+		t.Errorf("Expected indented JSON, actual: %s", w.Body.String())
+	}
+}
+
+func TestVersionIsServedWithoutAuthentication(t *testing.T) {
+	SetVersion("1.2.3", "2024-01-31T10:15:30Z")
+	t.Cleanup(func() {
+		SetVersion("", "")
+	})
+	router := newAppRouter()
+
+	req := httptest.NewRequest(http.MethodGet, "/version", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var versionOut getVersionDataOut
+	parseDataResponse(t, w, &versionOut)
+	if versionOut.Version != "1.2.3" {
+		t.Errorf("Expected '1.2.3', actual: '%s'", versionOut.Version)
+	}
+	if versionOut.BuildTime != "2024-01-31T10:15:30Z" {
+		t.Errorf("Expected the build time, actual: '%s'", versionOut.BuildTime)
+	}
+	if !strings.HasPrefix(versionOut.GoVersion, "go") {
+		t.Errorf("Expected the go version, actual: '%s'", versionOut.GoVersion)
+	}
+}
+
+func TestRequestLoggerSamplesSuccessfulRequestsPerRoute(t *testing.T) {
+	useLogSampleN(t, 10)
+	router, buf := newLoggedRouter()
+	router.GET("/files/:filename", func(c *gin.Context) {
+		c.String(http.StatusOK, "content")
+	})
+	router.GET("/files", func(c *gin.Context) {
+		c.Status(http.StatusNotModified)
+	})
+	router.GET("/fail", func(c *gin.Context) {
+		c.String(http.StatusInternalServerError, "failed")
+	})
+
+	countLogged := func(target string, requests int) int {
+		buf.Reset()
+		for i := 0; i < requests; i++ {
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", fmt.Sprintf(target, i), nil))
+		}
+		return strings.Count(buf.String(), "\n")
+	}
+
+	if logged := countLogged("/files/note%d.md", 100); logged != 10 {
+		t.Errorf("Expected 10 of 100 successful requests logged, actual: %d", logged)
+	}
+	if logged := countLogged("/files?page=%d", 15); logged != 2 {
+		t.Errorf("Expected 2 of 15 not modified requests logged, actual: %d", logged)
+	}
+	if logged := countLogged("/fail?attempt=%d", 20); logged != 20 {
+		t.Errorf("Expected all 20 failed requests logged, actual: %d", logged)
+	}
+	if logged := countLogged("/nope/%d", 20); logged != 20 {
+		t.Errorf("Expected all 20 unknown paths logged, actual: %d", logged)
+	}
+}
+
+func TestRequestLoggerMarksSampledEntries(t *testing.T) {
+	useLogSampleN(t, 10)
+	router, buf := newLoggedRouter()
+	router.GET("/files", func(c *gin.Context) {
+		c.String(http.StatusOK, "[]")
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/files", nil))
+
+	entry := parseLogEntry(t, buf)
+	if entry["sample_n"] != float64(10) {
+		t.Errorf("Expected sample_n 10, actual: %v", entry["sample_n"])
+	}
+}
+
+func TestRequestLoggerLogsEverythingByDefault(t *testing.T) {
+	useLogSampleN(t, 1)
+	router, buf := newLoggedRouter()
+	router.GET("/files", func(c *gin.Context) {
+		c.String(http.StatusOK, "[]")
+	})
+
+	for i := 0; i < 5; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/files", nil))
+	}
+
+	if logged := strings.Count(buf.String(), "\n"); logged != 5 {
+		t.Errorf("Expected 5 requests logged, actual: %d", logged)
+	}
+	if strings.Contains(buf.String(), "sample_n") {
+		t.Errorf("Expected no sample_n")
+	}
+}
@@ -0,0 +1,260 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Where the audit entries go: "s3" appends them to the user audit log, next to the notes,
+// "log" only writes them into the service log, "off" drops them.
+var (
+	AUDIT_SINK_S3  = "s3"
+	AUDIT_SINK_LOG = "log"
+	AUDIT_SINK_OFF = "off"
+)
+
+var AUDIT_SINK = AUDIT_SINK_S3
+
+var (
+	AUDIT_ENTRIES_DEFAULT int = 100
+	AUDIT_ENTRIES_MAX     int = 1000
+)
+
+var AUDIT_LOG_CONTENT_TYPE = "application/x-ndjson"
+
+var (
+	AUDIT_ACTION_CREATE = "create"
+	AUDIT_ACTION_UPDATE = "update"
+	AUDIT_ACTION_DELETE = "delete"
+	AUDIT_ACTION_RENAME = "rename"
+	AUDIT_ACTION_MOVE   = "move"
+)
+
+func SetAuditSink(sink string) error {
+	if sink != AUDIT_SINK_S3 && sink != AUDIT_SINK_LOG && sink != AUDIT_SINK_OFF {
+		return fmt.Errorf("invalid audit sink '%s', should be one of '%s', '%s', '%s'", sink, AUDIT_SINK_S3, AUDIT_SINK_LOG, AUDIT_SINK_OFF)
+	}
+	AUDIT_SINK = sink
+	return nil
+}
+
+// Stored as a single JSON line
+type auditEntry struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Action      string    `json:"action"`
+	FileName    string    `json:"fileName"`              // with the folder, e.g. "work/my file.md"
+	NewFileName string    `json:"newFileName,omitempty"` // only for rename and move
+	ETag        string    `json:"etag,omitempty"`        // the new one, none for delete
+	RequestId   string    `json:"requestId,omitempty"`
+}
+
+type getAuditDataIn struct {
+	Limit int `form:"limit"`
+}
+
+type getAuditDataOut struct {
+	Entries []*auditEntry `json:"entries"` // newest first
+}
+
+// Tracks the audit entries being written, so the tests can wait for them
+var _auditWrites sync.WaitGroup
+
+// One object per entry, e.g. ".audit/202401/8240000000000000000-1a2b3c4d.json", so recording the entry is a single write,
+// however many entries the month already has. The name starts with the time counted backwards,
+// so S3 lists the entries of the month newest first, and the random part keeps the entries made at the same time apart.
+func getAuditEntryFileName(t time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return getAuditMonthFolder(t) + fmt.Sprintf("%019d", math.MaxInt64-t.UnixNano()) + "-" + hex.EncodeToString(suffix) + ".json"
+}
+
+func getAuditMonthFolder(t time.Time) string {
+	return AUDIT_FOLDER + t.UTC().Format("200601") + "/"
+}
+
+// The entries used to be appended to one file per month, e.g. ".audit/log-202401.jsonl", these are still read
+func getAuditLogFileName(t time.Time) string {
+	return AUDIT_FOLDER + "log-" + t.UTC().Format("200601") + ".jsonl"
+}
+
+// Records the successful mutation in the background, so it doesn't slow the request down.
+// The mutation has already happened by then, so the failure to record it is only logged.
+func recordAudit(c *gin.Context, userId string, entry *auditEntry) {
+	entry.Timestamp = time.Now().UTC()
+	entry.RequestId = c.GetString(REQUEST_ID_KEY)
+
+	prefix := userPrefix(c, userId) // the context is not to be used once the request is over
+
+	// wake up the polls, whatever the sink
+	_changeFeed.publish(prefix, entry)
+
+	switch AUDIT_SINK {
+	case AUDIT_SINK_S3:
+		_auditWrites.Add(1)
+		go func() {
+			defer _auditWrites.Done()
+			writeAuditEntry(context.Background(), prefix, entry)
+		}()
+	case AUDIT_SINK_LOG:
+		log.WithFields(log.Fields{
+			"user_id":       userId,
+			"action":        entry.Action,
+			"file_name":     entry.FileName,
+			"new_file_name": entry.NewFileName,
+			"etag":          entry.ETag,
+			"request_id":    entry.RequestId,
+		}).Info("audit")
+	}
+}
+
+func writeAuditEntry(ctx context.Context, prefix string, entry *auditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+
+	err = createServiceFile(ctx, getBucket(), prefix, getAuditEntryFileName(entry.Timestamp), string(line)+"\n", AUDIT_LOG_CONTENT_TYPE)
+	if err != nil {
+		log.Printf("could not record audit entry %s '%s': %v", entry.Action, entry.FileName, err)
+	}
+}
+
+// Reads up to limit most recent entries, newest first, from this month and the month before.
+// Within the month, the entries stored one per object come first, then the older ones from the monthly log, if any.
+// The entries that can't be read or parsed are skipped.
+func getRecentAuditEntries(ctx context.Context, prefix string, now time.Time, limit int) ([]*auditEntry, error) {
+	entries := make([]*auditEntry, 0)
+
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for _, month := range []time.Time{thisMonth, thisMonth.AddDate(0, -1, 0)} {
+		monthEntries, err := getAuditEntriesOfMonth(ctx, prefix, month, limit-len(entries))
+		if err != nil {
+			return nil, err // already wrapped
+		}
+		entries = append(entries, monthEntries...)
+		if len(entries) >= limit {
+			break
+		}
+
+		result, err := getFileContent(ctx, getBucket(), prefix, getAuditLogFileName(month), "")
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return nil, err // already wrapped
+		}
+
+		lines := strings.Split(strings.TrimSpace(result.Content), "\n")
+		for i := len(lines) - 1; i >= 0 && len(entries) < limit; i-- {
+			var entry auditEntry
+			if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil {
+				continue
+			}
+			entries = append(entries, &entry)
+		}
+		if len(entries) >= limit {
+			break
+		}
+	}
+
+	return entries, nil
+}
+
+// Reads up to limit most recent entries of the month stored one per object, newest first.
+// The entries are fetched concurrently, within the limit shared by all the fan-out operations.
+func getAuditEntriesOfMonth(ctx context.Context, prefix string, month time.Time, limit int) ([]*auditEntry, error) {
+	folder := getAuditMonthFolder(month)
+	fileNames, err := listFirstFileNames(ctx, getBucket(), prefix+folder, limit)
+	if err != nil {
+		return nil, err // already wrapped
+	}
+
+	fetched := make([]*auditEntry, len(fileNames))
+	limiter := _s3Limiter
+	var wg sync.WaitGroup
+	for i, fileName := range fileNames {
+		if err := limiter.Acquire(ctx); err != nil {
+			log.Printf("%v", err)
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, fileName string) {
+			defer wg.Done()
+			defer limiter.Release()
+
+			result, err := getFileContent(ctx, getBucket(), prefix, folder+fileName, "")
+			if err != nil {
+				return // already logged
+			}
+			var entry auditEntry
+			if err := json.Unmarshal([]byte(result.Content), &entry); err != nil {
+				return
+			}
+			fetched[i] = &entry
+		}(i, fileName)
+	}
+	wg.Wait()
+
+	entries := make([]*auditEntry, 0, len(fetched))
+	for _, entry := range fetched {
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Returns the most recent mutations of the notes, newest first, from this month and the month before.
+// Only the entries recorded in S3 can be read back, with the other sinks the list is always empty.
+//
+// The entries are written in the background, so the latest mutation may take a moment to show up.
+func handleGetAudit(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+
+	// get params from query string
+	var getAuditIn getAuditDataIn
+	if err := c.ShouldBindQuery(&getAuditIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// sanitize
+	if getAuditIn.Limit < 0 || getAuditIn.Limit > AUDIT_ENTRIES_MAX {
+		err := fmt.Errorf("invalid limit '%d', should be between 0 and %d", getAuditIn.Limit, AUDIT_ENTRIES_MAX)
+		toBadRequest(c, err)
+		return
+	}
+	limit := getAuditIn.Limit
+	if limit == 0 {
+		limit = AUDIT_ENTRIES_DEFAULT
+	}
+
+	// read the entries
+	entries := make([]*auditEntry, 0)
+	if AUDIT_SINK == AUDIT_SINK_S3 {
+		var err error
+		entries, err = getRecentAuditEntries(c.Request.Context(), prefix, time.Now().UTC(), limit)
+		if err != nil {
+			toInternalServerError(c, err.Error())
+			return
+		}
+	}
+
+	// create response
+	toSuccess(c, &getAuditDataOut{
+		Entries: entries,
+	})
+}
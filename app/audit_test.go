@@ -0,0 +1,212 @@
+package app
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func useAuditSink(t *testing.T, sink string) {
+	original := AUDIT_SINK
+	AUDIT_SINK = sink
+	t.Cleanup(func() {
+		AUDIT_SINK = original
+	})
+}
+
+func getTestAuditEntries(t *testing.T) []*auditEntry {
+	_auditWrites.Wait()
+
+	c, w := newTestContext("GET", "/audit", "")
+	runAsUser(c, handleGetAudit, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getAuditDataOut
+	parseDataResponse(t, w, &out)
+	return out.Entries
+}
+
+func getTestAuditKeys(fake *fakeS3, month time.Time) []string {
+	keys := []string{}
+	for key := range fake.snapshot() {
+		if strings.HasPrefix(key, "user1/"+getAuditMonthFolder(month)) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestPutFileIsAudited(t *testing.T) {
+	fake := useFakeS3(t)
+	useAuditSink(t, AUDIT_SINK_S3)
+
+	c, w := newTestContext("PUT", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Set(REQUEST_ID_KEY, "request-1")
+	runAsUser(c, handlePutFile, "user1")
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	_auditWrites.Wait()
+
+	keys := getTestAuditKeys(fake, time.Now())
+	if len(keys) != 1 {
+		t.Fatalf("Expected 1 audit entry to be written, actual: %v", keys)
+	}
+	obj, _ := fake.get(keys[0])
+	var entry auditEntry
+	if err := json.Unmarshal(obj.content, &entry); err != nil {
+		t.Fatalf("Expected the entry to be JSON: %v", err)
+	}
+	if entry.Action != AUDIT_ACTION_UPDATE || entry.FileName != "note.md" || entry.RequestId != "request-1" {
+		t.Errorf("Expected update of note.md by request-1, actual: %+v", entry)
+	}
+	if entry.ETag != w.Header().Get("ETag") {
+		t.Errorf("Expected etag %s, actual: %s", w.Header().Get("ETag"), entry.ETag)
+	}
+	if entry.Timestamp.IsZero() {
+		t.Errorf("Expected the timestamp to be set")
+	}
+}
+
+func TestAuditEntriesAreReturnedNewestFirst(t *testing.T) {
+	useFakeS3(t)
+	useAuditSink(t, AUDIT_SINK_S3)
+
+	postTestNote(t, "old.md", "", "")
+	_auditWrites.Wait()
+
+	c, w := newTestContext("POST", "/rename", `{"fileName": "old.md", "newFileName": "new.md"}`)
+	runAsUser(c, handleRenameFile, "user1")
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	_auditWrites.Wait()
+
+	c, w = newTestContext("DELETE", "/files/new.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "new.md"}}
+	runAsUser(c, handleDeleteFile, "user1")
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+
+	entries := getTestAuditEntries(t)
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, actual: %d", len(entries))
+	}
+	if entries[0].Action != AUDIT_ACTION_DELETE || entries[0].FileName != "new.md" {
+		t.Errorf("Expected delete of new.md, actual: %+v", entries[0])
+	}
+	if entries[1].Action != AUDIT_ACTION_RENAME || entries[1].FileName != "old.md" || entries[1].NewFileName != "new.md" {
+		t.Errorf("Expected rename of old.md into new.md, actual: %+v", entries[1])
+	}
+	if entries[2].Action != AUDIT_ACTION_CREATE || entries[2].FileName != "old.md" {
+		t.Errorf("Expected create of old.md, actual: %+v", entries[2])
+	}
+}
+
+func TestAuditLogIsNotListed(t *testing.T) {
+	useFakeS3(t)
+	useAuditSink(t, AUDIT_SINK_S3)
+	postTestNote(t, "note.md", "", "")
+	_auditWrites.Wait()
+
+	c, w := newTestContext("GET", "/files", "")
+	runAsUser(c, handleGetFiles, "user1")
+	var files getFilesDataOut
+	parseDataResponse(t, w, &files)
+	if len(files.Files) != 1 || files.Files[0].FileName != "note.md" {
+		t.Errorf("Expected only note.md, actual: %d files", len(files.Files))
+	}
+
+	c, w = newTestContext("GET", "/folders", "")
+	runAsUser(c, handleListFolders, "user1")
+	var folders getFoldersDataOut
+	parseDataResponse(t, w, &folders)
+	if len(folders.Folders) != 0 {
+		t.Errorf("Expected no folders, actual: %v", folders.Folders)
+	}
+}
+
+func TestAuditSinkOff(t *testing.T) {
+	fake := useFakeS3(t)
+	useAuditSink(t, AUDIT_SINK_OFF)
+
+	postTestNote(t, "note.md", "", "")
+
+	if keys := getTestAuditKeys(fake, time.Now()); len(keys) != 0 {
+		t.Errorf("Expected no audit log, actual: %v", keys)
+	}
+	if entries := getTestAuditEntries(t); len(entries) != 0 {
+		t.Errorf("Expected no entries, actual: %d", len(entries))
+	}
+}
+
+func TestAuditEntryIsWrittenWithoutRewritingTheOthers(t *testing.T) {
+	fake := useFakeS3(t)
+	useAuditSink(t, AUDIT_SINK_S3)
+
+	postTestNote(t, "a.md", "", "")
+	_auditWrites.Wait()
+	first := fake.snapshot()
+
+	postTestNote(t, "b.md", "", "")
+	_auditWrites.Wait()
+
+	keys := getTestAuditKeys(fake, time.Now())
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 audit entries, actual: %v", keys)
+	}
+	for _, key := range keys {
+		if etag, ok := first[key]; ok {
+			if obj, _ := fake.get(key); obj.etag != etag {
+				t.Errorf("Expected the earlier entry to stay as it was")
+			}
+		}
+	}
+}
+
+func TestAuditEntriesOfMonthlyLogAreStillRead(t *testing.T) {
+	fake := useFakeS3(t)
+	useAuditSink(t, AUDIT_SINK_S3)
+	now := time.Now()
+	fake.seed("user1/"+getAuditLogFileName(now),
+		`{"timestamp":"2000-01-01T00:00:00Z","action":"create","fileName":"old.md"}`+"\n"+
+			`{"timestamp":"2000-01-01T00:00:01Z","action":"update","fileName":"old.md"}`+"\n")
+
+	postTestNote(t, "new.md", "", "")
+
+	entries := getTestAuditEntries(t)
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, actual: %d", len(entries))
+	}
+	if entries[0].FileName != "new.md" || entries[1].Action != AUDIT_ACTION_UPDATE || entries[2].Action != AUDIT_ACTION_CREATE {
+		t.Errorf("Expected the new entry first, then the monthly log newest first, actual: %+v %+v %+v", entries[0], entries[1], entries[2])
+	}
+}
+
+func TestAuditEntriesAreLimited(t *testing.T) {
+	useFakeS3(t)
+	useAuditSink(t, AUDIT_SINK_S3)
+	for _, fileName := range []string{"a.md", "b.md", "c.md"} {
+		postTestNote(t, fileName, "", "")
+		_auditWrites.Wait()
+	}
+
+	c, w := newTestContext("GET", "/audit?limit=2", "")
+	runAsUser(c, handleGetAudit, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getAuditDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Entries) != 2 || out.Entries[0].FileName != "c.md" || out.Entries[1].FileName != "b.md" {
+		t.Errorf("Expected c.md and b.md, actual: %+v", out.Entries)
+	}
+}
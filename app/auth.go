@@ -1,7 +1,10 @@
 package app
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
@@ -11,6 +14,57 @@ type handlerFuncWithAuth func(*gin.Context, string, string)
 
 type sessionHeaderData struct {
 	XSession string `header:"x-session"`
+	XApiKey  string `header:"x-api-key"`
+}
+
+// Machine clients that can't sign in authenticate with the api key instead of the session, maps the key to the user id
+var _apiKeys = map[string]string{}
+
+// Expects the JSON object, e.g. {"some-long-random-key": "userId"}
+func SetApiKeys(apiKeysJson string) error {
+	apiKeys := map[string]string{}
+	if apiKeysJson != "" {
+		err := json.Unmarshal([]byte(apiKeysJson), &apiKeys)
+		if err != nil {
+			return fmt.Errorf("could not parse api keys: %w", err)
+		}
+	}
+	for apiKey, userId := range apiKeys {
+		if apiKey == "" {
+			return fmt.Errorf("empty api key for the user id '%s'", userId)
+		}
+		if !isUserIdValid(userId) {
+			return fmt.Errorf("invalid user id '%s' for the api key", userId)
+		}
+	}
+
+	_apiKeys = apiKeys
+	return nil
+}
+
+// Compares with every key in constant time, so the keys can't be guessed by timing the responses
+func getUserIdByApiKey(apiKey string) (string, bool) {
+	userId := ""
+	found := false
+	for key, keyUserId := range _apiKeys {
+		if subtle.ConstantTimeCompare([]byte(apiKey), []byte(key)) == 1 {
+			userId = keyUserId
+			found = true
+		}
+	}
+	return userId, found
+}
+
+// Only accepted when the session cookie is enabled, the cookie left from before is ignored otherwise
+func getSessionCookie(c *gin.Context) (string, bool) {
+	if !SESSION_COOKIE_ENABLED {
+		return "", false
+	}
+	cookie, err := c.Cookie(SESSION_COOKIE_NAME)
+	if err != nil || cookie == "" {
+		return "", false
+	}
+	return cookie, true
 }
 
 func withAuthentication(handler handlerFuncWithAuth) gin.HandlerFunc {
@@ -22,27 +76,67 @@ func withAuthentication(handler handlerFuncWithAuth) gin.HandlerFunc {
 			return
 		}
 
+		// the api key, when provided, takes over the session
+		if sessionHeader.XApiKey != "" {
+			userId, ok := getUserIdByApiKey(sessionHeader.XApiKey)
+			if !ok {
+				log.Printf("invalid 'x-api-key' header")
+				toUnauthorized(c)
+				return
+			}
+
+			c.Set(USER_ID_KEY, userId)
+			handler(c, userId, "")
+			return
+		}
+
+		var encryptedSession []byte
+		var err error
 		base64Session := sessionHeader.XSession
-		if base64Session == "" {
+		if base64Session != "" {
+			encryptedSession, err = base64.StdEncoding.DecodeString(base64Session)
+			if err != nil {
+				log.Printf("'x-session' is not base64 encoded string")
+				toUnauthorized(c)
+				return
+			}
+		} else if cookieSession, ok := getSessionCookie(c); ok {
+			// the browser clients send the session cookie instead, the header still takes precedence
+			encryptedSession, err = base64.RawURLEncoding.DecodeString(cookieSession)
+			if err != nil {
+				log.Printf("session cookie is not base64 encoded string")
+				toUnauthorized(c)
+				return
+			}
+		} else {
 			log.Printf("'x-session' header is empty")
 			toUnauthorized(c)
 			return
 		}
 
-		encryptedSession, err := base64.StdEncoding.DecodeString(base64Session)
+		session, err := parseEncryptedSession(encryptedSession)
 		if err != nil {
-			log.Printf("'x-session' is not base64 encoded string")
+			log.Printf("%v", err)
 			toUnauthorized(c)
 			return
 		}
 
-		session, err := parseEncryptedSession(encryptedSession)
-		if err != nil {
-			log.Printf("%v", err)
+		// the session is only issued for the valid user id, but it is the key namespace, so better be sure
+		if !isUserIdValid(session.UserId) {
+			log.Printf("invalid user id in session: '%s'", session.UserId)
 			toUnauthorized(c)
 			return
 		}
+		if session.TenantId != "" && !isTenantIdValid(session.TenantId) {
+			log.Printf("invalid tenant id in session: '%s'", session.TenantId)
+			toUnauthorized(c)
+			return
+		}
+		if session.TenantId != "" {
+			c.Set(TENANT_ID_KEY, session.TenantId)
+		}
 
+		c.Set(USER_ID_KEY, session.UserId)
 		handler(c, session.UserId, session.Email)
 	}
 }
@@ -0,0 +1,307 @@
+package app
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func useApiKeys(t *testing.T, apiKeysJson string) {
+	original := _apiKeys
+	t.Cleanup(func() {
+		_apiKeys = original
+	})
+
+	err := SetApiKeys(apiKeysJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func runAuthenticated(t *testing.T, headers map[string]string) (int, string) {
+	c, w := newTestContext("GET", "/files", "")
+	for key, value := range headers {
+		c.Request.Header.Set(key, value)
+	}
+
+	authenticatedAs := ""
+	withAuthentication(func(c *gin.Context, userId string, email string) {
+		authenticatedAs = userId
+	})(c)
+	c.Writer.WriteHeaderNow()
+
+	return w.Code, authenticatedAs
+}
+
+func TestSetApiKeys(t *testing.T) {
+	useApiKeys(t, "")
+
+	cases := []struct {
+		apiKeysJson string
+		valid       bool
+	}{
+		{"", true},
+		{`{}`, true},
+		{`{"key1": "user1", "key2": "user2"}`, true},
+		{`{"key1": ""}`, false},
+		{`{"": "user1"}`, false},
+		{`["key1"]`, false},
+		{`not json`, false},
+	}
+
+	for _, tc := range cases {
+		err := SetApiKeys(tc.apiKeysJson)
+		if tc.valid && err != nil {
+			t.Errorf("Expected '%s' to be valid, got: %s", tc.apiKeysJson, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("Expected '%s' to be invalid", tc.apiKeysJson)
+		}
+	}
+}
+
+func TestAuthenticateWithValidApiKey(t *testing.T) {
+	useApiKeys(t, `{"key1": "user1", "key2": "user2"}`)
+
+	code, userId := runAuthenticated(t, map[string]string{"X-API-Key": "key2"})
+
+	if code != 200 {
+		t.Fatalf("Expected 200, actual: %d", code)
+	}
+	if userId != "user2" {
+		t.Errorf("Expected user2, actual: '%s'", userId)
+	}
+}
+
+func TestAuthenticateWithInvalidApiKey(t *testing.T) {
+	useApiKeys(t, `{"key1": "user1"}`)
+
+	code, userId := runAuthenticated(t, map[string]string{"X-API-Key": "key"})
+
+	if code != 401 {
+		t.Fatalf("Expected 401, actual: %d", code)
+	}
+	if userId != "" {
+		t.Errorf("Expected handler not to be called, actual: '%s'", userId)
+	}
+}
+
+func TestAuthenticateWithInvalidApiKeyDoesNotFallBackToSession(t *testing.T) {
+	useApiKeys(t, `{"key1": "user1"}`)
+	SetEncryptionPassphrase("test passphrase")
+	session, err := generateSession("user2", "user2@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ := runAuthenticated(t, map[string]string{
+		"X-API-Key": "key",
+		"x-session": base64.StdEncoding.EncodeToString(session),
+	})
+
+	if code != 401 {
+		t.Fatalf("Expected 401, actual: %d", code)
+	}
+}
+
+func TestAuthenticateWithSessionWhenNoApiKey(t *testing.T) {
+	useApiKeys(t, `{"key1": "user1"}`)
+	SetEncryptionPassphrase("test passphrase")
+	session, err := generateSession("user2", "user2@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, userId := runAuthenticated(t, map[string]string{
+		"x-session": base64.StdEncoding.EncodeToString(session),
+	})
+
+	if code != 200 {
+		t.Fatalf("Expected 200, actual: %d", code)
+	}
+	if userId != "user2" {
+		t.Errorf("Expected user2, actual: '%s'", userId)
+	}
+}
+
+func TestSessionWithMaliciousUserIdIsRejected(t *testing.T) {
+	SetEncryptionPassphrase("test passphrase")
+	session, err := generateSession("user1/../user2", "user1@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, authenticatedAs := runAuthenticated(t, map[string]string{
+		"x-session": base64.StdEncoding.EncodeToString(session),
+	})
+
+	if code != 401 {
+		t.Errorf("Expected 401, actual: %d", code)
+	}
+	if authenticatedAs != "" {
+		t.Errorf("Expected not to be authenticated, actual: '%s'", authenticatedAs)
+	}
+}
+
+func TestApiKeyWithMaliciousUserIdIsRejected(t *testing.T) {
+	useApiKeys(t, "")
+
+	err := SetApiKeys(`{"key1": "../user2"}`)
+	if err == nil {
+		t.Errorf("Expected the api key for '../user2' to be rejected")
+	}
+}
+
+func TestAuthenticateWithSessionCookie(t *testing.T) {
+	useSessionCookieEnabled(t, true)
+	SetEncryptionPassphrase("test passphrase")
+	session, err := generateSession("user2", "user2@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, userId := runAuthenticated(t, map[string]string{
+		"Cookie": SESSION_COOKIE_NAME + "=" + base64.RawURLEncoding.EncodeToString(session),
+	})
+
+	if code != 200 {
+		t.Fatalf("Expected 200, actual: %d", code)
+	}
+	if userId != "user2" {
+		t.Errorf("Expected user2, actual: '%s'", userId)
+	}
+}
+
+func TestSessionCookieIsIgnoredWhenDisabled(t *testing.T) {
+	useSessionCookieEnabled(t, false)
+	SetEncryptionPassphrase("test passphrase")
+	session, err := generateSession("user2", "user2@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ := runAuthenticated(t, map[string]string{
+		"Cookie": SESSION_COOKIE_NAME + "=" + base64.RawURLEncoding.EncodeToString(session),
+	})
+
+	if code != 401 {
+		t.Errorf("Expected 401, actual: %d", code)
+	}
+}
+
+func TestTamperedSessionCookieIsRejected(t *testing.T) {
+	useSessionCookieEnabled(t, true)
+	SetEncryptionPassphrase("test passphrase")
+	session, err := generateSession("user2", "user2@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, session...)
+	tampered[len(tampered)-1] ^= 1
+
+	cookies := []string{
+		base64.RawURLEncoding.EncodeToString(tampered),
+		base64.RawURLEncoding.EncodeToString(session[:NONCE_SIZE-1]), // truncated
+		"not base64!",
+	}
+	for _, cookie := range cookies {
+		code, userId := runAuthenticated(t, map[string]string{
+			"Cookie": SESSION_COOKIE_NAME + "=" + cookie,
+		})
+
+		if code != 401 {
+			t.Errorf("Expected 401, actual: %d", code)
+		}
+		if userId != "" {
+			t.Errorf("Expected handler not to be called, actual: '%s'", userId)
+		}
+	}
+}
+
+func TestExpiredSessionCookieIsRejected(t *testing.T) {
+	useSessionCookieEnabled(t, true)
+	SetEncryptionPassphrase("test passphrase")
+	session, err := encryptSession(newSession("user2", "user2@example.com", time.Now().Add(-SESSION_DURATION-time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ := runAuthenticated(t, map[string]string{
+		"Cookie": SESSION_COOKIE_NAME + "=" + base64.RawURLEncoding.EncodeToString(session),
+	})
+
+	if code != 401 {
+		t.Errorf("Expected 401, actual: %d", code)
+	}
+}
+
+func TestSessionWithTenantUsesTenantLayout(t *testing.T) {
+	SetEncryptionPassphrase("test passphrase")
+	sessionData := newSession("user1", "user1@example.com", time.Now())
+	sessionData.TenantId = "tenant1"
+	session, err := encryptSession(sessionData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, w := newTestContext("GET", "/files", "")
+	c.Request.Header.Set("x-session", base64.StdEncoding.EncodeToString(session))
+	prefix := ""
+	withAuthentication(func(c *gin.Context, userId string, email string) {
+		prefix = userPrefix(c, userId)
+	})(c)
+	c.Writer.WriteHeaderNow()
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	if prefix != "tenants/tenant1/user1/" {
+		t.Errorf("Expected 'tenants/tenant1/user1/', actual: '%s'", prefix)
+	}
+}
+
+func TestSessionWithoutTenantUsesSingleTenantLayout(t *testing.T) {
+	SetEncryptionPassphrase("test passphrase")
+	session, err := generateSession("user1", "user1@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, w := newTestContext("GET", "/files", "")
+	c.Request.Header.Set("x-session", base64.StdEncoding.EncodeToString(session))
+	prefix := ""
+	withAuthentication(func(c *gin.Context, userId string, email string) {
+		prefix = userPrefix(c, userId)
+	})(c)
+	c.Writer.WriteHeaderNow()
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	if prefix != "user1/" {
+		t.Errorf("Expected 'user1/', actual: '%s'", prefix)
+	}
+}
+
+func TestSessionWithMaliciousTenantIdIsRejected(t *testing.T) {
+	SetEncryptionPassphrase("test passphrase")
+	sessionData := newSession("user1", "user1@example.com", time.Now())
+	sessionData.TenantId = "../tenant2"
+	session, err := encryptSession(sessionData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, authenticatedAs := runAuthenticated(t, map[string]string{
+		"x-session": base64.StdEncoding.EncodeToString(session),
+	})
+
+	if code != 401 {
+		t.Fatalf("Expected 401, actual: %d", code)
+	}
+	if authenticatedAs != "" {
+		t.Errorf("Expected handler not to be called, actual: '%s'", authenticatedAs)
+	}
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+type bindingErrorDetail struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func init() {
+	// report the fields the way the client sends them, i.e. "newFileName" instead of "NewFileName"
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(getFieldName)
+	}
+}
+
+func getFieldName(field reflect.StructField) string {
+	for _, tag := range []string{"json", "uri", "form", "header"} {
+		name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+		if name == "-" {
+			return ""
+		}
+		if name != "" {
+			return name
+		}
+	}
+	return field.Name
+}
+
+// Translates the error returned by ShouldBindJSON/ShouldBindQuery/ShouldBindUri
+// into the list of fields that were wrong, and why.
+// Errors not related to a particular field are reported with the empty field name.
+func bindingErrorDetails(err error) []*bindingErrorDetail {
+	var validationErrs validator.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		details := make([]*bindingErrorDetail, 0, len(validationErrs))
+		for _, fieldErr := range validationErrs {
+			details = append(details, &bindingErrorDetail{
+				Field:  fieldErr.Field(),
+				Reason: getValidationReason(fieldErr),
+			})
+		}
+		return details
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return []*bindingErrorDetail{{
+			Field:  typeErr.Field,
+			Reason: fmt.Sprintf("should be %s", typeErr.Type.String()),
+		}}
+	}
+
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return []*bindingErrorDetail{{
+			Reason: "malformed JSON",
+		}}
+	}
+
+	if errors.Is(err, io.EOF) {
+		return []*bindingErrorDetail{{
+			Reason: "body is empty",
+		}}
+	}
+
+	return []*bindingErrorDetail{{
+		Reason: err.Error(),
+	}}
+}
+
+func getValidationReason(fieldErr validator.FieldError) string {
+	switch fieldErr.Tag() {
+	case "required":
+		return "is required"
+	case "min":
+		return fmt.Sprintf("should be at least %s", fieldErr.Param())
+	case "max":
+		return fmt.Sprintf("should be at most %s", fieldErr.Param())
+	default:
+		return fmt.Sprintf("failed '%s' validation", fieldErr.Tag())
+	}
+}
+
+// Same as toBadRequest, but also tells which fields were wrong
+func toBindingError(c *gin.Context, err error) {
+	details := bindingErrorDetails(err)
+
+	messages := make([]string, 0, len(details))
+	for _, detail := range details {
+		messages = append(messages, strings.TrimSpace(detail.Field+" "+detail.Reason))
+	}
+
+	toJSON(c, http.StatusBadRequest, gin.H{
+		"err":     strings.Join(messages, "; "),
+		"details": details,
+	})
+}
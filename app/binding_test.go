@@ -0,0 +1,83 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type bindingErrorResponse struct {
+	Err     string                `json:"err"`
+	Details []*bindingErrorDetail `json:"details"`
+}
+
+func parseBindingErrorResponse(t *testing.T, w *httptest.ResponseRecorder) *bindingErrorResponse {
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response bindingErrorResponse
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("could not parse the response: %v", err)
+	}
+	return &response
+}
+
+func TestRenameFileReportsMissingRequiredField(t *testing.T) {
+	useFakeS3(t)
+
+	c, w := newTestContext(http.MethodPost, "/rename", `{"fileName":"old.md"}`)
+	runAsUser(c, handleRenameFile, "user1")
+
+	response := parseBindingErrorResponse(t, w)
+	if len(response.Details) != 1 {
+		t.Fatalf("expected 1 detail, got %d", len(response.Details))
+	}
+	if response.Details[0].Field != "newFileName" || response.Details[0].Reason != "is required" {
+		t.Fatalf("expected 'newFileName' 'is required', got '%s' '%s'", response.Details[0].Field, response.Details[0].Reason)
+	}
+	if response.Err != "newFileName is required" {
+		t.Fatalf("expected 'newFileName is required', got '%s'", response.Err)
+	}
+}
+
+func TestRenameFileReportsAllMissingFields(t *testing.T) {
+	useFakeS3(t)
+
+	c, w := newTestContext(http.MethodPost, "/rename", `{}`)
+	runAsUser(c, handleRenameFile, "user1")
+
+	response := parseBindingErrorResponse(t, w)
+	if len(response.Details) != 2 {
+		t.Fatalf("expected 2 details, got %d", len(response.Details))
+	}
+	if response.Details[0].Field != "fileName" || response.Details[1].Field != "newFileName" {
+		t.Fatalf("expected 'fileName' and 'newFileName', got '%s' and '%s'", response.Details[0].Field, response.Details[1].Field)
+	}
+}
+
+func TestRenameFileReportsWrongFieldType(t *testing.T) {
+	useFakeS3(t)
+
+	c, w := newTestContext(http.MethodPost, "/rename", `{"fileName":"old.md","newFileName":42}`)
+	runAsUser(c, handleRenameFile, "user1")
+
+	response := parseBindingErrorResponse(t, w)
+	if len(response.Details) != 1 || response.Details[0].Field != "newFileName" {
+		t.Fatalf("expected the error about 'newFileName', got %v", response.Err)
+	}
+}
+
+func TestRenameFileReportsMalformedJson(t *testing.T) {
+	useFakeS3(t)
+
+	c, w := newTestContext(http.MethodPost, "/rename", `{"fileName":`)
+	runAsUser(c, handleRenameFile, "user1")
+
+	response := parseBindingErrorResponse(t, w)
+	if len(response.Details) != 1 || response.Details[0].Field != "" {
+		t.Fatalf("expected the error not related to any field, got %v", response.Err)
+	}
+}
@@ -0,0 +1,168 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var BULK_RENAME_MAX_FILES = 10000 // the notes looked at, same as the index, beyond that the bulk rename is refused
+
+var ErrBulkRenameCollision = errors.New("some of the new file names collide, nothing was renamed")
+
+type bulkRenameDataIn struct {
+	Find    string `json:"find" binding:"required"`
+	Replace string `json:"replace"` // empty to remove the found text
+	DryRun  bool   `json:"dryRun"`  // same as ?dryRun=true
+}
+
+type bulkRenameDataOut struct {
+	Files []*bulkRenameFileDataOut `json:"files"`
+}
+
+type bulkRenameFileDataOut struct {
+	FileName    string `json:"fileName"`
+	NewFileName string `json:"newFileName"`
+	Renamed     bool   `json:"renamed"`
+	Error       string `json:"err,omitempty"`
+}
+
+type bulkRenameCollisionDataOut struct {
+	Collisions []*dryRunFileDataOut `json:"collisions"`
+}
+
+// Replaces the text in the file name without the extension, so "Project X.md" can become "Project Y.md",
+// but ".md" can't be turned into ".txt". Gives the same file name when there is nothing to replace.
+func getBulkRenamedFileName(fileName string, find string, replace string) string {
+	ext := path.Ext(fileName)
+	base := strings.TrimSuffix(fileName, ext)
+	return strings.ReplaceAll(base, find, replace) + ext
+}
+
+// Finds the renames whose new file name is taken, either by another new file name, or by the note that already exists.
+// The renames are not chained, so the existing note is taken even when it is going to be renamed as well.
+func getBulkRenameCollisions(renames []*dryRunFileDataOut, existing map[string]bool) []*dryRunFileDataOut {
+	byNewFileName := map[string]int{}
+	for _, rename := range renames {
+		byNewFileName[rename.NewFileName]++
+	}
+
+	collisions := []*dryRunFileDataOut{}
+	for _, rename := range renames {
+		if byNewFileName[rename.NewFileName] > 1 || existing[rename.NewFileName] {
+			collisions = append(collisions, rename)
+		}
+	}
+	return collisions
+}
+
+// Renames all the notes in the root folder that have the text in the file name, replacing it, e.g. after renaming the project.
+// All the new file names are checked before anything is renamed, and when any of them is invalid, or collides with another one,
+// or with the existing note, nothing is renamed. The notes are then renamed one by one, the same way as by POST /rename,
+// and the result is reported for every note, so the failed ones can be retried.
+func handleBulkRename(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+
+	// get params from query string
+	var dryRunIn dryRunQueryDataIn
+	if err := c.ShouldBindQuery(&dryRunIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get app data from the POST body
+	var bulkRenameIn bulkRenameDataIn
+	if err := c.ShouldBindJSON(&bulkRenameIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// sanitize
+	if strings.Contains(bulkRenameIn.Replace, "/") {
+		err := fmt.Errorf("invalid replace '%s', should not contain '/'", bulkRenameIn.Replace)
+		toBadRequest(c, err)
+		return
+	}
+
+	// get files
+	result, err := listAllFiles(c.Request.Context(), getBucket(), prefix, S3_MAX_KEYS, BULK_RENAME_MAX_FILES)
+	if err != nil {
+		toMoveError(c, err)
+		return
+	}
+	if result.HasMore {
+		err := fmt.Errorf("too many notes, should be less or equal than %d", BULK_RENAME_MAX_FILES)
+		toBadRequest(c, err)
+		return
+	}
+
+	// plan the renames
+	existing := map[string]bool{}
+	renames := []*dryRunFileDataOut{}
+	for _, file := range result.Files {
+		existing[file.FileName] = true
+		if !isFileNameValid(file.FileName) {
+			continue
+		}
+		newFileName := getBulkRenamedFileName(file.FileName, bulkRenameIn.Find, bulkRenameIn.Replace)
+		if newFileName == file.FileName {
+			continue
+		}
+		if err := validateFileName(newFileName); err != nil {
+			err := fmt.Errorf("invalid new fileName '%s' for '%s', %v", newFileName, file.FileName, err)
+			toBadRequest(c, err)
+			return
+		}
+		if err := validateKeyLength(prefix, newFileName); err != nil {
+			err := fmt.Errorf("invalid new fileName '%s' for '%s', %v", newFileName, file.FileName, err)
+			toBadRequest(c, err)
+			return
+		}
+		renames = append(renames, &dryRunFileDataOut{
+			FileName:    file.FileName,
+			NewFileName: newFileName,
+		})
+	}
+	sort.Slice(renames, func(i, j int) bool { return renames[i].FileName < renames[j].FileName })
+
+	if collisions := getBulkRenameCollisions(renames, existing); len(collisions) > 0 {
+		toConflict(c, ErrBulkRenameCollision, &bulkRenameCollisionDataOut{Collisions: collisions})
+		return
+	}
+
+	// only report the renames
+	if dryRunIn.DryRun || bulkRenameIn.DryRun {
+		toDryRun(c, DRY_RUN_ACTION_RENAME, renames)
+		return
+	}
+
+	// rename the files, one by one
+	files := make([]*bulkRenameFileDataOut, 0, len(renames))
+	for _, rename := range renames {
+		file := &bulkRenameFileDataOut{
+			FileName:    rename.FileName,
+			NewFileName: rename.NewFileName,
+		}
+		files = append(files, file)
+
+		result, err := getStorage().RenameFile(c.Request.Context(), getBucket(), prefix, rename.FileName, rename.NewFileName)
+		if err != nil {
+			file.Error = err.Error()
+			continue
+		}
+		file.Renamed = true
+
+		recordAudit(c, userId, &auditEntry{
+			Action:      AUDIT_ACTION_RENAME,
+			FileName:    rename.FileName,
+			NewFileName: rename.NewFileName,
+			ETag:        result.ETag,
+		})
+	}
+
+	toSuccess(c, &bulkRenameDataOut{Files: files})
+}
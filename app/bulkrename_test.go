@@ -0,0 +1,181 @@
+package app
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGetBulkRenamedFileNameKeepsExtension(t *testing.T) {
+	cases := []struct {
+		fileName    string
+		find        string
+		replace     string
+		newFileName string
+	}{
+		{"Project X notes.md", "Project X", "Project Y", "Project Y notes.md"},
+		{"X and X.txt", "X", "Y", "Y and Y.txt"},
+		{"notes.md", "md", "txt", "notes.md"},
+		{"other.md", "Project X", "Project Y", "other.md"},
+	}
+
+	for _, tc := range cases {
+		newFileName := getBulkRenamedFileName(tc.fileName, tc.find, tc.replace)
+		if newFileName != tc.newFileName {
+			t.Errorf("Expected '%s' for '%s', actual: '%s'", tc.newFileName, tc.fileName, newFileName)
+		}
+	}
+}
+
+func TestBulkRename(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/Project X plan.md", "plan")
+	fake.seed("user1/Project X notes.txt", "notes")
+	fake.seed("user1/other.md", "other")
+	fake.seed("user2/Project X plan.md", "someone else's plan")
+
+	c, w := newTestContext("POST", "/rename/bulk", `{"find": "Project X", "replace": "Project Y"}`)
+	runAsUser(c, handleBulkRename, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out bulkRenameDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 2 {
+		t.Fatalf("Expected 2 renames, actual: %v", out.Files)
+	}
+	for _, file := range out.Files {
+		if !file.Renamed {
+			t.Errorf("Expected '%s' to be renamed, actual error: %s", file.FileName, file.Error)
+		}
+	}
+	expected := map[string]string{
+		"user1/Project Y plan.md":   "plan",
+		"user1/Project Y notes.txt": "notes",
+		"user1/other.md":            "other",
+		"user2/Project X plan.md":   "someone else's plan",
+	}
+	if fake.count() != len(expected) {
+		t.Errorf("Expected %d objects, actual: %v", len(expected), fake.snapshot())
+	}
+	for key, content := range expected {
+		obj, ok := fake.get(key)
+		if !ok || string(obj.content) != content {
+			t.Errorf("Expected '%s' with '%s'", key, content)
+		}
+	}
+}
+
+func TestBulkRenameCollisionRenamesNothing(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/Project X.md", "x")
+	fake.seed("user1/Project Z.md", "z")
+	fake.seed("user1/Project X plan.md", "plan")
+	before := fake.snapshot()
+
+	c, w := newTestContext("POST", "/rename/bulk", `{"find": "X", "replace": "Z"}`)
+	runAsUser(c, handleBulkRename, "user1")
+
+	if w.Code != 409 {
+		t.Fatalf("Expected 409, actual: %d", w.Code)
+	}
+	var out bulkRenameCollisionDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Collisions) != 1 || out.Collisions[0].FileName != "Project X.md" || out.Collisions[0].NewFileName != "Project Z.md" {
+		t.Errorf("Expected 'Project X.md' to collide with 'Project Z.md', actual: %v", out.Collisions)
+	}
+	if len(fake.snapshot()) != len(before) {
+		t.Errorf("Expected nothing to be renamed, actual: %v", fake.snapshot())
+	}
+	for key, etag := range before {
+		if fake.snapshot()[key] != etag {
+			t.Errorf("Expected '%s' to stay", key)
+		}
+	}
+}
+
+func TestBulkRenameCollisionBetweenNewFileNames(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/ax.md", "a")
+	fake.seed("user1/xa.md", "b")
+	fake.seed("user1/x-files.md", "c")
+
+	c, w := newTestContext("POST", "/rename/bulk", `{"find": "x", "replace": ""}`)
+	runAsUser(c, handleBulkRename, "user1")
+
+	if w.Code != 409 {
+		t.Fatalf("Expected 409, actual: %d", w.Code)
+	}
+	var out bulkRenameCollisionDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Collisions) != 2 || out.Collisions[0].NewFileName != "a.md" || out.Collisions[1].NewFileName != "a.md" {
+		t.Errorf("Expected both renames to 'a.md' to collide, actual: %v", out.Collisions)
+	}
+	if _, ok := fake.get("user1/x-files.md"); !ok || fake.count() != 3 {
+		t.Errorf("Expected nothing to be renamed, actual: %v", fake.snapshot())
+	}
+}
+
+func TestBulkRenameDryRun(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/Project X plan.md", "plan")
+	before := fake.snapshot()
+
+	c, w := newTestContext("POST", "/rename/bulk", `{"find": "Project X", "replace": "Project Y", "dryRun": true}`)
+	runAsUser(c, handleBulkRename, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out dryRunDataOut
+	parseDataResponse(t, w, &out)
+	if !out.DryRun || out.Action != DRY_RUN_ACTION_RENAME || len(out.Files) != 1 || out.Files[0].NewFileName != "Project Y plan.md" {
+		t.Errorf("Expected the planned rename to 'Project Y plan.md', actual: %+v", out)
+	}
+	if fake.snapshot()["user1/Project X plan.md"] != before["user1/Project X plan.md"] || fake.count() != 1 {
+		t.Errorf("Expected nothing to change, actual: %v", fake.snapshot())
+	}
+}
+
+func TestBulkRenameRejectsInvalidNewFileName(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/plan.md", "plan")
+
+	c, w := newTestContext("POST", "/rename/bulk", `{"find": "plan", "replace": ""}`)
+	runAsUser(c, handleBulkRename, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("user1/plan.md"); !ok {
+		t.Errorf("Expected 'plan.md' to stay")
+	}
+}
+
+func TestBulkRenameWithLocalStorage(t *testing.T) {
+	fake := useFakeS3(t)
+	useLocalStorage(t)
+	storage := getStorage()
+	ctx := context.Background()
+	storage.SaveFileContent(ctx, getBucket(), "user1/", "Project X plan.md", "plan", false, nil)
+	storage.SaveFileContent(ctx, getBucket(), "user1/", "other.md", "other", false, nil)
+
+	c, w := newTestContext("POST", "/rename/bulk", `{"find": "Project X", "replace": "Project Y"}`)
+	runAsUser(c, handleBulkRename, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out bulkRenameDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 1 || !out.Files[0].Renamed || out.Files[0].NewFileName != "Project Y plan.md" {
+		t.Fatalf("Expected 'Project X plan.md' to be renamed, actual: %+v", out.Files)
+	}
+	result, err := storage.GetFileContent(ctx, getBucket(), "user1/", "Project Y plan.md", "")
+	if err != nil || result.Content != "plan" {
+		t.Errorf("Expected 'Project Y plan.md' with 'plan', actual: %v", err)
+	}
+	if fake.count() != 0 {
+		t.Errorf("Expected nothing in S3, actual: %v", fake.snapshot())
+	}
+}
@@ -0,0 +1,214 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"artemkv.net/notedok/internal/fanout"
+	"github.com/gin-gonic/gin"
+)
+
+// How long GET /changes holds the request when there are no changes, in seconds
+var (
+	CHANGES_TIMEOUT_DEFAULT int = 30
+	CHANGES_TIMEOUT_MAX     int = 60
+)
+
+var CHANGES_FEED_SIZE = 1000 // the most recent changes of all the users, older tokens can't be resumed
+
+var MAX_CHANGES_POLLS = 1024 // the polls held at the same time, the rest get 503, these don't count towards MAX_INFLIGHT
+
+var _changesPollLimiter, _ = fanout.NewLimiter(MAX_CHANGES_POLLS)
+
+func SetMaxChangesPolls(limit int) error {
+	limiter, err := fanout.NewLimiter(limit)
+	if err != nil {
+		return err
+	}
+	MAX_CHANGES_POLLS = limit
+	_changesPollLimiter = limiter
+	return nil
+}
+
+type getChangesDataIn struct {
+	Since   string `form:"since"`
+	Timeout int    `form:"timeout"`
+}
+
+type getChangesDataOut struct {
+	Changes   []*auditEntry `json:"changes"` // oldest first
+	NextToken string        `json:"nextToken"`
+	Reset     bool          `json:"reset,omitempty"` // the changes since the token are lost, the client should reload the list
+}
+
+type changeFeedEvent struct {
+	seq    uint64
+	prefix string // the userPrefix, so the same user id in different tenants is told apart
+	entry  *auditEntry
+}
+
+// The changes made through this instance, in memory, fed by the same mutations that are audited.
+// The token is the position in the feed, prefixed with the feed epoch, so the token of the restarted instance is detected.
+type changeFeed struct {
+	mu     sync.Mutex
+	epoch  string
+	seq    uint64
+	events []*changeFeedEvent // oldest first, up to size
+	size   int
+	notify chan struct{} // closed on every change, to wake up the polls
+}
+
+var _changeFeed = newChangeFeed(strconv.FormatInt(time.Now().UnixNano(), 36), CHANGES_FEED_SIZE)
+
+func newChangeFeed(epoch string, size int) *changeFeed {
+	return &changeFeed{
+		epoch:  epoch,
+		events: make([]*changeFeedEvent, 0, size),
+		size:   size,
+		notify: make(chan struct{}),
+	}
+}
+
+func (feed *changeFeed) token(seq uint64) string {
+	return feed.epoch + "." + strconv.FormatUint(seq, 10)
+}
+
+func (feed *changeFeed) publish(prefix string, entry *auditEntry) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	feed.seq++
+	if len(feed.events) == feed.size {
+		feed.events = feed.events[1:]
+	}
+	feed.events = append(feed.events, &changeFeedEvent{
+		seq:    feed.seq,
+		prefix: prefix,
+		entry:  entry,
+	})
+
+	close(feed.notify)
+	feed.notify = make(chan struct{})
+}
+
+// Returns the changes of the user after the token, the token to continue from, and the channel closed on the next change.
+// The reset is true when the token is from another instance, or is too old, so the changes since are lost.
+// The empty token starts from now.
+func (feed *changeFeed) changesSince(prefix string, since string) (changes []*auditEntry, next string, reset bool, wait <-chan struct{}) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	changes = make([]*auditEntry, 0)
+	next = feed.token(feed.seq)
+	wait = feed.notify
+	if since == "" {
+		return changes, next, false, wait
+	}
+
+	epoch, seq, err := parseChangesToken(since)
+	if err != nil || epoch != feed.epoch || seq > feed.seq {
+		return changes, next, true, wait
+	}
+	if len(feed.events) > 0 && seq < feed.events[0].seq-1 {
+		return changes, next, true, wait
+	}
+
+	for _, event := range feed.events {
+		if event.seq > seq && event.prefix == prefix {
+			changes = append(changes, event.entry)
+		}
+	}
+	return changes, next, false, wait
+}
+
+func parseChangesToken(token string) (string, uint64, error) {
+	epoch, seq, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", 0, fmt.Errorf("invalid token")
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid token")
+	}
+	return epoch, n, nil
+}
+
+func isChangesTokenValid(token string) bool {
+	if token == "" {
+		return true
+	}
+	_, _, err := parseChangesToken(token)
+	return err == nil && len(token) <= 100
+}
+
+// Long-polls for the changes of the notes made after the token, for the clients that can't keep the stream open.
+// Returns as soon as there are changes, or with no changes and the new token when the timeout is over.
+// Without the token, returns the token to start from right away.
+//
+// Only sees the changes made through this instance, same as the audit log, the entries are not deduplicated.
+// Not limited by MAX_INFLIGHT, but by MAX_CHANGES_POLLS, so the idle polls never shed the other requests.
+func handleGetChanges(c *gin.Context, userId string, email string) {
+	// get params from query string
+	var getChangesIn getChangesDataIn
+	if err := c.ShouldBindQuery(&getChangesIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// sanitize
+	if !isChangesTokenValid(getChangesIn.Since) {
+		err := fmt.Errorf("invalid since '%s', should be the nextToken from the previous response", getChangesIn.Since)
+		toBadRequest(c, err)
+		return
+	}
+	if getChangesIn.Timeout < 0 || getChangesIn.Timeout > CHANGES_TIMEOUT_MAX {
+		err := fmt.Errorf("invalid timeout '%d', should be between 0 and %d", getChangesIn.Timeout, CHANGES_TIMEOUT_MAX)
+		toBadRequest(c, err)
+		return
+	}
+	timeout := getChangesIn.Timeout
+	if timeout == 0 {
+		timeout = CHANGES_TIMEOUT_DEFAULT
+	}
+
+	// same as for the other requests, rejected right away, so the client can retry later or with another instance
+	limiter := _changesPollLimiter
+	if !limiter.TryAcquire() {
+		c.Header("Retry-After", "1")
+		toJSON(c, http.StatusServiceUnavailable, gin.H{"err": "too many polls in progress, retry later"})
+		return
+	}
+	defer limiter.Release()
+
+	// wait for the changes
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	for {
+		changes, next, reset, wait := _changeFeed.changesSince(userPrefix(c, userId), getChangesIn.Since)
+		if getChangesIn.Since == "" || reset || len(changes) > 0 {
+			toSuccess(c, &getChangesDataOut{
+				Changes:   changes,
+				NextToken: next,
+				Reset:     reset,
+			})
+			return
+		}
+
+		select {
+		case <-wait:
+			// the change may be of another user, check again
+		case <-ctx.Done():
+			toSuccess(c, &getChangesDataOut{
+				Changes:   changes,
+				NextToken: next,
+			})
+			return
+		}
+	}
+}
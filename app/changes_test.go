@@ -0,0 +1,233 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func useChangeFeed(t *testing.T) *changeFeed {
+	original := _changeFeed
+	_changeFeed = newChangeFeed("test", 3)
+	t.Cleanup(func() {
+		_changeFeed = original
+	})
+
+	return _changeFeed
+}
+
+func pollChanges(since string, timeout string) (*httptest.ResponseRecorder, <-chan struct{}) {
+	c, w := newTestContext("GET", "/changes?since="+since+"&timeout="+timeout, "")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runAsUser(c, handleGetChanges, "user1")
+	}()
+	return w, done
+}
+
+func TestGetChangesWithoutTokenReturnsTokenRightAway(t *testing.T) {
+	feed := useChangeFeed(t)
+	feed.publish("user1/", &auditEntry{Action: AUDIT_ACTION_CREATE, FileName: "note.md"})
+
+	w, done := pollChanges("", "60")
+	<-done
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var changesOut getChangesDataOut
+	parseDataResponse(t, w, &changesOut)
+	if len(changesOut.Changes) != 0 {
+		t.Errorf("Expected no changes, actual: %d", len(changesOut.Changes))
+	}
+	if changesOut.NextToken != "test.1" {
+		t.Errorf("Expected 'test.1', actual: '%s'", changesOut.NextToken)
+	}
+}
+
+func TestChangeWakesWaitingPoll(t *testing.T) {
+	useFakeS3(t)
+	useChangeFeed(t)
+
+	w, done := pollChanges("test.0", "60")
+	time.Sleep(20 * time.Millisecond) // let the poll start waiting
+
+	c, pw := newTestContext("POST", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePostFile, "user1")
+	if pw.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", pw.Code)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the poll to return on the change")
+	}
+
+	var changesOut getChangesDataOut
+	parseDataResponse(t, w, &changesOut)
+	if len(changesOut.Changes) != 1 {
+		t.Fatalf("Expected 1 change, actual: %d", len(changesOut.Changes))
+	}
+	if changesOut.Changes[0].Action != AUDIT_ACTION_CREATE || changesOut.Changes[0].FileName != "note.md" {
+		t.Errorf("Expected the note to be created, actual: %s '%s'", changesOut.Changes[0].Action, changesOut.Changes[0].FileName)
+	}
+	if changesOut.NextToken != "test.1" {
+		t.Errorf("Expected 'test.1', actual: '%s'", changesOut.NextToken)
+	}
+}
+
+func TestChangeOfAnotherUserDoesNotEndPoll(t *testing.T) {
+	feed := useChangeFeed(t)
+	original := CHANGES_TIMEOUT_DEFAULT
+	CHANGES_TIMEOUT_DEFAULT = 1
+	t.Cleanup(func() {
+		CHANGES_TIMEOUT_DEFAULT = original
+	})
+
+	w, done := pollChanges("test.0", "")
+	time.Sleep(20 * time.Millisecond)
+	feed.publish("user2/", &auditEntry{Action: AUDIT_ACTION_CREATE, FileName: "note.md"})
+	<-done
+
+	var changesOut getChangesDataOut
+	parseDataResponse(t, w, &changesOut)
+	if len(changesOut.Changes) != 0 {
+		t.Errorf("Expected no changes, actual: %d", len(changesOut.Changes))
+	}
+	if changesOut.NextToken != "test.1" {
+		t.Errorf("Expected 'test.1', actual: '%s'", changesOut.NextToken)
+	}
+}
+
+func TestGetChangesSinceTokenReturnsChangesMadeBefore(t *testing.T) {
+	feed := useChangeFeed(t)
+	feed.publish("user1/", &auditEntry{Action: AUDIT_ACTION_CREATE, FileName: "a.md"})
+	feed.publish("user1/", &auditEntry{Action: AUDIT_ACTION_UPDATE, FileName: "a.md"})
+
+	w, done := pollChanges("test.1", "60")
+	<-done
+
+	var changesOut getChangesDataOut
+	parseDataResponse(t, w, &changesOut)
+	if len(changesOut.Changes) != 1 || changesOut.Changes[0].Action != AUDIT_ACTION_UPDATE {
+		t.Errorf("Expected only the update, actual: %v", changesOut.Changes)
+	}
+}
+
+func TestGetChangesResetsLostToken(t *testing.T) {
+	feed := useChangeFeed(t)
+	for i := 0; i < 5; i++ {
+		feed.publish("user1/", &auditEntry{Action: AUDIT_ACTION_UPDATE, FileName: "a.md"})
+	}
+
+	for _, since := range []string{"test.0", "other.5", "test.9"} {
+		w, done := pollChanges(since, "60")
+		<-done
+
+		var changesOut getChangesDataOut
+		parseDataResponse(t, w, &changesOut)
+		if !changesOut.Reset {
+			t.Errorf("Expected the token '%s' to be reset", since)
+		}
+		if changesOut.NextToken != "test.5" {
+			t.Errorf("Expected 'test.5', actual: '%s'", changesOut.NextToken)
+		}
+	}
+}
+
+func TestGetChangesInvalidParams(t *testing.T) {
+	useChangeFeed(t)
+
+	for _, query := range []string{"since=nodot", "since=test.x", "timeout=-1", "timeout=61"} {
+		c, w := newTestContext("GET", "/changes?"+query, "")
+		runAsUser(c, handleGetChanges, "user1")
+
+		if w.Code != 400 {
+			t.Errorf("Expected 400 for '%s', actual: %d", query, w.Code)
+		}
+	}
+}
+
+func TestChangesOfSameUserIdInAnotherTenantAreNotSeen(t *testing.T) {
+	feed := useChangeFeed(t)
+	feed.publish(getUserPrefix("tenant1", "user1"), &auditEntry{Action: AUDIT_ACTION_CREATE, FileName: "note.md"})
+
+	changes, _, _, _ := feed.changesSince(getUserPrefix("tenant2", "user1"), "test.0")
+	if len(changes) != 0 {
+		t.Errorf("Expected no changes of the other tenant, actual: %d", len(changes))
+	}
+	changes, _, _, _ = feed.changesSince(getUserPrefix("tenant1", "user1"), "test.0")
+	if len(changes) != 1 {
+		t.Errorf("Expected 1 change, actual: %d", len(changes))
+	}
+}
+
+func useMaxChangesPolls(t *testing.T, limit int) {
+	maxChangesPolls, changesPollLimiter := MAX_CHANGES_POLLS, _changesPollLimiter
+	t.Cleanup(func() {
+		MAX_CHANGES_POLLS, _changesPollLimiter = maxChangesPolls, changesPollLimiter
+	})
+	err := SetMaxChangesPolls(limit)
+	if err != nil {
+		t.Fatalf("Error setting max changes polls: %s", err)
+	}
+}
+
+func TestWaitingPollsDoNotShedOtherRequests(t *testing.T) {
+	useFakeS3(t)
+	feed := useChangeFeed(t)
+	useMaxInflight(t, 1)
+	router := newAppRouter()
+
+	// both requests are made up front, signing the session is not safe while the other request is handled
+	pollReq := newAuthenticatedRequest(t, http.MethodGet, "/changes?since=test.0&timeout=60", "")
+	filesReq := newAuthenticatedRequest(t, http.MethodGet, "/files", "")
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, pollReq)
+		done <- w.Code
+	}()
+	time.Sleep(20 * time.Millisecond) // let the poll start waiting
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, filesReq)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 while the poll is waiting, actual: %d", w.Code)
+	}
+
+	feed.publish("user1/", &auditEntry{Action: AUDIT_ACTION_CREATE, FileName: "note.md"})
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected 200 for the poll, actual: %d", code)
+	}
+}
+
+func TestPollOverLimitIsRejected(t *testing.T) {
+	feed := useChangeFeed(t)
+	useMaxChangesPolls(t, 1)
+
+	w, done := pollChanges("test.0", "60")
+	time.Sleep(20 * time.Millisecond) // let the poll start waiting
+
+	overflow, overflowDone := pollChanges("test.0", "60")
+	<-overflowDone
+	if overflow.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 on overflow, actual: %d", overflow.Code)
+	}
+	if overflow.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected Retry-After")
+	}
+
+	feed.publish("user1/", &auditEntry{Action: AUDIT_ACTION_CREATE, FileName: "note.md"})
+	<-done
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for the admitted poll, actual: %d", w.Code)
+	}
+}
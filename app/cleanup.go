@@ -0,0 +1,144 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// The rename pre-creates the empty file under the new name, which stays behind when the copy fails.
+// The placeholder is marked in the object user-metadata, so it is never confused with the empty note.
+var META_RENAME_PLACEHOLDER = "placeholder"
+
+// Off by default, scans the whole bucket
+var (
+	CLEANUP_ORPHANS          bool          = false
+	CLEANUP_ORPHANS_INTERVAL time.Duration = time.Duration(1) * time.Hour
+	CLEANUP_ORPHANS_MIN_AGE  time.Duration = time.Duration(24) * time.Hour // way longer than any rename takes
+)
+
+func SetCleanupOrphans(enabled bool, interval time.Duration, minAge time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid orphan cleanup interval %v, should be positive", interval)
+	}
+	if minAge <= 0 {
+		return fmt.Errorf("invalid orphan cleanup min age %v, should be positive", minAge)
+	}
+
+	CLEANUP_ORPHANS = enabled
+	CLEANUP_ORPHANS_INTERVAL = interval
+	CLEANUP_ORPHANS_MIN_AGE = minAge
+	return nil
+}
+
+// Removes the orphaned rename placeholders every CLEANUP_ORPHANS_INTERVAL until the context is done, if enabled.
+// The placeholders are only left behind in S3, so there is nothing to clean up with any other storage.
+func StartOrphanCleanup(ctx context.Context) {
+	if !CLEANUP_ORPHANS || !isS3Storage() {
+		return
+	}
+
+	go func() {
+		for {
+			select {
+			case <-time.After(CLEANUP_ORPHANS_INTERVAL):
+			case <-ctx.Done():
+				return
+			}
+			if isReadOnly() {
+				continue // nothing changes during the maintenance
+			}
+
+			removed, err := cleanupOrphans(ctx, getBucket(), time.Now())
+			if err != nil {
+				log.Printf("could not clean up orphaned rename placeholders: %v", err)
+			}
+			if removed > 0 {
+				log.Printf("removed %d orphaned rename placeholders", removed)
+			}
+		}
+	}()
+}
+
+// Removes the empty objects marked as the rename placeholder and not modified for CLEANUP_ORPHANS_MIN_AGE, in all the user namespaces.
+// The listing only gives the size, so the marker is checked for every empty object, right before removing it.
+//
+// Returns the number of placeholders removed, even when failed half way.
+func cleanupOrphans(ctx context.Context, bucket string, now time.Time) (int, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return 0, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	removed := 0
+	var continuationToken *string
+	for {
+		// Get the next page
+		output, err := s3client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            &bucket,
+			ContinuationToken: continuationToken,
+		})
+		if err != nil {
+			return removed, logAndReturnError(err, ErrServiceUnavailable)
+		}
+
+		for _, obj := range output.Contents {
+			key := aws.ToString(obj.Key)
+			if key == "" || aws.ToInt64(obj.Size) != 0 || now.Sub(aws.ToTime(obj.LastModified)) < CLEANUP_ORPHANS_MIN_AGE {
+				continue
+			}
+
+			ok, err := removeOrphanedPlaceholder(ctx, s3client, bucket, key)
+			if err != nil {
+				return removed, err // already wrapped
+			}
+			if ok {
+				log.Printf("removed orphaned rename placeholder '%s', last modified %v", key, aws.ToTime(obj.LastModified))
+				removed++
+			}
+		}
+
+		if !aws.ToBool(output.IsTruncated) {
+			return removed, nil
+		}
+		continuationToken = output.NextContinuationToken
+	}
+}
+
+// Returns false when the object is not the placeholder, or is already gone
+func removeOrphanedPlaceholder(ctx context.Context, s3client s3Client, bucket string, key string) (bool, error) {
+	headOutput, err := s3client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			// HEAD responses have no body, so S3 reports missing key as "NotFound"
+			if apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey" {
+				return false, nil
+			}
+		}
+
+		return false, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	if headOutput.Metadata[META_RENAME_PLACEHOLDER] != "true" || aws.ToInt64(headOutput.ContentLength) != 0 {
+		return false, nil
+	}
+
+	err = deleteObjectWithRetry(ctx, s3client, &s3.DeleteObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return false, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	return true, nil
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type copyFailingS3 struct {
+	*fakeS3
+}
+
+func (fake *copyFailingS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	return nil, fakeApiError("InternalError")
+}
+
+func (fake *fakeS3) age(key string, age time.Duration) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.objects[key].lastModified = time.Now().Add(-age)
+}
+
+func TestFailedRenameLeavesMarkedPlaceholder(t *testing.T) {
+	fake := &copyFailingS3{useFakeS3(t)}
+	newS3Client = func() (s3Client, error) { return fake, nil }
+	fake.seed("user1/old.md", "content")
+
+	_, err := renameFile(context.Background(), getBucket(), "user1/", "old.md", "new.md")
+	if err == nil {
+		t.Fatalf("Expected the rename to fail")
+	}
+
+	obj, ok := fake.get("user1/new.md")
+	if !ok {
+		t.Fatalf("Expected the placeholder to stay")
+	}
+	if len(obj.content) != 0 || obj.metadata[META_RENAME_PLACEHOLDER] != "true" {
+		t.Errorf("Expected the empty marked placeholder, actual: '%s' %v", string(obj.content), obj.metadata)
+	}
+}
+
+func TestFailedMoveLeavesMarkedPlaceholder(t *testing.T) {
+	fake := &copyFailingS3{useFakeS3(t)}
+	newS3Client = func() (s3Client, error) { return fake, nil }
+	fake.seed("user1/note.md", "content")
+
+	_, err := moveFile(context.Background(), getBucket(), "user1/", "user1/work/", "note.md")
+	if err == nil {
+		t.Fatalf("Expected the move to fail")
+	}
+
+	obj, ok := fake.get("user1/work/note.md")
+	if !ok {
+		t.Fatalf("Expected the placeholder to stay")
+	}
+	if len(obj.content) != 0 || obj.metadata[META_RENAME_PLACEHOLDER] != "true" {
+		t.Errorf("Expected the empty marked placeholder, actual: '%s' %v", string(obj.content), obj.metadata)
+	}
+}
+
+func TestRenamedFileIsNotPlaceholder(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/old.md", "")
+
+	_, err := renameFile(context.Background(), getBucket(), "user1/", "old.md", "new.md")
+	if err != nil {
+		t.Fatalf("Expected the rename to succeed, got: %v", err)
+	}
+
+	obj, _ := fake.get("user1/new.md")
+	if obj.metadata[META_RENAME_PLACEHOLDER] != "" {
+		t.Errorf("Expected no placeholder marker on the renamed file")
+	}
+}
+
+func TestCleanupOrphansRemovesStalePlaceholders(t *testing.T) {
+	fake := &copyFailingS3{useFakeS3(t)}
+	newS3Client = func() (s3Client, error) { return fake, nil }
+	fake.seed("user1/old.md", "content")
+	fake.seed("user2/work/old.md", "content")
+	renameFile(context.Background(), getBucket(), "user1/", "old.md", "stale.md")
+	renameFile(context.Background(), getBucket(), "user2/", "work/old.md", "work/stale.md")
+	renameFile(context.Background(), getBucket(), "user1/", "old.md", "fresh.md")
+	fake.age("user1/stale.md", CLEANUP_ORPHANS_MIN_AGE+time.Minute)
+	fake.age("user2/work/stale.md", CLEANUP_ORPHANS_MIN_AGE+time.Minute)
+	fake.seed("user1/empty note.md", "") // legit
+	fake.age("user1/empty note.md", CLEANUP_ORPHANS_MIN_AGE+time.Minute)
+
+	removed, err := cleanupOrphans(context.Background(), getBucket(), time.Now())
+
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("Expected 2 removed, actual: %d", removed)
+	}
+	for _, key := range []string{"user1/stale.md", "user2/work/stale.md"} {
+		if _, ok := fake.get(key); ok {
+			t.Errorf("Expected '%s' to be removed", key)
+		}
+	}
+	for _, key := range []string{"user1/fresh.md", "user1/empty note.md", "user1/old.md", "user2/work/old.md"} {
+		if _, ok := fake.get(key); !ok {
+			t.Errorf("Expected '%s' to stay", key)
+		}
+	}
+}
+
+func TestSetCleanupOrphansValidates(t *testing.T) {
+	enabled, interval, minAge := CLEANUP_ORPHANS, CLEANUP_ORPHANS_INTERVAL, CLEANUP_ORPHANS_MIN_AGE
+	t.Cleanup(func() {
+		CLEANUP_ORPHANS, CLEANUP_ORPHANS_INTERVAL, CLEANUP_ORPHANS_MIN_AGE = enabled, interval, minAge
+	})
+
+	if err := SetCleanupOrphans(true, 0, time.Hour); err == nil {
+		t.Errorf("Expected error for zero interval")
+	}
+	if err := SetCleanupOrphans(true, time.Hour, -time.Hour); err == nil {
+		t.Errorf("Expected error for negative min age")
+	}
+	if err := SetCleanupOrphans(true, time.Minute, time.Hour); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+}
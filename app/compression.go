@@ -0,0 +1,82 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Compression of the notes stored in S3, the API always returns plain UTF-8
+var (
+	COMPRESS_AT_REST           bool = false
+	COMPRESS_AT_REST_THRESHOLD int  = 8192 // in bytes, smaller notes are stored as is
+)
+
+var CONTENT_ENCODING_GZIP = "gzip"
+var META_COMPRESSION = "compression"
+
+func SetCompressAtRest(enabled bool, threshold int) error {
+	if threshold < 0 {
+		return fmt.Errorf("invalid compression threshold %d, should not be negative", threshold)
+	}
+
+	COMPRESS_AT_REST = enabled
+	COMPRESS_AT_REST_THRESHOLD = threshold
+	return nil
+}
+
+func shouldCompress(content string) bool {
+	return COMPRESS_AT_REST && len(content) > COMPRESS_AT_REST_THRESHOLD
+}
+
+// The object is only considered compressed when both the content encoding and the metadata marker agree,
+// so objects uploaded by other means are never decompressed by mistake
+func isCompressed(contentEncoding string, metadata map[string]string) bool {
+	return contentEncoding == CONTENT_ENCODING_GZIP && metadata[META_COMPRESSION] == CONTENT_ENCODING_GZIP
+}
+
+// The gzip header is left empty (no name, no modification time),
+// so the same content always produces the same bytes, and therefore the same ETag
+func compress(content string) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(content)); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// Decompresses as it reads, so the large note doesn't have to be in memory at once
+func newDecompressingReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// Decompresses the beginning of the compressed data, up to maxLength bytes.
+// The data can be cut anywhere, e.g. when fetched with a range, and whatever could be decompressed is returned.
+func decompressPrefix(data []byte, maxLength int) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(zr, int64(maxLength)))
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return decompressed, nil
+}
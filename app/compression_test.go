@@ -0,0 +1,136 @@
+package app
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func useCompressAtRest(t *testing.T, threshold int) {
+	enabled, originalThreshold := COMPRESS_AT_REST, COMPRESS_AT_REST_THRESHOLD
+	t.Cleanup(func() {
+		COMPRESS_AT_REST, COMPRESS_AT_REST_THRESHOLD = enabled, originalThreshold
+	})
+
+	if err := SetCompressAtRest(true, threshold); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompressedNoteRoundTrip(t *testing.T) {
+	fake := useFakeS3(t)
+	useCompressAtRest(t, 100)
+	ctx := context.Background()
+
+	content := strings.Repeat("# Привет, notes\n", 100)
+	_, err := saveFileContent(ctx, getBucket(), "user1/", "big.md", content, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, _ := fake.get("user1/big.md")
+	if obj.encoding != "gzip" || obj.metadata[META_COMPRESSION] != "gzip" {
+		t.Fatalf("expected the note to be stored compressed, got encoding '%s', metadata %v", obj.encoding, obj.metadata)
+	}
+	if len(obj.content) >= len(content) {
+		t.Fatalf("expected the stored note to be smaller than %d bytes, got %d", len(content), len(obj.content))
+	}
+
+	result, err := getFileContent(ctx, getBucket(), "user1/", "big.md", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Content != content {
+		t.Fatal("expected to get back the original content")
+	}
+}
+
+func TestSmallNoteIsNotCompressed(t *testing.T) {
+	fake := useFakeS3(t)
+	useCompressAtRest(t, 100)
+	ctx := context.Background()
+
+	_, err := saveFileContent(ctx, getBucket(), "user1/", "small.md", "short", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, _ := fake.get("user1/small.md")
+	if obj.encoding != "" || string(obj.content) != "short" {
+		t.Fatalf("expected the note to be stored as is, got encoding '%s'", obj.encoding)
+	}
+
+	result, err := getFileContent(ctx, getBucket(), "user1/", "small.md", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Content != "short" {
+		t.Fatalf("expected 'short', got '%s'", result.Content)
+	}
+}
+
+func TestCompressedNoteHasStableEtag(t *testing.T) {
+	useFakeS3(t)
+	useCompressAtRest(t, 0)
+	ctx := context.Background()
+
+	first, err := saveFileContent(ctx, getBucket(), "user1/", "a.md", "same content", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := saveFileContent(ctx, getBucket(), "user1/", "b.md", "same content", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.ETag != second.ETag {
+		t.Fatalf("expected the same ETag for the same content, got %s and %s", first.ETag, second.ETag)
+	}
+}
+
+func TestCompressedNoteReadableAfterDisablingCompression(t *testing.T) {
+	useFakeS3(t)
+	useCompressAtRest(t, 0)
+	ctx := context.Background()
+
+	_, err := saveFileContent(ctx, getBucket(), "user1/", "a.md", "compressed", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	COMPRESS_AT_REST = false
+
+	result, err := getFileContent(ctx, getBucket(), "user1/", "a.md", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Content != "compressed" {
+		t.Fatalf("expected 'compressed', got '%s'", result.Content)
+	}
+}
+
+func TestMovingToTrashKeepsCompressionMarker(t *testing.T) {
+	fake := useFakeS3(t)
+	useCompressAtRest(t, 0)
+	ctx := context.Background()
+
+	_, err := saveFileContent(ctx, getBucket(), "user1/", "a.md", "compressed", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = moveAllFilesToTrash(ctx, getBucket(), "user1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, ok := fake.get("user1/" + TRASH_FOLDER + "a.md")
+	if !ok {
+		t.Fatal("expected the note to be moved to the trash")
+	}
+	if !isCompressed(obj.encoding, obj.metadata) {
+		t.Fatalf("expected the trashed note to keep the compression marker, got encoding '%s', metadata %v", obj.encoding, obj.metadata)
+	}
+	if obj.metadata[TRASH_META_ORIGINAL_NAME] != "a.md" {
+		t.Fatalf("expected the original name to be kept, got '%s'", obj.metadata[TRASH_META_ORIGINAL_NAME])
+	}
+}
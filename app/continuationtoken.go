@@ -0,0 +1,92 @@
+package app
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The listing changes over time, so the old continuation token, e.g. kept by the client across sessions,
+// gives the confusing page, it is rejected after this time, and the client has to start the listing over.
+var CONTINUATION_TOKEN_TTL = time.Duration(1) * time.Hour
+
+var (
+	ErrContinuationTokenInvalid = errors.New("invalid continuationToken, restart the listing from the beginning")
+	ErrContinuationTokenExpired = errors.New("continuationToken has expired, restart the listing from the beginning")
+)
+
+var ERROR_CODE_CONTINUATION_TOKEN_EXPIRED = "CONTINUATION_TOKEN_EXPIRED"
+
+func SetContinuationTokenTTL(ttl time.Duration) error {
+	if ttl < time.Minute {
+		return fmt.Errorf("invalid continuation token TTL %v, should be at least 1 minute", ttl)
+	}
+	CONTINUATION_TOKEN_TTL = ttl
+	return nil
+}
+
+// The S3 token is given to the client in the signed envelope, together with the prefix it was issued for and the time,
+// so the tampered token, or the token used for another folder, can be told apart from the one that is simply too old
+type continuationTokenEnvelope struct {
+	Token    string `json:"t"`
+	Prefix   string `json:"p"`
+	IssuedAt int64  `json:"iat"` // unix seconds
+}
+
+// Gives "<payload>.<signature>", both base64url-encoded, without padding, so the token can be passed in the query string as is.
+// The empty token stays empty, there is no next page.
+func signContinuationToken(token string, prefix string, now time.Time) string {
+	if token == "" {
+		return ""
+	}
+	payload, _ := json.Marshal(&continuationTokenEnvelope{
+		Token:    token,
+		Prefix:   prefix,
+		IssuedAt: now.Unix(),
+	})
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(sign(payload))
+}
+
+// Gives back the S3 token, once the signature, the prefix and the age are checked. The empty token means the first page.
+func verifyContinuationToken(signed string, prefix string, now time.Time) (string, error) {
+	if signed == "" {
+		return "", nil
+	}
+	encodedPayload, encodedSignature, ok := strings.Cut(signed, ".")
+	if !ok {
+		return "", ErrContinuationTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return "", ErrContinuationTokenInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, sign(payload)) {
+		return "", ErrContinuationTokenInvalid
+	}
+
+	var envelope continuationTokenEnvelope
+	if err := json.Unmarshal(payload, &envelope); err != nil || envelope.Prefix != prefix {
+		return "", ErrContinuationTokenInvalid
+	}
+	if now.Sub(time.Unix(envelope.IssuedAt, 0)) > CONTINUATION_TOKEN_TTL {
+		return "", ErrContinuationTokenExpired
+	}
+	return envelope.Token, nil
+}
+
+// Both give 400, the expired token comes with the code, so the client can restart the listing without bothering the user
+func toContinuationTokenError(c *gin.Context, err error) {
+	if errors.Is(err, ErrContinuationTokenExpired) {
+		toJSON(c, http.StatusBadRequest, gin.H{"err": err.Error(), "code": ERROR_CODE_CONTINUATION_TOKEN_EXPIRED})
+		return
+	}
+	toBadRequest(c, err)
+}
@@ -0,0 +1,115 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type convertFileUriDataIn struct {
+	FileName string `uri:"filename" binding:"required"`
+}
+
+type convertFileDataIn struct {
+	ToExtension string `json:"toExtension" binding:"required"`
+}
+
+// The note is either markdown or plain text, e.g. "md" or ".md"
+func getConvertExtension(toExtension string) (string, error) {
+	ext := "." + strings.TrimPrefix(toExtension, ".")
+	if ext != ".md" && ext != ".txt" {
+		return "", fmt.Errorf("invalid toExtension '%s', should be 'md' or 'txt'", toExtension)
+	}
+	return ext, nil
+}
+
+// Converts the plain-text note to markdown, or the other way round, by renaming it to the same base name with the new extension.
+// The content and the note metadata are kept, the content type follows the extension.
+//
+// The response has the new file name and the etag, same as POST /files/:filename.
+// The conversion to the extension the note already has is rejected, the note with the new name already existing is the conflict.
+func handleConvertFile(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+
+	// get params from url
+	var convertFileUriIn convertFileUriDataIn
+	if err := c.ShouldBindUri(&convertFileUriIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get app data from the POST body
+	var convertFileIn convertFileDataIn
+	if err := c.ShouldBindJSON(&convertFileIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// sanitize
+	if err := validateFileName(convertFileUriIn.FileName); err != nil {
+		err := fmt.Errorf("invalid fileName '%s', %v", convertFileUriIn.FileName, err)
+		toBadRequest(c, err)
+		return
+	}
+	fileName, err := url.PathUnescape(convertFileUriIn.FileName)
+	if err != nil {
+		err := fmt.Errorf("invalid fileName '%s', could not decode", convertFileUriIn.FileName)
+		toBadRequest(c, err)
+		return
+	}
+	ext, err := getConvertExtension(convertFileIn.ToExtension)
+	if err != nil {
+		toBadRequest(c, err)
+		return
+	}
+	if path.Ext(fileName) == ext {
+		err := fmt.Errorf("invalid toExtension '%s', the file is already '%s'", convertFileIn.ToExtension, ext)
+		toBadRequest(c, err)
+		return
+	}
+	newFileNameIn := strings.TrimSuffix(convertFileUriIn.FileName, path.Ext(convertFileUriIn.FileName)) + ext
+	if err := validateFileName(newFileNameIn); err != nil {
+		err := fmt.Errorf("invalid new fileName '%s', %v", newFileNameIn, err)
+		toBadRequest(c, err)
+		return
+	}
+	newFileName := strings.TrimSuffix(fileName, path.Ext(fileName)) + ext
+	if err := validateKeyLength(prefix, newFileName); err != nil {
+		err := fmt.Errorf("invalid new fileName '%s', %v", newFileNameIn, err)
+		toBadRequest(c, err)
+		return
+	}
+
+	// rename the file
+	result, err := getStorage().RenameFile(c.Request.Context(), getBucket(), prefix, fileName, newFileName)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			toNotFound(c)
+			return
+		}
+		if errors.Is(err, ErrAlreadyExists) {
+			toConflict(c, err, nil)
+			return
+		}
+
+		toInternalServerError(c, err.Error())
+		return
+	}
+
+	recordAudit(c, userId, &auditEntry{
+		Action:      AUDIT_ACTION_RENAME,
+		FileName:    fileName,
+		NewFileName: newFileName,
+		ETag:        result.ETag,
+	})
+
+	c.Header("ETag", result.ETag)
+	toSuccess(c, &postFileDataOut{
+		FileName: newFileName,
+		ETag:     result.ETag,
+	})
+}
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestConvertTxtToMd(t *testing.T) {
+	fake := useFakeS3(t)
+
+	c, _ := newTestContext("PUT", "/files/my%20note.txt", "# content")
+	c.Params = gin.Params{{Key: "filename", Value: "my%20note.txt"}}
+	c.Request.Header.Set(NOTE_TITLE_HEADER, "My note")
+	runAsUser(c, handlePutFile, "user1")
+
+	c, w := newTestContext("POST", "/files/my%20note.txt/convert", `{"toExtension": "md"}`)
+	c.Params = gin.Params{{Key: "filename", Value: "my%20note.txt"}}
+	runAsUser(c, handleConvertFile, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out postFileDataOut
+	parseDataResponse(t, w, &out)
+	if out.FileName != "my note.md" {
+		t.Errorf("Expected 'my note.md', actual: '%s'", out.FileName)
+	}
+	if out.ETag == "" || w.Header().Get("ETag") != out.ETag {
+		t.Errorf("Expected the ETag in the header and the data, actual: '%s' and '%s'", w.Header().Get("ETag"), out.ETag)
+	}
+
+	if _, ok := fake.get("user1/my note.txt"); ok {
+		t.Errorf("Expected the txt file to be gone")
+	}
+	obj, ok := fake.get("user1/my note.md")
+	if !ok {
+		t.Fatalf("Expected the md file to exist")
+	}
+	if string(obj.content) != "# content" {
+		t.Errorf("Expected '# content', actual: '%s'", string(obj.content))
+	}
+	if obj.contentType != getContentType("my note.md") {
+		t.Errorf("Expected content type '%s', actual: '%s'", getContentType("my note.md"), obj.contentType)
+	}
+	if meta := getNoteMetadata(obj.metadata); meta == nil || meta.Title != "My note" {
+		t.Errorf("Expected the note metadata to be kept, actual: %v", obj.metadata)
+	}
+}
+
+func TestConvertKeepsCompression(t *testing.T) {
+	fake := useFakeS3(t)
+	useCompressAtRest(t, 10)
+	content := strings.Repeat("long enough to be compressed ", 10)
+
+	c, _ := newTestContext("PUT", "/files/note.md", content)
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+
+	c, w := newTestContext("POST", "/files/note.md/convert", `{"toExtension": ".txt"}`)
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleConvertFile, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	c, w = newTestContext("GET", "/files/note.txt", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.txt"}}
+	runAsUser(c, handleGetFile, "user1")
+	if w.Body.String() != content {
+		t.Errorf("Expected the same content, actual: '%s'", w.Body.String())
+	}
+	if obj, _ := fake.get("user1/note.txt"); obj.encoding != CONTENT_ENCODING_GZIP {
+		t.Errorf("Expected the file to stay compressed")
+	}
+}
+
+func TestConvertInvalidExtension(t *testing.T) {
+	for _, toExtension := range []string{"pdf", "md", ".md", ""} {
+		fake := useFakeS3(t)
+		fake.seed("user1/note.md", "content")
+
+		c, w := newTestContext("POST", "/files/note.md/convert", `{"toExtension": "`+toExtension+`"}`)
+		c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+		runAsUser(c, handleConvertFile, "user1")
+
+		if w.Code != 400 {
+			t.Errorf("Expected 400 for '%s', actual: %d", toExtension, w.Code)
+		}
+		if _, ok := fake.get("user1/note.md"); !ok || fake.count() != 1 {
+			t.Errorf("Expected nothing to change for '%s'", toExtension)
+		}
+	}
+}
+
+func TestConvertToExistingFile(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.txt", "text")
+	fake.seed("user1/note.md", "markdown")
+
+	c, w := newTestContext("POST", "/files/note.txt/convert", `{"toExtension": "md"}`)
+	c.Params = gin.Params{{Key: "filename", Value: "note.txt"}}
+	runAsUser(c, handleConvertFile, "user1")
+
+	if w.Code != 409 {
+		t.Fatalf("Expected 409, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "markdown" {
+		t.Errorf("Expected the existing file to be intact")
+	}
+}
+
+func TestConvertMissingFile(t *testing.T) {
+	useFakeS3(t)
+
+	c, w := newTestContext("POST", "/files/note.txt/convert", `{"toExtension": "md"}`)
+	c.Params = gin.Params{{Key: "filename", Value: "note.txt"}}
+	runAsUser(c, handleConvertFile, "user1")
+
+	if w.Code != 404 {
+		t.Fatalf("Expected 404, actual: %d", w.Code)
+	}
+}
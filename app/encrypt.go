@@ -3,8 +3,10 @@ package app
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"fmt"
 	"io"
 
 	"golang.org/x/crypto/pbkdf2"
@@ -13,15 +15,26 @@ import (
 var NONCE_SIZE = 12
 var key = []byte("It was green as an emerald, and the reverberation was stunning.")
 
+// For the tokens given to the clients, e.g. the continuation tokens, not the same as the encryption key
+var signingKey = []byte("The white rabbit was in a great hurry.")
+
 func SetEncryptionPassphrase(passphrase string) {
 	salt := []byte("champagne and cake")
 	key = deriveKey(passphrase, salt)
+	signingKey = deriveKey(passphrase, []byte("tea and jam tarts"))
 }
 
 func deriveKey(passphrase string, salt []byte) []byte {
 	return pbkdf2.Key([]byte(passphrase), salt, 1000, 32, sha256.New)
 }
 
+// HMAC-SHA256 of the data
+func sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
 func encrypt(plaintext []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -40,6 +53,9 @@ func encrypt(plaintext []byte) ([]byte, error) {
 }
 
 func decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < NONCE_SIZE {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
 	nonce := ciphertext[:NONCE_SIZE]
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -0,0 +1,212 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	EXPORT_PAGE_SIZE int = 100
+	EXPORT_WORKERS   int = 8 // max files fetched at the same time by a single export
+)
+
+var EXPORT_CONTENT_TYPE = "application/x-ndjson"
+
+// The SHA-256 of the whole export, sent as the HTTP trailer, once all the notes are streamed
+var EXPORT_SHA256_TRAILER = "X-Content-SHA256"
+
+type exportQueryDataIn struct {
+	WithManifest bool `form:"withManifest"`
+}
+
+// One line of the export
+type exportedFileDataOut struct {
+	FileName     string    `json:"fileName"` // with the folder, e.g. "work/my file.md"
+	Content      string    `json:"content"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"lastModified"`
+	Sha256       string    `json:"sha256"` // hex encoded, of the content, as exported, i.e. UTF-8
+}
+
+// The last line of the export, when requested, so the client can tell the export is complete
+type exportManifestDataOut struct {
+	Manifest *exportManifestData `json:"manifest"`
+}
+
+type exportManifestData struct {
+	Files     []*exportManifestFileData `json:"files"` // in the export order
+	Count     int                       `json:"count"`
+	TotalSize int64                     `json:"totalSize"` // in bytes, of all the contents
+}
+
+type exportManifestFileData struct {
+	FileName string `json:"fileName"`
+	Size     int64  `json:"size"` // in bytes, of the content
+	Sha256   string `json:"sha256"`
+}
+
+type exportResult struct {
+	result *GetFileContentResult
+	err    error
+}
+
+// Exports all the notes, including the ones in the folders, as newline-delimited JSON, one note per line,
+// e.g. to process them with jq, or to import them somewhere else. The trash and the audit log are not exported.
+//
+// The notes are streamed as they are fetched, page by page, so the memory use doesn't depend on the number of notes.
+// The notes deleted while exporting are skipped. When the export fails half way, it is too late for the status,
+// so the last line is {"err": "..."} instead of the note.
+//
+// Every line has the SHA-256 of the note content. When requested, the manifest listing all the exported notes comes as the last line,
+// the names and sizes of all the notes are then kept until the end of the export.
+// The length is not known upfront, so instead of Content-Length, the SHA-256 of the whole export comes as the trailer,
+// only when the export is complete.
+func handleExportNdjson(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+	ctx := c.Request.Context()
+
+	// get params from query string
+	var exportQueryIn exportQueryDataIn
+	if err := c.ShouldBindQuery(&exportQueryIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// fetch the first page before starting the response, so the failure can still be reported with the proper status
+	page, err := listFilesStartingAfter(ctx, getBucket(), prefix, EXPORT_PAGE_SIZE, "")
+	if err != nil {
+		toInternalServerError(c, err.Error())
+		return
+	}
+
+	// start streaming
+	c.Header("Content-Type", EXPORT_CONTENT_TYPE)
+	c.Header("Content-Disposition", `attachment; filename="notes.ndjson"`)
+	c.Header("Trailer", EXPORT_SHA256_TRAILER)
+	c.Status(http.StatusOK)
+
+	hash := sha256.New()
+	encoder := json.NewEncoder(io.MultiWriter(c.Writer, hash)) // adds the newline after every value
+	manifest := &exportManifestData{Files: []*exportManifestFileData{}}
+	emit := func(file *FileData, result *GetFileContentResult) {
+		contentHash := sha256.Sum256([]byte(result.Content))
+		exported := &exportedFileDataOut{
+			FileName:     file.FileName,
+			Content:      result.Content,
+			ETag:         result.ETag,
+			LastModified: file.LastModified,
+			Sha256:       hex.EncodeToString(contentHash[:]),
+		}
+		encoder.Encode(exported)
+		c.Writer.Flush()
+
+		if exportQueryIn.WithManifest {
+			manifest.Files = append(manifest.Files, &exportManifestFileData{
+				FileName: exported.FileName,
+				Size:     int64(len(exported.Content)),
+				Sha256:   exported.Sha256,
+			})
+			manifest.Count++
+			manifest.TotalSize += int64(len(exported.Content))
+		}
+	}
+	fetch := func(fileName string) (*GetFileContentResult, error) {
+		return getFileContent(ctx, getBucket(), prefix, fileName, "")
+	}
+
+	for {
+		files := make([]*FileData, 0, len(page.Files))
+		for _, file := range page.Files {
+			if !strings.HasPrefix(file.FileName, TRASH_FOLDER) && !strings.HasPrefix(file.FileName, AUDIT_FOLDER) {
+				files = append(files, file)
+			}
+		}
+
+		err = exportFiles(ctx, files, fetch, emit)
+		if err != nil {
+			break
+		}
+		if !page.HasMore {
+			if exportQueryIn.WithManifest {
+				encoder.Encode(&exportManifestDataOut{Manifest: manifest})
+			}
+			c.Writer.Header().Set(EXPORT_SHA256_TRAILER, hex.EncodeToString(hash.Sum(nil)))
+			return
+		}
+
+		page, err = listFilesStartingAfter(ctx, getBucket(), prefix, EXPORT_PAGE_SIZE, page.NextContinuationToken)
+		if err != nil {
+			break
+		}
+	}
+
+	log.Printf("export failed half way: %v", err)
+	encoder.Encode(gin.H{"err": err.Error()})
+}
+
+// Fetches the files in the given order, up to EXPORT_WORKERS at the same time,
+// and never more than MAX_S3_CONCURRENCY across all the fan-out operations.
+// Every fetched file is passed to emit, in the same order as files, the files not found are skipped.
+//
+// The worker is only freed once its file is emitted, so no more than EXPORT_WORKERS notes are held in memory.
+// Stops at the first error, or when the context is done, and returns it.
+func exportFiles(ctx context.Context, files []*FileData, fetch func(fileName string) (*GetFileContentResult, error), emit func(file *FileData, result *GetFileContentResult)) error {
+	results := make([]chan *exportResult, len(files))
+	for i := range results {
+		results[i] = make(chan *exportResult, 1) // buffered, so the late workers never block
+	}
+
+	// cancelled on return, so no more files are fetched once the export is over
+	dispatchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	limiter := _s3Limiter
+	workers := make(chan struct{}, EXPORT_WORKERS)
+
+	go func() {
+		for i, file := range files {
+			select {
+			case workers <- struct{}{}:
+			case <-dispatchCtx.Done():
+				return
+			}
+			// the files are also fetched within the limit shared with all the other fan-out operations
+			if err := limiter.Acquire(dispatchCtx); err != nil {
+				<-workers
+				return
+			}
+
+			go func(result chan<- *exportResult, file *FileData) {
+				defer limiter.Release()
+				content, err := fetch(file.FileName)
+				result <- &exportResult{result: content, err: err}
+			}(results[i], file)
+		}
+	}()
+
+	for i, file := range files {
+		select {
+		case exported := <-results[i]:
+			<-workers
+			if exported.err != nil {
+				if errors.Is(exported.err, ErrNotFound) {
+					continue // deleted since listed
+				}
+				return exported.err
+			}
+			emit(file, exported.result)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
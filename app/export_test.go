@@ -0,0 +1,188 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Lists the first pages as usual, then fails, so the export fails half way
+type failingListS3 struct {
+	*fakeS3
+	failAfter int
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (failing *failingListS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	failing.mu.Lock()
+	failing.calls++
+	calls := failing.calls
+	failing.mu.Unlock()
+
+	if calls > failing.failAfter {
+		return nil, fakeApiError("ServiceUnavailable")
+	}
+	return failing.fakeS3.ListObjectsV2(ctx, params, optFns...)
+}
+
+func TestExportNdjson(t *testing.T) {
+	fake := useFakeS3(t)
+	original := EXPORT_PAGE_SIZE
+	EXPORT_PAGE_SIZE = 2 // to go through the pages
+	t.Cleanup(func() {
+		EXPORT_PAGE_SIZE = original
+	})
+	fake.seed("user1/a.md", "# A\nline")
+	fake.seed("user1/b.txt", "B \"quoted\"")
+	fake.seed("user1/work/c.md", "C")
+	fake.seed("user1/"+TRASH_FOLDER+"d.md", "deleted")
+	fake.seed("user1/"+AUDIT_FOLDER+"log-202401.jsonl", "{}")
+	fake.seed("user2/e.md", "another user")
+
+	c, w := newTestContext("GET", "/export.ndjson", "")
+	runAsUser(c, handleExportNdjson, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	if w.Header().Get("Content-Type") != EXPORT_CONTENT_TYPE {
+		t.Errorf("Expected %s, actual: %s", EXPORT_CONTENT_TYPE, w.Header().Get("Content-Type"))
+	}
+
+	exported := map[string]*exportedFileDataOut{}
+	scanner := bufio.NewScanner(strings.NewReader(w.Body.String()))
+	for scanner.Scan() {
+		var file exportedFileDataOut
+		if err := json.Unmarshal(scanner.Bytes(), &file); err != nil {
+			t.Fatalf("Expected the valid JSON line, actual: %s", scanner.Text())
+		}
+		exported[file.FileName] = &file
+	}
+
+	if len(exported) != 3 {
+		t.Fatalf("Expected 3 notes, actual: %d\n%s", len(exported), w.Body.String())
+	}
+	for key, content := range map[string]string{"a.md": "# A\nline", "b.txt": "B \"quoted\"", "work/c.md": "C"} {
+		file, ok := exported[key]
+		if !ok {
+			t.Errorf("Expected '%s' to be exported", key)
+			continue
+		}
+		obj, _ := fake.get("user1/" + key)
+		if file.Content != content || file.ETag != obj.etag || file.LastModified.IsZero() {
+			t.Errorf("Expected '%s' to be exported with the content and etag, actual: %+v", key, file)
+		}
+	}
+}
+
+func TestExportNdjsonOfNoNotesIsEmpty(t *testing.T) {
+	useFakeS3(t)
+
+	c, w := newTestContext("GET", "/export.ndjson", "")
+	runAsUser(c, handleExportNdjson, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected empty export, actual: %s", w.Body.String())
+	}
+}
+
+func TestExportNdjsonIntegrity(t *testing.T) {
+	fake := useFakeS3(t)
+	original := EXPORT_PAGE_SIZE
+	EXPORT_PAGE_SIZE = 2 // to go through the pages
+	t.Cleanup(func() {
+		EXPORT_PAGE_SIZE = original
+	})
+	fake.seed("user1/a.md", "# A\nline")
+	fake.seed("user1/b.txt", "B, with ünïcödé")
+	fake.seed("user1/work/c.md", "C")
+
+	c, w := newTestContext("GET", "/export.ndjson?withManifest=true", "")
+	runAsUser(c, handleExportNdjson, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+
+	// the trailer is the hash of the whole body
+	bodyHash := sha256.Sum256(w.Body.Bytes())
+	trailer := w.Result().Trailer.Get(EXPORT_SHA256_TRAILER)
+	if trailer != hex.EncodeToString(bodyHash[:]) {
+		t.Errorf("Expected the trailer %s, actual: '%s'", hex.EncodeToString(bodyHash[:]), trailer)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected 3 notes and the manifest, actual: %d\n%s", len(lines), w.Body.String())
+	}
+
+	// every note matches its hash
+	exported := []*exportedFileDataOut{}
+	for _, line := range lines[:3] {
+		var file exportedFileDataOut
+		if err := json.Unmarshal([]byte(line), &file); err != nil {
+			t.Fatalf("Expected the valid JSON line, actual: %s", line)
+		}
+		contentHash := sha256.Sum256([]byte(file.Content))
+		if file.Sha256 != hex.EncodeToString(contentHash[:]) {
+			t.Errorf("Expected the hash of '%s' to match the content, actual: %s", file.FileName, file.Sha256)
+		}
+		exported = append(exported, &file)
+	}
+
+	// the manifest lists the notes as exported
+	var manifest exportManifestDataOut
+	if err := json.Unmarshal([]byte(lines[3]), &manifest); err != nil || manifest.Manifest == nil {
+		t.Fatalf("Expected the manifest as the last line, actual: %s", lines[3])
+	}
+	if manifest.Manifest.Count != 3 || len(manifest.Manifest.Files) != 3 {
+		t.Fatalf("Expected 3 notes in the manifest, actual: %+v", manifest.Manifest)
+	}
+	totalSize := int64(0)
+	for i, file := range manifest.Manifest.Files {
+		if file.FileName != exported[i].FileName || file.Size != int64(len(exported[i].Content)) || file.Sha256 != exported[i].Sha256 {
+			t.Errorf("Expected the manifest entry to match '%s', actual: %+v", exported[i].FileName, file)
+		}
+		totalSize += file.Size
+	}
+	if manifest.Manifest.TotalSize != totalSize {
+		t.Errorf("Expected the total size %d, actual: %d", totalSize, manifest.Manifest.TotalSize)
+	}
+}
+
+func TestExportNdjsonNoTrailerWhenFailedHalfWay(t *testing.T) {
+	fake := useFakeS3(t)
+	original := EXPORT_PAGE_SIZE
+	EXPORT_PAGE_SIZE = 1
+	t.Cleanup(func() {
+		EXPORT_PAGE_SIZE = original
+	})
+	fake.seed("user1/a.md", "A")
+	fake.seed("user1/b.md", "B")
+	failing := &failingListS3{fakeS3: fake, failAfter: 1}
+	newS3Client = func() (s3Client, error) {
+		return failing, nil
+	}
+
+	c, w := newTestContext("GET", "/export.ndjson?withManifest=true", "")
+	runAsUser(c, handleExportNdjson, "user1")
+
+	if !strings.Contains(w.Body.String(), `"err"`) || strings.Contains(w.Body.String(), `"manifest"`) {
+		t.Errorf("Expected the error as the last line, and no manifest, actual: %s", w.Body.String())
+	}
+	if trailer := w.Result().Trailer.Get(EXPORT_SHA256_TRAILER); trailer != "" {
+		t.Errorf("Expected no trailer for the incomplete export, actual: %s", trailer)
+	}
+}
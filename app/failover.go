@@ -0,0 +1,207 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Not set by default, all the notes are kept in the one bucket.
+// With the secondary bucket, e.g. the replica in another region, the note is read from there when the primary one is unavailable.
+// Empty region means the secondary bucket is in the same region as the primary one.
+var (
+	_secondaryBucket       string
+	_secondaryBucketRegion string
+	_secondaryBucketMu     sync.RWMutex
+)
+
+// Off by default, the secondary bucket is expected to be kept in sync by S3 replication.
+// With mirroring, every saved, renamed, moved or deleted note is also changed in the secondary bucket, best-effort,
+// the failure is only logged. The tags are not mirrored.
+var MIRROR_WRITES = false
+
+func SetSecondaryBucket(bucket string, region string) error {
+	if bucket == "" && region != "" {
+		return fmt.Errorf("invalid secondary bucket region '%s', the secondary bucket is not set", region)
+	}
+	if bucket != "" && bucket == getBucket() {
+		return fmt.Errorf("invalid secondary bucket '%s', should not be the same as the primary one", bucket)
+	}
+
+	_secondaryBucketMu.Lock()
+	defer _secondaryBucketMu.Unlock()
+	_secondaryBucket = bucket
+	_secondaryBucketRegion = region
+	return nil
+}
+
+func getSecondaryBucket() string {
+	_secondaryBucketMu.RLock()
+	defer _secondaryBucketMu.RUnlock()
+	return _secondaryBucket
+}
+
+func getSecondaryBucketRegion() string {
+	_secondaryBucketMu.RLock()
+	defer _secondaryBucketMu.RUnlock()
+	return _secondaryBucketRegion
+}
+
+func SetMirrorWrites(enabled bool) {
+	MIRROR_WRITES = enabled
+}
+
+// Gives the client for the secondary bucket in another region, shared by all the calls, can be replaced in tests
+var newSecondaryS3Client = getSharedSecondaryS3Client
+
+var (
+	_s3secondaryClient   s3Client
+	_s3secondaryClientMu sync.Mutex
+)
+
+func getSharedSecondaryS3Client() (s3Client, error) {
+	_s3secondaryClientMu.Lock()
+	defer _s3secondaryClientMu.Unlock()
+
+	if _s3secondaryClient != nil {
+		return _s3secondaryClient, nil
+	}
+	cfg, err := loadAwsConfig(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	cfg.Region = getSecondaryBucketRegion()
+	_s3secondaryClient = &countingS3Client{s3Client: s3.NewFromConfig(cfg)}
+	return _s3secondaryClient, nil
+}
+
+// The client is per region, the secondary bucket in another region needs its own
+func newS3ClientForBucket(bucket string) (s3Client, error) {
+	if bucket == getSecondaryBucket() && getSecondaryBucketRegion() != "" {
+		return newSecondaryS3Client()
+	}
+	return newS3Client()
+}
+
+// Retrieves the file content, same as getFileContent, but when the bucket is unavailable, falls back to the secondary one, if set.
+// The secondary bucket may lag behind, so the note read from there can be older than the one in the primary.
+func getFileContentWithFailover(ctx context.Context, bucket string, prefix string, fileName string, etag string) (*GetFileContentResult, error) {
+	result, err := getStorage().GetFileContent(ctx, bucket, prefix, fileName, etag)
+	secondaryBucket := getSecondaryBucket()
+	if err == nil || !errors.Is(err, ErrServiceUnavailable) || secondaryBucket == "" || secondaryBucket == bucket {
+		return result, err
+	}
+
+	log.Printf("bucket '%s' is unavailable, reading '%s' from the secondary bucket '%s'", bucket, fileName, secondaryBucket)
+	return getStorage().GetFileContent(ctx, secondaryBucket, prefix, fileName, etag)
+}
+
+// Gives the client for the secondary bucket, when the change made in the bucket should be mirrored there
+func getMirrorS3Client(bucket string, key string) (s3Client, string, bool) {
+	secondaryBucket := getSecondaryBucket()
+	if !MIRROR_WRITES || secondaryBucket == "" || secondaryBucket == bucket {
+		return nil, "", false
+	}
+
+	s3client, err := newS3ClientForBucket(secondaryBucket)
+	if err != nil {
+		log.Printf("could not mirror '%s' to the secondary bucket '%s': %v", key, secondaryBucket, err)
+		return nil, "", false
+	}
+	return s3client, secondaryBucket, true
+}
+
+// Writes the same object to the secondary bucket, once it is written to the primary one, when mirroring.
+// The conditions only make sense for the primary bucket, the secondary one simply gets the latest content.
+// Best-effort, the note is already saved, so the failure is only logged, the secondary bucket catches up with the next save.
+func mirrorPutObject(ctx context.Context, input *s3.PutObjectInput) {
+	s3client, secondaryBucket, ok := getMirrorS3Client(*input.Bucket, *input.Key)
+	if !ok {
+		return
+	}
+
+	// the body was read by the primary write, the same content is sent again from the start
+	body, ok := input.Body.(io.Seeker)
+	if !ok {
+		log.Printf("could not mirror '%s' to the secondary bucket '%s': the body can't be re-read", *input.Key, secondaryBucket)
+		return
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		log.Printf("could not mirror '%s' to the secondary bucket '%s': %v", *input.Key, secondaryBucket, err)
+		return
+	}
+	mirrored := *input
+	mirrored.Bucket = &secondaryBucket
+	mirrored.IfMatch = nil
+	mirrored.IfNoneMatch = nil
+
+	_, err := timeS3Call(ctx, "PutObject", *input.Key, func() (*s3.PutObjectOutput, error) { return s3client.PutObject(ctx, &mirrored) })
+	if err != nil {
+		log.Printf("could not mirror '%s' to the secondary bucket '%s': %v", *input.Key, secondaryBucket, err)
+	}
+}
+
+// Copies the object within the secondary bucket, the same way it was copied in the primary one, e.g. on rename, when mirroring.
+// Best-effort, the same as mirrorPutObject. When the source was never mirrored, the copy fails, and the note only gets
+// to the secondary bucket with the next save.
+func mirrorCopyObject(ctx context.Context, input *s3.CopyObjectInput) {
+	s3client, secondaryBucket, ok := getMirrorS3Client(*input.Bucket, *input.Key)
+	if !ok {
+		return
+	}
+
+	mirrored := *input
+	mirrored.Bucket = &secondaryBucket
+	source := secondaryBucket + "/" + strings.TrimPrefix(*input.CopySource, *input.Bucket+"/")
+	mirrored.CopySource = &source
+
+	_, err := timeS3Call(ctx, "CopyObject", *input.Key, func() (*s3.CopyObjectOutput, error) { return s3client.CopyObject(ctx, &mirrored) })
+	if err != nil {
+		log.Printf("could not mirror '%s' to the secondary bucket '%s': %v", *input.Key, secondaryBucket, err)
+	}
+}
+
+// Deletes the objects from the secondary bucket, once they are deleted from the primary one, when mirroring,
+// so the deleted or renamed note doesn't come back when read from the secondary bucket.
+// Best-effort, the same as mirrorPutObject, the note the delete failed for can still be read from there.
+func mirrorDeleteObjects(ctx context.Context, bucket string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	s3client, secondaryBucket, ok := getMirrorS3Client(bucket, keys[0])
+	if !ok {
+		return
+	}
+
+	for start := 0; start < len(keys); start += 1000 {
+		end := min(start+1000, len(keys))
+		objectIds := make([]types.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objectIds = append(objectIds, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+		input := &s3.DeleteObjectsInput{
+			Bucket: &secondaryBucket,
+			Delete: &types.Delete{
+				Objects: objectIds,
+				Quiet:   aws.Bool(true), // only report errors
+			},
+		}
+
+		output, err := timeS3Call(ctx, "DeleteObjects", keys[start], func() (*s3.DeleteObjectsOutput, error) { return s3client.DeleteObjects(ctx, input) })
+		if err != nil {
+			log.Printf("could not mirror deleting %d objects to the secondary bucket '%s': %v", end-start, secondaryBucket, err)
+			continue
+		}
+		for _, deleteErr := range output.Errors {
+			log.Printf("could not mirror deleting '%s' to the secondary bucket '%s': %s", aws.ToString(deleteErr.Key), secondaryBucket, aws.ToString(deleteErr.Message))
+		}
+	}
+}
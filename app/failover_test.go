@@ -0,0 +1,296 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+func useSecondaryBucket(t *testing.T, bucket string, mirrorWrites bool) {
+	originalBucket, originalRegion, originalMirrorWrites := getSecondaryBucket(), getSecondaryBucketRegion(), MIRROR_WRITES
+	t.Cleanup(func() {
+		SetSecondaryBucket(originalBucket, originalRegion)
+		MIRROR_WRITES = originalMirrorWrites
+	})
+
+	err := SetSecondaryBucket(bucket, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetMirrorWrites(mirrorWrites)
+}
+
+// Fails every call to the unavailable bucket, and remembers the buckets the objects were read from and written to
+type failingBucketS3 struct {
+	*fakeS3
+	unavailableBucket string
+
+	mu          sync.Mutex
+	readFrom    []string
+	writtenTo   []string
+	copiedIn    []string
+	deletedFrom []string
+}
+
+func useFailingBucketS3(t *testing.T, unavailableBucket string) (*fakeS3, *failingBucketS3) {
+	fake := useFakeS3(t)
+	failing := &failingBucketS3{fakeS3: fake, unavailableBucket: unavailableBucket}
+	newS3Client = func() (s3Client, error) {
+		return failing, nil
+	}
+	return fake, failing
+}
+
+func (failing *failingBucketS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	failing.mu.Lock()
+	failing.readFrom = append(failing.readFrom, aws.ToString(params.Bucket))
+	failing.mu.Unlock()
+
+	if aws.ToString(params.Bucket) == failing.unavailableBucket {
+		return nil, fakeApiError("ServiceUnavailable")
+	}
+	return failing.fakeS3.GetObject(ctx, params, optFns...)
+}
+
+func (failing *failingBucketS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	failing.mu.Lock()
+	failing.writtenTo = append(failing.writtenTo, aws.ToString(params.Bucket))
+	failing.mu.Unlock()
+
+	if aws.ToString(params.Bucket) == failing.unavailableBucket {
+		return nil, fakeApiError("ServiceUnavailable")
+	}
+	return failing.fakeS3.PutObject(ctx, params, optFns...)
+}
+
+func (failing *failingBucketS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	failing.mu.Lock()
+	failing.copiedIn = append(failing.copiedIn, aws.ToString(params.Bucket))
+	failing.mu.Unlock()
+
+	if aws.ToString(params.Bucket) == failing.unavailableBucket {
+		return nil, fakeApiError("ServiceUnavailable")
+	}
+	return failing.fakeS3.CopyObject(ctx, params, optFns...)
+}
+
+func (failing *failingBucketS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	failing.mu.Lock()
+	failing.deletedFrom = append(failing.deletedFrom, aws.ToString(params.Bucket))
+	failing.mu.Unlock()
+
+	if aws.ToString(params.Bucket) == failing.unavailableBucket {
+		return nil, fakeApiError("ServiceUnavailable")
+	}
+	return failing.fakeS3.DeleteObject(ctx, params, optFns...)
+}
+
+func (failing *failingBucketS3) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	failing.mu.Lock()
+	failing.deletedFrom = append(failing.deletedFrom, aws.ToString(params.Bucket))
+	failing.mu.Unlock()
+
+	if aws.ToString(params.Bucket) == failing.unavailableBucket {
+		return nil, fakeApiError("ServiceUnavailable")
+	}
+	return failing.fakeS3.DeleteObjects(ctx, params, optFns...)
+}
+
+func TestGetFileFallsBackToSecondaryBucket(t *testing.T) {
+	fake, failing := useFailingBucketS3(t, getBucket())
+	useSecondaryBucket(t, "secondary-bucket", false)
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("GET", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleGetFile, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	if w.Body.String() != "content" {
+		t.Errorf("Expected 'content', actual: '%s'", w.Body.String())
+	}
+	expected := []string{getBucket(), "secondary-bucket"}
+	if len(failing.readFrom) != 2 || failing.readFrom[0] != expected[0] || failing.readFrom[1] != expected[1] {
+		t.Errorf("Expected reads from %v, actual: %v", expected, failing.readFrom)
+	}
+}
+
+func TestGetFileWithoutSecondaryBucketFails(t *testing.T) {
+	fake, failing := useFailingBucketS3(t, getBucket())
+	useSecondaryBucket(t, "", false)
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("GET", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleGetFile, "user1")
+
+	if w.Code != 500 {
+		t.Fatalf("Expected 500, actual: %d", w.Code)
+	}
+	if len(failing.readFrom) != 1 {
+		t.Errorf("Expected a single read, actual: %v", failing.readFrom)
+	}
+}
+
+func TestGetFileMissingInPrimaryIsNotReadFromSecondary(t *testing.T) {
+	_, failing := useFailingBucketS3(t, "")
+	useSecondaryBucket(t, "secondary-bucket", false)
+
+	c, w := newTestContext("GET", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleGetFile, "user1")
+
+	if w.Code != 404 {
+		t.Fatalf("Expected 404, actual: %d", w.Code)
+	}
+	if len(failing.readFrom) != 1 {
+		t.Errorf("Expected a single read, actual: %v", failing.readFrom)
+	}
+}
+
+func TestPutFileIsMirroredToSecondaryBucket(t *testing.T) {
+	_, failing := useFailingBucketS3(t, "")
+	useSecondaryBucket(t, "secondary-bucket", true)
+
+	c, w := newTestContext("PUT", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	expected := []string{getBucket(), "secondary-bucket"}
+	if len(failing.writtenTo) != 2 || failing.writtenTo[0] != expected[0] || failing.writtenTo[1] != expected[1] {
+		t.Errorf("Expected writes to %v, actual: %v", expected, failing.writtenTo)
+	}
+}
+
+func TestPutFileSucceedsWhenMirroringFails(t *testing.T) {
+	fake, failing := useFailingBucketS3(t, "secondary-bucket")
+	useSecondaryBucket(t, "secondary-bucket", true)
+
+	c, w := newTestContext("PUT", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "content" {
+		t.Errorf("Expected 'content', actual: '%s'", string(obj.content))
+	}
+	if len(failing.writtenTo) != 2 {
+		t.Errorf("Expected the mirrored write to be attempted, actual: %v", failing.writtenTo)
+	}
+}
+
+func TestPutFileIsNotMirroredByDefault(t *testing.T) {
+	_, failing := useFailingBucketS3(t, "")
+	useSecondaryBucket(t, "secondary-bucket", false)
+
+	c, w := newTestContext("PUT", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if len(failing.writtenTo) != 1 {
+		t.Errorf("Expected a single write, actual: %v", failing.writtenTo)
+	}
+}
+
+func TestDeleteFileIsMirroredToSecondaryBucket(t *testing.T) {
+	fake, failing := useFailingBucketS3(t, "")
+	useSecondaryBucket(t, "secondary-bucket", true)
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("DELETE", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleDeleteFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	expected := []string{getBucket(), "secondary-bucket"}
+	if len(failing.deletedFrom) != 2 || failing.deletedFrom[0] != expected[0] || failing.deletedFrom[1] != expected[1] {
+		t.Errorf("Expected deletes from %v, actual: %v", expected, failing.deletedFrom)
+	}
+}
+
+func TestDeleteFileSucceedsWhenMirroringFails(t *testing.T) {
+	fake, failing := useFailingBucketS3(t, "secondary-bucket")
+	useSecondaryBucket(t, "secondary-bucket", true)
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("DELETE", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleDeleteFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("user1/note.md"); ok {
+		t.Errorf("Expected the file to be deleted")
+	}
+	if len(failing.deletedFrom) != 2 {
+		t.Errorf("Expected the mirrored delete to be attempted, actual: %v", failing.deletedFrom)
+	}
+}
+
+func TestRenameFileIsMirroredToSecondaryBucket(t *testing.T) {
+	fake, failing := useFailingBucketS3(t, "")
+	useSecondaryBucket(t, "secondary-bucket", true)
+	fake.seed("user1/old.md", "content")
+
+	c, w := newTestContext("POST", "/rename", `{"fileName": "old.md", "newFileName": "new.md"}`)
+	runAsUser(c, handleRenameFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	expected := []string{getBucket(), "secondary-bucket"}
+	if len(failing.copiedIn) != 2 || failing.copiedIn[0] != expected[0] || failing.copiedIn[1] != expected[1] {
+		t.Errorf("Expected copies in %v, actual: %v", expected, failing.copiedIn)
+	}
+	if len(failing.deletedFrom) != 2 || failing.deletedFrom[0] != expected[0] || failing.deletedFrom[1] != expected[1] {
+		t.Errorf("Expected deletes from %v, actual: %v", expected, failing.deletedFrom)
+	}
+}
+
+func TestDeleteFileIsNotMirroredByDefault(t *testing.T) {
+	fake, failing := useFailingBucketS3(t, "")
+	useSecondaryBucket(t, "secondary-bucket", false)
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("DELETE", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleDeleteFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if len(failing.deletedFrom) != 1 {
+		t.Errorf("Expected a single delete, actual: %v", failing.deletedFrom)
+	}
+}
+
+func TestSetSecondaryBucketValidates(t *testing.T) {
+	useSecondaryBucket(t, "", false)
+
+	if err := SetSecondaryBucket(getBucket(), ""); err == nil {
+		t.Errorf("Expected the primary bucket to be rejected as the secondary one")
+	}
+	if err := SetSecondaryBucket("", "eu-west-1"); err == nil {
+		t.Errorf("Expected the region without the bucket to be rejected")
+	}
+	if err := SetSecondaryBucket("secondary-bucket", "eu-west-1"); err != nil {
+		t.Errorf("Expected the secondary bucket to be valid, got: %s", err)
+	}
+}
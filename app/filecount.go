@@ -0,0 +1,51 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var FILE_COUNT_CACHE_TTL = time.Duration(30) * time.Second
+
+type fileCountData struct {
+	count   int
+	expires time.Time
+}
+
+var fileCountCache = map[string]*fileCountData{}
+var fileCountCacheLock sync.Mutex
+
+// Returns the number of files by the prefix.
+// Counting requires scanning all the files, so the result is cached for a short time,
+// which means the count is approximate when notes are being created or deleted concurrently.
+func getFileCount(ctx context.Context, bucket string, prefix string) (int, error) {
+	now := time.Now()
+
+	fileCountCacheLock.Lock()
+	cached, ok := fileCountCache[prefix]
+	fileCountCacheLock.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.count, nil
+	}
+
+	count, err := countFiles(ctx, bucket, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	fileCountCacheLock.Lock()
+	// drop expired entries, so the cache does not grow with the number of users
+	for k, v := range fileCountCache {
+		if !now.Before(v.expires) {
+			delete(fileCountCache, k)
+		}
+	}
+	fileCountCache[prefix] = &fileCountData{
+		count:   count,
+		expires: now.Add(FILE_COUNT_CACHE_TTL),
+	}
+	fileCountCacheLock.Unlock()
+
+	return count, nil
+}
@@ -0,0 +1,62 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Off by default, the service doesn't care what is in the notes, but the tools that read the front-matter choke on the malformed one.
+// Only applies to the markdown files saved through the API.
+var VALIDATE_FRONTMATTER = false
+
+func SetValidateFrontmatter(validate bool) {
+	VALIDATE_FRONTMATTER = validate
+}
+
+var FRONTMATTER_DELIMITER = "---"
+
+// The YAML errors come as "yaml: line 2: did not find expected key", the unmarshal ones as "line 2: cannot unmarshal ..."
+var yamlErrorLinePattern = regexp.MustCompile(`line (\d+): (.*)`)
+
+// Returns the YAML between the leading "---" and the closing "---" (or "..."), and false when the note has no front-matter.
+// The front-matter that is never closed is not one, the leading "---" is just the horizontal rule then.
+func getFrontmatter(content string) (string, bool) {
+	lines := strings.Split(content, "\n")
+	if strings.TrimRight(lines[0], "\r") != FRONTMATTER_DELIMITER {
+		return "", false
+	}
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+		if line == FRONTMATTER_DELIMITER || line == "..." {
+			return strings.Join(lines[1:i], "\n"), true
+		}
+	}
+	return "", false
+}
+
+// The front-matter, if present, should be the YAML mapping, e.g. "title: My note", with no duplicate keys.
+// The error gives the line of the problem in the note, counting the opening "---" as line 1.
+// The YAML parser doesn't report the column, nor the line of the problem in the first line of the front-matter.
+func validateFrontmatter(content string) error {
+	frontmatter, ok := getFrontmatter(content)
+	if !ok {
+		return nil
+	}
+
+	var parsed map[string]interface{}
+	err := yaml.UnmarshalStrict([]byte(frontmatter), &parsed)
+	if err == nil {
+		return nil
+	}
+
+	match := yamlErrorLinePattern.FindStringSubmatch(err.Error())
+	if match == nil {
+		return fmt.Errorf("invalid front-matter: %s", strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	line, _ := strconv.Atoi(match[1])
+	return fmt.Errorf("invalid front-matter at line %d: %s", line+1, match[2])
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func useValidateFrontmatter(t *testing.T, validate bool) {
+	original := VALIDATE_FRONTMATTER
+	SetValidateFrontmatter(validate)
+	t.Cleanup(func() {
+		VALIDATE_FRONTMATTER = original
+	})
+}
+
+func TestValidateFrontmatter(t *testing.T) {
+	cases := []struct {
+		content string
+		valid   bool
+	}{
+		{"", true},
+		{"# No front-matter", true},
+		{"---\ntitle: My note\ntags: [a, b]\n---\n# My note", true},
+		{"---\r\ntitle: My note\r\n---\r\n# My note", true},
+		{"---\ntitle: My note\n...\n# My note", true},
+		{"---\n---\n# Empty front-matter", true},
+		{"---\nnever closed: [", true}, // the horizontal rule
+		{"---\ntitle: My note\ntags: [a, b\n---\n", false},
+		{"---\ntitle: a: b\n---\n", false},
+		{"---\njust text\n---\n", false},
+		{"---\ntitle: a\ntitle: b\n---\n", false},
+	}
+
+	for _, tc := range cases {
+		err := validateFrontmatter(tc.content)
+		if tc.valid && err != nil {
+			t.Errorf("Expected %q to be valid, got: %v", tc.content, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("Expected %q to be invalid", tc.content)
+		}
+	}
+}
+
+func TestFrontmatterErrorGivesLineInNote(t *testing.T) {
+	err := validateFrontmatter("---\ntitle: My note\nauthor: a: b\n---\n")
+
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+	if !strings.HasPrefix(err.Error(), "invalid front-matter at line 3: ") {
+		t.Errorf("Expected error at line 3, actual: '%v'", err)
+	}
+}
+
+func TestPutFileWithInvalidFrontmatterGivesBadRequest(t *testing.T) {
+	fake := useFakeS3(t)
+	useValidateFrontmatter(t, true)
+
+	c, w := newTestContext("PUT", "/files/note.md", "---\ntitle: My note\nauthor: a: b\n---\n# Note")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "line 3") {
+		t.Errorf("Expected the error to give the line, actual: %s", w.Body.String())
+	}
+	if fake.count() != 0 {
+		t.Errorf("Expected nothing to be saved, actual: %d objects", fake.count())
+	}
+}
+
+func TestPostFileWithValidFrontmatterIsSaved(t *testing.T) {
+	useFakeS3(t)
+	useValidateFrontmatter(t, true)
+
+	c, w := newTestContext("POST", "/files/note.md", "---\ntitle: My note\n---\n# Note")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Errorf("Expected 201, actual: %d", w.Code)
+	}
+}
+
+func TestFrontmatterIsNotValidatedInTextFiles(t *testing.T) {
+	useFakeS3(t)
+	useValidateFrontmatter(t, true)
+
+	c, w := newTestContext("POST", "/files/note.txt", "---\ntitle: a: b\n---\n")
+	c.Params = gin.Params{{Key: "filename", Value: "note.txt"}}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Errorf("Expected 201, actual: %d", w.Code)
+	}
+}
+
+func TestRenameAndSaveWithInvalidFrontmatterGivesBadRequest(t *testing.T) {
+	fake := useFakeS3(t)
+	useValidateFrontmatter(t, true)
+	fake.seed("user1/old.md", "old content")
+
+	c, w := newTestContext("POST", "/files/old.md/renameAndSave", `{"newFileName": "new.md", "content": "---\ntitle: a: b\n---\n"}`)
+	c.Params = gin.Params{{Key: "filename", Value: "old.md"}}
+	runAsUser(c, handleRenameAndSaveFile, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("user1/new.md"); ok {
+		t.Errorf("Expected nothing to be saved")
+	}
+}
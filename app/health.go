@@ -0,0 +1,114 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type S3StatusData struct {
+	Reachable bool  `json:"reachable"`
+	LatencyMs int64 `json:"latencyMs"`
+}
+
+type KeySetStatusData struct {
+	Loaded            bool      `json:"loaded"`
+	KeyCount          int       `json:"keyCount"`
+	LastRefresh       time.Time `json:"lastRefresh"`
+	AgeSeconds        int64     `json:"ageSeconds"`
+	Stale             bool      `json:"stale"`
+	LastRefreshFailed bool      `json:"lastRefreshFailed"`
+	LastError         string    `json:"lastError,omitempty"`
+}
+
+// The slow dependency counts as unavailable, so the probes never hang long enough to trip the orchestrator timeouts
+var HEALTH_TIMEOUT = time.Duration(2000) * time.Millisecond
+
+func SetHealthTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return fmt.Errorf("invalid health timeout %v, should be positive", timeout)
+	}
+	HEALTH_TIMEOUT = timeout
+	return nil
+}
+
+// Gives up on the check after HEALTH_TIMEOUT, even if the check doesn't respect the context,
+// then the check finishes in the background, and its result is ignored.
+func checkWithTimeout(check func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), HEALTH_TIMEOUT)
+	defer cancel()
+
+	result := make(chan error, 1) // buffered, so the late check never blocks
+	go func() {
+		result <- check(ctx)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func checkS3(ctx context.Context) error {
+	return checkBucket(ctx, getBucket())
+}
+
+// Checks whether the bucket can be reached, and how long it takes, up to HEALTH_TIMEOUT
+func GetS3Status() interface{} {
+	start := time.Now()
+	err := checkWithTimeout(checkS3)
+	latency := time.Since(start)
+
+	return &S3StatusData{
+		Reachable: err == nil,
+		LatencyMs: latency.Milliseconds(),
+	}
+}
+
+// Reports the state of the keys used to validate id tokens, by issuer.
+// The keys that are not refreshed for JWKS_STALE_AFTER are reported as stale, they most probably keep working until rotated.
+func GetKeySetStatus() interface{} {
+	statuses := make(map[string]*KeySetStatusData, len(_keySetCaches))
+	for issuer, cache := range _keySetCaches {
+		statuses[issuer] = getKeySetCacheStatus(cache)
+	}
+	return statuses
+}
+
+func getKeySetCacheStatus(cache *keySetCache) *KeySetStatusData {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+
+	status := &KeySetStatusData{
+		Loaded:            cache.keySet != nil,
+		LastRefresh:       cache.lastRefresh,
+		LastRefreshFailed: cache.lastErr != nil,
+	}
+	if cache.keySet != nil {
+		age := time.Since(cache.lastRefresh)
+		status.KeyCount = cache.keySet.Len()
+		status.AgeSeconds = int64(age.Seconds())
+		status.Stale = age > JWKS_STALE_AFTER
+	}
+	if cache.lastErr != nil {
+		status.LastError = cache.lastErr.Error()
+	}
+	return status
+}
+
+// The service can't serve any note when the bucket can't be reached within HEALTH_TIMEOUT
+func IsS3Ready() bool {
+	return checkWithTimeout(checkS3) == nil
+}
+
+// The service can't authenticate anyone until the keys of every issuer are loaded at least once
+func IsKeySetReady() bool {
+	for _, cache := range _keySetCaches {
+		if cache.get() == nil {
+			return false
+		}
+	}
+	return true
+}
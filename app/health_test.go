@@ -0,0 +1,216 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"artemkv.net/notedok/health"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+func useKeySetCaches(t *testing.T, caches map[string]*keySetCache) {
+	keySetCaches := _keySetCaches
+	t.Cleanup(func() {
+		_keySetCaches = keySetCaches
+	})
+	_keySetCaches = caches
+}
+
+func getTestKeySetStatus(t *testing.T, issuer string) *KeySetStatusData {
+	statuses := GetKeySetStatus().(map[string]*KeySetStatusData)
+	status, ok := statuses[issuer]
+	if !ok {
+		t.Fatalf("Expected the status of '%s'", issuer)
+	}
+	return status
+}
+
+func newTestKeySet(t *testing.T) jwk.Set {
+	key, err := jwk.New([]byte("test key"))
+	if err != nil {
+		t.Fatalf("Error creating the key: %s", err)
+	}
+	keySet := jwk.NewSet()
+	keySet.Add(key)
+	return keySet
+}
+
+func TestKeySetStatusReportsStaleKeys(t *testing.T) {
+	useKeySetCaches(t, map[string]*keySetCache{
+		"issuer1": {
+			keySet:      newTestKeySet(t),
+			lastRefresh: time.Now().Add(-JWKS_STALE_AFTER - time.Hour),
+			lastErr:     errors.New("connection refused"),
+		},
+	})
+
+	status := getTestKeySetStatus(t, "issuer1")
+
+	if !status.Loaded || status.KeyCount != 1 {
+		t.Errorf("Expected 1 key loaded, actual: %v %d", status.Loaded, status.KeyCount)
+	}
+	if !status.Stale {
+		t.Errorf("Expected keys to be stale")
+	}
+	if status.AgeSeconds < int64((JWKS_STALE_AFTER + time.Hour).Seconds()) {
+		t.Errorf("Expected age to be at least %v, actual: %ds", JWKS_STALE_AFTER+time.Hour, status.AgeSeconds)
+	}
+	if !status.LastRefreshFailed || status.LastError != "connection refused" {
+		t.Errorf("Expected the last refresh to fail, actual: %v '%s'", status.LastRefreshFailed, status.LastError)
+	}
+	if !IsKeySetReady() {
+		t.Errorf("Expected to be ready with stale keys")
+	}
+}
+
+func TestKeySetNeverLoadedForOneIssuerIsNotReady(t *testing.T) {
+	useKeySetCaches(t, map[string]*keySetCache{
+		"issuer1": {keySet: newTestKeySet(t), lastRefresh: time.Now()},
+		"issuer2": {lastErr: errors.New("connection refused")},
+	})
+
+	status := getTestKeySetStatus(t, "issuer2")
+
+	if status.Loaded || status.Stale {
+		t.Errorf("Expected not loaded and not stale, actual: %v %v", status.Loaded, status.Stale)
+	}
+	if IsKeySetReady() {
+		t.Errorf("Expected not to be ready")
+	}
+}
+
+func TestKeySetRefreshFailureKeepsKeys(t *testing.T) {
+	cache := &keySetCache{url: "url"}
+	useKeySetCaches(t, map[string]*keySetCache{"issuer1": cache})
+	fetch := fetchKeySet
+	t.Cleanup(func() {
+		fetchKeySet = fetch
+	})
+
+	keySet := newTestKeySet(t)
+	fetchKeySet = func(ctx context.Context, url string) (jwk.Set, error) {
+		return keySet, nil
+	}
+	if err := cache.refresh(context.Background()); err != nil {
+		t.Fatalf("Error refreshing: %s", err)
+	}
+
+	fetchKeySet = func(ctx context.Context, url string) (jwk.Set, error) {
+		return nil, errors.New("connection refused")
+	}
+	if err := cache.refresh(context.Background()); err == nil {
+		t.Fatalf("Expected the refresh to fail")
+	}
+
+	status := getTestKeySetStatus(t, "issuer1")
+	if cache.get() != keySet || !status.LastRefreshFailed || status.Stale {
+		t.Errorf("Expected the keys to be kept after the failed refresh, actual: %v", status)
+	}
+}
+
+// The bucket check that hangs, until the context is done, or for a second, when it doesn't respect the context
+type hangingS3 struct {
+	*fakeS3
+	respectContext bool
+	returned       chan struct{}
+}
+
+// The test waits for the abandoned check to return, before the fake is gone
+func useHangingS3(t *testing.T, respectContext bool) {
+	fake := &hangingS3{fakeS3: useFakeS3(t), respectContext: respectContext, returned: make(chan struct{}, 1)}
+	newS3Client = func() (s3Client, error) { return fake, nil }
+	t.Cleanup(func() {
+		<-fake.returned
+	})
+}
+
+func (fake *hangingS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	defer func() { fake.returned <- struct{}{} }()
+
+	if fake.respectContext {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	time.Sleep(time.Second)
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func useHealthTimeout(t *testing.T, timeout time.Duration) {
+	original := HEALTH_TIMEOUT
+	if err := SetHealthTimeout(timeout); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() {
+		HEALTH_TIMEOUT = original
+	})
+}
+
+func TestS3IsReady(t *testing.T) {
+	useFakeS3(t)
+
+	if !IsS3Ready() {
+		t.Errorf("Expected S3 to be ready")
+	}
+}
+
+func TestSlowS3IsNotReadyWithinTimeout(t *testing.T) {
+	for _, respectContext := range []bool{true, false} {
+		t.Run(fmt.Sprintf("respectContext=%v", respectContext), func(t *testing.T) {
+			useHangingS3(t, respectContext)
+			useHealthTimeout(t, 50*time.Millisecond)
+
+			start := time.Now()
+			ready := IsS3Ready()
+			elapsed := time.Since(start)
+
+			if ready {
+				t.Errorf("Expected S3 not to be ready")
+			}
+			if elapsed > 500*time.Millisecond {
+				t.Errorf("Expected the probe to give up after the timeout, actual: %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestReadinessWithSlowS3GivesServiceUnavailableQuickly(t *testing.T) {
+	useHangingS3(t, true)
+	useHealthTimeout(t, 50*time.Millisecond)
+	health.RegisterReadinessCheck("s3", IsS3Ready)
+	health.SetIsReadyGlobally()
+	router := newAppRouter()
+
+	start := time.Now()
+	req := httptest.NewRequest(http.MethodGet, "/readiness", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	elapsed := time.Since(start)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503, actual: %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "s3") {
+		t.Errorf("Expected s3 not to be ready, actual: %s", w.Body.String())
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the probe to give up after the timeout, actual: %v", elapsed)
+	}
+}
+
+func TestS3StatusWithSlowS3IsUnreachable(t *testing.T) {
+	useHangingS3(t, true)
+	useHealthTimeout(t, 50*time.Millisecond)
+
+	status := GetS3Status().(*S3StatusData)
+
+	if status.Reachable {
+		t.Errorf("Expected S3 to be unreachable")
+	}
+}
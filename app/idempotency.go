@@ -0,0 +1,111 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+var IDEMPOTENCY_REPLAYED_HEADER = "Idempotent-Replayed"
+
+var (
+	IDEMPOTENCY_KEY_TTL        time.Duration = time.Duration(1) * time.Hour // long enough for the client to give up retrying
+	IDEMPOTENCY_KEY_MAX_LENGTH int           = 255
+	IDEMPOTENCY_MAX_KEYS       int           = 10000 // bounds the memory, the oldest keys are dropped first
+)
+
+var (
+	ErrIdempotencyKeyInProgress = errors.New("request with the same Idempotency-Key is in progress")
+	ErrIdempotencyKeyReused     = errors.New("Idempotency-Key was already used for a different request")
+)
+
+// The result of the successful create, replayed when the same key comes again
+type idempotentResult struct {
+	fileName string
+	etag     string
+}
+
+type idempotencyData struct {
+	fileName string
+	result   *idempotentResult // nil while the request is in progress
+	expires  time.Time
+}
+
+// By user prefix and key, so the keys of different users, and of the same user id in different tenants, never clash
+var idempotencyCache = map[string]*idempotencyData{}
+var idempotencyCacheLock sync.Mutex
+
+// The prefix is the userPrefix, it ends with "/"
+func getIdempotencyCacheKey(prefix string, key string) string {
+	return prefix + key
+}
+
+// Checks whether the request with the same key was already handled, and if so, returns its result.
+// Otherwise, marks the key as in progress, and the caller must either complete or abandon it.
+//
+// The key is bound to the file name, replaying it for another file returns an error.
+func beginIdempotentRequest(prefix string, key string, fileName string) (*idempotentResult, error) {
+	now := time.Now()
+	cacheKey := getIdempotencyCacheKey(prefix, key)
+
+	idempotencyCacheLock.Lock()
+	defer idempotencyCacheLock.Unlock()
+
+	cached, ok := idempotencyCache[cacheKey]
+	if ok && now.Before(cached.expires) {
+		if cached.fileName != fileName {
+			return nil, ErrIdempotencyKeyReused
+		}
+		if cached.result == nil {
+			return nil, ErrIdempotencyKeyInProgress
+		}
+		return cached.result, nil
+	}
+
+	evictIdempotencyKeys(now)
+	idempotencyCache[cacheKey] = &idempotencyData{
+		fileName: fileName,
+		expires:  now.Add(IDEMPOTENCY_KEY_TTL),
+	}
+	return nil, nil
+}
+
+// Remembers the result, so it is replayed for the same key until the key expires
+func completeIdempotentRequest(prefix string, key string, result *idempotentResult) {
+	idempotencyCacheLock.Lock()
+	defer idempotencyCacheLock.Unlock()
+
+	cached, ok := idempotencyCache[getIdempotencyCacheKey(prefix, key)]
+	if ok {
+		cached.result = result
+	}
+}
+
+// Forgets the key after the failed request, so the client can retry with the same key
+func abandonIdempotentRequest(prefix string, key string) {
+	idempotencyCacheLock.Lock()
+	defer idempotencyCacheLock.Unlock()
+
+	delete(idempotencyCache, getIdempotencyCacheKey(prefix, key))
+}
+
+// Makes room for one more key, should be called under the lock
+func evictIdempotencyKeys(now time.Time) {
+	for k, v := range idempotencyCache {
+		if !now.Before(v.expires) {
+			delete(idempotencyCache, k)
+		}
+	}
+
+	for len(idempotencyCache) >= IDEMPOTENCY_MAX_KEYS {
+		oldestKey := ""
+		var oldest time.Time
+		for k, v := range idempotencyCache {
+			if oldestKey == "" || v.expires.Before(oldest) {
+				oldestKey, oldest = k, v.expires
+			}
+		}
+		delete(idempotencyCache, oldestKey)
+	}
+}
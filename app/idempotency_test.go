@@ -0,0 +1,183 @@
+package app
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func resetIdempotencyCache(t *testing.T) {
+	idempotencyCacheLock.Lock()
+	idempotencyCache = map[string]*idempotencyData{}
+	idempotencyCacheLock.Unlock()
+
+	maxKeys := IDEMPOTENCY_MAX_KEYS
+	t.Cleanup(func() {
+		IDEMPOTENCY_MAX_KEYS = maxKeys
+		idempotencyCacheLock.Lock()
+		idempotencyCache = map[string]*idempotencyData{}
+		idempotencyCacheLock.Unlock()
+	})
+}
+
+func TestPostFileWithSameIdempotencyKeyIsReplayed(t *testing.T) {
+	fake := useFakeS3(t)
+	resetIdempotencyCache(t)
+
+	c, w := newTestContext("POST", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set(IDEMPOTENCY_KEY_HEADER, "key1")
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+	etag := w.Header().Get("ETag")
+
+	c, w = newTestContext("POST", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set(IDEMPOTENCY_KEY_HEADER, "key1")
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201 on replay, actual: %d", w.Code)
+	}
+	if w.Header().Get("ETag") != etag || w.Header().Get(IDEMPOTENCY_REPLAYED_HEADER) != "true" {
+		t.Errorf("Expected the original result to be replayed, actual ETag: %s", w.Header().Get("ETag"))
+	}
+	var out postFileDataOut
+	parseDataResponse(t, w, &out)
+	if out.FileName != "note.md" || out.ETag != etag {
+		t.Errorf("Expected 'note.md' with ETag %s, actual: '%s' with ETag %s", etag, out.FileName, out.ETag)
+	}
+	if fake.count() != 1 {
+		t.Errorf("Expected only one file to be created, actual: %d", fake.count())
+	}
+}
+
+func TestIdempotencyKeyIsNotSharedAcrossTenants(t *testing.T) {
+	fake := useFakeS3(t)
+	resetIdempotencyCache(t)
+
+	c, w := newTestContext("POST", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set(IDEMPOTENCY_KEY_HEADER, "key1")
+	c.Set(TENANT_ID_KEY, "tenant1")
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+
+	c, w = newTestContext("POST", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set(IDEMPOTENCY_KEY_HEADER, "key1")
+	c.Set(TENANT_ID_KEY, "tenant2")
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+	if w.Header().Get(IDEMPOTENCY_REPLAYED_HEADER) != "" {
+		t.Errorf("Expected the request not to be replayed for another tenant")
+	}
+	if _, ok := fake.get("tenants/tenant2/user1/note.md"); !ok {
+		t.Errorf("Expected the file to be created in the second tenant")
+	}
+}
+
+func TestPostFileWithoutIdempotencyKeyIsNotReplayed(t *testing.T) {
+	useFakeS3(t)
+	resetIdempotencyCache(t)
+
+	for i, expected := range []int{201, 409} {
+		c, w := newTestContext("POST", "/files/note.md", "content")
+		c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+		runAsUser(c, handlePostFile, "user1")
+
+		if w.Code != expected {
+			t.Errorf("Expected %d on attempt %d, actual: %d", expected, i+1, w.Code)
+		}
+	}
+}
+
+func TestIdempotencyKeyReusedForAnotherFile(t *testing.T) {
+	useFakeS3(t)
+	resetIdempotencyCache(t)
+
+	c, w := newTestContext("POST", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set(IDEMPOTENCY_KEY_HEADER, "key1")
+	runAsUser(c, handlePostFile, "user1")
+
+	c, w = newTestContext("POST", "/files/other.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "other.md"}}
+	c.Request.Header.Set(IDEMPOTENCY_KEY_HEADER, "key1")
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 422 {
+		t.Errorf("Expected 422, actual: %d", w.Code)
+	}
+}
+
+func TestIdempotencyKeysAreScopedByUser(t *testing.T) {
+	fake := useFakeS3(t)
+	resetIdempotencyCache(t)
+
+	for _, userId := range []string{"user1", "user2"} {
+		c, w := newTestContext("POST", "/files/note.md", "content")
+		c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+		c.Request.Header.Set(IDEMPOTENCY_KEY_HEADER, "key1")
+		runAsUser(c, handlePostFile, userId)
+
+		if w.Code != 201 || w.Header().Get(IDEMPOTENCY_REPLAYED_HEADER) != "" {
+			t.Errorf("Expected %s to create the file, actual: %d", userId, w.Code)
+		}
+	}
+	if fake.count() != 2 {
+		t.Errorf("Expected 2 files, actual: %d", fake.count())
+	}
+}
+
+func TestFailedRequestCanBeRetriedWithSameIdempotencyKey(t *testing.T) {
+	resetIdempotencyCache(t)
+
+	_, err := beginIdempotentRequest("user1/", "key1", "note.md")
+	if err != nil {
+		t.Fatalf("Error beginning: %s", err)
+	}
+	_, err = beginIdempotentRequest("user1/", "key1", "note.md")
+	if err != ErrIdempotencyKeyInProgress {
+		t.Errorf("Expected in progress, actual: %v", err)
+	}
+
+	abandonIdempotentRequest("user1/", "key1")
+	result, err := beginIdempotentRequest("user1/", "key1", "note.md")
+	if err != nil || result != nil {
+		t.Errorf("Expected to begin again, actual: %v %v", result, err)
+	}
+}
+
+func TestIdempotencyCacheIsBounded(t *testing.T) {
+	resetIdempotencyCache(t)
+	IDEMPOTENCY_MAX_KEYS = 3
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("key%d", i)
+		beginIdempotentRequest("user1/", key, "note.md")
+		completeIdempotentRequest("user1/", key, &idempotentResult{fileName: "note.md", etag: key})
+		time.Sleep(time.Millisecond) // so the keys expire in order
+	}
+
+	if len(idempotencyCache) != 3 {
+		t.Errorf("Expected 3 keys, actual: %d", len(idempotencyCache))
+	}
+	if _, ok := idempotencyCache[getIdempotencyCacheKey("user1/", "key0")]; ok {
+		t.Errorf("Expected the oldest key to be dropped")
+	}
+	if _, ok := idempotencyCache[getIdempotencyCacheKey("user1/", "key4")]; !ok {
+		t.Errorf("Expected the newest key to be kept")
+	}
+}
@@ -0,0 +1,390 @@
+package app
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The note metadata is kept next to the note, in the file with this suffix, which is never listed as a note
+var LOCAL_STORAGE_META_SUFFIX = ".meta"
+
+// The storage in the local directory, for running the API without AWS, e.g. for development.
+// The prefix maps to the directory, e.g. "user1/work/" to "<dir>/user1/work", and the note to the file in it.
+// The bucket is ignored, all the notes are kept in the one directory.
+// The ETag is the MD5 of the content, same as S3 gives to the small objects, and the last modified time is the file mtime.
+// Only meant for a single instance, the conditional writes are made safe by the lock, not by the file system.
+type localStorage struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewLocalStorage(dir string) (Storage, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("invalid local storage dir, should not be empty")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create local storage dir '%s': %v", dir, err)
+	}
+	return &localStorage{dir: dir}, nil
+}
+
+func getLocalEtag(content []byte) string {
+	hash := md5.Sum(content)
+	return "\"" + hex.EncodeToString(hash[:]) + "\""
+}
+
+// Same check as for the S3 keys, so the path always stays under the prefix
+func (storage *localStorage) getFilePath(prefix string, fileName string) (string, error) {
+	key, err := buildKey(prefix, fileName)
+	if err != nil {
+		return "", logAndReturnError(err, ErrInvalidArgument)
+	}
+	return filepath.Join(storage.dir, filepath.FromSlash(key)), nil
+}
+
+func (storage *localStorage) getDirPath(prefix string) (string, error) {
+	if !strings.HasSuffix(prefix, "/") {
+		return "", logAndReturnError(fmt.Errorf("invalid prefix '%s', should end with '/'", prefix), ErrInvalidArgument)
+	}
+	for _, segment := range strings.Split(strings.TrimSuffix(prefix, "/"), "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", logAndReturnError(fmt.Errorf("invalid prefix '%s', resolves outside the storage", prefix), ErrInvalidArgument)
+		}
+	}
+	return filepath.Join(storage.dir, filepath.FromSlash(prefix)), nil
+}
+
+func readLocalMetadata(path string) *NoteMetadata {
+	data, err := os.ReadFile(path + LOCAL_STORAGE_META_SUFFIX)
+	if err != nil {
+		return &NoteMetadata{}
+	}
+	metadata := map[string]string{}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		log.Printf("could not read the metadata of '%s': %v", path, err)
+		return &NoteMetadata{}
+	}
+	return getNoteMetadata(metadata)
+}
+
+func writeLocalMetadata(path string, meta *NoteMetadata) error {
+	metadata := map[string]string{}
+	setNoteMetadata(metadata, meta)
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return writeLocalFile(path+LOCAL_STORAGE_META_SUFFIX, data)
+}
+
+// Writes into the temp file first, so the note is never seen half-written
+func writeLocalFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Works as listFiles: only the notes directly under the prefix, the subfolders are skipped.
+// The continuation token is the last file name on the page, the notes are listed in the alphabetical order.
+func (storage *localStorage) ListFiles(ctx context.Context, bucket string, prefix string, pageSize int, continuationToken string) (*ListFilesResult, error) {
+	dirPath, err := storage.getDirPath(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &ListFilesResult{Files: []*FileData{}}, nil
+		}
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	fileNames := []string{}
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if entry.Type().IsRegular() && isSupportedFileType(&fileName) && fileName > continuationToken {
+			fileNames = append(fileNames, fileName)
+		}
+	}
+	sort.Strings(fileNames)
+
+	result := &ListFilesResult{Files: []*FileData{}}
+	for _, fileName := range fileNames {
+		if len(result.Files) == pageSize {
+			result.HasMore = true
+			result.NextContinuationToken = result.Files[len(result.Files)-1].FileName
+			break
+		}
+		path := filepath.Join(dirPath, fileName)
+		info, err := os.Stat(path)
+		if err != nil {
+			continue // deleted meanwhile
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		result.Files = append(result.Files, &FileData{
+			FileName:     fileName,
+			LastModified: info.ModTime().UTC(),
+			ETag:         getLocalEtag(data),
+			Size:         info.Size(),
+		})
+	}
+	return result, nil
+}
+
+// Works as getFileContent, if etag matches, returns "not modified"
+func (storage *localStorage) GetFileContent(ctx context.Context, bucket string, prefix string, fileName string, etag string) (*GetFileContentResult, error) {
+	path, err := storage.getFilePath(prefix, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	currentEtag := getLocalEtag(data)
+	if etag != "" && etag == currentEtag {
+		return nil, ErrNotModified
+	}
+
+	result := &GetFileContentResult{
+		Content:      string(data),
+		ETag:         currentEtag,
+		LastModified: info.ModTime().UTC(),
+		Metadata:     readLocalMetadata(path),
+	}
+	return result, nil
+}
+
+// Works as getFileInfo, the ETag is always the MD5 of the content
+func (storage *localStorage) GetFileInfo(ctx context.Context, bucket string, prefix string, fileName string) (*FileInfoResult, error) {
+	path, err := storage.getFilePath(prefix, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	result := &FileInfoResult{
+		ETag:         getLocalEtag(data),
+		ETagIsMd5:    true,
+		LastModified: info.ModTime().UTC(),
+		Metadata:     readLocalMetadata(path),
+	}
+	return result, nil
+}
+
+// Works as saveFileContent: without overwrite, fails with "already exists" when the note is there,
+// with overwrite, the metadata values not given are kept from the existing note.
+func (storage *localStorage) SaveFileContent(ctx context.Context, bucket string, prefix string, fileName string, content string, overwrite bool, meta *NoteMetadata) (*SaveFileContentResult, error) {
+	path, err := storage.getFilePath(prefix, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	_, err = os.Stat(path)
+	exists := err == nil
+	if exists && !overwrite {
+		return nil, ErrAlreadyExists
+	}
+	if exists {
+		meta = mergeNoteMetadata(readLocalMetadata(path), meta)
+	} else {
+		meta = mergeNoteMetadata(&NoteMetadata{Created: time.Now()}, meta)
+	}
+
+	data := []byte(content)
+	if err := writeLocalFile(path, data); err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	if err := writeLocalMetadata(path, meta); err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	result := &SaveFileContentResult{
+		ETag: getLocalEtag(data),
+	}
+	return result, nil
+}
+
+// Works as updateFileContent: fails with "not found" when there is no note, and with "precondition failed" when the etag doesn't match.
+// The metadata values not given are kept from the existing note.
+func (storage *localStorage) UpdateFileContent(ctx context.Context, bucket string, prefix string, fileName string, content string, etag string, meta *NoteMetadata) (*SaveFileContentResult, error) {
+	path, err := storage.getFilePath(prefix, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	if etag != getLocalEtag(current) {
+		return nil, ErrPreconditionFailed
+	}
+	meta = mergeNoteMetadata(readLocalMetadata(path), meta)
+
+	data := []byte(content)
+	if err := writeLocalFile(path, data); err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	if err := writeLocalMetadata(path, meta); err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	result := &SaveFileContentResult{
+		ETag: getLocalEtag(data),
+	}
+	return result, nil
+}
+
+// Works as renameFile: fails with "not found" when there is no note, and with "already exists" when the new one is there.
+// The metadata goes with the note.
+func (storage *localStorage) RenameFile(ctx context.Context, bucket string, prefix string, fileName string, newFileName string) (*RenameFileResult, error) {
+	path, err := storage.getFilePath(prefix, fileName)
+	if err != nil {
+		return nil, err
+	}
+	newPath, err := storage.getFilePath(prefix, newFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if _, err := os.Stat(newPath); err == nil {
+		return nil, ErrAlreadyExists
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0o700); err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	if err := os.Rename(path, newPath); err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	err = os.Rename(path+LOCAL_STORAGE_META_SUFFIX, newPath+LOCAL_STORAGE_META_SUFFIX)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("could not move the metadata of '%s' to '%s': %v", path, newPath, err)
+	}
+
+	result := &RenameFileResult{
+		ETag: getLocalEtag(data),
+	}
+	return result, nil
+}
+
+// Works as deleteFile: when the etag is given, only deletes the note that matches, the missing note is not an error
+func (storage *localStorage) DeleteFile(ctx context.Context, bucket string, prefix string, fileName string, etag string) error {
+	path, err := storage.getFilePath(prefix, fileName)
+	if err != nil {
+		return err
+	}
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return logAndReturnError(err, ErrServiceUnavailable)
+	}
+	if etag != "" && etag != getLocalEtag(data) {
+		return ErrPreconditionFailed
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return logAndReturnError(err, ErrServiceUnavailable)
+	}
+	if err := os.Remove(path + LOCAL_STORAGE_META_SUFFIX); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("could not delete the metadata of '%s': %v", path, err)
+	}
+	return nil
+}
+
+// Works as deleteAllFiles: everything under the prefix goes, including the subfolders
+func (storage *localStorage) DeleteAllFiles(ctx context.Context, bucket string, prefix string) error {
+	dirPath, err := storage.getDirPath(prefix)
+	if err != nil {
+		return err
+	}
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if err := os.RemoveAll(dirPath); err != nil {
+		return logAndReturnError(err, ErrServiceUnavailable)
+	}
+	return nil
+}
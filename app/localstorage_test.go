@@ -0,0 +1,301 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func useLocalStorage(t *testing.T) string {
+	dir := t.TempDir()
+	storage, err := NewLocalStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := getStorage()
+	SetStorage(storage)
+	t.Cleanup(func() {
+		SetStorage(original)
+	})
+	return dir
+}
+
+func TestLocalStorageHandlerFlows(t *testing.T) {
+	fake := useFakeS3(t)
+	dir := useLocalStorage(t)
+	router := newAppRouter()
+
+	// create
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodPost, "/files/note.md", "content"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 on create, actual: %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "user1", "note.md")); err != nil {
+		t.Errorf("Expected the note in the user directory: %v", err)
+	}
+
+	// create again
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodPost, "/files/note.md", "other content"))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 on create of the existing note, actual: %d", w.Code)
+	}
+
+	// overwrite
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodPut, "/files/note.md", "new content"))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on overwrite, actual: %d", w.Code)
+	}
+	etag := w.Header().Get("ETag")
+
+	// read
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodGet, "/files/note.md", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on read, actual: %d", w.Code)
+	}
+	if w.Body.String() != "new content" {
+		t.Errorf("Expected 'new content', actual: '%s'", w.Body.String())
+	}
+	if w.Header().Get("ETag") != etag {
+		t.Errorf("Expected ETag %s, actual: %s", etag, w.Header().Get("ETag"))
+	}
+
+	// read again
+	req := newAuthenticatedRequest(t, http.MethodGet, "/files/note.md", "")
+	req.Header.Set("If-None-Match", "W/"+etag)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("Expected 304 on read with If-None-Match, actual: %d", w.Code)
+	}
+
+	// rename
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodPost, "/rename", `{"fileName": "note.md", "newFileName": "renamed.md"}`))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on rename, actual: %d", w.Code)
+	}
+
+	// list
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodGet, "/files", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on list, actual: %d", w.Code)
+	}
+	var list getFilesDataOut
+	parseDataResponse(t, w, &list)
+	if len(list.Files) != 1 || list.Files[0].FileName != "renamed.md" || list.Files[0].ETag != etag {
+		t.Errorf("Expected only 'renamed.md' with ETag %s, actual: %v", etag, list.Files)
+	}
+
+	// delete
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodDelete, "/files/renamed.md", ""))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on delete, actual: %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "user1", "renamed.md")); !os.IsNotExist(err) {
+		t.Errorf("Expected the note to be deleted, actual: %v", err)
+	}
+	if fake.count() != 0 {
+		t.Errorf("Expected nothing in S3, actual: %v", fake.snapshot())
+	}
+}
+
+func TestLocalStorageConditionalSaves(t *testing.T) {
+	fake := useFakeS3(t)
+	useLocalStorage(t)
+	router := newAppRouter()
+
+	// create
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodPost, "/files/note.md", "a"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 on create, actual: %d", w.Code)
+	}
+	etag := w.Header().Get("ETag")
+
+	// save with the stale etag
+	req := newAuthenticatedRequest(t, http.MethodPut, "/files/note.md", "b")
+	req.Header.Set("If-Match", `"stale"`)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 on save with the stale etag, actual: %d", w.Code)
+	}
+
+	// save with the current etag
+	req = newAuthenticatedRequest(t, http.MethodPut, "/files/note.md", "b")
+	req.Header.Set("If-Match", etag)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on save with the current etag, actual: %d", w.Code)
+	}
+	etag = w.Header().Get("ETag")
+
+	// save if unmodified since
+	req = newAuthenticatedRequest(t, http.MethodPut, "/files/note.md", "c")
+	req.Header.Set("If-Unmodified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on save if unmodified since, actual: %d", w.Code)
+	}
+	etag = w.Header().Get("ETag")
+
+	// create again gives the existing note
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodPost, "/files/note.md", "d"))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 on create of the existing note, actual: %d", w.Code)
+	}
+	var existing existingFileDataOut
+	parseDataResponse(t, w, &existing)
+	if existing.ETag != etag {
+		t.Errorf("Expected the existing note with ETag %s, actual: %s", etag, existing.ETag)
+	}
+
+	// create under the unique name
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodPost, "/files/note.md?unique=true", "d"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 on create under the unique name, actual: %d", w.Code)
+	}
+	var created postFileDataOut
+	parseDataResponse(t, w, &created)
+	if created.FileName == "note.md" {
+		t.Errorf("Expected the unique file name, actual: '%s'", created.FileName)
+	}
+
+	// exists
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodGet, "/files/"+created.FileName+"/exists", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on exists, actual: %d", w.Code)
+	}
+
+	if fake.count() != 0 {
+		t.Errorf("Expected nothing in S3, actual: %v", fake.snapshot())
+	}
+}
+
+func TestLocalStorageS3OnlyEndpointsAreNotImplemented(t *testing.T) {
+	useFakeS3(t)
+	useLocalStorage(t)
+	router := newAppRouter()
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodGet, "/trash", ""},
+		{http.MethodGet, "/folders", ""},
+		{http.MethodPost, "/files/note.md/pin", ""},
+		{http.MethodGet, "/files?withCount=true", ""},
+		{http.MethodPost, "/deleteall", `{"confirm": "DELETE ALL"}`},
+		{http.MethodPost, "/deleteall?permanent=true&dryRun=true", `{"confirm": "DELETE ALL"}`},
+	}
+
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newAuthenticatedRequest(t, tc.method, tc.path, tc.body))
+		if w.Code != http.StatusNotImplemented {
+			t.Errorf("Expected 501 on %s %s, actual: %d", tc.method, tc.path, w.Code)
+		}
+	}
+}
+
+func TestLocalStorageRenameToExistingIsConflict(t *testing.T) {
+	useFakeS3(t)
+	useLocalStorage(t)
+	storage := getStorage()
+	storage.SaveFileContent(context.Background(), getBucket(), "user1/", "a.md", "a", false, nil)
+	storage.SaveFileContent(context.Background(), getBucket(), "user1/", "b.md", "b", false, nil)
+	router := newAppRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodPost, "/rename", `{"fileName": "a.md", "newFileName": "b.md"}`))
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409, actual: %d", w.Code)
+	}
+	result, err := storage.GetFileContent(context.Background(), getBucket(), "user1/", "b.md", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Content != "b" {
+		t.Errorf("Expected 'b' to stay, actual: '%s'", result.Content)
+	}
+}
+
+func TestLocalStorageDeleteWithStaleEtag(t *testing.T) {
+	useLocalStorage(t)
+	storage := getStorage()
+	storage.SaveFileContent(context.Background(), getBucket(), "user1/", "a.md", "a", false, nil)
+
+	err := storage.DeleteFile(context.Background(), getBucket(), "user1/", "a.md", `"stale"`)
+
+	if err != ErrPreconditionFailed {
+		t.Errorf("Expected precondition failed, actual: %v", err)
+	}
+}
+
+func TestLocalStorageKeepsMetadataOnOverwrite(t *testing.T) {
+	useLocalStorage(t)
+	storage := getStorage()
+	ctx := context.Background()
+	storage.SaveFileContent(ctx, getBucket(), "user1/", "a.md", "a", false, &NoteMetadata{Title: "My note"})
+
+	_, err := storage.SaveFileContent(ctx, getBucket(), "user1/", "a.md", "b", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := storage.GetFileContent(ctx, getBucket(), "user1/", "a.md", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Metadata.Title != "My note" || result.Metadata.Created.IsZero() {
+		t.Errorf("Expected the title and the created time to be kept, actual: %v", result.Metadata)
+	}
+}
+
+func TestLocalStorageStaysUnderPrefix(t *testing.T) {
+	useLocalStorage(t)
+	storage := getStorage()
+
+	_, err := storage.SaveFileContent(context.Background(), getBucket(), "user1/", "../user2/note.md", "content", true, nil)
+
+	if err != ErrInvalidArgument {
+		t.Errorf("Expected invalid argument, actual: %v", err)
+	}
+}
+
+func TestLocalStorageManifest(t *testing.T) {
+	useFakeS3(t)
+	useLocalStorage(t)
+	getStorage().SaveFileContent(context.Background(), getBucket(), "user1/", "a.md", "a", false, nil)
+	router := newAppRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodGet, "/manifest", ""))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getManifestDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 1 || out.Files[0].FileName != "a.md" {
+		t.Errorf("Expected only 'a.md', actual: %v", out.Files)
+	}
+}
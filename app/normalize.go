@@ -0,0 +1,43 @@
+package app
+
+import (
+	"strings"
+)
+
+// Off by default, the notes are stored byte for byte as sent.
+// When on, the line endings are converted to LF and the note ends with a single newline.
+var NORMALIZE_CONTENT = false
+
+// Off by default even when normalizing, the two trailing spaces are the line break in markdown
+var NORMALIZE_CONTENT_TRIM_TRAILING_SPACES = false
+
+func SetNormalizeContent(enabled bool, trimTrailingSpaces bool) {
+	NORMALIZE_CONTENT = enabled
+	NORMALIZE_CONTENT_TRIM_TRAILING_SPACES = trimTrailingSpaces
+}
+
+// Only the text files are normalized, judging by the content type they are stored with
+func isNormalizable(fileName string) bool {
+	return strings.HasPrefix(getContentType(fileName), "text/")
+}
+
+// Converts CRLF (and lone CR) to LF, optionally trims the spaces and tabs at the end of every line,
+// and makes sure the content ends with exactly one newline. The empty content stays empty.
+func normalizeContent(content string, trimTrailingSpaces bool) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = strings.ReplaceAll(content, "\r", "\n")
+
+	if trimTrailingSpaces {
+		lines := strings.Split(content, "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(line, " \t")
+		}
+		content = strings.Join(lines, "\n")
+	}
+
+	content = strings.TrimRight(content, "\n")
+	if content == "" {
+		return ""
+	}
+	return content + "\n"
+}
@@ -0,0 +1,139 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func useNormalizeContent(t *testing.T, enabled bool, trimTrailingSpaces bool) {
+	original := NORMALIZE_CONTENT
+	originalTrimTrailingSpaces := NORMALIZE_CONTENT_TRIM_TRAILING_SPACES
+	SetNormalizeContent(enabled, trimTrailingSpaces)
+	t.Cleanup(func() {
+		NORMALIZE_CONTENT = original
+		NORMALIZE_CONTENT_TRIM_TRAILING_SPACES = originalTrimTrailingSpaces
+	})
+}
+
+func TestNormalizeContentLineEndings(t *testing.T) {
+	cases := []struct {
+		content  string
+		expected string
+	}{
+		{"a\r\nb\r\n", "a\nb\n"},
+		{"a\rb\n", "a\nb\n"},
+		{"a\r\n\r\nb\n", "a\n\nb\n"},
+		{"a\nb\n", "a\nb\n"},
+	}
+
+	for _, tc := range cases {
+		actual := normalizeContent(tc.content, false)
+		if actual != tc.expected {
+			t.Errorf("Expected %q to be normalized to %q, actual: %q", tc.content, tc.expected, actual)
+		}
+	}
+}
+
+func TestNormalizeContentTrailingNewline(t *testing.T) {
+	cases := []struct {
+		content  string
+		expected string
+	}{
+		{"", ""},
+		{"\n\n", ""},
+		{"a", "a\n"},
+		{"a\n", "a\n"},
+		{"a\n\n\n", "a\n"},
+		{"a\r\n\r\n", "a\n"},
+	}
+
+	for _, tc := range cases {
+		actual := normalizeContent(tc.content, false)
+		if actual != tc.expected {
+			t.Errorf("Expected %q to be normalized to %q, actual: %q", tc.content, tc.expected, actual)
+		}
+	}
+}
+
+func TestNormalizeContentTrailingSpaces(t *testing.T) {
+	content := "line 1  \nline 2\t\n  indented \r\n"
+
+	if actual := normalizeContent(content, true); actual != "line 1\nline 2\n  indented\n" {
+		t.Errorf("Expected the trailing spaces to be trimmed, actual: %q", actual)
+	}
+	if actual := normalizeContent(content, false); actual != "line 1  \nline 2\t\n  indented \n" {
+		t.Errorf("Expected the trailing spaces to be kept, actual: %q", actual)
+	}
+}
+
+func TestPostFileContentIsNormalized(t *testing.T) {
+	fake := useFakeS3(t)
+	useNormalizeContent(t, true, true)
+
+	c, w := newTestContext("POST", "/files/note.md", "# Note  \r\ntext\r\n\r\n")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+	obj, ok := fake.get("user1/note.md")
+	if !ok {
+		t.Fatalf("Expected the file to be saved")
+	}
+	if string(obj.content) != "# Note\ntext\n" {
+		t.Errorf("Expected the normalized content, actual: %q", string(obj.content))
+	}
+}
+
+func TestPutFileContentIsNormalized(t *testing.T) {
+	fake := useFakeS3(t)
+	useNormalizeContent(t, true, false)
+	fake.seed("user1/note.txt", "original content")
+	original, _ := fake.get("user1/note.txt")
+
+	c, w := newTestContext("PUT", "/files/note.txt", "new  \r\ncontent")
+	c.Params = gin.Params{{Key: "filename", Value: "note.txt"}}
+	c.Request.Header.Set("If-Match", original.etag)
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.txt"); string(obj.content) != "new  \ncontent\n" {
+		t.Errorf("Expected the normalized content, actual: %q", string(obj.content))
+	}
+}
+
+func TestPostFileContentIsKeptAsSentByDefault(t *testing.T) {
+	fake := useFakeS3(t)
+
+	c, w := newTestContext("POST", "/files/note.md", "# Note  \r\ntext\r\n\r\n")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "# Note  \r\ntext\r\n\r\n" {
+		t.Errorf("Expected the content as sent, actual: %q", string(obj.content))
+	}
+}
+
+func TestRenameAndSaveContentIsNormalized(t *testing.T) {
+	fake := useFakeS3(t)
+	useNormalizeContent(t, true, true)
+	fake.seed("user1/old.md", "old content")
+
+	c, w := newTestContext("POST", "/files/old.md/renameAndSave", `{"newFileName": "new.md", "content": "# Note  \r\ntext\r\n\r\n"}`)
+	c.Params = gin.Params{{Key: "filename", Value: "old.md"}}
+	runAsUser(c, handleRenameAndSaveFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/new.md"); string(obj.content) != "# Note\ntext\n" {
+		t.Errorf("Expected the normalized content, actual: %q", string(obj.content))
+	}
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+var INDEX_MAX_FILES = 10000 // same as the manifest, beyond that the index is partial, and says so
+var INDEX_CACHE_TTL = time.Duration(30) * time.Second
+
+var (
+	INDEX_BY_LETTER = "letter" // by the first letter of the file name, A-Z index
+	INDEX_BY_MONTH  = "month"  // by the month of the last modification, timeline
+)
+
+var INDEX_OTHER_GROUP = "#" // the file names that don't start with a letter, e.g. digits or the untitled notes
+
+type getIndexDataIn struct {
+	By            string `form:"by" binding:"required"`
+	WithFileNames bool   `form:"withFileNames"`
+}
+
+type getIndexDataOut struct {
+	By        string              `json:"by"`
+	Counts    map[string]int      `json:"counts"`
+	FileNames map[string][]string `json:"fileNames,omitempty"` // only when requested, in the listing order
+	HasMore   bool                `json:"hasMore"`             // true when there are more than INDEX_MAX_FILES files, and only those are counted
+}
+
+type indexCacheData struct {
+	files   []*FileData
+	hasMore bool
+	expires time.Time
+}
+
+var indexCache = map[string]*indexCacheData{}
+var indexCacheLock sync.Mutex
+
+// Lists all the files by the prefix, up to INDEX_MAX_FILES.
+// Requires scanning all the files, so the listing is cached for a short time, the index UIs tend to be opened repeatedly,
+// which means the index is approximate when notes are being created or deleted concurrently.
+func getIndexFiles(ctx context.Context, bucket string, prefix string) ([]*FileData, bool, error) {
+	now := time.Now()
+
+	indexCacheLock.Lock()
+	cached, ok := indexCache[prefix]
+	indexCacheLock.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.files, cached.hasMore, nil
+	}
+
+	result, err := listAllFiles(ctx, bucket, prefix, S3_MAX_KEYS, INDEX_MAX_FILES)
+	if err != nil {
+		return nil, false, err // already wrapped
+	}
+
+	indexCacheLock.Lock()
+	// drop expired entries, so the cache does not grow with the number of users
+	for k, v := range indexCache {
+		if !now.Before(v.expires) {
+			delete(indexCache, k)
+		}
+	}
+	indexCache[prefix] = &indexCacheData{
+		files:   result.Files,
+		hasMore: result.HasMore,
+		expires: now.Add(INDEX_CACHE_TTL),
+	}
+	indexCacheLock.Unlock()
+
+	return result.Files, result.HasMore, nil
+}
+
+// The first letter of the file name, in upper case, so "apple.md" and "Avocado.md" go together
+func getIndexLetter(fileName string) string {
+	r, _ := utf8.DecodeRuneInString(fileName)
+	if !unicode.IsLetter(r) {
+		return INDEX_OTHER_GROUP
+	}
+	return string(unicode.ToUpper(r))
+}
+
+// The month of the last modification, as YYYY-MM in UTC, sorts chronologically as a string
+func getIndexMonth(lastModified time.Time) string {
+	return lastModified.UTC().Format("2006-01")
+}
+
+// Groups all the notes by the first letter of the file name, or by the month of the last modification,
+// and returns the number of notes in every group, optionally with the file names,
+// so the A-Z or timeline index can be built without the client downloading the whole listing.
+func handleGetIndex(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+
+	// get params from query string
+	var getIndexIn getIndexDataIn
+	if err := c.ShouldBindQuery(&getIndexIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// sanitize
+	var groupOf func(file *FileData) string
+	switch getIndexIn.By {
+	case INDEX_BY_LETTER:
+		groupOf = func(file *FileData) string { return getIndexLetter(file.FileName) }
+	case INDEX_BY_MONTH:
+		groupOf = func(file *FileData) string { return getIndexMonth(file.LastModified) }
+	default:
+		err := fmt.Errorf("invalid by '%s', should be '%s' or '%s'", getIndexIn.By, INDEX_BY_LETTER, INDEX_BY_MONTH)
+		toBadRequest(c, err)
+		return
+	}
+
+	// get files
+	files, hasMore, err := getIndexFiles(c.Request.Context(), getBucket(), prefix)
+	if err != nil {
+		toInternalServerError(c, err.Error())
+		return
+	}
+
+	// pack result
+	getIndexDataOut := &getIndexDataOut{
+		By:      getIndexIn.By,
+		Counts:  map[string]int{},
+		HasMore: hasMore,
+	}
+	if getIndexIn.WithFileNames {
+		getIndexDataOut.FileNames = map[string][]string{}
+	}
+	for _, file := range files {
+		if !isFileNameValid(file.FileName) {
+			continue
+		}
+		group := groupOf(file)
+		getIndexDataOut.Counts[group]++
+		if getIndexIn.WithFileNames {
+			getIndexDataOut.FileNames[group] = append(getIndexDataOut.FileNames[group], file.FileName)
+		}
+	}
+
+	// create response
+	toSuccess(c, getIndexDataOut)
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func resetIndexCache() {
+	indexCacheLock.Lock()
+	indexCache = map[string]*indexCacheData{}
+	indexCacheLock.Unlock()
+}
+
+func TestGetIndexByLetter(t *testing.T) {
+	fake := useFakeS3(t)
+	resetIndexCache()
+	fake.seed("user1/apple.md", "content")
+	fake.seed("user1/Avocado.txt", "content")
+	fake.seed("user1/banana.md", "content")
+	fake.seed("user1/élan.md", "content")
+	fake.seed("user1/2024 plans.md", "content")
+	fake.seed("user2/cherry.md", "someone else's note")
+
+	c, w := newTestContext("GET", "/files/index?by=letter", "")
+	runAsUser(c, handleGetIndex, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getIndexDataOut
+	parseDataResponse(t, w, &out)
+	expected := map[string]int{"A": 2, "B": 1, "É": 1, "#": 1}
+	if !reflect.DeepEqual(out.Counts, expected) {
+		t.Errorf("Expected %v, actual: %v", expected, out.Counts)
+	}
+	if out.FileNames != nil {
+		t.Errorf("Expected no file names unless requested, actual: %v", out.FileNames)
+	}
+	if out.HasMore {
+		t.Errorf("Expected hasMore to be false")
+	}
+}
+
+func TestGetIndexByLetterWithFileNames(t *testing.T) {
+	fake := useFakeS3(t)
+	resetIndexCache()
+	fake.seed("user1/apple.md", "content")
+	fake.seed("user1/banana.md", "content")
+
+	c, w := newTestContext("GET", "/files/index?by=letter&withFileNames=true", "")
+	runAsUser(c, handleGetIndex, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getIndexDataOut
+	parseDataResponse(t, w, &out)
+	expected := map[string][]string{"A": {"apple.md"}, "B": {"banana.md"}}
+	if !reflect.DeepEqual(out.FileNames, expected) {
+		t.Errorf("Expected %v, actual: %v", expected, out.FileNames)
+	}
+}
+
+func TestGetIndexByMonth(t *testing.T) {
+	fake := useFakeS3(t)
+	resetIndexCache()
+	for fileName, lastModified := range map[string]time.Time{
+		"jan 1.md": time.Date(2024, 1, 5, 10, 0, 0, 0, time.UTC),
+		"jan 2.md": time.Date(2024, 1, 31, 23, 59, 0, 0, time.UTC),
+		"mar.md":   time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		"dec.md":   time.Date(2023, 12, 15, 12, 0, 0, 0, time.UTC),
+	} {
+		fake.seed("user1/"+fileName, "content")
+		obj, _ := fake.get("user1/" + fileName)
+		obj.lastModified = lastModified
+	}
+
+	c, w := newTestContext("GET", "/files/index?by=month", "")
+	runAsUser(c, handleGetIndex, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getIndexDataOut
+	parseDataResponse(t, w, &out)
+	expected := map[string]int{"2023-12": 1, "2024-01": 2, "2024-03": 1}
+	if !reflect.DeepEqual(out.Counts, expected) {
+		t.Errorf("Expected %v, actual: %v", expected, out.Counts)
+	}
+}
+
+func TestGetIndexIsCapped(t *testing.T) {
+	fake := useFakeS3(t)
+	resetIndexCache()
+	original := INDEX_MAX_FILES
+	INDEX_MAX_FILES = 2
+	t.Cleanup(func() {
+		INDEX_MAX_FILES = original
+	})
+	fake.seed("user1/a.md", "content")
+	fake.seed("user1/b.md", "content")
+	fake.seed("user1/c.md", "content")
+
+	c, w := newTestContext("GET", "/files/index?by=letter", "")
+	runAsUser(c, handleGetIndex, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getIndexDataOut
+	parseDataResponse(t, w, &out)
+	if !out.HasMore {
+		t.Errorf("Expected hasMore to be true")
+	}
+	total := 0
+	for _, count := range out.Counts {
+		total += count
+	}
+	if total != 2 {
+		t.Errorf("Expected 2 files counted, actual: %d", total)
+	}
+}
+
+func TestGetIndexIsCached(t *testing.T) {
+	fake := useFakeS3(t)
+	resetIndexCache()
+	fake.seed("user1/apple.md", "content")
+
+	c, _ := newTestContext("GET", "/files/index?by=letter", "")
+	runAsUser(c, handleGetIndex, "user1")
+
+	fake.seed("user1/banana.md", "content")
+	c, w := newTestContext("GET", "/files/index?by=letter", "")
+	runAsUser(c, handleGetIndex, "user1")
+
+	var out getIndexDataOut
+	parseDataResponse(t, w, &out)
+	if out.Counts["B"] != 0 {
+		t.Errorf("Expected the cached index, actual: %v", out.Counts)
+	}
+}
+
+func TestGetIndexRejectsUnknownGrouping(t *testing.T) {
+	useFakeS3(t)
+	resetIndexCache()
+
+	for _, target := range []string{"/files/index?by=year", "/files/index"} {
+		c, w := newTestContext("GET", target, "")
+		runAsUser(c, handleGetIndex, "user1")
+
+		if w.Code != 400 {
+			t.Errorf("Expected 400 for '%s', actual: %d", target, w.Code)
+		}
+	}
+}
+
+func TestGetIndexIsRoutedBeforeTheNote(t *testing.T) {
+	fake := useFakeS3(t)
+	resetIndexCache()
+	fake.seed("user1/apple.md", "content")
+	router := newAppRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodGet, "/files/index?by=letter", ""))
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getIndexDataOut
+	parseDataResponse(t, w, &out)
+	if out.Counts["A"] != 1 {
+		t.Errorf("Expected the index, actual: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,89 @@
+package app
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// On by default, the saves of the same note are made one after another, so the read-modify-write of one save
+// can't interleave with another one, e.g. when adding the tags, or when the client doesn't send the ETag.
+// Only helps within one instance, when there are many, the clients should rely on If-Match.
+var LOCK_NOTE_WRITES = true
+
+func SetLockNoteWrites(enabled bool) {
+	LOCK_NOTE_WRITES = enabled
+}
+
+var NOTE_LOCK_SHARDS = 256 // the different notes sharing the shard also wait for each other, which is rare and short
+
+// Never grows, unlike the mutex per key, so there is nothing to clean up
+type shardedLock struct {
+	shards []sync.Mutex
+}
+
+func newShardedLock(shards int) *shardedLock {
+	return &shardedLock{shards: make([]sync.Mutex, shards)}
+}
+
+func (l *shardedLock) shardIndex(key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(len(l.shards)))
+}
+
+// Returns the function that releases the lock
+func (l *shardedLock) lock(key string) func() {
+	shard := &l.shards[l.shardIndex(key)]
+
+	shard.Lock()
+	return shard.Unlock
+}
+
+// Locks all the keys at once, always taking the shards in the same order, so two callers locking
+// the same keys can't deadlock. The keys sharing the shard take it once.
+// Returns the function that releases the locks.
+func (l *shardedLock) lockAll(keys ...string) func() {
+	indexes := []int{}
+	taken := map[int]bool{}
+	for _, key := range keys {
+		index := l.shardIndex(key)
+		if !taken[index] {
+			taken[index] = true
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+
+	for _, index := range indexes {
+		l.shards[index].Lock()
+	}
+	return func() {
+		for i := len(indexes) - 1; i >= 0; i-- {
+			l.shards[indexes[i]].Unlock()
+		}
+	}
+}
+
+var _noteLocks = newShardedLock(NOTE_LOCK_SHARDS)
+
+// Locks the note of the user for writing, when enabled. Returns the function that releases the lock.
+func lockNote(prefix string, fileName string) func() {
+	if !LOCK_NOTE_WRITES {
+		return func() {}
+	}
+	return _noteLocks.lock(prefix + fileName)
+}
+
+// Locks several notes of the user for writing, e.g. the old and the new name of the renamed note, when enabled.
+// Returns the function that releases the locks.
+func lockNotes(prefix string, fileNames ...string) func() {
+	if !LOCK_NOTE_WRITES {
+		return func() {}
+	}
+	keys := make([]string, 0, len(fileNames))
+	for _, fileName := range fileNames {
+		keys = append(keys, prefix+fileName)
+	}
+	return _noteLocks.lockAll(keys...)
+}
@@ -0,0 +1,193 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func useLockNoteWrites(t *testing.T, enabled bool) {
+	original := LOCK_NOTE_WRITES
+	LOCK_NOTE_WRITES = enabled
+	t.Cleanup(func() {
+		LOCK_NOTE_WRITES = original
+	})
+}
+
+func TestShardedLockSerializes(t *testing.T) {
+	lock := newShardedLock(4)
+
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := lock.lock("user1/note.md")
+			defer unlock()
+			counter++
+		}()
+	}
+	wg.Wait()
+
+	if counter != 100 {
+		t.Errorf("Expected 100, actual: %d", counter)
+	}
+}
+
+func TestShardedLockAllTakesSharedShardOnce(t *testing.T) {
+	lock := newShardedLock(1)
+
+	done := make(chan bool)
+	go func() {
+		unlock := lock.lockAll("user1/old.md", "user1/new.md")
+		unlock()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the keys in the same shard not to deadlock")
+	}
+}
+
+func TestConcurrentTagChangesAreNotLost(t *testing.T) {
+	fake := useFakeS3(t)
+	useLockNoteWrites(t, true)
+	fake.seed("user1/note.md", "content")
+
+	var wg sync.WaitGroup
+	for i := 0; i < MAX_NOTE_TAGS; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := applyFileTags(context.Background(), getBucket(), "user1/", "note.md", []string{fmt.Sprintf("tag%d", i)}, nil)
+			if err != nil {
+				t.Errorf("Expected no error, actual: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	tags, err := getFileTags(context.Background(), getBucket(), "user1/", "note.md")
+	if err != nil {
+		t.Fatalf("Expected no error, actual: %v", err)
+	}
+	if noteTags := getNoteTags(tags); len(noteTags) != MAX_NOTE_TAGS {
+		t.Errorf("Expected %d tags, actual: %v", MAX_NOTE_TAGS, noteTags)
+	}
+}
+
+func TestPutFileWaitsForTheNoteLock(t *testing.T) {
+	fake := useFakeS3(t)
+	useLockNoteWrites(t, true)
+
+	unlock := lockNote("user1/", "note.md")
+	done := make(chan int)
+	go func() {
+		c, w := newTestContext("PUT", "/files/note.md", "content")
+		c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+		runAsUser(c, handlePutFile, "user1")
+		done <- w.Code
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Expected the save to wait for the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if fake.count() != 0 {
+		t.Fatalf("Expected nothing to be written while locked")
+	}
+
+	unlock()
+	if code := <-done; code != 204 {
+		t.Fatalf("Expected 204, actual: %d", code)
+	}
+	if _, ok := fake.get("user1/note.md"); !ok {
+		t.Errorf("Expected the file to be written")
+	}
+}
+
+func TestPutFileDoesNotWaitWhenNotLocking(t *testing.T) {
+	fake := useFakeS3(t)
+	useLockNoteWrites(t, false)
+
+	unlock := _noteLocks.lock("user1/note.md")
+	defer unlock()
+
+	c, w := newTestContext("PUT", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("user1/note.md"); !ok {
+		t.Errorf("Expected the file to be written")
+	}
+}
+
+func TestRenameAndSaveWaitsForTheLockOfEitherNote(t *testing.T) {
+	for _, lockedFileName := range []string{"old.md", "new.md"} {
+		fake := useFakeS3(t)
+		useLockNoteWrites(t, true)
+		fake.seed("user1/old.md", "old content")
+
+		unlock := lockNote("user1/", lockedFileName)
+		done := make(chan int)
+		go func() {
+			c, w := newTestContext("POST", "/files/old.md/renameAndSave", `{"newFileName": "new.md", "content": "new content"}`)
+			c.Params = gin.Params{{Key: "filename", Value: "old.md"}}
+			runAsUser(c, handleRenameAndSaveFile, "user1")
+			done <- w.Code
+		}()
+
+		select {
+		case <-done:
+			t.Fatalf("Expected the rename to wait for the lock of '%s'", lockedFileName)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if _, ok := fake.get("user1/new.md"); ok {
+			t.Fatalf("Expected nothing to be written while '%s' is locked", lockedFileName)
+		}
+
+		unlock()
+		if code := <-done; code != 204 {
+			t.Fatalf("Expected 204, actual: %d", code)
+		}
+	}
+}
+
+func TestPostFileWaitsForTheNoteLock(t *testing.T) {
+	fake := useFakeS3(t)
+	useLockNoteWrites(t, true)
+
+	unlock := lockNote("user1/", "note.md")
+	done := make(chan int)
+	go func() {
+		c, w := newTestContext("POST", "/files/note.md", "content")
+		c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+		runAsUser(c, handlePostFile, "user1")
+		done <- w.Code
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Expected the save to wait for the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if fake.count() != 0 {
+		t.Fatalf("Expected nothing to be written while locked")
+	}
+
+	unlock()
+	if code := <-done; code != 201 {
+		t.Fatalf("Expected 201, actual: %d", code)
+	}
+}
@@ -0,0 +1,139 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The note metadata stored in the object user-metadata, so the title doesn't have to fit into the file name
+var META_TITLE = "title"
+var META_CREATED = "created"
+
+var NOTE_TITLE_HEADER = "X-Note-Title"     // percent-encoded UTF-8, same as stored
+var NOTE_CREATED_HEADER = "X-Note-Created" // RFC3339
+
+var MAX_TITLE_LENGTH = 200
+
+// The empty values are not stored
+type NoteMetadata struct {
+	Title   string
+	Created time.Time
+}
+
+// Metadata is sent in headers, so the title has to be ASCII
+func setNoteMetadata(metadata map[string]string, meta *NoteMetadata) {
+	if meta == nil {
+		return
+	}
+	if meta.Title != "" {
+		metadata[META_TITLE] = url.PathEscape(meta.Title)
+	}
+	if !meta.Created.IsZero() {
+		metadata[META_CREATED] = meta.Created.UTC().Format(time.RFC3339)
+	}
+}
+
+// The values that can't be parsed are skipped, the same as missing
+func getNoteMetadata(metadata map[string]string) *NoteMetadata {
+	meta := &NoteMetadata{}
+	if title, err := url.PathUnescape(metadata[META_TITLE]); err == nil {
+		meta.Title = title
+	}
+	if created, err := time.Parse(time.RFC3339, metadata[META_CREATED]); err == nil {
+		meta.Created = created
+	}
+	return meta
+}
+
+// The values given explicitly win, the rest are taken from the existing metadata
+func mergeNoteMetadata(existing *NoteMetadata, meta *NoteMetadata) *NoteMetadata {
+	merged := &NoteMetadata{}
+	if existing != nil {
+		*merged = *existing
+	}
+	if meta != nil {
+		if meta.Title != "" {
+			merged.Title = meta.Title
+		}
+		if !meta.Created.IsZero() {
+			merged.Created = meta.Created
+		}
+	}
+	return merged
+}
+
+func isTitleValid(title string) bool {
+	return len(title) <= MAX_TITLE_LENGTH &&
+		utf8.ValidString(title) &&
+		strings.IndexFunc(title, unicode.IsControl) < 0
+}
+
+// Both headers are optional, returns nil when none is given
+func getNoteMetadataFromHeaders(header http.Header) (*NoteMetadata, error) {
+	titleText := header.Get(NOTE_TITLE_HEADER)
+	createdText := header.Get(NOTE_CREATED_HEADER)
+	if titleText == "" && createdText == "" {
+		return nil, nil
+	}
+
+	meta := &NoteMetadata{}
+	if titleText != "" {
+		title, err := url.PathUnescape(titleText)
+		if err != nil || !isTitleValid(title) {
+			return nil, fmt.Errorf("invalid %s '%s', should be percent-encoded and less or equal than %d bytes long", NOTE_TITLE_HEADER, titleText, MAX_TITLE_LENGTH)
+		}
+		meta.Title = title
+	}
+	if createdText != "" {
+		created, err := time.Parse(time.RFC3339, createdText)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s '%s', should be RFC3339", NOTE_CREATED_HEADER, createdText)
+		}
+		meta.Created = created
+	}
+	return meta, nil
+}
+
+// Fetches the metadata of every file, concurrently, within the limit shared by all the fan-out operations.
+//
+// Returns the metadata in the same order as the files.
+// The metadata is empty when the file could not be fetched, so one failing file doesn't break the whole listing.
+func getNoteMetadatas(ctx context.Context, bucket string, prefix string, fileNames []string) []*NoteMetadata {
+	metas := make([]*NoteMetadata, len(fileNames))
+	for i := range metas {
+		metas[i] = &NoteMetadata{}
+	}
+
+	limiter := _s3Limiter
+	var wg sync.WaitGroup
+	for i, fileName := range fileNames {
+		if err := limiter.Acquire(ctx); err != nil {
+			log.Printf("%v", err)
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, fileName string) {
+			defer wg.Done()
+			defer limiter.Release()
+
+			info, err := getFileInfo(ctx, bucket, prefix, fileName)
+			if err != nil {
+				return // already logged
+			}
+			metas[i] = info.Metadata
+		}(i, fileName)
+	}
+	wg.Wait()
+
+	return metas
+}
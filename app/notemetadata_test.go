@@ -0,0 +1,177 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func postTestNote(t *testing.T, fileName string, title string, created string) {
+	c, w := newTestContext("POST", "/files/"+fileName, "content")
+	c.Params = gin.Params{{Key: "filename", Value: fileName}}
+	if title != "" {
+		c.Request.Header.Set(NOTE_TITLE_HEADER, title)
+	}
+	if created != "" {
+		c.Request.Header.Set(NOTE_CREATED_HEADER, created)
+	}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+}
+
+func getTestNoteHeaders(t *testing.T, fileName string) (string, string) {
+	c, w := newTestContext("GET", "/files/"+fileName, "")
+	c.Params = gin.Params{{Key: "filename", Value: fileName}}
+	runAsUser(c, handleGetFile, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	return w.Header().Get(NOTE_TITLE_HEADER), w.Header().Get(NOTE_CREATED_HEADER)
+}
+
+func TestNoteMetadataRoundTrip(t *testing.T) {
+	useFakeS3(t)
+
+	postTestNote(t, "note.md", "What%3F%20Why%2F%20%C3%A9t%C3%A9", "2024-01-31T10:15:30Z")
+
+	title, created := getTestNoteHeaders(t, "note.md")
+	if title != "What%3F%20Why%2F%20%C3%A9t%C3%A9" {
+		t.Errorf("Expected the title to round-trip, actual: '%s'", title)
+	}
+	if created != "2024-01-31T10:15:30Z" {
+		t.Errorf("Expected created '2024-01-31T10:15:30Z', actual: '%s'", created)
+	}
+}
+
+func TestNewNoteGetsCreatedByDefault(t *testing.T) {
+	useFakeS3(t)
+	before := time.Now().Add(-time.Second)
+
+	postTestNote(t, "note.md", "", "")
+
+	title, createdText := getTestNoteHeaders(t, "note.md")
+	if title != "" {
+		t.Errorf("Expected no title, actual: '%s'", title)
+	}
+	created, err := time.Parse(time.RFC3339, createdText)
+	if err != nil || created.Before(before) {
+		t.Errorf("Expected created to be now, actual: '%s'", createdText)
+	}
+}
+
+func TestPutFileKeepsNoteMetadata(t *testing.T) {
+	useFakeS3(t)
+	postTestNote(t, "note.md", "My%20title", "2024-01-31T10:15:30Z")
+
+	c, w := newTestContext("PUT", "/files/note.md", "updated")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+
+	title, created := getTestNoteHeaders(t, "note.md")
+	if title != "My%20title" || created != "2024-01-31T10:15:30Z" {
+		t.Errorf("Expected the metadata to be kept, actual: '%s' '%s'", title, created)
+	}
+}
+
+func TestPutFileReplacesTitle(t *testing.T) {
+	useFakeS3(t)
+	postTestNote(t, "note.md", "Old", "2024-01-31T10:15:30Z")
+
+	c, w := newTestContext("PUT", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set(NOTE_TITLE_HEADER, "New")
+	runAsUser(c, handlePutFile, "user1")
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+
+	title, created := getTestNoteHeaders(t, "note.md")
+	if title != "New" || created != "2024-01-31T10:15:30Z" {
+		t.Errorf("Expected the new title and the same created, actual: '%s' '%s'", title, created)
+	}
+}
+
+func TestRenameFileKeepsNoteMetadata(t *testing.T) {
+	useFakeS3(t)
+	postTestNote(t, "old.md", "My%20title", "2024-01-31T10:15:30Z")
+
+	c, w := newTestContext("POST", "/rename", `{"fileName": "old.md", "newFileName": "new.md"}`)
+	runAsUser(c, handleRenameFile, "user1")
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+
+	title, created := getTestNoteHeaders(t, "new.md")
+	if title != "My%20title" || created != "2024-01-31T10:15:30Z" {
+		t.Errorf("Expected the metadata to be kept, actual: '%s' '%s'", title, created)
+	}
+}
+
+func TestRenameAndSaveFileKeepsCreated(t *testing.T) {
+	useFakeS3(t)
+	postTestNote(t, "old.md", "Old", "2024-01-31T10:15:30Z")
+
+	c, w := newTestContext("POST", "/files/old.md/renameAndSave", `{"newFileName": "new.md", "content": "new content", "title": "New title"}`)
+	c.Params = gin.Params{{Key: "filename", Value: "old.md"}}
+	runAsUser(c, handleRenameAndSaveFile, "user1")
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+
+	title, created := getTestNoteHeaders(t, "new.md")
+	if title != "New%20title" || created != "2024-01-31T10:15:30Z" {
+		t.Errorf("Expected the new title and the same created, actual: '%s' '%s'", title, created)
+	}
+}
+
+func TestGetFilesWithMetadata(t *testing.T) {
+	fake := useFakeS3(t)
+	postTestNote(t, "a.md", "Title%20A", "2024-01-31T10:15:30Z")
+	fake.seed("user1/b.md", "stored before the metadata")
+
+	c, w := newTestContext("GET", "/files?withMetadata=true", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getFilesDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 2 {
+		t.Fatalf("Expected 2 files, actual: %d", len(out.Files))
+	}
+	a, b := out.Files[0], out.Files[1]
+	if a.Title != "Title A" || a.Created == nil || !a.Created.Equal(time.Date(2024, 1, 31, 10, 15, 30, 0, time.UTC)) {
+		t.Errorf("Expected the metadata of a.md, actual: '%s' %v", a.Title, a.Created)
+	}
+	if b.Title != "" || b.Created != nil {
+		t.Errorf("Expected no metadata for b.md, actual: '%s' %v", b.Title, b.Created)
+	}
+}
+
+func TestPostFileRejectsInvalidNoteMetadata(t *testing.T) {
+	useFakeS3(t)
+
+	for _, header := range [][2]string{
+		{NOTE_TITLE_HEADER, "bad%zz"},
+		{NOTE_TITLE_HEADER, "line%0Abreak"},
+		{NOTE_CREATED_HEADER, "yesterday"},
+	} {
+		c, w := newTestContext("POST", "/files/note.md", "content")
+		c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+		c.Request.Header.Set(header[0], header[1])
+		runAsUser(c, handlePostFile, "user1")
+
+		if w.Code != 400 {
+			t.Errorf("Expected 400 for %s '%s', actual: %d", header[0], header[1], w.Code)
+		}
+	}
+}
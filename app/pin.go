@@ -0,0 +1,109 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+type pinFileUriDataIn struct {
+	FileName string `uri:"filename" binding:"required"`
+}
+
+type pinFileDataOut struct {
+	Pinned bool `json:"pinned"`
+}
+
+// Tells which of the files are pinned, fetching the tags of every file, concurrently, within the limit shared by all the fan-out operations.
+//
+// Returns the flags in the same order as the files.
+// The file is not pinned when its tags could not be fetched, so one failing file doesn't break the whole listing.
+func getFilesPinned(ctx context.Context, bucket string, prefix string, fileNames []string) []bool {
+	pinned := make([]bool, len(fileNames))
+
+	limiter := _s3Limiter
+	var wg sync.WaitGroup
+	for i, fileName := range fileNames {
+		if err := limiter.Acquire(ctx); err != nil {
+			log.Printf("%v", err)
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, fileName string) {
+			defer wg.Done()
+			defer limiter.Release()
+
+			tags, err := getFileTags(ctx, bucket, prefix, fileName)
+			if err != nil {
+				return // already logged
+			}
+			for _, tag := range tags {
+				if aws.ToString(tag.Key) == TAG_PINNED && aws.ToString(tag.Value) == "true" {
+					pinned[i] = true
+				}
+			}
+		}(i, fileName)
+	}
+	wg.Wait()
+
+	return pinned
+}
+
+func handlePinFile(c *gin.Context, userId string, email string) {
+	setPinned(c, userId, true)
+}
+
+func handleUnpinFile(c *gin.Context, userId string, email string) {
+	setPinned(c, userId, false)
+}
+
+// Pins the note, so the client shows it first, or unpins it, by setting or removing the pinned tag.
+// Pinning the pinned note, or unpinning the one that is not pinned, changes nothing, and is not an error.
+func setPinned(c *gin.Context, userId string, pinned bool) {
+	prefix := userPrefix(c, userId)
+
+	// get params from url
+	var pinFileUriIn pinFileUriDataIn
+	if err := c.ShouldBindUri(&pinFileUriIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// sanitize
+	if err := validateFileName(pinFileUriIn.FileName); err != nil {
+		err := fmt.Errorf("invalid fileName '%s', %v", pinFileUriIn.FileName, err)
+		toBadRequest(c, err)
+		return
+	}
+	fileName, err := url.PathUnescape(pinFileUriIn.FileName)
+	if err != nil {
+		err := fmt.Errorf("invalid fileName '%s', could not decode", pinFileUriIn.FileName)
+		toBadRequest(c, err)
+		return
+	}
+
+	// pin or unpin
+	err = setFileFlagTag(c.Request.Context(), getBucket(), prefix, fileName, TAG_PINNED, pinned)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			toNotFound(c)
+			return
+		}
+		if errors.Is(err, ErrTooManyTags) {
+			toConflict(c, err, nil)
+			return
+		}
+
+		toInternalServerError(c, err.Error())
+		return
+	}
+
+	toSuccess(c, &pinFileDataOut{Pinned: pinned})
+}
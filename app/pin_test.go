@@ -0,0 +1,137 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func pinFile(t *testing.T, method string, fileName string) int {
+	c, w := newTestContext(method, "/files/"+fileName+"/pin", "")
+	c.Params = gin.Params{{Key: "filename", Value: fileName}}
+	if method == "DELETE" {
+		runAsUser(c, handleUnpinFile, "user1")
+	} else {
+		runAsUser(c, handlePinFile, "user1")
+	}
+	return w.Code
+}
+
+func listWithPinned(t *testing.T, query string) (map[string]*bool, string) {
+	c, w := newTestContext("GET", "/files?"+query, "")
+	runAsUser(c, handleGetFiles, "user1")
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+
+	var out getFilesDataOut
+	parseDataResponse(t, w, &out)
+	pinned := map[string]*bool{}
+	for _, file := range out.Files {
+		pinned[file.FileName] = file.Pinned
+	}
+	return pinned, w.Header().Get("ETag")
+}
+
+func TestPinAndUnpin(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/a.md", "a")
+	fake.seed("user1/b.md", "b")
+
+	if code := pinFile(t, "POST", "a.md"); code != 200 {
+		t.Fatalf("Expected 200, actual: %d", code)
+	}
+	pinned, _ := listWithPinned(t, "withPinned=true")
+	if pinned["a.md"] == nil || !*pinned["a.md"] {
+		t.Errorf("Expected a.md to be pinned")
+	}
+	if pinned["b.md"] == nil || *pinned["b.md"] {
+		t.Errorf("Expected b.md not to be pinned")
+	}
+
+	if code := pinFile(t, "DELETE", "a.md"); code != 200 {
+		t.Fatalf("Expected 200, actual: %d", code)
+	}
+	pinned, _ = listWithPinned(t, "withPinned=true")
+	if pinned["a.md"] == nil || *pinned["a.md"] {
+		t.Errorf("Expected a.md not to be pinned once unpinned")
+	}
+}
+
+func TestPinKeepsOtherTags(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+	if _, err := applyFileTags(context.Background(), getBucket(), "user1/", "note.md", []string{"work"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := setFilePublic(context.Background(), getBucket(), "user1/", "note.md", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := pinFile(t, "POST", "note.md"); code != 200 {
+		t.Fatalf("Expected 200, actual: %d", code)
+	}
+	if code := pinFile(t, "POST", "note.md"); code != 200 {
+		t.Fatalf("Expected pinning again to be fine, actual: %d", code)
+	}
+
+	tags, err := getFileTags(context.Background(), getBucket(), "user1/", "note.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 3 {
+		t.Errorf("Expected the note tag, the public and the pinned tags, actual: %v", tags)
+	}
+}
+
+func TestPinMissingFile(t *testing.T) {
+	useFakeS3(t)
+
+	if code := pinFile(t, "POST", "missing.md"); code != 404 {
+		t.Fatalf("Expected 404, actual: %d", code)
+	}
+}
+
+func TestPinNoteWithAllTheTags(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+	noteTags := make([]string, 0, MAX_NOTE_TAGS)
+	for i := 0; i < MAX_NOTE_TAGS; i++ {
+		noteTags = append(noteTags, fmt.Sprintf("tag%d", i))
+	}
+	if _, err := applyFileTags(context.Background(), getBucket(), "user1/", "note.md", noteTags, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := setFilePublic(context.Background(), getBucket(), "user1/", "note.md", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := pinFile(t, "POST", "note.md"); code != 200 {
+		t.Fatalf("Expected the pinned tag to fit, actual: %d", code)
+	}
+}
+
+func TestGetFilesWithoutPinned(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/a.md", "a")
+
+	pinned, _ := listWithPinned(t, "")
+	if pinned["a.md"] != nil {
+		t.Errorf("Expected no pinned flag unless requested")
+	}
+}
+
+func TestGetFilesPinningChangesEtag(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/a.md", "a")
+
+	_, before := listWithPinned(t, "withPinned=true")
+	pinFile(t, "POST", "a.md")
+	_, after := listWithPinned(t, "withPinned=true")
+
+	if before == after {
+		t.Errorf("Expected the listing ETag to change once pinned")
+	}
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var PREVIEW_MAX_LENGTH = 500 // every preview is a separate S3 call, so keep them short
+
+var (
+	markdownCodeFence  = regexp.MustCompile("(?m)^\\s*(```|~~~).*$")
+	markdownImage      = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink       = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	markdownHeading    = regexp.MustCompile(`(?m)^\s{0,3}#{1,6}\s+`)
+	markdownBlockquote = regexp.MustCompile(`(?m)^\s{0,3}>\s?`)
+	markdownListMarker = regexp.MustCompile(`(?m)^\s*([-*+]|\d+[.)])\s+`)
+	markdownHorizontal = regexp.MustCompile(`(?m)^\s{0,3}([-*_]\s*){3,}$`)
+	markdownHtmlTag    = regexp.MustCompile(`<[^>]+>`)
+	markdownEmphasis   = regexp.MustCompile("[*_~`]+")
+	whitespaceSequence = regexp.MustCompile(`\s+`)
+)
+
+// Fetches the beginning of every file, up to length bytes, and turns it into the preview.
+// The files are fetched concurrently, within the limit shared by all the fan-out operations.
+//
+// Returns the previews in the same order as the files.
+// The preview is empty when the file could not be fetched, so one failing file doesn't break the whole listing.
+func getFilePreviews(ctx context.Context, bucket string, prefix string, fileNames []string, length int) []string {
+	previews := make([]string, len(fileNames))
+
+	limiter := _s3Limiter
+	var wg sync.WaitGroup
+	for i, fileName := range fileNames {
+		if err := limiter.Acquire(ctx); err != nil {
+			log.Printf("%v", err)
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, fileName string) {
+			defer wg.Done()
+			defer limiter.Release()
+
+			text, err := getFileBeginning(ctx, bucket, prefix, fileName, length)
+			if err != nil {
+				return // already logged
+			}
+			previews[i] = getPreview(fileName, text)
+		}(i, fileName)
+	}
+	wg.Wait()
+
+	return previews
+}
+
+// The preview is a single line of plain text, with the markdown syntax stripped for .md files
+func getPreview(fileName string, text string) string {
+	if isMarkdown(fileName) {
+		text = stripMarkdown(text)
+	}
+	return strings.TrimSpace(whitespaceSequence.ReplaceAllString(text, " "))
+}
+
+// Good enough for the preview, not a markdown parser
+func stripMarkdown(text string) string {
+	text = markdownCodeFence.ReplaceAllString(text, "")
+	text = markdownImage.ReplaceAllString(text, "$1")
+	text = markdownLink.ReplaceAllString(text, "$1")
+	text = markdownHorizontal.ReplaceAllString(text, "")
+	text = markdownHeading.ReplaceAllString(text, "")
+	text = markdownBlockquote.ReplaceAllString(text, "")
+	text = markdownListMarker.ReplaceAllString(text, "")
+	text = markdownHtmlTag.ReplaceAllString(text, "")
+	text = markdownEmphasis.ReplaceAllString(text, "")
+	return text
+}
@@ -0,0 +1,104 @@
+package app
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStripMarkdown(t *testing.T) {
+	cases := []struct {
+		fileName string
+		text     string
+		preview  string
+	}{
+		{"note.md", "# Title\n\nSome **bold** and _italic_ text", "Title Some bold and italic text"},
+		{"note.md", "- item 1\n- item 2\n1. first", "item 1 item 2 first"},
+		{"note.md", "See [the docs](https://example.com) ![logo](logo.png)", "See the docs logo"},
+		{"note.md", "> quoted\n\n---\n\n```go\ncode()\n```", "quoted code()"},
+		{"note.md", "<b>html</b> and `code`", "html and code"},
+		{"note.txt", "# not a title in text", "# not a title in text"},
+		{"note.txt", "  several\n\n  lines  ", "several lines"},
+	}
+
+	for _, tc := range cases {
+		preview := getPreview(tc.fileName, tc.text)
+		if preview != tc.preview {
+			t.Errorf("Expected preview of %q in %s to be %q, actual: %q", tc.text, tc.fileName, tc.preview, preview)
+		}
+	}
+}
+
+func TestGetFilesWithPreview(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/a.md", "# Shopping\n\n- **milk**\n- bread\n- butter and a very long list after that")
+	fake.seed("user1/b.txt", "plain text note")
+	fake.seed("user1/c.md", "")
+
+	c, w := newTestContext("GET", "/files?withPreview=30", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getFilesDataOut
+	parseDataResponse(t, w, &out)
+	expected := map[string]string{
+		"a.md":  "Shopping milk bread",
+		"b.txt": "plain text note",
+		"c.md":  "",
+	}
+	for _, file := range out.Files {
+		if file.Preview != expected[file.FileName] {
+			t.Errorf("Expected preview of %s to be %q, actual: %q", file.FileName, expected[file.FileName], file.Preview)
+		}
+	}
+}
+
+func TestGetFilesWithPreviewOfCompressedFile(t *testing.T) {
+	useFakeS3(t)
+	useCompressAtRest(t, 10)
+	content := "first words " + strings.Repeat("and many more words ", 100)
+
+	c, _ := newTestContext("PUT", "/files/note.txt", content)
+	c.Params = []gin.Param{{Key: "filename", Value: "note.txt"}}
+	runAsUser(c, handlePutFile, "user1")
+
+	c, w := newTestContext("GET", "/files?withPreview=50", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	var out getFilesDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 1 || !strings.HasPrefix(out.Files[0].Preview, "first words and many more words") {
+		t.Errorf("Expected the preview of the decompressed content, actual: %v", out.Files)
+	}
+	if len(out.Files[0].Preview) > 50 {
+		t.Errorf("Expected at most 50 bytes, actual: %d", len(out.Files[0].Preview))
+	}
+}
+
+func TestGetFilesWithoutPreview(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/a.md", "content")
+
+	c, w := newTestContext("GET", "/files", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	var out getFilesDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 1 || out.Files[0].Preview != "" {
+		t.Errorf("Expected no preview, actual: %v", out.Files)
+	}
+}
+
+func TestGetFilesRejectsTooLongPreview(t *testing.T) {
+	useFakeS3(t)
+
+	c, w := newTestContext("GET", "/files?withPreview=501", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, actual: %d", w.Code)
+	}
+}
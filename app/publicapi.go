@@ -0,0 +1,105 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+type getPublicFileDataIn struct {
+	UserId   string `uri:"userId" binding:"required"`
+	FileName string `uri:"filename" binding:"required"`
+}
+
+type getPublicFileQueryDataIn struct {
+	TenantId string `form:"tenant"`
+}
+
+// Serves the note shared publicly as read-only, no authentication required.
+// The note that exists but is not shared gives 404, same as the note that does not exist,
+// so the existence of private notes is never revealed.
+func handleGetPublicFile(c *gin.Context) {
+	// get params from url
+	var getPublicFileIn getPublicFileDataIn
+	if err := c.ShouldBindUri(&getPublicFileIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get params from query string
+	var getPublicFileQueryIn getPublicFileQueryDataIn
+	if err := c.ShouldBindQuery(&getPublicFileQueryIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get params from headers
+	ifNoneMatch := getIfNoneMatch(c.Request.Header)
+
+	// sanitize
+	if !isUserIdValid(getPublicFileIn.UserId) {
+		toNotFound(c)
+		return
+	}
+	if getPublicFileQueryIn.TenantId != "" && !isTenantIdValid(getPublicFileQueryIn.TenantId) {
+		toNotFound(c)
+		return
+	}
+	prefix := getUserPrefix(getPublicFileQueryIn.TenantId, getPublicFileIn.UserId)
+	if err := validateFileName(getPublicFileIn.FileName); err != nil {
+		err := fmt.Errorf("invalid fileName '%s', %v", getPublicFileIn.FileName, err)
+		toBadRequest(c, err)
+		return
+	}
+	fileName, err := url.PathUnescape(getPublicFileIn.FileName)
+	if err != nil {
+		err := fmt.Errorf("invalid fileName '%s', could not decode", getPublicFileIn.FileName)
+		toBadRequest(c, err)
+		return
+	}
+	if err := ifNoneMatch.validate(); err != nil {
+		toBadRequest(c, err)
+		return
+	}
+
+	// check the note is shared
+	public, err := isFilePublic(c.Request.Context(), getBucket(), prefix, fileName)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			toNotFound(c)
+			return
+		}
+
+		toInternalServerError(c, err.Error())
+		return
+	}
+	if !public {
+		toNotFound(c)
+		return
+	}
+
+	// get file content
+	etag := ifNoneMatch.single()
+	result, err := getFileContent(c.Request.Context(), getBucket(), prefix, fileName, etag)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			toNotFound(c)
+			return
+		}
+		if errors.Is(err, ErrNotModified) {
+			toNotModified(c, etag)
+			return
+		}
+
+		toInternalServerError(c, err.Error())
+		return
+	}
+	if ifNoneMatch.matches(result.ETag) {
+		toNotModified(c, result.ETag)
+		return
+	}
+
+	toTextWithEtag(c, result.Content, getContentType(fileName), result.ETag)
+}
@@ -0,0 +1,214 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getPublicFile(userId string, fileName string) (int, string) {
+	c, w := newTestContext("GET", "/public/"+userId+"/"+fileName, "")
+	c.Params = gin.Params{{Key: "userId", Value: userId}, {Key: "filename", Value: fileName}}
+	handleGetPublicFile(c)
+	c.Writer.WriteHeaderNow()
+
+	return w.Code, w.Body.String()
+}
+
+func TestGetPublicFile(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/shared.md", "shared content")
+	err := setFilePublic(context.Background(), getBucket(), "user1/", "shared.md", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := getPublicFile("user1", "shared.md")
+
+	if code != 200 {
+		t.Fatalf("Expected 200, actual: %d", code)
+	}
+	if body != "shared content" {
+		t.Errorf("Expected 'shared content', actual: '%s'", body)
+	}
+}
+
+func TestGetPrivateFileAsPublic(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/private.md", "private content")
+
+	code, body := getPublicFile("user1", "private.md")
+
+	if code != 404 {
+		t.Fatalf("Expected 404, actual: %d", code)
+	}
+	if body == "private content" {
+		t.Errorf("Expected content not to be served")
+	}
+}
+
+func TestGetMissingFileAsPublic(t *testing.T) {
+	useFakeS3(t)
+
+	code, _ := getPublicFile("user1", "missing.md")
+
+	if code != 404 {
+		t.Fatalf("Expected 404, actual: %d", code)
+	}
+}
+
+func TestSetFilePublicKeepsOtherTags(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+	obj, _ := fake.get("user1/note.md")
+	obj.tags = parseFakeTagging("project=notedok")
+
+	ctx := context.Background()
+	if err := setFilePublic(ctx, getBucket(), "user1/", "note.md", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := setFilePublic(ctx, getBucket(), "user1/", "note.md", false); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, _ = fake.get("user1/note.md")
+	if len(obj.tags) != 1 || *obj.tags[0].Key != "project" {
+		t.Errorf("Expected only the project tag to be left, actual: %v", obj.tags)
+	}
+	public, err := isFilePublic(ctx, getBucket(), "user1/", "note.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if public {
+		t.Errorf("Expected the note not to be public")
+	}
+}
+
+func TestSetSharing(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("PUT", "/files/note.md/sharing", `{"public": true}`)
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleSetSharing, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out setSharingDataOut
+	parseDataResponse(t, w, &out)
+	if !out.Public || out.Url != "/public/user1/note.md" {
+		t.Fatalf("Expected public url '/public/user1/note.md', actual: '%s'", out.Url)
+	}
+	if code, body := getPublicFile("user1", "note.md"); code != 200 || body != "content" {
+		t.Fatalf("Expected the note to be served publicly, actual: %d", code)
+	}
+
+	c, w = newTestContext("PUT", "/files/note.md/sharing", `{"public": false}`)
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleSetSharing, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	out = setSharingDataOut{}
+	parseDataResponse(t, w, &out)
+	if out.Public || out.Url != "" {
+		t.Errorf("Expected not public and no url, actual: %v '%s'", out.Public, out.Url)
+	}
+	if code, _ := getPublicFile("user1", "note.md"); code != 404 {
+		t.Errorf("Expected 404 once not shared, actual: %d", code)
+	}
+}
+
+func TestSetSharingEscapesUrl(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/my note.md", "content")
+
+	c, w := newTestContext("PUT", "/files/my%20note.md/sharing", `{"public": true}`)
+	c.Params = gin.Params{{Key: "filename", Value: "my%20note.md"}}
+	runAsUser(c, handleSetSharing, "user1")
+
+	var out setSharingDataOut
+	parseDataResponse(t, w, &out)
+	if out.Url != "/public/user1/my%20note.md" {
+		t.Errorf("Expected '/public/user1/my%%20note.md', actual: '%s'", out.Url)
+	}
+}
+
+func TestPublicFileUrlUnderBasePath(t *testing.T) {
+	useBasePath(t, "/notes")
+
+	cases := []struct {
+		forwardedHost  string
+		forwardedProto string
+		expected       string
+	}{
+		{"", "", "/notes/public/user1/my%20note.md"},
+		{"example.com", "", "https://example.com/notes/public/user1/my%20note.md"},
+		{"example.com, proxy.internal", "http, https", "http://example.com/notes/public/user1/my%20note.md"},
+		{"example.com", "javascript", "https://example.com/notes/public/user1/my%20note.md"},
+	}
+
+	for _, tc := range cases {
+		header := http.Header{}
+		if tc.forwardedHost != "" {
+			header.Set("X-Forwarded-Host", tc.forwardedHost)
+		}
+		if tc.forwardedProto != "" {
+			header.Set("X-Forwarded-Proto", tc.forwardedProto)
+		}
+
+		publicUrl := getPublicFileUrl(header, "", "user1", "my note.md")
+		if publicUrl != tc.expected {
+			t.Errorf("Expected '%s', actual: '%s'", tc.expected, publicUrl)
+		}
+	}
+}
+
+func TestSetSharingOnMissingFile(t *testing.T) {
+	useFakeS3(t)
+
+	c, w := newTestContext("PUT", "/files/note.md/sharing", `{"public": true}`)
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleSetSharing, "user1")
+
+	if w.Code != 404 {
+		t.Fatalf("Expected 404, actual: %d", w.Code)
+	}
+}
+
+func TestSetSharingRequiresPublic(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("PUT", "/files/note.md/sharing", `{}`)
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleSetSharing, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+}
+
+func TestSavingKeepsSharing(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+	err := setFilePublic(context.Background(), getBucket(), "user1/", "note.md", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, w := newTestContext("PUT", "/files/note.md", "new content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if code, body := getPublicFile("user1", "note.md"); code != 200 || body != "new content" {
+		t.Errorf("Expected the updated note to be still shared, actual: %d", code)
+	}
+}
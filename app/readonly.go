@@ -0,0 +1,69 @@
+package app
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Off by default. In the read-only mode, e.g. during the migration, the notes can still be read, listed and searched,
+// but every request that would change anything gets 503. Can be toggled at runtime through POST /admin/readonly.
+var _readOnly atomic.Bool
+
+func SetReadOnly(enabled bool) {
+	_readOnly.Store(enabled)
+}
+
+func isReadOnly() bool {
+	return _readOnly.Load()
+}
+
+var READ_ONLY_RETRY_AFTER = 60 // seconds, the maintenance is not expected to be over any sooner
+
+// The sign-in doesn't change any notes, and the admin has to be able to turn the read-only mode off
+var READ_ONLY_EXEMPT_PATHS = []string{"/signin", "/admin/readonly"}
+
+type setReadOnlyDataIn struct {
+	ReadOnly *bool `json:"readOnly" binding:"required"` // pointer, so false is not taken for missing
+}
+
+type setReadOnlyDataOut struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+func isMutatingMethod(method string) bool {
+	return method == http.MethodPost || method == http.MethodPut || method == http.MethodDelete || method == http.MethodPatch
+}
+
+// Rejects the requests that would change anything with 503 when in the read-only mode, the GETs go through as usual
+func rejectWritesWhenReadOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isReadOnly() || !isMutatingMethod(c.Request.Method) ||
+			slices.Contains(READ_ONLY_EXEMPT_PATHS, strings.TrimPrefix(c.Request.URL.Path, BASE_PATH)) {
+			c.Next()
+			return
+		}
+
+		c.Header("Retry-After", strconv.Itoa(READ_ONLY_RETRY_AFTER))
+		toJSON(c, http.StatusServiceUnavailable, gin.H{"err": "the service is in read-only mode for maintenance, retry later"})
+		c.Abort()
+	}
+}
+
+// Turns the read-only mode on or off at runtime, without the restart. Only affects this instance.
+func handleSetReadOnly(c *gin.Context) {
+	// get app data from the POST body
+	var setReadOnlyIn setReadOnlyDataIn
+	if err := c.ShouldBindJSON(&setReadOnlyIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	SetReadOnly(*setReadOnlyIn.ReadOnly)
+
+	toSuccess(c, &setReadOnlyDataOut{ReadOnly: isReadOnly()})
+}
@@ -0,0 +1,137 @@
+package app
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func useReadOnly(t *testing.T, enabled bool) {
+	original := isReadOnly()
+	SetReadOnly(enabled)
+	t.Cleanup(func() {
+		SetReadOnly(original)
+	})
+}
+
+func newAuthenticatedRequest(t *testing.T, method string, target string, body string) *http.Request {
+	SetEncryptionPassphrase("test passphrase")
+	session, err := generateSession("user1", "user1@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("x-session", base64.StdEncoding.EncodeToString(session))
+	return req
+}
+
+func TestReadOnlyRejectsPut(t *testing.T) {
+	fake := useFakeS3(t)
+	useReadOnly(t, true)
+	router := newAppRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, "PUT", "/files/note.md", "content"))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503, actual: %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected Retry-After")
+	}
+	if !strings.Contains(w.Body.String(), "read-only") {
+		t.Errorf("Expected the read-only message, actual: '%s'", w.Body.String())
+	}
+	if fake.count() != 0 {
+		t.Errorf("Expected nothing to be written")
+	}
+}
+
+func TestReadOnlyAllowsGet(t *testing.T) {
+	fake := useFakeS3(t)
+	useReadOnly(t, true)
+	fake.seed("user1/note.md", "content")
+	router := newAppRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, "GET", "/files/note.md", ""))
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	if w.Body.String() != "content" {
+		t.Errorf("Expected 'content', actual: '%s'", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/liveness", nil))
+	if w.Code != 200 {
+		t.Errorf("Expected liveness 200, actual: %d", w.Code)
+	}
+}
+
+func TestReadOnlyOffAllowsPut(t *testing.T) {
+	fake := useFakeS3(t)
+	useReadOnly(t, false)
+	router := newAppRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, "PUT", "/files/note.md", "content"))
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("user1/note.md"); !ok {
+		t.Errorf("Expected the file to be written")
+	}
+}
+
+func TestToggleReadOnlyAtRuntime(t *testing.T) {
+	useFakeS3(t)
+	useReadOnly(t, false)
+	useAdminToken(t, "secret")
+	router := newAppRouter()
+
+	toggle := func(body string) int {
+		req := httptest.NewRequest("POST", "/admin/readonly", strings.NewReader(body))
+		req.Header.Set("X-Admin-Token", "secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := toggle(`{"readOnly": true}`); code != 200 {
+		t.Fatalf("Expected 200, actual: %d", code)
+	}
+	if !isReadOnly() {
+		t.Fatalf("Expected read-only mode")
+	}
+	if code := toggle(`{"readOnly": false}`); code != 200 {
+		t.Fatalf("Expected the read-only mode to be turned off while on, actual: %d", code)
+	}
+	if isReadOnly() {
+		t.Fatalf("Expected read-only mode to be off")
+	}
+	if code := toggle(`{}`); code != 400 {
+		t.Errorf("Expected 400 without readOnly, actual: %d", code)
+	}
+}
+
+func TestToggleReadOnlyRequiresAdminToken(t *testing.T) {
+	useReadOnly(t, false)
+	useAdminToken(t, "secret")
+	router := newAppRouter()
+
+	req := httptest.NewRequest("POST", "/admin/readonly", strings.NewReader(`{"readOnly": true}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != 401 {
+		t.Fatalf("Expected 401, actual: %d", w.Code)
+	}
+	if isReadOnly() {
+		t.Errorf("Expected read-only mode to stay off")
+	}
+}
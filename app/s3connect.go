@@ -1,15 +1,29 @@
 package app
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"maps"
+	"mime"
 	"net/url"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"artemkv.net/notedok/internal/fanout"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
@@ -22,8 +36,116 @@ var (
 	ErrNotFound           = errors.New("not found")
 	ErrNotModified        = errors.New("not modified")
 	ErrAlreadyExists      = errors.New("already exists")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrBucketNotFound     = errors.New("bucket not found")
+	ErrAccessDenied       = errors.New("access denied")
+	ErrTooManyTags        = errors.New("too many tags")
 )
 
+// The subset of the S3 API used by the app
+type s3Client interface {
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
+}
+
+// Gives the client shared by all the calls, can be replaced in tests
+var newS3Client = getSharedS3Client
+
+// The client is safe for concurrent use, and loading the config (credentials, region) on every call is a waste,
+// so the client is created on the first use. The failure is not remembered, the next call simply tries again.
+var (
+	_s3client   s3Client
+	_s3clientMu sync.Mutex
+)
+
+func getSharedS3Client() (s3Client, error) {
+	_s3clientMu.Lock()
+	defer _s3clientMu.Unlock()
+
+	if _s3client != nil {
+		return _s3client, nil
+	}
+	cfg, err := loadAwsConfig(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	_s3client = &countingS3Client{s3Client: s3.NewFromConfig(cfg)}
+	return _s3client, nil
+}
+
+// Empty unless given, the default credential chain (env, shared config, instance role) and region are used then.
+// The explicit keys are for the deployments that don't get the credentials from AWS, e.g. the S3-compatible storage, or CI.
+var (
+	AWS_ACCESS_KEY_ID     = ""
+	AWS_SECRET_ACCESS_KEY = ""
+	AWS_SESSION_TOKEN     = "" // only for the temporary credentials
+	AWS_REGION            = ""
+)
+
+func SetAwsCredentials(accessKeyId string, secretAccessKey string, sessionToken string, region string) error {
+	if (accessKeyId == "") != (secretAccessKey == "") {
+		return fmt.Errorf("invalid AWS credentials, both the access key id and the secret access key should be given")
+	}
+	if sessionToken != "" && accessKeyId == "" {
+		return fmt.Errorf("invalid AWS credentials, the session token is only used with the access key id and the secret access key")
+	}
+
+	AWS_ACCESS_KEY_ID = accessKeyId
+	AWS_SECRET_ACCESS_KEY = secretAccessKey
+	AWS_SESSION_TOKEN = sessionToken
+	AWS_REGION = region
+	return nil
+}
+
+// The static credentials, when configured, otherwise the default chain
+func loadAwsConfig(ctx context.Context) (aws.Config, error) {
+	var options []func(*config.LoadOptions) error
+	if AWS_REGION != "" {
+		options = append(options, config.WithRegion(AWS_REGION))
+	}
+	if AWS_ACCESS_KEY_ID != "" {
+		options = append(options, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN)))
+	}
+	return config.LoadDefaultConfig(ctx, options...)
+}
+
+var MAX_S3_CONCURRENCY = 16 // max S3 calls made at the same time by all the fan-out operations together
+
+// Shared by all the fan-out operations, so many simultaneous users can't overwhelm S3 or exhaust file descriptors
+var _s3Limiter, _ = fanout.NewLimiter(MAX_S3_CONCURRENCY)
+
+func SetMaxS3Concurrency(limit int) error {
+	limiter, err := fanout.NewLimiter(limit)
+	if err != nil {
+		return err
+	}
+	MAX_S3_CONCURRENCY = limit
+	_s3Limiter = limiter
+	return nil
+}
+
+var TAG_PUBLIC = "public" // the note is shared publicly as read-only when the tag is "true"
+var TAG_PINNED = "pinned" // the client shows the note first when the tag is "true"
+
+var TAG_NOTE_PREFIX = "tag:" // the tags given to the note by the user, e.g. "tag:work", kept apart from the service tags
+var S3_MAX_TAGS = 10         // per object
+var MAX_NOTE_TAGS = 8        // the rest is left for the public and the pinned tags
+
+var TRASH_FOLDER = ".trash/"
+var TRASH_META_ORIGINAL_NAME = "original-name"
+var TRASH_META_DELETED_AT = "deleted-at"
+
+var AUDIT_FOLDER = ".audit/" // not a note folder, never listed, moved or searched
+
 type ListFilesResult struct {
 	Files                 []*FileData
 	HasMore               bool
@@ -34,11 +156,40 @@ type FileData struct {
 	FileName     string
 	LastModified time.Time
 	ETag         string
+	Size         int64 // as stored, i.e. compressed, when compressed at rest
+}
+
+type ListTrashedFilesResult struct {
+	Files                 []*TrashedFileData
+	HasMore               bool
+	NextContinuationToken string
+}
+
+type TrashedFileData struct {
+	FileName         string // name in the trash
+	OriginalFileName string
+	DeletedAt        time.Time
+	ETag             string
 }
 
 type GetFileContentResult struct {
-	Content string // UTF-8 encoded content of the file
-	ETag    string
+	Content      string // UTF-8 encoded content of the file
+	ETag         string
+	LastModified time.Time
+	Metadata     *NoteMetadata
+}
+
+type FileChecksumResult struct {
+	ETag   string
+	Sha256 string // hex encoded
+	Size   int64  // in bytes, of the content as returned by the API, i.e. decompressed
+}
+
+type FileInfoResult struct {
+	ETag         string
+	ETagIsMd5    bool // of the bytes as stored, not the case for multipart uploads and KMS encryption
+	LastModified time.Time
+	Metadata     *NoteMetadata
 }
 
 type SaveFileContentResult struct {
@@ -49,11 +200,46 @@ type RenameFileResult struct {
 	ETag string
 }
 
+type UsageData struct {
+	UserId      string
+	ObjectCount int
+	TotalBytes  int64
+}
+
+type MoveFileResult struct {
+	ETag string
+}
+
+type DeleteFileResult struct {
+	FileName string
+	Deleted  bool
+	Error    string
+}
+
 func logAndReturnError(errIn error, errOut error) error {
 	log.Printf("%v", errIn)
 	return errOut
 }
 
+// The last line of defense against escaping the user namespace, e.g. with "..%2F" decoded into the file name.
+// The prefix has to be a folder, i.e. end with "/", and none of the key segments can be empty, "." or "..",
+// so the key always stays under the prefix.
+func buildKey(prefix string, fileName string) (string, error) {
+	if prefix == "" || !strings.HasSuffix(prefix, "/") {
+		return "", fmt.Errorf("invalid prefix '%s', should end with '/'", prefix)
+	}
+	key := prefix + fileName
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("invalid key '%s', resolves outside the prefix '%s'", key, prefix)
+		}
+	}
+	if err := validateKeyLength(prefix, fileName); err != nil {
+		return "", fmt.Errorf("invalid key '%s', %v", key, err)
+	}
+	return key, nil
+}
+
 func isSupportedFileType(fileName *string) bool {
 	return strings.HasSuffix(*fileName, ".txt") || strings.HasSuffix(*fileName, ".md")
 }
@@ -62,6 +248,83 @@ func isMarkdown(fileName string) bool {
 	return strings.HasSuffix(fileName, ".md")
 }
 
+// By extension, used both when storing the file and when returning it, so the browsers open the downloads correctly
+var CONTENT_TYPES = map[string]string{
+	".md":  "text/markdown; charset=UTF-8",
+	".txt": "text/plain; charset=UTF-8",
+}
+var CONTENT_TYPE_DEFAULT = "text/plain; charset=UTF-8"
+
+// Expects the JSON object, e.g. {".json": "application/json", ".csv": "text/csv; charset=UTF-8"},
+// the entries are added to the defaults, or replace them
+func SetContentTypes(contentTypesJson string) error {
+	contentTypes := map[string]string{}
+	if contentTypesJson != "" {
+		err := json.Unmarshal([]byte(contentTypesJson), &contentTypes)
+		if err != nil {
+			return fmt.Errorf("could not parse content types: %w", err)
+		}
+	}
+	for ext, contentType := range contentTypes {
+		if len(ext) < 2 || !strings.HasPrefix(ext, ".") || strings.Contains(ext[1:], ".") {
+			return fmt.Errorf("invalid extension '%s', should start with '.', e.g. '.json'", ext)
+		}
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return fmt.Errorf("invalid content type '%s' for the extension '%s': %w", contentType, ext, err)
+		}
+	}
+
+	merged := maps.Clone(CONTENT_TYPES)
+	for ext, contentType := range contentTypes {
+		merged[strings.ToLower(ext)] = contentType
+	}
+	CONTENT_TYPES = merged
+	return nil
+}
+
+func getContentType(fileName string) string {
+	if contentType, ok := CONTENT_TYPES[strings.ToLower(path.Ext(fileName))]; ok {
+		return contentType
+	}
+	return CONTENT_TYPE_DEFAULT
+}
+
+// Checks that the bucket exists and is accessible with the current credentials.
+//
+// If the bucket does not exist, the method returns "bucket not found" error.
+// If the credentials don't give access to the bucket, the method returns "access denied" error.
+func checkBucket(ctx context.Context, bucket string) error {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Initialize input
+	input := &s3.HeadBucketInput{
+		Bucket: &bucket,
+	}
+
+	// Check the bucket
+	_, err = s3client.HeadBucket(ctx, input)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			// HEAD responses have no body, so S3 reports only the status, as "NotFound" or "Forbidden"
+			switch apiErr.ErrorCode() {
+			case "NotFound", "NoSuchBucket":
+				return logAndReturnError(err, ErrBucketNotFound)
+			case "Forbidden", "AccessDenied":
+				return logAndReturnError(err, ErrAccessDenied)
+			}
+		}
+
+		return logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	return nil
+}
+
 // Retrieves the list of files by the prefix.
 // Supports 2 types of files: text (.txt) and markdown (.md)
 // Every record in the file list is the file name in the format "my file.md" or "my file.txt" (stripping the prefix).
@@ -73,30 +336,32 @@ func isMarkdown(fileName string) bool {
 // The filtering is done after fetching the page from s3, so the page returned back to the client may be empty.
 // To avoid this, the API should prevent users from submitting files that are neither ".md" nor ".txt".
 //
-// This method has no check for filtering out subfolders. The API should ensure the file name never comes with "/".
+// Only the files directly under the prefix are retrieved, the subfolders (including the trash) are rolled up by S3 using "/" as a delimiter,
+// but they still count towards the page size, so the page may come back with less files.
 //
 // The results are not in any particular order.
-func listFiles(bucket string, prefix string, pageSize int, continuationToken string) (*ListFilesResult, error) {
+func listFiles(ctx context.Context, bucket string, prefix string, pageSize int, continuationToken string) (*ListFilesResult, error) {
 	// Setup client
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	s3client, err := newS3Client()
 	if err != nil {
 		return nil, logAndReturnError(err, ErrServiceUnavailable)
 	}
-	s3client := s3.NewFromConfig(cfg)
 
 	// Initialize input
 	maxKeys := int32(pageSize)
+	delimiter := "/"
 	input := &s3.ListObjectsV2Input{
-		Bucket:  &bucket,
-		Prefix:  &prefix,
-		MaxKeys: &maxKeys,
+		Bucket:    &bucket,
+		Prefix:    &prefix,
+		Delimiter: &delimiter,
+		MaxKeys:   &maxKeys,
 	}
 	if continuationToken != "" {
 		input.ContinuationToken = &continuationToken
 	}
 
 	// Fetch the files
-	output, err := s3client.ListObjectsV2(context.TODO(), input)
+	output, err := timeS3Call(ctx, "ListObjectsV2", prefix, func() (*s3.ListObjectsV2Output, error) { return s3client.ListObjectsV2(ctx, input) })
 	if err != nil {
 		// Since we control for the rest of the parameters,
 		// the only one that can fail, in theory, is a continuation token
@@ -111,15 +376,17 @@ func listFiles(bucket string, prefix string, pageSize int, continuationToken str
 	}
 
 	// Process the output
+	// some S3-compatible backends leave out the fields AWS always sets, so none of the pointers is trusted
 	files := make([]*FileData, 0, len(output.Contents))
 	for _, obj := range output.Contents {
-		if isSupportedFileType(obj.Key) {
+		if obj.Key != nil && isSupportedFileType(obj.Key) {
 			prefixStripped, _ := strings.CutPrefix(*obj.Key, prefix)
 
 			file := &FileData{
 				FileName:     prefixStripped,
-				LastModified: *obj.LastModified,
-				ETag:         *obj.ETag,
+				LastModified: aws.ToTime(obj.LastModified),
+				ETag:         aws.ToString(obj.ETag),
+				Size:         aws.ToInt64(obj.Size),
 			}
 			files = append(files, file)
 		}
@@ -128,32 +395,190 @@ func listFiles(bucket string, prefix string, pageSize int, continuationToken str
 	// Prepare the result
 	result := &ListFilesResult{
 		Files:                 files,
-		HasMore:               *output.IsTruncated,
-		NextContinuationToken: "",
+		HasMore:               aws.ToBool(output.IsTruncated),
+		NextContinuationToken: aws.ToString(output.NextContinuationToken),
+	}
+
+	return result, nil
+}
+
+// Retrieves the list of files by the prefix, starting after the specified file name.
+// Works exactly as listFiles, except instead of the continuation token, it uses the file name to start after.
+// The file names are returned in the alphabetical order, and starting after the empty file name means starting from the beginning.
+//
+// NextContinuationToken in the result is the last file name on the page (including the filtered out files),
+// the caller should start after it to get the next page.
+func listFilesStartingAfter(ctx context.Context, bucket string, prefix string, pageSize int, startAfterFileName string) (*ListFilesResult, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Initialize input
+	maxKeys := int32(pageSize)
+	input := &s3.ListObjectsV2Input{
+		Bucket:  &bucket,
+		Prefix:  &prefix,
+		MaxKeys: &maxKeys,
+	}
+	if startAfterFileName != "" {
+		startAfter := prefix + startAfterFileName
+		input.StartAfter = &startAfter
+	}
+
+	// Fetch the files
+	output, err := timeS3Call(ctx, "ListObjectsV2", prefix, func() (*s3.ListObjectsV2Output, error) { return s3client.ListObjectsV2(ctx, input) })
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Process the output
+	files := make([]*FileData, 0, len(output.Contents))
+	lastFileName := ""
+	for _, obj := range output.Contents {
+		if obj.Key == nil {
+			continue
+		}
+		prefixStripped, _ := strings.CutPrefix(*obj.Key, prefix)
+		lastFileName = prefixStripped
+
+		if isSupportedFileType(obj.Key) {
+			file := &FileData{
+				FileName:     prefixStripped,
+				LastModified: aws.ToTime(obj.LastModified),
+				ETag:         aws.ToString(obj.ETag),
+				Size:         aws.ToInt64(obj.Size),
+			}
+			files = append(files, file)
+		}
 	}
-	if output.NextContinuationToken != nil {
-		result.NextContinuationToken = *output.NextContinuationToken
+
+	// Prepare the result
+	result := &ListFilesResult{
+		Files:                 files,
+		HasMore:               aws.ToBool(output.IsTruncated),
+		NextContinuationToken: lastFileName,
 	}
 
 	return result, nil
 }
 
+// Counts the files by the prefix, going through all the pages.
+// Only markdown and text files are counted, same as listFiles does, files in subfolders are skipped.
+//
+// This requires one S3 call per 1000 files, so the caller should avoid calling it on every request.
+// The count is only a snapshot: files created or deleted while counting may or may not be included.
+func countFiles(ctx context.Context, bucket string, prefix string) (int, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return 0, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	count := 0
+	var continuationToken *string
+	for {
+		// Initialize input
+		maxKeys := int32(1000)
+		input := &s3.ListObjectsV2Input{
+			Bucket:            &bucket,
+			Prefix:            &prefix,
+			MaxKeys:           &maxKeys,
+			ContinuationToken: continuationToken,
+		}
+
+		// Fetch the page
+		output, err := s3client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return 0, logAndReturnError(err, ErrServiceUnavailable)
+		}
+
+		// Count the files
+		for _, obj := range output.Contents {
+			if isSupportedFileType(obj.Key) {
+				prefixStripped, _ := strings.CutPrefix(*obj.Key, prefix)
+				if !strings.Contains(prefixStripped, "/") {
+					count++
+				}
+			}
+		}
+
+		if !aws.ToBool(output.IsTruncated) || output.NextContinuationToken == nil {
+			break
+		}
+		continuationToken = output.NextContinuationToken
+	}
+
+	return count, nil
+}
+
+// Retrieves the names of the folders directly under the prefix, going through all the pages.
+// Folders are not stored in S3, they are the common prefixes of the files, using "/" as a delimiter,
+// so S3 returns every folder once, no matter how many files it has.
+// Every record in the list is the folder name, without the prefix and the trailing "/".
+//
+// The names are not validated, the API should filter out the ones that are not valid folders, such as the trash.
+func listFolders(ctx context.Context, bucket string, prefix string) ([]string, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	folders := make([]string, 0)
+	var continuationToken *string
+	for {
+		// Initialize input
+		maxKeys := int32(1000)
+		delimiter := "/"
+		input := &s3.ListObjectsV2Input{
+			Bucket:            &bucket,
+			Prefix:            &prefix,
+			Delimiter:         &delimiter,
+			MaxKeys:           &maxKeys,
+			ContinuationToken: continuationToken,
+		}
+
+		// Fetch the page
+		output, err := s3client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return nil, logAndReturnError(err, ErrServiceUnavailable)
+		}
+
+		// Collect the folders
+		for _, commonPrefix := range output.CommonPrefixes {
+			folder, _ := strings.CutPrefix(*commonPrefix.Prefix, prefix)
+			folders = append(folders, strings.TrimSuffix(folder, delimiter))
+		}
+
+		if !aws.ToBool(output.IsTruncated) || output.NextContinuationToken == nil {
+			break
+		}
+		continuationToken = output.NextContinuationToken
+	}
+
+	return folders, nil
+}
+
 // Retrieves the file content as a string.
 // The file name in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
 //
 // The string that is returned contains the byte array exactly as returned by S3.
 //
 // If etag matches, returns "not modified".
-func getFileContent(bucket string, prefix string, fileName string, etag string) (*GetFileContentResult, error) {
+func getFileContent(ctx context.Context, bucket string, prefix string, fileName string, etag string) (*GetFileContentResult, error) {
 	// Setup client
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	s3client, err := newS3ClientForBucket(bucket)
 	if err != nil {
 		return nil, logAndReturnError(err, ErrServiceUnavailable)
 	}
-	s3client := s3.NewFromConfig(cfg)
 
 	// Initialize input
-	key := prefix + fileName
+	key, err := buildKey(prefix, fileName)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrInvalidArgument)
+	}
 	input := &s3.GetObjectInput{
 		Bucket: &bucket,
 		Key:    &key,
@@ -163,7 +588,7 @@ func getFileContent(bucket string, prefix string, fileName string, etag string)
 	}
 
 	// Fetch the content
-	output, err := s3client.GetObject(context.TODO(), input)
+	output, err := timeS3Call(ctx, "GetObject", key, func() (*s3.GetObjectOutput, error) { return s3client.GetObject(ctx, input) })
 	if err != nil {
 		var apiErr smithy.APIError
 		if errors.As(err, &apiErr) {
@@ -181,134 +606,1183 @@ func getFileContent(bucket string, prefix string, fileName string, etag string)
 
 	// Process the output
 	defer output.Body.Close()
-	bytes, err := io.ReadAll(output.Body)
+	data, err := io.ReadAll(&contextReader{ctx: ctx, r: output.Body})
 	if err != nil {
 		return nil, logAndReturnError(err, ErrServiceUnavailable)
 	}
+	if isCompressed(aws.ToString(output.ContentEncoding), output.Metadata) {
+		data, err = decompress(data)
+		if err != nil {
+			return nil, logAndReturnError(err, ErrServiceUnavailable)
+		}
+	}
 
 	// Prepare the result
 	result := &GetFileContentResult{
-		Content: string(bytes[:]),
-		ETag:    *output.ETag,
+		Content:      string(data[:]),
+		ETag:         *output.ETag,
+		LastModified: aws.ToTime(output.LastModified),
+		Metadata:     getNoteMetadata(output.Metadata),
 	}
 
 	return result, nil
 }
 
-// Saves the content into a file with the specified file name.
+// Computes the SHA-256 of the file content, streaming it, so the content is never held in memory.
 // The file name in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
 //
-// The file name is supposed to be file system-friendly, and don't use any special characters that are not allowed by any existing file system.
-// In practice that means it should not contain any of the following characters: /?<>\:*|"^%
-// S3 has it's own recommendations for special characters in the object name: https://docs.aws.amazon.com/AmazonS3/latest/userguide/object-keys.html
-//
-// The string is passed to S3 as is, no attempt to ensure encoding is done.
-// If the file with the same path already exists, parameter "overwrite" controls the method behavior.
-//
-// For a new note, overwrite should be set to false to avoid replacing the existing note.
-// The caller should check for "already exists" error and re-submit it with the unique name.
-// Uniqueness can be ensured by applying the timestamp to the file path, i.e. "my file~~1426963430173.txt"
-//
-// For an existing note, overwrite should be set to true.
-//
-// When restoring a deleted note, overwrite should be set to false, to avoid replacing the existing note.
-// If the note with the same path already exists, the caller should re-submit with the unique name.
+// The file compressed at rest is decompressed, so the checksum is of the content as returned by the API.
 //
-// Empty file name is not allowed.
-// If the note title is empty, the caller is supposed to ensure the path is non-empty, by applying the timestamp to the file path, i.e. "/~~1426963430173.txt"
-func saveFileContent(bucket string, prefix string, fileName string, content string, overwrite bool) (*SaveFileContentResult, error) {
+// If etag matches, returns "not modified".
+func getFileChecksum(ctx context.Context, bucket string, prefix string, fileName string, etag string) (*FileChecksumResult, error) {
 	// Setup client
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	s3client, err := newS3Client()
 	if err != nil {
 		return nil, logAndReturnError(err, ErrServiceUnavailable)
 	}
-	s3client := s3.NewFromConfig(cfg)
 
 	// Initialize input
-	key := prefix + fileName
-	var contentType string
-	if isMarkdown(fileName) {
-		contentType = "text/markdown; charset=UTF-8"
-	} else {
-		contentType = "text/plain"
+	key, err := buildKey(prefix, fileName)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrInvalidArgument)
 	}
-	input := &s3.PutObjectInput{
-		Bucket:      &bucket,
-		Key:         &key,
-		ContentType: &contentType,
-		Body:        strings.NewReader(content),
+	input := &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
 	}
-	if !overwrite {
-		asterisk := "*"
-		input.IfNoneMatch = &asterisk // fails if already exists
+	if etag != "" {
+		input.IfNoneMatch = &etag
 	}
 
-	// Store the content
-	output, err := s3client.PutObject(context.TODO(), input)
+	// Fetch the content
+	output, err := s3client.GetObject(ctx, input)
 	if err != nil {
 		var apiErr smithy.APIError
 		if errors.As(err, &apiErr) {
-			if apiErr.ErrorCode() == "PreconditionFailed" {
-				return nil, logAndReturnError(err, ErrAlreadyExists)
+			if apiErr.ErrorCode() == "NoSuchKey" {
+				return nil, logAndReturnError(err, ErrNotFound)
+			}
+
+			if apiErr.ErrorCode() == "NotModified" {
+				return nil, logAndReturnError(err, ErrNotModified)
 			}
 		}
 
 		return nil, logAndReturnError(err, ErrServiceUnavailable)
 	}
 
+	// Hash the content as it comes
+	defer output.Body.Close()
+	var body io.Reader = &contextReader{ctx: ctx, r: output.Body}
+	if isCompressed(aws.ToString(output.ContentEncoding), output.Metadata) {
+		decompressed, err := newDecompressingReader(body)
+		if err != nil {
+			return nil, logAndReturnError(err, ErrServiceUnavailable)
+		}
+		defer decompressed.Close()
+		body = decompressed
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, body)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
 	// Prepare the result
-	result := &SaveFileContentResult{
-		ETag: *output.ETag,
+	result := &FileChecksumResult{
+		ETag:   aws.ToString(output.ETag),
+		Sha256: hex.EncodeToString(hash.Sum(nil)),
+		Size:   size,
 	}
 
 	return result, nil
 }
 
-// Renames the file by changing the corresponding file name to the new file name.
+// Retrieves the first length bytes of the file content, as text, using the ranged get.
 // The file name in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
 //
-// The new file name is supposed to be file system-friendly, and don't use any special characters that are not allowed by any existing file system.
-// In practice that means it should not contain any of the following characters: /?<>\:*|"^%
-// S3 has it's own recommendations for special characters in the object name: https://docs.aws.amazon.com/AmazonS3/latest/userguide/object-keys.html
-//
-// The file with the file name provided is supposed to exist, ot the error will be returned.
-//
-// If the file with new file name already exists, the method will return error.
-// The caller should check for "already exists" error and re-submit it with the unique name.
-// Uniqueness can be ensured by applying the timestamp to the file path, i.e. "my file~~1426963430173.txt"
+// The file compressed at rest is decompressed, and the result is up to length bytes of the decompressed text.
+// The text can be cut in the middle of a character, so the incomplete character at the end is dropped.
 //
-// If none of the files exist, it will create an empty file with the target name, which is kind of logical.
-func renameFile(bucket string, prefix string, fileName string, newFileName string) (*RenameFileResult, error) {
+// If the file does not exist, the method returns "not found" error.
+func getFileBeginning(ctx context.Context, bucket string, prefix string, fileName string, length int) (string, error) {
 	// Setup client
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	s3client, err := newS3Client()
 	if err != nil {
-		return nil, logAndReturnError(err, ErrServiceUnavailable)
+		return "", logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Initialize input
+	key, err := buildKey(prefix, fileName)
+	if err != nil {
+		return "", logAndReturnError(err, ErrInvalidArgument)
+	}
+	input := &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", length-1)),
+	}
+
+	// Fetch the content
+	output, err := s3client.GetObject(ctx, input)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "NoSuchKey" {
+				return "", logAndReturnError(err, ErrNotFound)
+			}
+			// the range can't be satisfied for the empty file
+			if apiErr.ErrorCode() == "InvalidRange" {
+				return "", nil
+			}
+		}
+
+		return "", logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Process the output
+	defer output.Body.Close()
+	data, err := io.ReadAll(&contextReader{ctx: ctx, r: output.Body})
+	if err != nil {
+		return "", logAndReturnError(err, ErrServiceUnavailable)
+	}
+	if isCompressed(aws.ToString(output.ContentEncoding), output.Metadata) {
+		data, err = decompressPrefix(data, length)
+		if err != nil {
+			return "", logAndReturnError(err, ErrServiceUnavailable)
+		}
+	}
+
+	// Prepare the result
+	return strings.ToValidUTF8(string(data), ""), nil
+}
+
+// Retrieves the file info without the content.
+// The file name in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
+//
+// If the file does not exist, the method returns "not found" error.
+func getFileInfo(ctx context.Context, bucket string, prefix string, fileName string) (*FileInfoResult, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Initialize input
+	key, err := buildKey(prefix, fileName)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrInvalidArgument)
+	}
+	input := &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+
+	// Fetch the info
+	output, err := s3client.HeadObject(ctx, input)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "NotFound" {
+				return nil, logAndReturnError(err, ErrNotFound)
+			}
+		}
+
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Prepare the result
+	result := &FileInfoResult{
+		ETag:         aws.ToString(output.ETag),
+		ETagIsMd5:    isEtagMd5(aws.ToString(output.ETag), output.ServerSideEncryption),
+		LastModified: aws.ToTime(output.LastModified),
+		Metadata:     getNoteMetadata(output.Metadata),
+	}
+
+	return result, nil
+}
+
+// Checks whether the file is shared publicly, i.e. tagged as public.
+// The file name in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
+//
+// If the file does not exist, the method returns "not found" error.
+func isFilePublic(ctx context.Context, bucket string, prefix string, fileName string) (bool, error) {
+	tags, err := getFileTags(ctx, bucket, prefix, fileName)
+	if err != nil {
+		return false, err // already wrapped
+	}
+	return isTaggedPublic(tags), nil
+}
+
+// Retrieves all the S3 tags of the file, both the service ones, like public, and the ones given by the user.
+// The file name in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
+//
+// If the file does not exist, the method returns "not found" error.
+func getFileTags(ctx context.Context, bucket string, prefix string, fileName string) ([]types.Tag, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Initialize input
+	key, err := buildKey(prefix, fileName)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrInvalidArgument)
+	}
+	input := &s3.GetObjectTaggingInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+
+	// Fetch the tags
+	output, err := s3client.GetObjectTagging(ctx, input)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "NoSuchKey" {
+				return nil, logAndReturnError(err, ErrNotFound)
+			}
+		}
+
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	return output.TagSet, nil
+}
+
+func isTaggedPublic(tags []types.Tag) bool {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == TAG_PUBLIC && aws.ToString(tag.Value) == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+// Shares the file publicly as read-only, or stops sharing it, by setting or removing the public tag.
+// Other tags on the file, if any, are kept.
+// The file name in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
+//
+// If the file does not exist, the method returns "not found" error.
+func setFilePublic(ctx context.Context, bucket string, prefix string, fileName string, public bool) error {
+	return setFileFlagTag(ctx, bucket, prefix, fileName, TAG_PUBLIC, public)
+}
+
+// Sets the service tag to "true", or removes it, keeping the other tags.
+//
+// If the file does not exist, the method returns "not found" error.
+// If the file already has as many tags as S3 allows, the method returns "too many tags" error.
+func setFileFlagTag(ctx context.Context, bucket string, prefix string, fileName string, tagKey string, value bool) error {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Fetch the existing tags
+	key, err := buildKey(prefix, fileName)
+	if err != nil {
+		return logAndReturnError(err, ErrInvalidArgument)
+	}
+	unlock := lockNote(prefix, fileName)
+	defer unlock()
+	getInput := &s3.GetObjectTaggingInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	output, err := s3client.GetObjectTagging(ctx, getInput)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "NoSuchKey" {
+				return logAndReturnError(err, ErrNotFound)
+			}
+		}
+
+		return logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Replace the flag tag
+	tags := make([]types.Tag, 0, len(output.TagSet)+1)
+	for _, tag := range output.TagSet {
+		if aws.ToString(tag.Key) != tagKey {
+			tags = append(tags, tag)
+		}
+	}
+	if value {
+		tags = append(tags, types.Tag{
+			Key:   aws.String(tagKey),
+			Value: aws.String("true"),
+		})
+	}
+	if len(tags) > S3_MAX_TAGS {
+		return logAndReturnError(fmt.Errorf("file '%s' would have %d tags", key, len(tags)), ErrTooManyTags)
+	}
+
+	// Store the tags
+	putInput := &s3.PutObjectTaggingInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Tagging: &types.Tagging{
+			TagSet: tags,
+		},
+	}
+	_, err = s3client.PutObjectTagging(ctx, putInput)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "NoSuchKey" {
+				return logAndReturnError(err, ErrNotFound)
+			}
+		}
+
+		return logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	return nil
+}
+
+// The note tags, without the prefix, sorted
+func getNoteTags(tags []types.Tag) []string {
+	noteTags := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if noteTag, ok := strings.CutPrefix(aws.ToString(tag.Key), TAG_NOTE_PREFIX); ok {
+			noteTags = append(noteTags, noteTag)
+		}
+	}
+	sort.Strings(noteTags)
+	return noteTags
+}
+
+// Adds and removes the note tags of the file, keeping the rest of the tags, including the public one.
+// Adding the tag the file already has, or removing the one it doesn't have, changes nothing.
+// The file name in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
+//
+// Returns the note tags the file has after the change.
+// If the file would end up with more than MAX_NOTE_TAGS note tags, nothing is changed, and the method returns "too many tags" error.
+// If the file does not exist, the method returns "not found" error.
+func applyFileTags(ctx context.Context, bucket string, prefix string, fileName string, addTags []string, removeTags []string) ([]string, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Fetch the existing tags
+	key, err := buildKey(prefix, fileName)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrInvalidArgument)
+	}
+	unlock := lockNote(prefix, fileName)
+	defer unlock()
+	existing, err := getFileTags(ctx, bucket, prefix, fileName)
+	if err != nil {
+		return nil, err // already wrapped
+	}
+
+	// Merge the note tags
+	noteTags := map[string]bool{}
+	for _, noteTag := range getNoteTags(existing) {
+		noteTags[noteTag] = true
+	}
+	for _, noteTag := range addTags {
+		noteTags[noteTag] = true
+	}
+	for _, noteTag := range removeTags {
+		delete(noteTags, noteTag)
+	}
+	if len(noteTags) > MAX_NOTE_TAGS {
+		return nil, logAndReturnError(fmt.Errorf("file '%s' would have %d tags", key, len(noteTags)), ErrTooManyTags)
+	}
+
+	tags := make([]types.Tag, 0, len(existing)+len(addTags))
+	for _, tag := range existing {
+		if !strings.HasPrefix(aws.ToString(tag.Key), TAG_NOTE_PREFIX) {
+			tags = append(tags, tag)
+		}
+	}
+	for noteTag := range noteTags {
+		tags = append(tags, types.Tag{
+			Key:   aws.String(TAG_NOTE_PREFIX + noteTag),
+			Value: aws.String("true"),
+		})
+	}
+
+	// Store the tags
+	putInput := &s3.PutObjectTaggingInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Tagging: &types.Tagging{
+			TagSet: tags,
+		},
+	}
+	_, err = s3client.PutObjectTagging(ctx, putInput)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "NoSuchKey" {
+				return nil, logAndReturnError(err, ErrNotFound)
+			}
+		}
+
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	return getNoteTags(tags), nil
+}
+
+// Saves the content into a file with the specified file name.
+// The file name in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
+//
+// The file name is supposed to be file system-friendly, and don't use any special characters that are not allowed by any existing file system.
+// In practice that means it should not contain any of the following characters: /?<>\:*|"^%
+// S3 has it's own recommendations for special characters in the object name: https://docs.aws.amazon.com/AmazonS3/latest/userguide/object-keys.html
+//
+// The string is passed to S3 as is, no attempt to ensure encoding is done.
+// If the file with the same path already exists, parameter "overwrite" controls the method behavior.
+//
+// For a new note, overwrite should be set to false to avoid replacing the existing note.
+// The caller should check for "already exists" error and re-submit it with the unique name.
+// Uniqueness can be ensured by applying the timestamp to the file path, i.e. "my file~~1426963430173.txt",
+// which is what saveFileContentUnique does.
+//
+// For an existing note, overwrite should be set to true.
+//
+// When restoring a deleted note, overwrite should be set to false, to avoid replacing the existing note.
+// If the note with the same path already exists, the caller should re-submit with the unique name.
+//
+// Empty file name is not allowed.
+// If the note title is empty, the caller is supposed to ensure the path is non-empty, by applying the timestamp to the file path, i.e. "/~~1426963430173.txt"
+//
+// The metadata is optional, when overwriting, the values not given are kept from the existing note.
+// The new note gets the current time as created, unless given.
+func saveFileContent(ctx context.Context, bucket string, prefix string, fileName string, content string, overwrite bool, meta *NoteMetadata) (*SaveFileContentResult, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Initialize input
+	key, err := buildKey(prefix, fileName)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrInvalidArgument)
+	}
+	var tags []types.Tag
+	if !overwrite {
+		meta = mergeNoteMetadata(&NoteMetadata{Created: time.Now()}, meta)
+	} else {
+		meta, tags, err = keepNoteState(ctx, s3client, bucket, key, meta)
+		if err != nil {
+			return nil, err // already wrapped
+		}
+	}
+	input, err := newPutFileContentInput(bucket, key, fileName, content, meta)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	if !overwrite {
+		asterisk := "*"
+		input.IfNoneMatch = &asterisk // fails if already exists
+	} else {
+		setTagging(input, tags)
+	}
+
+	// Store the content
+	output, err := timeS3Call(ctx, "PutObject", key, func() (*s3.PutObjectOutput, error) { return s3client.PutObject(ctx, input) })
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "PreconditionFailed" {
+				return nil, logAndReturnError(err, ErrAlreadyExists)
+			}
+		}
+
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	mirrorPutObject(ctx, input)
+
+	// Prepare the result
+	result := &SaveFileContentResult{
+		ETag: *output.ETag,
+	}
+
+	return result, nil
+}
+
+var SAVE_UNIQUE_MAX_ATTEMPTS = 5 // every attempt after the first takes the next millisecond
+
+// The unique file name keeps the extension, e.g. "my file~~1426963430173.txt".
+// The original file name is expected to be valid, the base is cut, if needed, so the unique file name is valid as well.
+func getUniqueFileName(fileName string, t time.Time) string {
+	ext := path.Ext(fileName)
+	base := strings.TrimSuffix(fileName, ext)
+	suffix := "~~" + strconv.FormatInt(t.UnixMilli(), 10) + ext
+
+	maxBaseLength := max(MAX_FILE_NAME_LENGTH-len(suffix), 0)
+	if len(base) > maxBaseLength {
+		base = strings.ToValidUTF8(base[:maxBaseLength], "")
+	}
+	return base + suffix
+}
+
+// Saves the content into the existing file, but only if the file has not changed since it was retrieved.
+// The etag is the one returned when retrieving (or saving) the file, same as getFileContent uses.
+//
+// If the file was changed by someone else in the meantime, the method returns "precondition failed" error and nothing is written.
+// If the file does not exist anymore, the method returns "not found" error.
+// Otherwise, works exactly as saveFileContent with overwrite set to true.
+func updateFileContent(ctx context.Context, bucket string, prefix string, fileName string, content string, etag string, meta *NoteMetadata) (*SaveFileContentResult, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Initialize input
+	key, err := buildKey(prefix, fileName)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrInvalidArgument)
+	}
+	meta, tags, err := keepNoteState(ctx, s3client, bucket, key, meta)
+	if err != nil {
+		return nil, err // already wrapped
+	}
+	input, err := newPutFileContentInput(bucket, key, fileName, content, meta)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	input.IfMatch = &etag // fails if changed
+	setTagging(input, tags)
+
+	// Store the content
+	output, err := timeS3Call(ctx, "PutObject", key, func() (*s3.PutObjectOutput, error) { return s3client.PutObject(ctx, input) })
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "PreconditionFailed" {
+				return nil, logAndReturnError(err, ErrPreconditionFailed)
+			}
+			if apiErr.ErrorCode() == "NoSuchKey" {
+				return nil, logAndReturnError(err, ErrNotFound)
+			}
+		}
+
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	mirrorPutObject(ctx, input)
+
+	// Prepare the result
+	result := &SaveFileContentResult{
+		ETag: *output.ETag,
+	}
+
+	return result, nil
+}
+
+// Overwriting the file replaces all its metadata and drops all its tags, so the note metadata, the public tag
+// and the note tags have to be carried over. When the file does not exist yet, it is a new note,
+// so it gets the current time as created, and has no tags.
+//
+// The one-byte read gives both the metadata and the number of tags, so the tags are only fetched when there are any.
+// The range can't be satisfied for the empty file, then the metadata comes from HeadObject, and the tags are always fetched.
+//
+// The tags are read before the write, so the tag change made in between is lost. Within one instance, the note lock
+// keeps the saves and the tag changes apart, see lockNote, with several instances the race remains.
+func keepNoteState(ctx context.Context, s3client s3Client, bucket string, key string, meta *NoteMetadata) (*NoteMetadata, []types.Tag, error) {
+	getInput := &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Range:  aws.String("bytes=0-0"),
+	}
+	output, err := timeS3Call(ctx, "GetObject", key, func() (*s3.GetObjectOutput, error) { return s3client.GetObject(ctx, getInput) })
+	var metadata map[string]string
+	hasTags := true
+	if err != nil {
+		var apiErr smithy.APIError
+		if !errors.As(err, &apiErr) {
+			return nil, nil, logAndReturnError(err, ErrServiceUnavailable)
+		}
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey":
+			return mergeNoteMetadata(&NoteMetadata{Created: time.Now()}, meta), nil, nil
+		case "InvalidRange":
+			// the range can't be satisfied for the empty file
+			headInput := &s3.HeadObjectInput{
+				Bucket: &bucket,
+				Key:    &key,
+			}
+			head, err := timeS3Call(ctx, "HeadObject", key, func() (*s3.HeadObjectOutput, error) { return s3client.HeadObject(ctx, headInput) })
+			if err != nil {
+				if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey") {
+					return mergeNoteMetadata(&NoteMetadata{Created: time.Now()}, meta), nil, nil
+				}
+				return nil, nil, logAndReturnError(err, ErrServiceUnavailable)
+			}
+			metadata = head.Metadata
+		default:
+			return nil, nil, logAndReturnError(err, ErrServiceUnavailable)
+		}
+	} else {
+		output.Body.Close()
+		metadata = output.Metadata
+		hasTags = aws.ToInt32(output.TagCount) > 0
+	}
+	meta = mergeNoteMetadata(getNoteMetadata(metadata), meta)
+	if !hasTags {
+		return meta, nil, nil
+	}
+
+	taggingInput := &s3.GetObjectTaggingInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	tagging, err := timeS3Call(ctx, "GetObjectTagging", key, func() (*s3.GetObjectTaggingOutput, error) { return s3client.GetObjectTagging(ctx, taggingInput) })
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey" {
+			return meta, nil, nil // deleted in the meantime, nothing to carry over
+		}
+		return nil, nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	return meta, tagging.TagSet, nil
+}
+
+func setTagging(input *s3.PutObjectInput, tags []types.Tag) {
+	if len(tags) == 0 {
+		return
+	}
+	tagging := url.Values{}
+	for _, tag := range tags {
+		tagging.Set(aws.ToString(tag.Key), aws.ToString(tag.Value))
+	}
+	input.Tagging = aws.String(tagging.Encode())
+}
+
+// The multipart upload ETag has the number of parts after "-", and the KMS encrypted object ETag is not the MD5 at all
+func isEtagMd5(etag string, encryption types.ServerSideEncryption) bool {
+	return len(etag) == 34 && !strings.Contains(etag, "-") &&
+		encryption != types.ServerSideEncryptionAwsKms && encryption != types.ServerSideEncryptionAwsKmsDsse
+}
+
+// Compares the current content of the file with the given one, streaming the current content,
+// so the current copy is never held in memory as a whole, and the comparison stops at the first difference.
+// The file compressed at rest is decompressed. Returns the current ETag, when the content is the same.
+func isFileContentEqual(ctx context.Context, bucket string, prefix string, fileName string, content string) (bool, string, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return false, "", logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Initialize input
+	key, err := buildKey(prefix, fileName)
+	if err != nil {
+		return false, "", logAndReturnError(err, ErrInvalidArgument)
+	}
+	input := &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+
+	// Fetch the content
+	output, err := timeS3Call(ctx, "GetObject", key, func() (*s3.GetObjectOutput, error) { return s3client.GetObject(ctx, input) })
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "NoSuchKey" {
+				return false, "", nil
+			}
+		}
+
+		return false, "", logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Compare the content as it comes
+	defer output.Body.Close()
+	var body io.Reader = &contextReader{ctx: ctx, r: output.Body}
+	if isCompressed(aws.ToString(output.ContentEncoding), output.Metadata) {
+		decompressed, err := newDecompressingReader(body)
+		if err != nil {
+			return false, "", logAndReturnError(err, ErrServiceUnavailable)
+		}
+		defer decompressed.Close()
+		body = decompressed
+	}
+	equal, err := isReaderEqual(body, content)
+	if err != nil {
+		return false, "", logAndReturnError(err, ErrServiceUnavailable)
+	}
+	if !equal {
+		return false, "", nil
+	}
+	return true, aws.ToString(output.ETag), nil
+}
+
+// Reads chunk by chunk, comparing every chunk with the same part of the content
+func isReaderEqual(r io.Reader, content string) (bool, error) {
+	buf := make([]byte, 32*1024)
+	offset := 0
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if offset+n > len(content) || content[offset:offset+n] != string(buf[:n]) {
+				return false, nil
+			}
+			offset += n
+		}
+		if err == io.EOF {
+			return offset == len(content), nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// The ETag S3 gives to the file with the content, as written by saveFileContent, i.e. compressed if needed
+func computeFileEtag(content string) (string, error) {
+	stored := []byte(content)
+	if shouldCompress(content) {
+		compressed, err := compress(content)
+		if err != nil {
+			return "", err
+		}
+		stored = compressed
+	}
+
+	hash := md5.Sum(stored)
+	return "\"" + hex.EncodeToString(hash[:]) + "\"", nil
+}
+
+func newPutFileContentInput(bucket string, key string, fileName string, content string, meta *NoteMetadata) (*s3.PutObjectInput, error) {
+	contentType := getContentType(fileName)
+	input := &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &key,
+		ContentType: &contentType,
+		Body:        strings.NewReader(content),
+		Metadata:    map[string]string{},
+	}
+	setNoteMetadata(input.Metadata, meta)
+	if shouldCompress(content) {
+		compressed, err := compress(content)
+		if err != nil {
+			return nil, err
+		}
+		input.Body = bytes.NewReader(compressed)
+		input.ContentEncoding = &CONTENT_ENCODING_GZIP
+		input.Metadata[META_COMPRESSION] = CONTENT_ENCODING_GZIP
+	}
+	return input, nil
+}
+
+// Creates the small service file, such as the audit entry, failing with "already exists" error if the file already exists.
+// Meant for the service files, not for the notes, the content is never compressed.
+func createServiceFile(ctx context.Context, bucket string, prefix string, fileName string, text string, contentType string) error {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Initialize input
+	key, err := buildKey(prefix, fileName)
+	if err != nil {
+		return logAndReturnError(err, ErrInvalidArgument)
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &key,
+		ContentType: &contentType,
+		Body:        strings.NewReader(text),
+		IfNoneMatch: aws.String("*"), // fails if already exists
+	}
+
+	// Store the content
+	_, err = timeS3Call(ctx, "PutObject", key, func() (*s3.PutObjectOutput, error) { return s3client.PutObject(ctx, input) })
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "PreconditionFailed" {
+				return logAndReturnError(err, ErrAlreadyExists)
+			}
+		}
+
+		return logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	return nil
+}
+
+// Retrieves the names of up to limit first files in the folder, in the S3 order, including the files in the subfolders.
+// The folder is given as the key prefix, e.g. "user1/.audit/202401/", the file names are relative to the prefix.
+func listFirstFileNames(ctx context.Context, bucket string, prefix string, limit int) ([]string, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Initialize input
+	maxKeys := int32(min(limit, 1000))
+	input := &s3.ListObjectsV2Input{
+		Bucket:  &bucket,
+		Prefix:  &prefix,
+		MaxKeys: &maxKeys,
+	}
+
+	// Fetch the page
+	output, err := timeS3Call(ctx, "ListObjectsV2", prefix, func() (*s3.ListObjectsV2Output, error) { return s3client.ListObjectsV2(ctx, input) })
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Prepare the result
+	fileNames := make([]string, 0, len(output.Contents))
+	for _, obj := range output.Contents {
+		fileName, _ := strings.CutPrefix(aws.ToString(obj.Key), prefix)
+		fileNames = append(fileNames, fileName)
+	}
+
+	return fileNames, nil
+}
+
+// Renames the file by changing the corresponding file name to the new file name.
+// The file name in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
+//
+// The new file name is supposed to be file system-friendly, and don't use any special characters that are not allowed by any existing file system.
+// In practice that means it should not contain any of the following characters: /?<>\:*|"^%
+// S3 has it's own recommendations for special characters in the object name: https://docs.aws.amazon.com/AmazonS3/latest/userguide/object-keys.html
+//
+// The file with the file name provided is supposed to exist, ot the error will be returned.
+//
+// If the file with new file name already exists, or is written by someone else during the rename, the method will return error.
+// The caller should check for "already exists" error and re-submit it with the unique name.
+// Uniqueness can be ensured by applying the timestamp to the file path, i.e. "my file~~1426963430173.txt"
+//
+// If none of the files exist, it will create an empty file with the target name, which is kind of logical.
+//
+// When the extension changes the content type, the copy gets the new one, the note metadata is kept either way.
+//
+// Once the file is copied, the original file is deleted, retrying a few times.
+// If it still can't be deleted, the rename is reported as successful, and the original file is left behind.
+func renameFile(ctx context.Context, bucket string, prefix string, fileName string, newFileName string) (*RenameFileResult, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Make sure both files stay in the user namespace
+	key, err := buildKey(prefix, fileName)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrInvalidArgument)
+	}
+	newKey, err := buildKey(prefix, newFileName)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrInvalidArgument)
+	}
+
+	// Pre-create an empty file, to make sure we don't overwrite
+	// If we fail after creating a dummy, then this means the dummy will stay.
+	// This is easily resolvable by a user, and the dummy is marked, so the orphan cleanup can find it.
+	placeholderEtag, err := saveRenamePlaceholder(ctx, s3client, bucket, newKey, newFileName)
+	if err != nil {
+		return nil, err // already wrapped
+	}
+
+	// Someone could have written the real note over the dummy in the meantime, the copy would overwrite it.
+	// S3 copy can't be made conditional on the destination, so check right before copying, which leaves a much smaller window.
+	err = checkRenamePlaceholder(ctx, s3client, bucket, newKey, placeholderEtag)
+	if err != nil {
+		return nil, err // already wrapped
+	}
+
+	// Initialize input
+	source := bucket + "/" + prefix + url.QueryEscape(fileName)
+	copyObjectInput := &s3.CopyObjectInput{
+		Bucket:            &bucket,
+		CopySource:        &source,
+		Key:               &newKey,
+		MetadataDirective: types.MetadataDirectiveCopy, // keeps the note metadata
+	}
+	if contentType := getContentType(newFileName); contentType != getContentType(fileName) {
+		err = replaceCopyContentType(ctx, s3client, bucket, key, copyObjectInput, contentType)
+		if err != nil {
+			return nil, err // already wrapped
+		}
+	}
+
+	// Copy the file
+	// TODO: haven't tested with large files that might take time to copy.
+	// TODO: The worry is whether it will finish synchronously, for delete to be able to do its job
+	output, err := timeS3Call(ctx, "CopyObject", newKey, func() (*s3.CopyObjectOutput, error) { return s3client.CopyObject(ctx, copyObjectInput) })
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "NoSuchKey" {
+				return nil, logAndReturnError(err, ErrNotFound)
+			}
+		}
+
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+	mirrorCopyObject(ctx, copyObjectInput)
+
+	// Prepare the result
+	result := &RenameFileResult{
+		ETag: *output.CopyObjectResult.ETag,
+	}
+
+	// Initialize input for deleting the old file
+	deleteObjectInput := &s3.DeleteObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+
+	// Deleting the old file
+	// the new file is already there, so failing to delete the old one is not a reason to fail
+	err = deleteObjectWithRetry(ctx, s3client, deleteObjectInput)
+	if err != nil {
+		log.Printf("could not clean up '%s' after copying it: %v", key, err)
+	} else {
+		mirrorDeleteObjects(ctx, bucket, []string{key})
+	}
+
+	return result, nil
+}
+
+// The copy keeps the content type of the original, which is wrong once the extension changes, e.g. from ".txt" to ".md".
+// The content type can only be changed by replacing all the metadata, so the compression marker and the note metadata are carried over.
+func replaceCopyContentType(ctx context.Context, s3client s3Client, bucket string, key string, input *s3.CopyObjectInput, contentType string) error {
+	headInput := &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	head, err := timeS3Call(ctx, "HeadObject", key, func() (*s3.HeadObjectOutput, error) { return s3client.HeadObject(ctx, headInput) })
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			// HEAD responses have no body, so S3 reports missing key as "NotFound"
+			if apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey" {
+				return logAndReturnError(err, ErrNotFound)
+			}
+		}
+
+		return logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	input.MetadataDirective = types.MetadataDirectiveReplace
+	input.ContentType = &contentType
+	input.Metadata = map[string]string{}
+	if isCompressed(aws.ToString(head.ContentEncoding), head.Metadata) {
+		input.ContentEncoding = &CONTENT_ENCODING_GZIP
+		input.Metadata[META_COMPRESSION] = CONTENT_ENCODING_GZIP
+	}
+	setNoteMetadata(input.Metadata, getNoteMetadata(head.Metadata))
+	return nil
+}
+
+// Creates the empty file marked as the rename placeholder, fails if the file already exists.
+// The copy replaces the metadata, so the marker only stays on the placeholder that was never overwritten.
+//
+// Returns the ETag of the placeholder.
+func saveRenamePlaceholder(ctx context.Context, s3client s3Client, bucket string, key string, fileName string) (string, error) {
+	input, err := newPutFileContentInput(bucket, key, fileName, "", &NoteMetadata{Created: time.Now()})
+	if err != nil {
+		return "", logAndReturnError(err, ErrServiceUnavailable)
+	}
+	input.Metadata[META_RENAME_PLACEHOLDER] = "true"
+	asterisk := "*"
+	input.IfNoneMatch = &asterisk // fails if already exists
+
+	output, err := timeS3Call(ctx, "PutObject", key, func() (*s3.PutObjectOutput, error) { return s3client.PutObject(ctx, input) })
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			if apiErr.ErrorCode() == "PreconditionFailed" {
+				return "", logAndReturnError(err, ErrAlreadyExists)
+			}
+		}
+
+		return "", logAndReturnError(err, ErrServiceUnavailable)
+	}
+	return aws.ToString(output.ETag), nil
+}
+
+// Makes sure the placeholder is still the one created by this rename, and returns "already exists" error if it was overwritten.
+// The placeholder that is gone has nothing to overwrite, so it is fine.
+func checkRenamePlaceholder(ctx context.Context, s3client s3Client, bucket string, key string, placeholderEtag string) error {
+	input := &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	output, err := timeS3Call(ctx, "HeadObject", key, func() (*s3.HeadObjectOutput, error) { return s3client.HeadObject(ctx, input) })
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			// HEAD responses have no body, so S3 reports missing key as "NotFound"
+			if apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey" {
+				return nil
+			}
+		}
+
+		return logAndReturnError(err, ErrServiceUnavailable)
+	}
+	if aws.ToString(output.ETag) != placeholderEtag {
+		err := fmt.Errorf("'%s' was written by someone else during the rename", key)
+		return logAndReturnError(err, ErrAlreadyExists)
+	}
+	return nil
+}
+
+// Renames the file and replaces its content in one go.
+// The file name in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
+//
+// Same requirements apply to the new file name as for renameFile.
+//
+// Unlike renameFile, the content is not copied from the original file, instead the new file is written with the new content
+// in a single put, so there is never a moment when the new file exists with the outdated content.
+// The put only succeeds if the file with new file name does not exist yet, otherwise the method returns "already exists" error.
+// Once the new file is written, the original file is deleted, same as in renameFile.
+//
+// The note metadata is kept from the original file, except for the values given.
+//
+// If the original file does not exist, the method returns "not found" error and nothing is written.
+// If the new file name is the same as the original one, the content is simply overwritten.
+func renameAndSaveFile(ctx context.Context, bucket string, prefix string, fileName string, newFileName string, content string, meta *NoteMetadata) (*RenameFileResult, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Make sure the original file exists
+	key, err := buildKey(prefix, fileName)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrInvalidArgument)
+	}
+	headObjectInput := &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	headObjectOutput, err := s3client.HeadObject(ctx, headObjectInput)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			// HEAD responses have no body, so S3 reports missing key as "NotFound"
+			if apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey" {
+				return nil, logAndReturnError(err, ErrNotFound)
+			}
+		}
+
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Write the new file with the new content
+	overwrite := fileName == newFileName
+	meta = mergeNoteMetadata(getNoteMetadata(headObjectOutput.Metadata), meta)
+	saveResult, err := saveFileContent(ctx, bucket, prefix, newFileName, content, overwrite, meta)
+	if err != nil {
+		return nil, err // already wrapped
+	}
+
+	// Prepare the result
+	result := &RenameFileResult{
+		ETag: saveResult.ETag,
+	}
+	if overwrite {
+		return result, nil
+	}
+
+	// Initialize input for deleting the old file
+	deleteObjectInput := &s3.DeleteObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+
+	// Deleting the old file
+	// the new file is already there, so failing to delete the old one is not a reason to fail
+	err = deleteObjectWithRetry(ctx, s3client, deleteObjectInput)
+	if err != nil {
+		log.Printf("could not clean up '%s' after copying it: %v", key, err)
+	} else {
+		mirrorDeleteObjects(ctx, bucket, []string{key})
+	}
+
+	return result, nil
+}
+
+// Moves the file from one folder to another, keeping the file name.
+// Folders are just key prefixes, e.g. "user1/" for the root and "user1/work/" for the folder "work".
+// The file name in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
+//
+// If the file does not exist, the method returns "not found" error and nothing is written.
+// If the file with the same name already exists in the target folder, or is written by someone else during the move,
+// the method returns "already exists" error.
+// Same as renameFile, an empty file is pre-created in the target folder, so nothing is overwritten,
+// and failing to delete the original file after copying it does not fail the move.
+func moveFile(ctx context.Context, bucket string, fromPrefix string, toPrefix string, fileName string) (*MoveFileResult, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Make sure both files stay in the user namespace
+	key, err := buildKey(fromPrefix, fileName)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrInvalidArgument)
+	}
+	newKey, err := buildKey(toPrefix, fileName)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrInvalidArgument)
+	}
+
+	// Check the file exists, so we don't leave the empty file behind
+	headObjectInput := &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	_, err = timeS3Call(ctx, "HeadObject", key, func() (*s3.HeadObjectOutput, error) { return s3client.HeadObject(ctx, headObjectInput) })
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			// HEAD responses have no body, so S3 reports missing key as "NotFound"
+			if apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey" {
+				return nil, logAndReturnError(err, ErrNotFound)
+			}
+		}
+
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
 	}
-	s3client := s3.NewFromConfig(cfg)
 
 	// Pre-create an empty file, to make sure we don't overwrite
-	// If someone is so mega quick that they manage to overwrite this file, we will write over them.
-	// In practice this will never happen.
-	// If we fail after creating a dummy, then this means the dummy will stay.
-	// This is easily resolvable by a user.
-	_, err = saveFileContent(bucket, prefix, newFileName, "", false)
+	// The dummy is marked the same way as in renameFile, so the orphan cleanup can find it if the move fails after this point.
+	placeholderEtag, err := saveRenamePlaceholder(ctx, s3client, bucket, newKey, fileName)
+	if err != nil {
+		return nil, err // already wrapped
+	}
+
+	// Same as in renameFile, someone could have written the real note over the dummy in the meantime
+	err = checkRenamePlaceholder(ctx, s3client, bucket, newKey, placeholderEtag)
 	if err != nil {
 		return nil, err // already wrapped
 	}
 
 	// Initialize input
-	source := bucket + "/" + prefix + url.QueryEscape(fileName)
-	newKey := prefix + newFileName
+	source := bucket + "/" + fromPrefix + url.QueryEscape(fileName)
 	copyObjectInput := &s3.CopyObjectInput{
-		Bucket:     &bucket,
-		CopySource: &source,
-		Key:        &newKey,
+		Bucket:            &bucket,
+		CopySource:        &source,
+		Key:               &newKey,
+		MetadataDirective: types.MetadataDirectiveCopy, // keeps the note metadata
 	}
 
 	// Copy the file
-	// TODO: haven't tested with large files that might take time to copy.
-	// TODO: The worry is whether it will finish synchronously, for delete to be able to do its job
-	output, err := s3client.CopyObject(context.TODO(), copyObjectInput)
+	output, err := timeS3Call(ctx, "CopyObject", newKey, func() (*s3.CopyObjectOutput, error) { return s3client.CopyObject(ctx, copyObjectInput) })
 	if err != nil {
 		var apiErr smithy.APIError
 		if errors.As(err, &apiErr) {
@@ -319,74 +1793,554 @@ func renameFile(bucket string, prefix string, fileName string, newFileName strin
 
 		return nil, logAndReturnError(err, ErrServiceUnavailable)
 	}
+	mirrorCopyObject(ctx, copyObjectInput)
 
 	// Prepare the result
-	result := &RenameFileResult{
+	result := &MoveFileResult{
 		ETag: *output.CopyObjectResult.ETag,
 	}
 
 	// Initialize input for deleting the old file
-	key := prefix + fileName
 	deleteObjectInput := &s3.DeleteObjectInput{
 		Bucket: &bucket,
 		Key:    &key,
 	}
 
 	// Deleting the old file
-	_, err = s3client.DeleteObject(context.TODO(), deleteObjectInput)
+	// the new file is already there, so failing to delete the old one is not a reason to fail
+	err = deleteObjectWithRetry(ctx, s3client, deleteObjectInput)
 	if err != nil {
-		return nil, logAndReturnError(err, ErrServiceUnavailable)
+		log.Printf("could not clean up '%s' after copying it: %v", key, err)
+	} else {
+		mirrorDeleteObjects(ctx, bucket, []string{key})
 	}
 
 	return result, nil
 }
 
+var (
+	CLEANUP_DELETE_ATTEMPTS    int           = 3
+	CLEANUP_DELETE_RETRY_DELAY time.Duration = time.Duration(200) * time.Millisecond // doubled after every attempt
+)
+
+// Deletes the object left behind by rename or move, retrying a few times, since the transient errors are common.
+// Gives up early when the context is done.
+func deleteObjectWithRetry(ctx context.Context, s3client s3Client, input *s3.DeleteObjectInput) error {
+	delay := CLEANUP_DELETE_RETRY_DELAY
+	var err error
+	for attempt := 1; attempt <= CLEANUP_DELETE_ATTEMPTS; attempt++ {
+		_, err = timeS3Call(ctx, "DeleteObject", aws.ToString(input.Key), func() (*s3.DeleteObjectOutput, error) { return s3client.DeleteObject(ctx, input) })
+		if err == nil {
+			return nil
+		}
+		if attempt == CLEANUP_DELETE_ATTEMPTS {
+			break
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+	return err
+}
+
 // Deletes the file with the specified file name.
 // The file name in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
 //
+// If the etag is given, the file is only deleted when it matches, otherwise the method returns "precondition failed" error.
+//
 // If file does not exist, does nothing and returns success.
-func deleteFile(bucket string, prefix string, fileName string) error {
+func deleteFile(ctx context.Context, bucket string, prefix string, fileName string, etag string) error {
 	// Setup client
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	s3client, err := newS3Client()
 	if err != nil {
 		return logAndReturnError(err, ErrServiceUnavailable)
 	}
-	s3client := s3.NewFromConfig(cfg)
 
 	// Initialize input for deleting the file
-	key := prefix + fileName
+	key, err := buildKey(prefix, fileName)
+	if err != nil {
+		return logAndReturnError(err, ErrInvalidArgument)
+	}
 	input := &s3.DeleteObjectInput{
 		Bucket: &bucket,
 		Key:    &key,
 	}
+	if etag != "" {
+		input.IfMatch = &etag
+	}
 
 	// Delete the file
-	_, err = s3client.DeleteObject(context.TODO(), input)
+	_, err = timeS3Call(ctx, "DeleteObject", key, func() (*s3.DeleteObjectOutput, error) { return s3client.DeleteObject(ctx, input) })
 	if err != nil {
 		var apiErr smithy.APIError
 		if errors.As(err, &apiErr) {
 			if apiErr.ErrorCode() == "NoSuchKey" {
+				mirrorDeleteObjects(ctx, bucket, []string{key}) // the secondary bucket can still have it
 				return nil
 			}
+			if apiErr.ErrorCode() == "PreconditionFailed" {
+				return logAndReturnError(err, ErrPreconditionFailed)
+			}
+		}
+
+		return logAndReturnError(err, ErrServiceUnavailable)
+	}
+	mirrorDeleteObjects(ctx, bucket, []string{key})
+
+	return nil
+}
+
+// Deletes the files with the specified file names, leaving all the other files intact.
+// The file names in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
+//
+// Delete is done in batches of 1000, since this is how S3 handles it.
+// Returns the result for every file, in the same order. Same as deleteFile, deleting the file that does not exist is a success.
+// If the batch fails as a whole, the files from that batch and all the following batches are reported as not deleted.
+func deleteFiles(ctx context.Context, bucket string, prefix string, fileNames []string) ([]*DeleteFileResult, error) {
+	keys := make([]string, 0, len(fileNames))
+	for _, fileName := range fileNames {
+		key, err := buildKey(prefix, fileName)
+		if err != nil {
+			return nil, logAndReturnError(err, ErrInvalidArgument)
+		}
+		keys = append(keys, key)
+	}
+
+	failed, err := deleteObjectsInBatches(ctx, bucket, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*DeleteFileResult, 0, len(fileNames))
+	for i, fileName := range fileNames {
+		result := &DeleteFileResult{
+			FileName: fileName,
+			Deleted:  true,
+		}
+		if errText, ok := failed[keys[i]]; ok {
+			result.Deleted = false
+			result.Error = errText
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// Tells which of the files exist, in the same order as fileNames, without changing anything.
+// The file names in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
+//
+// The files are checked concurrently, within the limit shared by all the fan-out operations.
+func checkFilesExist(ctx context.Context, bucket string, prefix string, fileNames []string) ([]bool, error) {
+	exist := make([]bool, len(fileNames))
+	errs := make([]error, len(fileNames))
+
+	limiter := _s3Limiter
+	var wg sync.WaitGroup
+	for i, fileName := range fileNames {
+		if err := limiter.Acquire(ctx); err != nil {
+			errs[i] = logAndReturnError(err, ErrServiceUnavailable)
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, fileName string) {
+			defer wg.Done()
+			defer limiter.Release()
+
+			_, err := getFileInfo(ctx, bucket, prefix, fileName)
+			if err != nil {
+				if !errors.Is(err, ErrNotFound) {
+					errs[i] = err // already wrapped
+				}
+				return
+			}
+			exist[i] = true
+		}(i, fileName)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return exist, nil
+}
+
+// Retrieves the names of all the files with a given prefix, including the files in the folders,
+// e.g. "my file.md" and "work/my file.md", going through all the pages.
+// The files in the trash are only included when withTrash is true, the audit log is never included.
+func listAllFileNames(ctx context.Context, bucket string, prefix string, withTrash bool) ([]string, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Fetch all the keys
+	keys, err := listAllKeys(ctx, s3client, bucket, prefix)
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Prepare the result
+	fileNames := make([]string, 0, len(keys))
+	for _, key := range keys {
+		fileName, _ := strings.CutPrefix(key, prefix)
+		if !withTrash && strings.HasPrefix(fileName, TRASH_FOLDER) {
+			continue
+		}
+		if strings.HasPrefix(fileName, AUDIT_FOLDER) {
+			continue
+		}
+		fileNames = append(fileNames, fileName)
+	}
+
+	return fileNames, nil
+}
+
+// Deletes the objects with the specified keys, in batches of 1000.
+// Returns the keys that could not be deleted, mapped to the error message.
+func deleteObjectsInBatches(ctx context.Context, bucket string, keys []string) (map[string]string, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	failed := map[string]string{}
+	for start := 0; start < len(keys); start += 1000 {
+		end := min(start+1000, len(keys))
+
+		// Initialize input for deleting the batch
+		objectIds := make([]types.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objectIds = append(objectIds, types.ObjectIdentifier{
+				Key: aws.String(key),
+			})
+		}
+		input := &s3.DeleteObjectsInput{
+			Bucket: &bucket,
+			Delete: &types.Delete{
+				Objects: objectIds,
+				Quiet:   aws.Bool(true), // only report errors
+			},
+		}
+
+		// Delete the batch
+		output, err := s3client.DeleteObjects(ctx, input)
+		if err != nil {
+			log.Printf("%v", err)
+			for _, key := range keys[start:] {
+				failed[key] = ErrServiceUnavailable.Error()
+			}
+			return failed, nil
+		}
+		for _, deleteErr := range output.Errors {
+			failed[aws.ToString(deleteErr.Key)] = aws.ToString(deleteErr.Message)
+		}
+		deleted := make([]string, 0, end-start)
+		for _, key := range keys[start:end] {
+			if _, ok := failed[key]; !ok {
+				deleted = append(deleted, key)
+			}
 		}
+		mirrorDeleteObjects(ctx, bucket, deleted)
+	}
+
+	return failed, nil
+}
+
+// Moves all the files with a given prefix into the trash, which is the ".trash/" folder under the same prefix.
+// Files that are already in the trash are left as they are, and so is the audit log.
+//
+// Every file is copied into the trash keeping its name, and the original name and the time of deletion
+// are stored in the object metadata. If the file with the same name is already in the trash, it gets replaced.
+// Only the files that were successfully copied are deleted, so no file is ever lost.
+// If any file could not be moved, the method returns an error, and the caller can simply retry.
+func moveAllFilesToTrash(ctx context.Context, bucket string, prefix string) error {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return logAndReturnError(err, ErrServiceUnavailable)
+	}
 
+	// Collect all the files, before starting to move them
+	trashPrefix := prefix + TRASH_FOLDER
+	auditPrefix := prefix + AUDIT_FOLDER
+	allKeys, err := listAllKeys(ctx, s3client, bucket, prefix)
+	if err != nil {
 		return logAndReturnError(err, ErrServiceUnavailable)
 	}
+	keys := make([]string, 0, len(allKeys))
+	for _, key := range allKeys {
+		if !strings.HasPrefix(key, trashPrefix) && !strings.HasPrefix(key, auditPrefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	// Copy the files into the trash
+	deletedAt := time.Now().UTC().Format(time.RFC3339)
+	copied := make([]string, 0, len(keys))
+	for _, key := range keys {
+		fileName, _ := strings.CutPrefix(key, prefix)
+		source := bucket + "/" + url.QueryEscape(key)
+		trashKey, err := buildKey(trashPrefix, fileName)
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+		contentType := getContentType(fileName)
+		input := &s3.CopyObjectInput{
+			Bucket:            &bucket,
+			CopySource:        &source,
+			Key:               &trashKey,
+			ContentType:       &contentType,
+			MetadataDirective: types.MetadataDirectiveReplace,
+			Metadata: map[string]string{
+				// metadata is sent in headers, so has to be ASCII
+				TRASH_META_ORIGINAL_NAME: url.PathEscape(fileName),
+				TRASH_META_DELETED_AT:    deletedAt,
+			},
+		}
+
+		// replacing the metadata drops the compression marker and the note metadata, so they have to be carried over
+		head, err := s3client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+		})
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+		if isCompressed(aws.ToString(head.ContentEncoding), head.Metadata) {
+			input.ContentEncoding = &CONTENT_ENCODING_GZIP
+			input.Metadata[META_COMPRESSION] = CONTENT_ENCODING_GZIP
+		}
+		setNoteMetadata(input.Metadata, getNoteMetadata(head.Metadata))
+
+		_, err = s3client.CopyObject(ctx, input)
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+		copied = append(copied, key)
+	}
 
+	// Delete the originals
+	failed, err := deleteObjectsInBatches(ctx, bucket, copied)
+	if err != nil {
+		return err
+	}
+
+	if len(copied) < len(keys) || len(failed) > 0 {
+		return ErrServiceUnavailable
+	}
 	return nil
 }
 
+// Retrieves the list of files in the trash under the prefix.
+// Works the same way as listFiles, but reads the original file name and the time of deletion from every file metadata,
+// so it makes an additional S3 call per file, and the caller should keep the pages small.
+//
+// Files that were put into the trash without metadata are reported using their name in the trash and the last modified time.
+func listTrashedFiles(ctx context.Context, bucket string, prefix string, pageSize int, continuationToken string) (*ListTrashedFilesResult, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// List the trash exactly as any other folder
+	trashPrefix := prefix + TRASH_FOLDER
+	page, err := listFiles(ctx, bucket, trashPrefix, pageSize, continuationToken)
+	if err != nil {
+		return nil, err // already wrapped
+	}
+
+	// Read the metadata
+	files := make([]*TrashedFileData, 0, len(page.Files))
+	for _, file := range page.Files {
+		key, err := buildKey(trashPrefix, file.FileName)
+		if err != nil {
+			return nil, logAndReturnError(err, ErrInvalidArgument)
+		}
+		input := &s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+		}
+		output, err := s3client.HeadObject(ctx, input)
+		if err != nil {
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) {
+				if apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey" {
+					continue // must have been deleted in the meantime
+				}
+			}
+
+			return nil, logAndReturnError(err, ErrServiceUnavailable)
+		}
+
+		trashedFile := &TrashedFileData{
+			FileName:         file.FileName,
+			OriginalFileName: file.FileName,
+			DeletedAt:        file.LastModified,
+			ETag:             file.ETag,
+		}
+		if originalFileName, err := url.PathUnescape(output.Metadata[TRASH_META_ORIGINAL_NAME]); err == nil && originalFileName != "" {
+			trashedFile.OriginalFileName = originalFileName
+		}
+		if deletedAt, err := time.Parse(time.RFC3339, output.Metadata[TRASH_META_DELETED_AT]); err == nil {
+			trashedFile.DeletedAt = deletedAt
+		}
+		files = append(files, trashedFile)
+	}
+
+	// Prepare the result
+	result := &ListTrashedFilesResult{
+		Files:                 files,
+		HasMore:               page.HasMore,
+		NextContinuationToken: page.NextContinuationToken,
+	}
+
+	return result, nil
+}
+
+// Permanently deletes all the files in the trash under the prefix.
+// Returns the number of files deleted and the number of files that could not be deleted.
+func emptyTrash(ctx context.Context, bucket string, prefix string) (int, int, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return 0, 0, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Collect all the files in the trash
+	keys, err := listAllKeys(ctx, s3client, bucket, prefix+TRASH_FOLDER)
+	if err != nil {
+		return 0, 0, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	// Delete them
+	failed, err := deleteObjectsInBatches(ctx, bucket, keys)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return len(keys) - len(failed), len(failed), nil
+}
+
+// Calculates the number of objects and the total size per user, going through all the objects in the bucket.
+// Every top-level prefix is considered to be a user id, objects in the root of the bucket are skipped.
+// The tenants are summed up per tenant, e.g. "tenants/tenant1".
+//
+// This requires one S3 call per 1000 objects in the whole bucket, so the caller should cache the result.
+func getBucketUsage(ctx context.Context, bucket string) (map[string]*UsageData, error) {
+	// Setup client
+	s3client, err := newS3Client()
+	if err != nil {
+		return nil, logAndReturnError(err, ErrServiceUnavailable)
+	}
+
+	usage := map[string]*UsageData{}
+	var continuationToken *string
+	for {
+		// Initialize input
+		maxKeys := int32(1000)
+		input := &s3.ListObjectsV2Input{
+			Bucket:            &bucket,
+			MaxKeys:           &maxKeys,
+			ContinuationToken: continuationToken,
+		}
+
+		// Fetch the page
+		output, err := s3client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return nil, logAndReturnError(err, ErrServiceUnavailable)
+		}
+
+		// Sum up per user
+		for _, obj := range output.Contents {
+			userId, rest, found := strings.Cut(*obj.Key, "/")
+			if !found {
+				continue
+			}
+			if userId == TENANTS_KEY_SEGMENT {
+				tenantId, _, found := strings.Cut(rest, "/")
+				if !found {
+					continue
+				}
+				userId = TENANTS_KEY_SEGMENT + "/" + tenantId
+			}
+			userUsage, ok := usage[userId]
+			if !ok {
+				userUsage = &UsageData{UserId: userId}
+				usage[userId] = userUsage
+			}
+			userUsage.ObjectCount++
+			userUsage.TotalBytes += aws.ToInt64(obj.Size)
+		}
+
+		if !aws.ToBool(output.IsTruncated) || output.NextContinuationToken == nil {
+			break
+		}
+		continuationToken = output.NextContinuationToken
+	}
+
+	return usage, nil
+}
+
+// Retrieves the keys of all the objects with a given prefix, going through all the pages.
+func listAllKeys(ctx context.Context, s3client s3Client, bucket string, prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	var continuationToken *string
+	for {
+		// Initialize input
+		maxKeys := int32(1000)
+		input := &s3.ListObjectsV2Input{
+			Bucket:            &bucket,
+			Prefix:            &prefix,
+			MaxKeys:           &maxKeys,
+			ContinuationToken: continuationToken,
+		}
+
+		// Fetch the page
+		output, err := s3client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range output.Contents {
+			keys = append(keys, *obj.Key)
+		}
+
+		if !aws.ToBool(output.IsTruncated) || output.NextContinuationToken == nil {
+			break
+		}
+		continuationToken = output.NextContinuationToken
+	}
+
+	return keys, nil
+}
+
 // Deletes all the files with a given prefix
 // Delete is done in batches of 1000, since this is how S3 handles it
-func deleteAllFiles(bucket string, prefix string) error {
-	objectIds, err := fetchFirst1000objects(bucket, prefix)
+func deleteAllFiles(ctx context.Context, bucket string, prefix string) error {
+	objectIds, err := fetchFirst1000objects(ctx, bucket, prefix)
 	if err != nil {
 		return err
 	}
 	for len(objectIds) > 0 {
-		deleteObjects(bucket, objectIds)
+		err = deleteObjects(ctx, bucket, objectIds)
+		if err != nil {
+			return err
+		}
 
-		objectIds, err = fetchFirst1000objects(bucket, prefix)
+		objectIds, err = fetchFirst1000objects(ctx, bucket, prefix)
 		if err != nil {
 			return err
 		}
@@ -394,13 +2348,12 @@ func deleteAllFiles(bucket string, prefix string) error {
 	return nil
 }
 
-func fetchFirst1000objects(bucket string, prefix string) ([]types.ObjectIdentifier, error) {
+func fetchFirst1000objects(ctx context.Context, bucket string, prefix string) ([]types.ObjectIdentifier, error) {
 	// Setup client
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	s3client, err := newS3Client()
 	if err != nil {
 		return nil, err
 	}
-	s3client := s3.NewFromConfig(cfg)
 
 	// Initialize input
 	maxKeys := int32(1000)
@@ -411,7 +2364,7 @@ func fetchFirst1000objects(bucket string, prefix string) ([]types.ObjectIdentifi
 	}
 
 	// Fetch the files
-	output, err := s3client.ListObjectsV2(context.TODO(), input)
+	output, err := s3client.ListObjectsV2(ctx, input)
 	if err != nil {
 		return nil, err
 	}
@@ -428,13 +2381,12 @@ func fetchFirst1000objects(bucket string, prefix string) ([]types.ObjectIdentifi
 	return objectIds, nil
 }
 
-func deleteObjects(bucket string, objectIds []types.ObjectIdentifier) error {
+func deleteObjects(ctx context.Context, bucket string, objectIds []types.ObjectIdentifier) error {
 	// Setup client
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	s3client, err := newS3Client()
 	if err != nil {
 		return err
 	}
-	s3client := s3.NewFromConfig(cfg)
 
 	// Initialize input for deleting the file
 	input := &s3.DeleteObjectsInput{
@@ -446,10 +2398,28 @@ func deleteObjects(bucket string, objectIds []types.ObjectIdentifier) error {
 	}
 
 	// Delete files
-	_, err = s3client.DeleteObjects(context.TODO(), input)
+	_, err = s3client.DeleteObjects(ctx, input)
 	if err != nil {
 		return err
 	}
+	keys := make([]string, 0, len(objectIds))
+	for _, objectId := range objectIds {
+		keys = append(keys, aws.ToString(objectId.Key))
+	}
+	mirrorDeleteObjects(ctx, bucket, keys)
 
 	return nil
 }
+
+// Stops reading as soon as the context is done, e.g. when the client disconnects
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
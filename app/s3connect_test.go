@@ -0,0 +1,628 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/gin-gonic/gin"
+)
+
+// Body that never ends, cancels the request after a few reads, the way a disconnecting client would
+type endlessBody struct {
+	mu     sync.Mutex
+	reads  int
+	closed bool
+	cancel context.CancelFunc
+}
+
+func (body *endlessBody) Read(p []byte) (int, error) {
+	body.mu.Lock()
+	defer body.mu.Unlock()
+
+	body.reads++
+	if body.reads == 3 {
+		body.cancel()
+	}
+	for i := range p {
+		p[i] = 'a'
+	}
+	return len(p), nil
+}
+
+func (body *endlessBody) Close() error {
+	body.mu.Lock()
+	defer body.mu.Unlock()
+
+	body.closed = true
+	return nil
+}
+
+type endlessS3 struct {
+	*fakeS3
+	body *endlessBody
+	ctx  context.Context
+}
+
+func (fake *endlessS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	fake.ctx = ctx
+	return &s3.GetObjectOutput{
+		Body: fake.body,
+		ETag: aws.String("\"etag\""),
+	}, nil
+}
+
+func TestGetFileStopsReadingWhenRequestIsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fake := &endlessS3{
+		fakeS3: useFakeS3(t),
+		body:   &endlessBody{cancel: cancel},
+	}
+	newS3Client = func() (s3Client, error) {
+		return fake, nil
+	}
+
+	c, w := newTestContext(http.MethodGet, "/files/note.md", "")
+	c.Request = c.Request.WithContext(ctx)
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+
+	done := make(chan struct{})
+	go func() {
+		runAsUser(c, handleGetFile, "user1")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler kept reading after the request was cancelled")
+	}
+
+	if fake.ctx == nil || fake.ctx.Err() == nil {
+		t.Fatal("expected the request context to be passed to S3")
+	}
+	if fake.body.reads != 3 {
+		t.Fatalf("expected reading to stop after 3 reads, got %d", fake.body.reads)
+	}
+	if !fake.body.closed {
+		t.Fatal("expected the body to be closed")
+	}
+	if w.Code == http.StatusOK {
+		t.Fatalf("expected the request to fail, got %d", w.Code)
+	}
+}
+
+type headBucketFailingS3 struct {
+	*fakeS3
+	err error
+}
+
+func (fake *headBucketFailingS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	return nil, fake.err
+}
+
+func TestVerifyBucket(t *testing.T) {
+	cases := []struct {
+		code     string
+		expected error
+	}{
+		{"NotFound", ErrBucketNotFound},
+		{"NoSuchBucket", ErrBucketNotFound},
+		{"Forbidden", ErrAccessDenied},
+		{"AccessDenied", ErrAccessDenied},
+		{"InternalError", ErrServiceUnavailable},
+	}
+
+	for _, tc := range cases {
+		fake := &headBucketFailingS3{
+			fakeS3: useFakeS3(t),
+			err:    fakeApiError(tc.code),
+		}
+		newS3Client = func() (s3Client, error) {
+			return fake, nil
+		}
+
+		err := checkBucket(context.Background(), getBucket())
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("%s: expected '%v', actual: '%v'", tc.code, tc.expected, err)
+		}
+
+		err = VerifyBucket(context.Background())
+		if err == nil || !strings.Contains(err.Error(), getBucket()) {
+			t.Errorf("%s: expected the error naming the bucket, actual: '%v'", tc.code, err)
+		}
+	}
+}
+
+func TestVerifyBucketSucceeds(t *testing.T) {
+	useFakeS3(t)
+
+	err := VerifyBucket(context.Background())
+	if err != nil {
+		t.Errorf("Expected no error, actual: '%v'", err)
+	}
+}
+
+func TestBuildKey(t *testing.T) {
+	cases := []struct {
+		prefix   string
+		fileName string
+		valid    bool
+	}{
+		{"user1/", "note.md", true},
+		{"user1/work/", "note.md", true},
+		{"user1/.trash/", "work/note.md", true},
+		{"user1/", "..", false},
+		{"user1/", "../user2/note.md", false},
+		{"user1/", "work/../../user2/note.md", false},
+		{"user1/", "./note.md", false},
+		{"user1/", "/note.md", false},
+		{"user1/", "", false},
+		{"user1/../user2/", "note.md", false},
+		{"user1", "note.md", false},
+		{"", "note.md", false},
+	}
+
+	for _, tc := range cases {
+		key, err := buildKey(tc.prefix, tc.fileName)
+		if tc.valid && (err != nil || key != tc.prefix+tc.fileName) {
+			t.Errorf("Expected '%s' + '%s' to be valid, actual: '%s' '%v'", tc.prefix, tc.fileName, key, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("Expected '%s' + '%s' to be rejected, actual: '%s'", tc.prefix, tc.fileName, key)
+		}
+	}
+}
+
+func TestTraversalIsRejectedByStorage(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user2/secret.md", "secret")
+	ctx := context.Background()
+
+	_, err := getFileContent(ctx, getBucket(), "user1/", "../user2/secret.md", "")
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Expected invalid argument on get, actual: '%v'", err)
+	}
+	_, err = saveFileContent(ctx, getBucket(), "user1/", "../user2/secret.md", "overwritten", true, nil)
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Expected invalid argument on save, actual: '%v'", err)
+	}
+	_, err = renameFile(ctx, getBucket(), "user1/", "../user2/secret.md", "stolen.md")
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Expected invalid argument on rename, actual: '%v'", err)
+	}
+	_, err = moveFile(ctx, getBucket(), "user2/", "user1/../", "secret.md")
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Expected invalid argument on move, actual: '%v'", err)
+	}
+	err = deleteFile(ctx, getBucket(), "user1/", "../user2/secret.md", "")
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Expected invalid argument on delete, actual: '%v'", err)
+	}
+	_, err = deleteFiles(ctx, getBucket(), "user1/", []string{"a.md", "../user2/secret.md"})
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Expected invalid argument on batch delete, actual: '%v'", err)
+	}
+
+	obj, ok := fake.get("user2/secret.md")
+	if !ok || string(obj.content) != "secret" || fake.count() != 1 {
+		t.Errorf("Expected nothing to be changed")
+	}
+}
+
+func useContentTypes(t *testing.T, contentTypesJson string) {
+	contentTypes := CONTENT_TYPES
+	t.Cleanup(func() {
+		CONTENT_TYPES = contentTypes
+	})
+	err := SetContentTypes(contentTypesJson)
+	if err != nil {
+		t.Fatalf("Error setting content types: %s", err)
+	}
+}
+
+func TestGetContentType(t *testing.T) {
+	useContentTypes(t, `{".json": "application/json", ".CSV": "text/csv; charset=UTF-8", ".txt": "text/plain"}`)
+
+	cases := []struct {
+		fileName    string
+		contentType string
+	}{
+		{"note.md", "text/markdown; charset=UTF-8"},
+		{"NOTE.MD", "text/markdown; charset=UTF-8"},
+		{"note.txt", "text/plain"},
+		{"data.json", "application/json"},
+		{"table.csv", "text/csv; charset=UTF-8"},
+		{"unknown.xyz", CONTENT_TYPE_DEFAULT},
+		{"no extension", CONTENT_TYPE_DEFAULT},
+	}
+
+	for _, tc := range cases {
+		contentType := getContentType(tc.fileName)
+		if contentType != tc.contentType {
+			t.Errorf("Expected '%s' for %s, actual: '%s'", tc.contentType, tc.fileName, contentType)
+		}
+	}
+}
+
+func TestSetContentTypesRejectsInvalidEntries(t *testing.T) {
+	useContentTypes(t, "")
+
+	for _, contentTypesJson := range []string{
+		`not json`,
+		`{"json": "application/json"}`,
+		`{".": "application/json"}`,
+		`{".tar.gz": "application/gzip"}`,
+		`{".json": "not a content type;;"}`,
+	} {
+		err := SetContentTypes(contentTypesJson)
+		if err == nil {
+			t.Errorf("Expected %s to be rejected", contentTypesJson)
+		}
+	}
+	if getContentType("note.md") != "text/markdown; charset=UTF-8" {
+		t.Errorf("Expected the defaults to be kept")
+	}
+}
+
+func TestFileIsStoredAndReturnedWithContentType(t *testing.T) {
+	fake := useFakeS3(t)
+
+	for fileName, contentType := range map[string]string{
+		"note.md":  "text/markdown; charset=UTF-8",
+		"note.txt": "text/plain; charset=UTF-8",
+	} {
+		_, err := saveFileContent(context.Background(), getBucket(), "user1/", fileName, "content", true, nil)
+		if err != nil {
+			t.Fatalf("Error saving %s: %s", fileName, err)
+		}
+		obj, _ := fake.get("user1/" + fileName)
+		if obj.contentType != contentType {
+			t.Errorf("Expected %s to be stored as '%s', actual: '%s'", fileName, contentType, obj.contentType)
+		}
+
+		c, w := newTestContext(http.MethodGet, "/files/"+fileName, "")
+		c.Params = gin.Params{{Key: "filename", Value: fileName}}
+		runAsUser(c, handleGetFile, "user1")
+		if w.Header().Get("Content-Type") != contentType {
+			t.Errorf("Expected %s to be returned as '%s', actual: '%s'", fileName, contentType, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+// Fails the first few deletes, the way S3 occasionally does
+type flakyDeleteS3 struct {
+	*fakeS3
+	failures int
+	attempts int
+}
+
+func (fake *flakyDeleteS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	fake.attempts++
+	if fake.attempts <= fake.failures {
+		return nil, fakeApiError("InternalError")
+	}
+	return fake.fakeS3.DeleteObject(ctx, params, optFns...)
+}
+
+func useFlakyDeleteS3(t *testing.T, failures int) *flakyDeleteS3 {
+	delay := CLEANUP_DELETE_RETRY_DELAY
+	t.Cleanup(func() {
+		CLEANUP_DELETE_RETRY_DELAY = delay
+	})
+	CLEANUP_DELETE_RETRY_DELAY = time.Millisecond
+
+	fake := &flakyDeleteS3{
+		fakeS3:   useFakeS3(t),
+		failures: failures,
+	}
+	newS3Client = func() (s3Client, error) {
+		return fake, nil
+	}
+	return fake
+}
+
+func TestRenameFileRetriesCleanupDelete(t *testing.T) {
+	fake := useFlakyDeleteS3(t, CLEANUP_DELETE_ATTEMPTS-1)
+	fake.seed("user1/old.md", "content")
+
+	result, err := renameFile(context.Background(), getBucket(), "user1/", "old.md", "new.md")
+	if err != nil {
+		t.Fatalf("Expected rename to succeed, actual: '%v'", err)
+	}
+	if obj, ok := fake.get("user1/new.md"); !ok || obj.etag != result.ETag {
+		t.Errorf("Expected the new file with ETag %s", result.ETag)
+	}
+	if _, ok := fake.get("user1/old.md"); ok {
+		t.Errorf("Expected the old file to be deleted on retry")
+	}
+	if fake.attempts != CLEANUP_DELETE_ATTEMPTS {
+		t.Errorf("Expected %d attempts, actual: %d", CLEANUP_DELETE_ATTEMPTS, fake.attempts)
+	}
+}
+
+func TestRenameFileSucceedsWhenCleanupDeleteKeepsFailing(t *testing.T) {
+	fake := useFlakyDeleteS3(t, CLEANUP_DELETE_ATTEMPTS)
+	fake.seed("user1/old.md", "content")
+
+	result, err := renameFile(context.Background(), getBucket(), "user1/", "old.md", "new.md")
+	if err != nil {
+		t.Fatalf("Expected rename to succeed, actual: '%v'", err)
+	}
+	if obj, ok := fake.get("user1/new.md"); !ok || obj.etag != result.ETag {
+		t.Errorf("Expected the new file with ETag %s", result.ETag)
+	}
+	if _, ok := fake.get("user1/old.md"); !ok {
+		t.Errorf("Expected the old file to be left behind")
+	}
+	if fake.attempts != CLEANUP_DELETE_ATTEMPTS {
+		t.Errorf("Expected %d attempts, actual: %d", CLEANUP_DELETE_ATTEMPTS, fake.attempts)
+	}
+}
+
+// The way some S3-compatible backends answer, leaving out the fields AWS always sets
+type partialListingS3 struct {
+	*fakeS3
+}
+
+func (fake *partialListingS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	return &s3.ListObjectsV2Output{
+		Contents: []types.Object{
+			{Key: aws.String("user1/full.md"), ETag: aws.String("\"etag\""), LastModified: aws.Time(time.Now()), Size: aws.Int64(7)},
+			{Key: aws.String("user1/partial.md")},
+			{ETag: aws.String("\"no key\"")},
+		},
+	}, nil
+}
+
+func TestListFilesToleratesPartialListing(t *testing.T) {
+	fake := &partialListingS3{fakeS3: useFakeS3(t)}
+	newS3Client = func() (s3Client, error) {
+		return fake, nil
+	}
+
+	for _, list := range []func() (*ListFilesResult, error){
+		func() (*ListFilesResult, error) {
+			return listFiles(context.Background(), getBucket(), "user1/", 100, "")
+		},
+		func() (*ListFilesResult, error) {
+			return listFilesStartingAfter(context.Background(), getBucket(), "user1/", 100, "")
+		},
+	} {
+		result, err := list()
+		if err != nil {
+			t.Fatalf("Expected no error, actual: '%v'", err)
+		}
+		if result.HasMore {
+			t.Errorf("Expected no more files")
+		}
+		if len(result.Files) != 2 {
+			t.Fatalf("Expected 2 files, actual: %d", len(result.Files))
+		}
+		partial := result.Files[1]
+		if partial.FileName != "partial.md" || partial.ETag != "" || !partial.LastModified.IsZero() || partial.Size != 0 {
+			t.Errorf("Expected partial.md with the empty values, actual: %+v", partial)
+		}
+	}
+}
+
+// Another client writes the real note over the rename placeholder as soon as it is created
+type concurrentWriteS3 struct {
+	*fakeS3
+}
+
+func (fake *concurrentWriteS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	output, err := fake.fakeS3.PutObject(ctx, params, optFns...)
+	if err == nil && params.Metadata[META_RENAME_PLACEHOLDER] == "true" {
+		fake.seed(aws.ToString(params.Key), "written concurrently")
+	}
+	return output, err
+}
+
+func TestRenameDoesNotOverwriteConcurrentlyCreatedFile(t *testing.T) {
+	fake := &concurrentWriteS3{useFakeS3(t)}
+	newS3Client = func() (s3Client, error) { return fake, nil }
+	fake.seed("user1/old.md", "content")
+
+	_, err := renameFile(context.Background(), getBucket(), "user1/", "old.md", "new.md")
+
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("Expected already exists, actual: %v", err)
+	}
+	if obj, _ := fake.get("user1/new.md"); string(obj.content) != "written concurrently" {
+		t.Errorf("Expected the concurrent write to survive, actual: '%s'", string(obj.content))
+	}
+	if _, ok := fake.get("user1/old.md"); !ok {
+		t.Errorf("Expected the original file to stay")
+	}
+}
+
+func TestRenameConflictWithConcurrentlyCreatedFileGivesConflict(t *testing.T) {
+	fake := &concurrentWriteS3{useFakeS3(t)}
+	newS3Client = func() (s3Client, error) { return fake, nil }
+	fake.seed("user1/old.md", "content")
+
+	c, w := newTestContext("POST", "/rename", `{"fileName": "old.md", "newFileName": "new.md"}`)
+	runAsUser(c, handleRenameFile, "user1")
+
+	if w.Code != 409 {
+		t.Errorf("Expected 409, actual: %d", w.Code)
+	}
+}
+
+func TestGetUniqueFileName(t *testing.T) {
+	now := time.UnixMilli(1426963430173)
+
+	if actual := getUniqueFileName("my file.txt", now); actual != "my file~~1426963430173.txt" {
+		t.Errorf("Expected 'my file~~1426963430173.txt', actual: '%s'", actual)
+	}
+
+	long := strings.Repeat("a", MAX_FILE_NAME_LENGTH-3) + ".md"
+	actual := getUniqueFileName(long, now)
+	if !isFileNameValid(actual) || !strings.HasSuffix(actual, "~~1426963430173.md") {
+		t.Errorf("Expected the valid unique file name, actual: '%s'", actual)
+	}
+}
+
+func TestSaveFileContentUniqueRetriesOnCollision(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "existing")
+
+	fileName, result, err := saveFileContentUnique(context.Background(), getBucket(), "user1/", "note.md", "new", nil)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(fileName, "note~~") || !strings.HasSuffix(fileName, ".md") {
+		t.Errorf("Expected the unique file name, actual: '%s'", fileName)
+	}
+	obj, ok := fake.get("user1/" + fileName)
+	if !ok || string(obj.content) != "new" || obj.etag != result.ETag {
+		t.Errorf("Expected the note under the unique file name")
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "existing" {
+		t.Errorf("Expected the existing note to be kept, actual: '%s'", string(obj.content))
+	}
+}
+
+func TestSaveFileContentUniqueKeepsFreeFileName(t *testing.T) {
+	useFakeS3(t)
+
+	fileName, _, err := saveFileContentUnique(context.Background(), getBucket(), "user1/", "note.md", "new", nil)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if fileName != "note.md" {
+		t.Errorf("Expected 'note.md', actual: '%s'", fileName)
+	}
+}
+
+func TestSharedS3ClientIsCreatedOnce(t *testing.T) {
+	t.Setenv("AWS_REGION", "us-east-1")
+	original := _s3client
+	_s3client = nil
+	t.Cleanup(func() {
+		_s3client = original
+	})
+
+	clients := make([]s3Client, 20)
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, err := getSharedS3Client()
+			if err != nil {
+				t.Errorf("Expected no error, actual: %v", err)
+			}
+			clients[i] = client
+		}(i)
+	}
+	wg.Wait()
+
+	for _, client := range clients {
+		if client == nil || client != clients[0] {
+			t.Fatalf("Expected the same client for all the calls")
+		}
+	}
+}
+
+func useAwsCredentials(t *testing.T, accessKeyId string, secretAccessKey string, sessionToken string, region string) {
+	originalAccessKeyId, originalSecretAccessKey, originalSessionToken, originalRegion := AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION
+	if err := SetAwsCredentials(accessKeyId, secretAccessKey, sessionToken, region); err != nil {
+		t.Fatalf("Expected no error, actual: %v", err)
+	}
+	t.Cleanup(func() {
+		AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION = originalAccessKeyId, originalSecretAccessKey, originalSessionToken, originalRegion
+	})
+}
+
+func TestLoadAwsConfigUsesStaticCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "from-env")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "from-env")
+	t.Setenv("AWS_REGION", "us-east-1")
+	useAwsCredentials(t, "key-id", "secret", "token", "eu-west-1")
+
+	cfg, err := loadAwsConfig(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, actual: %v", err)
+	}
+	if cfg.Region != "eu-west-1" {
+		t.Errorf("Expected region 'eu-west-1', actual: '%s'", cfg.Region)
+	}
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, actual: %v", err)
+	}
+	if creds.AccessKeyID != "key-id" || creds.SecretAccessKey != "secret" || creds.SessionToken != "token" {
+		t.Errorf("Expected the static credentials, actual: '%s' '%s' '%s'", creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken)
+	}
+	if creds.Source != credentials.StaticCredentialsName {
+		t.Errorf("Expected the source '%s', actual: '%s'", credentials.StaticCredentialsName, creds.Source)
+	}
+}
+
+func TestLoadAwsConfigFallsBackToDefaultChain(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "from-env")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "from-env")
+	t.Setenv("AWS_REGION", "us-east-1")
+	useAwsCredentials(t, "", "", "", "")
+
+	cfg, err := loadAwsConfig(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, actual: %v", err)
+	}
+	if cfg.Region != "us-east-1" {
+		t.Errorf("Expected region 'us-east-1', actual: '%s'", cfg.Region)
+	}
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, actual: %v", err)
+	}
+	if creds.AccessKeyID != "from-env" {
+		t.Errorf("Expected the credentials from env, actual: '%s'", creds.AccessKeyID)
+	}
+}
+
+func TestSetAwsCredentialsIncomplete(t *testing.T) {
+	useAwsCredentials(t, "", "", "", "")
+
+	for _, creds := range [][]string{
+		{"key-id", "", ""},
+		{"", "secret", ""},
+		{"", "", "token"},
+	} {
+		if err := SetAwsCredentials(creds[0], creds[1], creds[2], ""); err == nil {
+			t.Errorf("Expected error for %v", creds)
+		}
+	}
+}
+
+func TestMoveDoesNotOverwriteConcurrentlyCreatedFile(t *testing.T) {
+	fake := &concurrentWriteS3{useFakeS3(t)}
+	newS3Client = func() (s3Client, error) { return fake, nil }
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("POST", "/move", `{"fileName": "note.md", "toFolder": "work"}`)
+	runAsUser(c, handleMoveFile, "user1")
+
+	if w.Code != 409 {
+		t.Fatalf("Expected 409, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/work/note.md"); string(obj.content) != "written concurrently" {
+		t.Errorf("Expected the concurrent write to survive, actual: '%s'", string(obj.content))
+	}
+	if _, ok := fake.get("user1/note.md"); !ok {
+		t.Errorf("Expected the original file to stay")
+	}
+}
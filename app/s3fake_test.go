@@ -0,0 +1,364 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+type fakeS3Object struct {
+	content      []byte
+	contentType  string
+	encoding     string
+	etag         string
+	lastModified time.Time
+	metadata     map[string]string
+	tags         []types.Tag
+}
+
+// In-memory implementation of the S3 API, good enough to test the app logic
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeS3Object
+}
+
+func useFakeS3(t *testing.T) *fakeS3 {
+	fake := &fakeS3{
+		objects: map[string]*fakeS3Object{},
+	}
+
+	original := newS3Client
+	newS3Client = func() (s3Client, error) {
+		return fake, nil
+	}
+	// the audit entries would show up in the bucket at random moments, so the tests that need them turn them on
+	originalAuditSink := AUDIT_SINK
+	AUDIT_SINK = AUDIT_SINK_OFF
+	t.Cleanup(func() {
+		_auditWrites.Wait() // the audit entries are written in the background, still using the fake
+		newS3Client = original
+		AUDIT_SINK = originalAuditSink
+	})
+
+	return fake
+}
+
+func fakeEtag(content []byte) string {
+	hash := md5.Sum(content)
+	return "\"" + hex.EncodeToString(hash[:]) + "\""
+}
+
+func fakeApiError(code string) error {
+	return &smithy.GenericAPIError{Code: code, Message: code}
+}
+
+func (fake *fakeS3) seed(key string, content string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.objects[key] = &fakeS3Object{
+		content:      []byte(content),
+		etag:         fakeEtag([]byte(content)),
+		lastModified: time.Now(),
+	}
+}
+
+func (fake *fakeS3) get(key string) (*fakeS3Object, bool) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	obj, ok := fake.objects[key]
+	return obj, ok
+}
+
+// The keys mapped to the etags, to check whether anything has changed
+func (fake *fakeS3) snapshot() map[string]string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	snapshot := make(map[string]string, len(fake.objects))
+	for key, obj := range fake.objects {
+		snapshot[key] = obj.etag
+	}
+	return snapshot
+}
+
+func (fake *fakeS3) count() int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return len(fake.objects)
+}
+
+func (fake *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	prefix := aws.ToString(params.Prefix)
+	delimiter := aws.ToString(params.Delimiter)
+	startAfter := aws.ToString(params.StartAfter)
+	if params.ContinuationToken != nil {
+		startAfter = *params.ContinuationToken
+	}
+	maxKeys := int(aws.ToInt32(params.MaxKeys))
+	if maxKeys == 0 {
+		maxKeys = 1000
+	}
+
+	// with the delimiter, everything below the next delimiter rolls up into a single common prefix
+	entries := map[string]bool{} // entry -> is common prefix
+	for key := range fake.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		entry := key
+		isCommonPrefix := false
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entry = key[:len(prefix)+i+len(delimiter)]
+				isCommonPrefix = true
+			}
+		}
+		if entry > startAfter {
+			entries[entry] = isCommonPrefix
+		}
+	}
+	keys := make([]string, 0, len(entries))
+	for entry := range entries {
+		keys = append(keys, entry)
+	}
+	sort.Strings(keys)
+
+	output := &s3.ListObjectsV2Output{
+		IsTruncated: aws.Bool(false),
+	}
+	for i, key := range keys {
+		if i == maxKeys {
+			output.IsTruncated = aws.Bool(true)
+			output.NextContinuationToken = aws.String(keys[i-1])
+			break
+		}
+		if entries[key] {
+			output.CommonPrefixes = append(output.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(key)})
+			continue
+		}
+		obj := fake.objects[key]
+		output.Contents = append(output.Contents, types.Object{
+			Key:          aws.String(key),
+			ETag:         aws.String(obj.etag),
+			LastModified: aws.Time(obj.lastModified),
+			Size:         aws.Int64(int64(len(obj.content))),
+		})
+	}
+
+	return output, nil
+}
+
+func (fake *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	obj, ok := fake.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, fakeApiError("NoSuchKey")
+	}
+	if params.IfNoneMatch != nil && *params.IfNoneMatch == obj.etag {
+		return nil, fakeApiError("NotModified")
+	}
+
+	content := obj.content
+	if params.Range != nil {
+		// only "bytes=0-N" is used by the app
+		var end int
+		if _, err := fmt.Sscanf(*params.Range, "bytes=0-%d", &end); err != nil {
+			return nil, fakeApiError("InvalidArgument")
+		}
+		if len(content) == 0 {
+			return nil, fakeApiError("InvalidRange")
+		}
+		content = content[:min(end+1, len(content))]
+	}
+
+	return &s3.GetObjectOutput{
+		Body:            io.NopCloser(bytes.NewReader(content)),
+		ETag:            aws.String(obj.etag),
+		LastModified:    aws.Time(obj.lastModified),
+		ContentLength:   aws.Int64(int64(len(content))),
+		ContentType:     aws.String(obj.contentType),
+		ContentEncoding: aws.String(obj.encoding),
+		Metadata:        obj.metadata,
+		TagCount:        aws.Int32(int32(len(obj.tags))),
+	}, nil
+}
+
+func (fake *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	obj, ok := fake.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, fakeApiError("NotFound")
+	}
+
+	return &s3.HeadObjectOutput{
+		ETag:            aws.String(obj.etag),
+		LastModified:    aws.Time(obj.lastModified),
+		ContentLength:   aws.Int64(int64(len(obj.content))),
+		ContentType:     aws.String(obj.contentType),
+		ContentEncoding: aws.String(obj.encoding),
+		Metadata:        obj.metadata,
+	}, nil
+}
+
+func (fake *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	content, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	key := aws.ToString(params.Key)
+	existing, exists := fake.objects[key]
+	if aws.ToString(params.IfNoneMatch) == "*" && exists {
+		return nil, fakeApiError("PreconditionFailed")
+	}
+	if params.IfMatch != nil && !exists {
+		return nil, fakeApiError("NoSuchKey")
+	}
+	if params.IfMatch != nil && existing.etag != *params.IfMatch {
+		return nil, fakeApiError("PreconditionFailed")
+	}
+
+	obj := &fakeS3Object{
+		content:      content,
+		contentType:  aws.ToString(params.ContentType),
+		encoding:     aws.ToString(params.ContentEncoding),
+		etag:         fakeEtag(content),
+		lastModified: time.Now(),
+		metadata:     params.Metadata,
+		tags:         parseFakeTagging(aws.ToString(params.Tagging)),
+	}
+	fake.objects[key] = obj
+
+	return &s3.PutObjectOutput{
+		ETag: aws.String(obj.etag),
+	}, nil
+}
+
+func (fake *fakeS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	// copy source is "bucket/key", with the key url-encoded
+	source := aws.ToString(params.CopySource)
+	_, escapedKey, _ := strings.Cut(source, "/")
+	sourceKey, err := url.QueryUnescape(escapedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, ok := fake.objects[sourceKey]
+	if !ok {
+		return nil, fakeApiError("NoSuchKey")
+	}
+
+	copied := *obj
+	copied.lastModified = time.Now()
+	if params.MetadataDirective == types.MetadataDirectiveReplace {
+		copied.contentType = aws.ToString(params.ContentType)
+		copied.encoding = aws.ToString(params.ContentEncoding)
+		copied.metadata = params.Metadata
+	}
+	fake.objects[aws.ToString(params.Key)] = &copied
+
+	return &s3.CopyObjectOutput{
+		CopyObjectResult: &types.CopyObjectResult{
+			ETag:         aws.String(copied.etag),
+			LastModified: aws.Time(copied.lastModified),
+		},
+	}, nil
+}
+
+func (fake *fakeS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if params.IfMatch != nil {
+		existing, ok := fake.objects[aws.ToString(params.Key)]
+		if !ok {
+			return nil, fakeApiError("NoSuchKey")
+		}
+		if existing.etag != *params.IfMatch {
+			return nil, fakeApiError("PreconditionFailed")
+		}
+	}
+	delete(fake.objects, aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (fake *fakeS3) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	output := &s3.DeleteObjectsOutput{}
+	for _, id := range params.Delete.Objects {
+		delete(fake.objects, aws.ToString(id.Key))
+		output.Deleted = append(output.Deleted, types.DeletedObject{Key: id.Key})
+	}
+	return output, nil
+}
+
+func (fake *fakeS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (fake *fakeS3) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	obj, ok := fake.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, fakeApiError("NoSuchKey")
+	}
+	return &s3.GetObjectTaggingOutput{
+		TagSet: obj.tags,
+	}, nil
+}
+
+func (fake *fakeS3) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	obj, ok := fake.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, fakeApiError("NoSuchKey")
+	}
+	obj.tags = params.Tagging.TagSet
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+// Tagging on put comes url-encoded, e.g. "public=true"
+func parseFakeTagging(tagging string) []types.Tag {
+	values, _ := url.ParseQuery(tagging)
+	tags := make([]types.Tag, 0, len(values))
+	for key := range values {
+		tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(values.Get(key))})
+	}
+	return tags
+}
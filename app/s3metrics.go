@@ -0,0 +1,99 @@
+package app
+
+import (
+	"context"
+	"errors"
+
+	"artemkv.net/notedok/reststats"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// Counts every S3 call by the operation and the outcome, in the stats, so the user-facing errors can be told apart
+// from what S3 did, e.g. the throttling. Wraps the client, so no call made by s3connect.go is missed.
+type countingS3Client struct {
+	s3Client
+}
+
+// The S3 error codes as they come, the conditional requests give 304 and 412, the throttling comes in several flavors
+func getS3Outcome(err error) string {
+	if err == nil {
+		return reststats.S3_OUTCOME_SUCCESS
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return reststats.S3_OUTCOME_ERROR
+	}
+	switch apiErr.ErrorCode() {
+	case "NoSuchKey", "NotFound", "NoSuchBucket":
+		return reststats.S3_OUTCOME_NOT_FOUND
+	case "NotModified":
+		return reststats.S3_OUTCOME_NOT_MODIFIED
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return reststats.S3_OUTCOME_CONFLICT
+	case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequests":
+		return reststats.S3_OUTCOME_THROTTLED
+	default:
+		return reststats.S3_OUTCOME_ERROR
+	}
+}
+
+func (client *countingS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	output, err := client.s3Client.ListObjectsV2(ctx, params, optFns...)
+	reststats.CountS3Operation("ListObjectsV2", getS3Outcome(err))
+	return output, err
+}
+
+func (client *countingS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	output, err := client.s3Client.GetObject(ctx, params, optFns...)
+	reststats.CountS3Operation("GetObject", getS3Outcome(err))
+	return output, err
+}
+
+func (client *countingS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	output, err := client.s3Client.HeadObject(ctx, params, optFns...)
+	reststats.CountS3Operation("HeadObject", getS3Outcome(err))
+	return output, err
+}
+
+func (client *countingS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	output, err := client.s3Client.PutObject(ctx, params, optFns...)
+	reststats.CountS3Operation("PutObject", getS3Outcome(err))
+	return output, err
+}
+
+func (client *countingS3Client) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	output, err := client.s3Client.CopyObject(ctx, params, optFns...)
+	reststats.CountS3Operation("CopyObject", getS3Outcome(err))
+	return output, err
+}
+
+func (client *countingS3Client) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	output, err := client.s3Client.DeleteObject(ctx, params, optFns...)
+	reststats.CountS3Operation("DeleteObject", getS3Outcome(err))
+	return output, err
+}
+
+func (client *countingS3Client) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	output, err := client.s3Client.DeleteObjects(ctx, params, optFns...)
+	reststats.CountS3Operation("DeleteObjects", getS3Outcome(err))
+	return output, err
+}
+
+func (client *countingS3Client) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	output, err := client.s3Client.HeadBucket(ctx, params, optFns...)
+	reststats.CountS3Operation("HeadBucket", getS3Outcome(err))
+	return output, err
+}
+
+func (client *countingS3Client) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	output, err := client.s3Client.GetObjectTagging(ctx, params, optFns...)
+	reststats.CountS3Operation("GetObjectTagging", getS3Outcome(err))
+	return output, err
+}
+
+func (client *countingS3Client) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	output, err := client.s3Client.PutObjectTagging(ctx, params, optFns...)
+	reststats.CountS3Operation("PutObjectTagging", getS3Outcome(err))
+	return output, err
+}
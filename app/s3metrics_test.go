@@ -0,0 +1,78 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"artemkv.net/notedok/reststats"
+)
+
+// The counts are global, so the tests only look at how much they have grown
+func getS3OperationCount(operation string, outcome string) int {
+	return reststats.GetS3OperationCounts()[operation][outcome]
+}
+
+func useCountingFakeS3(t *testing.T) *fakeS3 {
+	fake := useFakeS3(t)
+	counting := &countingS3Client{s3Client: fake}
+	newS3Client = func() (s3Client, error) {
+		return counting, nil
+	}
+	return fake
+}
+
+func TestS3SuccessIsCounted(t *testing.T) {
+	useCountingFakeS3(t)
+	before := getS3OperationCount("PutObject", reststats.S3_OUTCOME_SUCCESS)
+
+	_, err := saveFileContent(context.Background(), getBucket(), "user1/", "note.md", "content", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after := getS3OperationCount("PutObject", reststats.S3_OUTCOME_SUCCESS); after != before+1 {
+		t.Errorf("Expected %d successful PutObject, actual: %d", before+1, after)
+	}
+}
+
+func TestS3ConflictIsCounted(t *testing.T) {
+	fake := useCountingFakeS3(t)
+	fake.seed("user1/note.md", "content")
+	before := getS3OperationCount("PutObject", reststats.S3_OUTCOME_CONFLICT)
+	beforeSuccess := getS3OperationCount("PutObject", reststats.S3_OUTCOME_SUCCESS)
+
+	_, err := saveFileContent(context.Background(), getBucket(), "user1/", "note.md", "new content", false, nil)
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("Expected already exists, actual: %v", err)
+	}
+
+	if after := getS3OperationCount("PutObject", reststats.S3_OUTCOME_CONFLICT); after != before+1 {
+		t.Errorf("Expected %d conflicting PutObject, actual: %d", before+1, after)
+	}
+	if after := getS3OperationCount("PutObject", reststats.S3_OUTCOME_SUCCESS); after != beforeSuccess {
+		t.Errorf("Expected no successful PutObject, actual: %d more", after-beforeSuccess)
+	}
+}
+
+func TestS3Outcome(t *testing.T) {
+	cases := []struct {
+		err     error
+		outcome string
+	}{
+		{nil, reststats.S3_OUTCOME_SUCCESS},
+		{fakeApiError("NoSuchKey"), reststats.S3_OUTCOME_NOT_FOUND},
+		{fakeApiError("NotFound"), reststats.S3_OUTCOME_NOT_FOUND},
+		{fakeApiError("NotModified"), reststats.S3_OUTCOME_NOT_MODIFIED},
+		{fakeApiError("PreconditionFailed"), reststats.S3_OUTCOME_CONFLICT},
+		{fakeApiError("SlowDown"), reststats.S3_OUTCOME_THROTTLED},
+		{fakeApiError("InternalError"), reststats.S3_OUTCOME_ERROR},
+		{errors.New("connection reset"), reststats.S3_OUTCOME_ERROR},
+	}
+
+	for _, tc := range cases {
+		if outcome := getS3Outcome(tc.err); outcome != tc.outcome {
+			t.Errorf("Expected '%s' for %v, actual: '%s'", tc.outcome, tc.err, outcome)
+		}
+	}
+}
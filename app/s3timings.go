@@ -0,0 +1,63 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/smithy-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Off by default, every S3 call of the main note operations is logged at debug level, with its duration
+var LOG_S3_TIMINGS = false
+
+func SetLogS3Timings(enabled bool) {
+	LOG_S3_TIMINGS = enabled
+}
+
+// Can be replaced in tests
+var _s3TimingsLogger = log.StandardLogger()
+
+type requestIdContextKey struct{}
+
+// The S3 calls only get the request context, so the request id is carried in it, to tie the calls to the request
+func withRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdContextKey{}, requestId)
+}
+
+func getRequestId(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdContextKey{}).(string)
+	return requestId
+}
+
+// Makes the S3 call, and logs how long it took, when enabled.
+// The key is the object key, or the prefix for the listing.
+func timeS3Call[T any](ctx context.Context, operation string, key string, call func() (T, error)) (T, error) {
+	if !LOG_S3_TIMINGS {
+		return call()
+	}
+
+	start := time.Now()
+	output, err := call()
+
+	fields := log.Fields{
+		"s3_operation": operation,
+		"key":          key,
+		"duration_ms":  time.Since(start).Milliseconds(),
+	}
+	if requestId := getRequestId(ctx); requestId != "" {
+		fields["request_id"] = requestId
+	}
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			fields["error_code"] = apiErr.ErrorCode()
+		} else {
+			fields["error"] = err.Error()
+		}
+	}
+	_s3TimingsLogger.WithFields(fields).Debug("s3 " + operation)
+
+	return output, err
+}
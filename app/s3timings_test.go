@@ -0,0 +1,113 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Turns the timings on and collects the log entries
+func useLogS3Timings(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.SetLevel(log.DebugLevel)
+
+	originalLogger := _s3TimingsLogger
+	original := LOG_S3_TIMINGS
+	_s3TimingsLogger = logger
+	SetLogS3Timings(true)
+	t.Cleanup(func() {
+		_s3TimingsLogger = originalLogger
+		LOG_S3_TIMINGS = original
+	})
+
+	return &buf
+}
+
+func parseLogEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Could not parse the log entry %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestS3TimingsLogged(t *testing.T) {
+	fake := useFakeS3(t)
+	buf := useLogS3Timings(t)
+	fake.seed("user-1/note.md", "hello")
+
+	ctx := withRequestId(context.Background(), "request-1")
+	if _, err := getFileContent(ctx, "bucket", "user-1/", "note.md", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	entries := parseLogEntries(t, buf)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 log entry, got %d: %s", len(entries), buf.String())
+	}
+	entry := entries[0]
+	if entry["level"] != "debug" {
+		t.Errorf("Expected debug level, got %v", entry["level"])
+	}
+	if entry["s3_operation"] != "GetObject" {
+		t.Errorf("Expected GetObject, got %v", entry["s3_operation"])
+	}
+	if entry["key"] != "user-1/note.md" {
+		t.Errorf("Expected the key, got %v", entry["key"])
+	}
+	if entry["request_id"] != "request-1" {
+		t.Errorf("Expected the request id, got %v", entry["request_id"])
+	}
+	if _, ok := entry["duration_ms"]; !ok {
+		t.Errorf("Expected the duration")
+	}
+	if _, ok := entry["error_code"]; ok {
+		t.Errorf("Expected no error code, got %v", entry["error_code"])
+	}
+}
+
+func TestS3TimingsLoggedWithErrorCode(t *testing.T) {
+	useFakeS3(t)
+	buf := useLogS3Timings(t)
+
+	ctx := withRequestId(context.Background(), "request-1")
+	if _, err := getFileContent(ctx, "bucket", "user-1/", "missing.md", ""); err == nil {
+		t.Fatalf("Expected error")
+	}
+
+	entries := parseLogEntries(t, buf)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 log entry, got %d: %s", len(entries), buf.String())
+	}
+	if entries[0]["error_code"] != "NoSuchKey" {
+		t.Errorf("Expected NoSuchKey, got %v", entries[0]["error_code"])
+	}
+}
+
+func TestS3TimingsNotLoggedWhenDisabled(t *testing.T) {
+	fake := useFakeS3(t)
+	buf := useLogS3Timings(t)
+	SetLogS3Timings(false)
+	fake.seed("user-1/note.md", "hello")
+
+	if _, err := getFileContent(context.Background(), "bucket", "user-1/", "note.md", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing logged, got: %s", buf.String())
+	}
+}
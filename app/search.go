@@ -0,0 +1,225 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	SEARCH_MAX_RESULTS_DEFAULT int           = 20
+	SEARCH_MAX_RESULTS_MAX     int           = 100
+	SEARCH_PAGE_SIZE           int           = 100
+	SEARCH_WORKERS             int           = 8                               // max files fetched at the same time by a single search
+	SEARCH_TIME_BUDGET         time.Duration = time.Duration(10) * time.Second // after that, return what was found so far
+)
+
+type searchDataIn struct {
+	Query             string `form:"q"`
+	MaxResults        int    `form:"maxResults"`
+	ContinuationToken string `form:"continuationToken"`
+}
+
+// Searches the notes by the text, case-insensitive, looking both at the file name and content.
+//
+// The results are streamed as they are found, so the client can show the first hits early.
+// The response is a regular JSON document {"data": {"files": [...], "hasMore": ..., "nextContinuationToken": ...}},
+// written incrementally, and it is only valid JSON once fully received.
+//
+// The search stops when maxResults hits are found or the time budget is exhausted, whichever comes first.
+// In both cases, hasMore is true and the continuation token allows resuming the search exactly where it stopped.
+// Files are examined in the alphabetical order, so the hits are also returned in this order.
+func handleSearch(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+
+	// get params from query string
+	var searchIn searchDataIn
+	if err := c.ShouldBindQuery(&searchIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// sanitize
+	if !isSearchQueryValid(searchIn.Query) {
+		err := fmt.Errorf("invalid q '%s', should be between 1 and 200 chars long", searchIn.Query)
+		toBadRequest(c, err)
+		return
+	}
+	query := strings.ToLower(searchIn.Query)
+	if searchIn.MaxResults < 0 || searchIn.MaxResults > SEARCH_MAX_RESULTS_MAX {
+		err := fmt.Errorf("invalid maxResults '%d', should be between 0 and %d", searchIn.MaxResults, SEARCH_MAX_RESULTS_MAX)
+		toBadRequest(c, err)
+		return
+	}
+	maxResults := searchIn.MaxResults
+	if maxResults == 0 {
+		maxResults = SEARCH_MAX_RESULTS_DEFAULT
+	}
+	if !isContinuationTokenValid(searchIn.ContinuationToken) {
+		err := fmt.Errorf("invalid continuationToken '%s', should be less or equal than %d chars long", searchIn.ContinuationToken, getMaxContinuationTokenLength())
+		toBadRequest(c, err)
+		return
+	}
+	startAfter, err := decodeContinuationToken(searchIn.ContinuationToken)
+	if err != nil {
+		err := fmt.Errorf("invalid continuationToken '%s'", searchIn.ContinuationToken)
+		toBadRequest(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), SEARCH_TIME_BUDGET)
+	defer cancel()
+
+	// fetch the first page before starting the response, so the failure can still be reported with the proper status
+	page, err := listFilesStartingAfter(c.Request.Context(), getBucket(), prefix, SEARCH_PAGE_SIZE, string(startAfter))
+	if err != nil {
+		toInternalServerError(c, err.Error())
+		return
+	}
+
+	// start streaming
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Status(http.StatusOK)
+	c.Writer.WriteString(`{"data":{"files":[`)
+	c.Writer.Flush()
+
+	found := 0
+	emit := func(file *FileData) bool {
+		hit, _ := json.Marshal(&FileDataOut{
+			FileName:     file.FileName,
+			LastModified: file.LastModified,
+			ETag:         file.ETag,
+			Size:         file.Size,
+			ContentType:  getContentType(file.FileName),
+		})
+		if found > 0 {
+			c.Writer.WriteString(",")
+		}
+		c.Writer.Write(hit)
+		c.Writer.Flush()
+
+		found++
+		return found < maxResults
+	}
+	fetch := func(fileName string) (string, error) {
+		result, err := getFileContent(ctx, getBucket(), prefix, fileName, "")
+		if err != nil {
+			return "", err
+		}
+		return result.Content, nil
+	}
+
+	lastExamined := string(startAfter)
+	hasMore := true
+	for {
+		files := make([]*FileData, 0, len(page.Files))
+		for _, file := range page.Files {
+			if isFileNameValid(file.FileName) {
+				files = append(files, file)
+			}
+		}
+
+		examined := searchFiles(ctx, files, query, fetch, emit)
+		if examined < len(files) {
+			// stopped early, either found enough or ran out of time
+			if examined > 0 {
+				lastExamined = files[examined-1].FileName
+			}
+			break
+		}
+
+		lastExamined = page.NextContinuationToken
+		if !page.HasMore {
+			hasMore = false
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		page, err = listFilesStartingAfter(ctx, getBucket(), prefix, SEARCH_PAGE_SIZE, lastExamined)
+		if err != nil {
+			// too late to report the error, let the client resume from here
+			log.Printf("%v", err)
+			break
+		}
+	}
+
+	nextContinuationToken := ""
+	if hasMore {
+		nextContinuationToken = encodeContinuationToken(lastExamined)
+	}
+	c.Writer.WriteString(fmt.Sprintf(`],"hasMore":%v,"nextContinuationToken":"%s"}}`, hasMore, nextContinuationToken))
+}
+
+// Examines the files in the given order, fetching up to SEARCH_WORKERS files at the same time,
+// and never more than MAX_S3_CONCURRENCY across all the searches.
+// Every file that matches the query is passed to emit, in the same order as files,
+// and emit returns whether the search should continue.
+//
+// Returns the number of files examined, counting from the beginning of the slice without gaps.
+// When the context is done, stops waiting for the files still being fetched and returns what was examined so far.
+func searchFiles(ctx context.Context, files []*FileData, query string, fetch func(fileName string) (string, error), emit func(file *FileData) bool) int {
+	results := make([]chan bool, len(files))
+	for i := range results {
+		results[i] = make(chan bool, 1) // buffered, so the late workers never block
+	}
+
+	// cancelled on return, so no more files are fetched once the search is over
+	dispatchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	limiter := _s3Limiter
+
+	go func() {
+		workers := make(chan struct{}, SEARCH_WORKERS)
+		for i, file := range files {
+			select {
+			case workers <- struct{}{}:
+			case <-dispatchCtx.Done():
+				return
+			}
+			// the files are also fetched within the limit shared with all the other searches
+			if err := limiter.Acquire(dispatchCtx); err != nil {
+				<-workers
+				return
+			}
+
+			go func(result chan<- bool, file *FileData) {
+				defer func() { <-workers }()
+				defer limiter.Release()
+				result <- matchesQuery(file, query, fetch)
+			}(results[i], file)
+		}
+	}()
+
+	for i, file := range files {
+		select {
+		case matched := <-results[i]:
+			if matched && !emit(file) {
+				return i + 1
+			}
+		case <-ctx.Done():
+			return i
+		}
+	}
+	return len(files)
+}
+
+func matchesQuery(file *FileData, query string, fetch func(fileName string) (string, error)) bool {
+	if strings.Contains(strings.ToLower(file.FileName), query) {
+		return true
+	}
+
+	content, err := fetch(file.FileName)
+	if err != nil {
+		log.Printf("%v", err)
+		return false
+	}
+	return strings.Contains(strings.ToLower(content), query)
+}
@@ -0,0 +1,157 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type searchDataOut struct {
+	Files                 []*FileDataOut `json:"files"`
+	HasMore               bool           `json:"hasMore"`
+	NextContinuationToken string         `json:"nextContinuationToken"`
+}
+
+func TestSearchFilesReturnsPartialResultsOnTimeout(t *testing.T) {
+	files := make([]*FileData, 0, 10)
+	for i := 0; i < 10; i++ {
+		files = append(files, &FileData{FileName: fmt.Sprintf("note %d.md", i)})
+	}
+	fetch := func(fileName string) (string, error) {
+		if fileName == "note 3.md" {
+			time.Sleep(time.Second)
+		}
+		return "matching content", nil
+	}
+	emitted := make([]string, 0)
+	emit := func(file *FileData) bool {
+		emitted = append(emitted, file.FileName)
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	examined := searchFiles(ctx, files, "matching", fetch, emit)
+
+	if time.Since(start) >= time.Second {
+		t.Errorf("Expected to stop on timeout, took: %v", time.Since(start))
+	}
+	if examined != 3 {
+		t.Errorf("Expected 3 files examined, actual: %d", examined)
+	}
+	if len(emitted) != 3 || emitted[2] != "note 2.md" {
+		t.Errorf("Expected the first 3 files to be emitted in order, actual: %v", emitted)
+	}
+}
+
+func TestSearchFilesStopsWhenEmitSaysSo(t *testing.T) {
+	files := []*FileData{{FileName: "a.md"}, {FileName: "b.md"}, {FileName: "c.md"}}
+	fetch := func(fileName string) (string, error) {
+		return "matching content", nil
+	}
+	emit := func(file *FileData) bool {
+		return file.FileName != "b.md"
+	}
+
+	examined := searchFiles(context.Background(), files, "matching", fetch, emit)
+
+	if examined != 2 {
+		t.Errorf("Expected 2 files examined, actual: %d", examined)
+	}
+}
+
+func TestSearchWithPagination(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/a.md", "the word is Banana")
+	fake.seed("user1/b.md", "nothing here")
+	fake.seed("user1/banana.txt", "")
+	fake.seed("user1/c.md", "banana again")
+	fake.seed("user2/d.md", "banana from someone else")
+
+	c, w := newTestContext("GET", "/search?q=banana&maxResults=2", "")
+	runAsUser(c, handleSearch, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out searchDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 2 || out.Files[0].FileName != "a.md" || out.Files[1].FileName != "banana.txt" {
+		t.Fatalf("Expected a.md and banana.txt, actual: %s", w.Body.String())
+	}
+	if !out.HasMore {
+		t.Errorf("Expected hasMore")
+	}
+	token, _ := base64.RawURLEncoding.DecodeString(out.NextContinuationToken)
+	if string(token) != "banana.txt" {
+		t.Errorf("Expected to continue after banana.txt, actual: %s", string(token))
+	}
+
+	c, w = newTestContext("GET", "/search?q=banana&maxResults=2&continuationToken="+out.NextContinuationToken, "")
+	runAsUser(c, handleSearch, "user1")
+
+	out = searchDataOut{}
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 1 || out.Files[0].FileName != "c.md" {
+		t.Fatalf("Expected c.md, actual: %s", w.Body.String())
+	}
+	if out.HasMore {
+		t.Errorf("Expected no more results")
+	}
+}
+
+func useMaxS3Concurrency(t *testing.T, limit int) {
+	maxS3Concurrency, s3Limiter := MAX_S3_CONCURRENCY, _s3Limiter
+	t.Cleanup(func() {
+		MAX_S3_CONCURRENCY, _s3Limiter = maxS3Concurrency, s3Limiter
+	})
+	err := SetMaxS3Concurrency(limit)
+	if err != nil {
+		t.Fatalf("Error setting max S3 concurrency: %s", err)
+	}
+}
+
+func TestSearchFilesRespectsSharedConcurrencyLimit(t *testing.T) {
+	useMaxS3Concurrency(t, 2)
+
+	files := make([]*FileData, 0, 10)
+	for i := 0; i < 10; i++ {
+		files = append(files, &FileData{FileName: fmt.Sprintf("note %d.md", i)})
+	}
+	var running, maxRunning int32
+	fetch := func(fileName string) (string, error) {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return "content", nil
+	}
+	emit := func(file *FileData) bool {
+		return true
+	}
+
+	// two searches at the same time share the same limit
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			searchFiles(context.Background(), files, "matching", fetch, emit)
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning > 2 {
+		t.Errorf("Expected at most 2 files fetched at the same time, actual: %d", maxRunning)
+	}
+}
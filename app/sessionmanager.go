@@ -9,24 +9,32 @@ import (
 var SESSION_DURATION = time.Duration(60) * time.Minute
 
 type sessionData struct {
-	UserId  string `json:"uid" binding:"required"`
-	Email   string `json:"email" binding:"required"`
-	Expires string `json:"exp" binding:"required"`
+	UserId   string `json:"uid" binding:"required"`
+	TenantId string `json:"tid,omitempty"` // only with the tenant claim configured, and present in the token
+	Email    string `json:"email" binding:"required"`
+	Expires  string `json:"exp" binding:"required"`
 }
 
 func generateSession(userId string, userEmail string) ([]byte, error) {
-	if userId == "" {
+	return encryptSession(newSession(userId, userEmail, time.Now()))
+}
+
+func newSession(userId string, userEmail string, now time.Time) *sessionData {
+	return &sessionData{
+		UserId:  userId,
+		Email:   userEmail,
+		Expires: now.Add(SESSION_DURATION).UTC().Format(time.RFC3339),
+	}
+}
+
+func encryptSession(session *sessionData) ([]byte, error) {
+	if session.UserId == "" {
 		return nil, fmt.Errorf("userId is empty")
 	}
-	if userEmail == "" {
+	if session.Email == "" {
 		return nil, fmt.Errorf("userEmail is empty")
 	}
 
-	session := sessionData{
-		UserId:  userId,
-		Email:   userEmail,
-		Expires: time.Now().Add(SESSION_DURATION).UTC().Format(time.RFC3339),
-	}
 	sessionJson, err := json.Marshal(session)
 	if err != nil {
 		return nil, err
@@ -1,7 +1,11 @@
 package app
 
 import (
+	"encoding/base64"
 	"fmt"
+	"net/http"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -12,15 +16,53 @@ type tokenContainerData struct {
 	IdToken string `json:"id_token" binding:"required"`
 }
 
-type sessionContainerData struct {
-	Session []byte `json:"session" binding:"required"`
+type meHeaderData struct {
+	Authorization string `header:"authorization"`
 }
 
+type meDataOut struct {
+	UserId    string    `json:"userId"`
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	TokenUse  string    `json:"tokenUse"`
+}
+
+// The session is what the client sends back as x-session, the rest is for the client to show
+type signInDataOut struct {
+	UserId    string    `json:"userId"`
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Session   []byte    `json:"session"`
+}
+
+var SESSION_COOKIE_NAME = "notedok_session"
+
+// Off by default, the browser clients that enable it don't need to keep the session in script reach
+var SESSION_COOKIE_ENABLED = false
+
+func SetSessionCookieEnabled(enabled bool) {
+	SESSION_COOKIE_ENABLED = enabled
+}
+
+// HttpOnly, so the scripts can't read it, and Lax, so it is not sent with the cross-site POSTs.
+// The value is the same encrypted session as in the response, expires together with it,
+// encoded URL-safe, since the cookie value is escaped otherwise.
+func setSessionCookie(c *gin.Context, session []byte) {
+	path := BASE_PATH
+	if path == "" {
+		path = "/"
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(SESSION_COOKIE_NAME, base64.RawURLEncoding.EncodeToString(session), int(SESSION_DURATION.Seconds()), path, "", true, true)
+}
+
+// Exchanges the valid id token for the session, the invalid one gives 401.
+// With the session cookie enabled, the session also comes as the HttpOnly cookie.
 func handleSignIn(c *gin.Context) {
 	// get app data from the POST body
 	var tokenContainer tokenContainerData
 	if err := c.ShouldBindJSON(&tokenContainer); err != nil {
-		toBadRequest(c, err)
+		toBindingError(c, err)
 		return
 	}
 
@@ -45,18 +87,78 @@ func handleSignIn(c *gin.Context) {
 		toUnauthorized(c)
 		return
 	}
+	tenantId := parsedToken.TenantId
+	if tenantId != "" && !isTenantIdValid(tenantId) {
+		log.Printf("%v", fmt.Errorf("invalid tenant id: '%s'", tenantId))
+		toUnauthorized(c)
+		return
+	}
 
 	// generate session
-	session, err := generateSession(userId, userEmail)
+	sessionData := newSession(userId, userEmail, time.Now())
+	sessionData.TenantId = tenantId
+	session, err := encryptSession(sessionData)
+	if err != nil {
+		log.Printf("%v", err)
+		toUnauthorized(c)
+		return
+	}
+	expiresAt, err := time.Parse(time.RFC3339, sessionData.Expires)
 	if err != nil {
 		log.Printf("%v", err)
 		toUnauthorized(c)
 		return
 	}
+	if SESSION_COOKIE_ENABLED {
+		setSessionCookie(c, session)
+	}
 
 	// create response
-	sessionContainer := sessionContainerData{
-		Session: session,
+	toSuccess(c, &signInDataOut{
+		UserId:    userId,
+		Email:     userEmail,
+		ExpiresAt: expiresAt,
+		Session:   session,
+	})
+}
+
+// Validates the id token sent as "Authorization: Bearer <id_token>" and returns its claims,
+// so the client can populate the UI right after the sign-in without making a business call.
+// The token is checked exactly like on sign in, the invalid or expired one gives 401.
+func handleMe(c *gin.Context) {
+	var meHeader meHeaderData
+	if err := c.ShouldBindHeader(&meHeader); err != nil {
+		log.Printf("%v", err)
+		toUnauthorized(c)
+		return
 	}
-	toSuccess(c, sessionContainer)
+	idToken := strings.TrimSpace(strings.TrimPrefix(meHeader.Authorization, "Bearer "))
+	if idToken == "" || idToken == meHeader.Authorization {
+		log.Printf("'authorization' header is not a bearer token")
+		toUnauthorized(c)
+		return
+	}
+
+	// parse token
+	parsedToken, err := parseAndValidateIdToken(idToken)
+	if err != nil {
+		log.Printf("%v", err)
+		toUnauthorized(c)
+		return
+	}
+
+	// sanitize
+	if !isUserIdValid(parsedToken.UserId) {
+		log.Printf("%v", fmt.Errorf("invalid user id: '%s'", parsedToken.UserId))
+		toUnauthorized(c)
+		return
+	}
+
+	// create response
+	toSuccess(c, &meDataOut{
+		UserId:    parsedToken.UserId,
+		Email:     parsedToken.EMail,
+		ExpiresAt: parsedToken.ExpiresAt,
+		TokenUse:  parsedToken.TokenUse,
+	})
 }
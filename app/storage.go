@@ -0,0 +1,251 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	STORAGE_S3    = "s3"
+	STORAGE_LOCAL = "local" // the directory on the local disk, for development, no AWS needed
+)
+
+// The basic operations on the notes the handlers need from the storage, S3 by default.
+// The bucket is where the notes are kept, e.g. the S3 bucket, and the prefix is the user (and folder) within it.
+// The implementations are expected to return the same errors as s3connect.go, e.g. ErrNotFound or ErrPreconditionFailed,
+// so the handlers respond the same way whatever the storage. The metadata of the note is never nil, empty when there is none.
+type Storage interface {
+	ListFiles(ctx context.Context, bucket string, prefix string, pageSize int, continuationToken string) (*ListFilesResult, error)
+	GetFileContent(ctx context.Context, bucket string, prefix string, fileName string, etag string) (*GetFileContentResult, error)
+	GetFileInfo(ctx context.Context, bucket string, prefix string, fileName string) (*FileInfoResult, error)
+	SaveFileContent(ctx context.Context, bucket string, prefix string, fileName string, content string, overwrite bool, meta *NoteMetadata) (*SaveFileContentResult, error)
+	UpdateFileContent(ctx context.Context, bucket string, prefix string, fileName string, content string, etag string, meta *NoteMetadata) (*SaveFileContentResult, error)
+	RenameFile(ctx context.Context, bucket string, prefix string, fileName string, newFileName string) (*RenameFileResult, error)
+	DeleteFile(ctx context.Context, bucket string, prefix string, fileName string, etag string) error
+	DeleteAllFiles(ctx context.Context, bucket string, prefix string) error
+}
+
+// The storage in S3, simply goes to s3connect.go
+type s3Storage struct{}
+
+func NewS3Storage() Storage {
+	return &s3Storage{}
+}
+
+func (storage *s3Storage) ListFiles(ctx context.Context, bucket string, prefix string, pageSize int, continuationToken string) (*ListFilesResult, error) {
+	return listFiles(ctx, bucket, prefix, pageSize, continuationToken)
+}
+
+func (storage *s3Storage) GetFileContent(ctx context.Context, bucket string, prefix string, fileName string, etag string) (*GetFileContentResult, error) {
+	return getFileContent(ctx, bucket, prefix, fileName, etag)
+}
+
+func (storage *s3Storage) GetFileInfo(ctx context.Context, bucket string, prefix string, fileName string) (*FileInfoResult, error) {
+	return getFileInfo(ctx, bucket, prefix, fileName)
+}
+
+func (storage *s3Storage) SaveFileContent(ctx context.Context, bucket string, prefix string, fileName string, content string, overwrite bool, meta *NoteMetadata) (*SaveFileContentResult, error) {
+	return saveFileContent(ctx, bucket, prefix, fileName, content, overwrite, meta)
+}
+
+func (storage *s3Storage) UpdateFileContent(ctx context.Context, bucket string, prefix string, fileName string, content string, etag string, meta *NoteMetadata) (*SaveFileContentResult, error) {
+	return updateFileContent(ctx, bucket, prefix, fileName, content, etag, meta)
+}
+
+func (storage *s3Storage) RenameFile(ctx context.Context, bucket string, prefix string, fileName string, newFileName string) (*RenameFileResult, error) {
+	return renameFile(ctx, bucket, prefix, fileName, newFileName)
+}
+
+func (storage *s3Storage) DeleteFile(ctx context.Context, bucket string, prefix string, fileName string, etag string) error {
+	return deleteFile(ctx, bucket, prefix, fileName, etag)
+}
+
+func (storage *s3Storage) DeleteAllFiles(ctx context.Context, bucket string, prefix string) error {
+	return deleteAllFiles(ctx, bucket, prefix)
+}
+
+// Set once on start, S3 unless replaced, e.g. by the local storage for development, or by the fake in tests
+var (
+	_storage   Storage = &s3Storage{}
+	_storageMu sync.RWMutex
+)
+
+func SetStorage(storage Storage) {
+	_storageMu.Lock()
+	defer _storageMu.Unlock()
+	_storage = storage
+}
+
+func getStorage() Storage {
+	_storageMu.RLock()
+	defer _storageMu.RUnlock()
+	return _storage
+}
+
+// The rest of the API, e.g. tags, sharing, trash or folders, goes to S3 directly, so it only works with the S3 storage
+var ErrNotSupportedByStorage = fmt.Errorf("not supported by the storage, only available with NOTEDOK_STORAGE=%s", STORAGE_S3)
+
+var ERROR_CODE_NOT_SUPPORTED_BY_STORAGE = "NOT_SUPPORTED_BY_STORAGE"
+
+func isS3Storage() bool {
+	_, ok := getStorage().(*s3Storage)
+	return ok
+}
+
+// Gives 501 for the endpoint that only works with S3, when the notes are kept elsewhere, instead of failing on S3
+func withS3Storage(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isS3Storage() {
+			toNotSupportedByStorage(c)
+			return
+		}
+		handler(c)
+	}
+}
+
+func toNotSupportedByStorage(c *gin.Context) {
+	toJSON(c, http.StatusNotImplemented, gin.H{"err": ErrNotSupportedByStorage.Error(), "code": ERROR_CODE_NOT_SUPPORTED_BY_STORAGE})
+}
+
+// Gives the current ETag of the file, when the file was not modified after the given time,
+// so the write that follows can be made conditional on it, and nobody can sneak in between.
+// S3 keeps the last modified time to the second, same as the HTTP dates.
+//
+// If the file does not exist, the method returns "not found" error.
+// If the file was modified after the given time, the method returns "precondition failed" error.
+func getEtagIfUnmodifiedSince(ctx context.Context, bucket string, prefix string, fileName string, since time.Time) (string, error) {
+	info, err := getStorage().GetFileInfo(ctx, bucket, prefix, fileName)
+	if err != nil {
+		return "", err // already wrapped
+	}
+	if info.LastModified.Truncate(time.Second).After(since) {
+		err := fmt.Errorf("file '%s' was modified at %v, after %v", fileName, info.LastModified, since)
+		return "", logAndReturnError(err, ErrPreconditionFailed)
+	}
+	return info.ETag, nil
+}
+
+// Creates the new note, same as saveFileContent with overwrite set to false, but when the file name is taken,
+// re-submits it under the unique name, by applying the timestamp to the file path, i.e. "my file~~1426963430173.txt".
+// Gives up with "already exists" error after SAVE_UNIQUE_MAX_ATTEMPTS.
+//
+// Returns the file name the note was saved under.
+func saveFileContentUnique(ctx context.Context, bucket string, prefix string, fileName string, content string, meta *NoteMetadata) (string, *SaveFileContentResult, error) {
+	now := time.Now()
+	uniqueFileName := fileName
+	for attempt := 1; ; attempt++ {
+		result, err := getStorage().SaveFileContent(ctx, bucket, prefix, uniqueFileName, content, false, meta)
+		if err == nil {
+			return uniqueFileName, result, nil
+		}
+		if !errors.Is(err, ErrAlreadyExists) || attempt >= SAVE_UNIQUE_MAX_ATTEMPTS {
+			return "", nil, err // already wrapped
+		}
+		uniqueFileName = getUniqueFileName(fileName, now.Add(time.Duration(attempt-1)*time.Millisecond))
+	}
+}
+
+// Tells whether the file already has exactly the same content, comparing the ETags, without fetching the content.
+// Returns the current ETag, when the content is the same.
+//
+// S3 ETag is the MD5 of the bytes as stored, but only for the objects uploaded in a single part and not encrypted with KMS.
+// For any other object, the ETags never match, and the method simply reports the content as changed.
+func isFileContentUnchanged(ctx context.Context, bucket string, prefix string, fileName string, content string) (bool, string, error) {
+	info, err := getStorage().GetFileInfo(ctx, bucket, prefix, fileName)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, "", nil
+		}
+		return false, "", err // already wrapped
+	}
+
+	etag, err := computeFileEtag(content)
+	if err != nil {
+		return false, "", logAndReturnError(err, ErrInvalidArgument)
+	}
+	if etag != info.ETag {
+		return false, "", nil
+	}
+	return true, info.ETag, nil
+}
+
+// Same as isFileContentUnchanged, but when the ETag is not the MD5 of the content, e.g. for multipart uploads or KMS encryption,
+// compares the content itself, instead of reporting the content as changed.
+// Returns the current ETag, when the content is the same.
+func isFileContentUnchangedComparingContent(ctx context.Context, bucket string, prefix string, fileName string, content string) (bool, string, error) {
+	info, err := getStorage().GetFileInfo(ctx, bucket, prefix, fileName)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, "", nil
+		}
+		return false, "", err // already wrapped
+	}
+
+	if info.ETagIsMd5 {
+		etag, err := computeFileEtag(content)
+		if err != nil {
+			return false, "", logAndReturnError(err, ErrInvalidArgument)
+		}
+		return etag == info.ETag, info.ETag, nil
+	}
+	return isFileContentEqual(ctx, bucket, prefix, fileName, content)
+}
+
+// Checks that the file can be moved or renamed, without changing anything.
+// The file names in format "my file.md" or "my file.txt" (exactly as retrieved by listFiles).
+//
+// If the file does not exist, the method returns "not found" error.
+// If the file with the new name already exists in the target folder, the method returns "already exists" error.
+// Same as with the actual move, the target can still be taken by the time the file is moved.
+func checkFileCanBeMoved(ctx context.Context, bucket string, fromPrefix string, fileName string, toPrefix string, newFileName string) error {
+	_, err := getStorage().GetFileInfo(ctx, bucket, fromPrefix, fileName)
+	if err != nil {
+		return err // already wrapped
+	}
+
+	_, err = getStorage().GetFileInfo(ctx, bucket, toPrefix, newFileName)
+	if err == nil {
+		return ErrAlreadyExists
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return err // already wrapped
+	}
+	return nil
+}
+
+// Retrieves the list of files by the prefix, going through all the pages of pageSize, up to maxFiles.
+// Works exactly as listFiles, except there is no continuation token, HasMore tells whether there were more than maxFiles files.
+func listAllFiles(ctx context.Context, bucket string, prefix string, pageSize int, maxFiles int) (*ListFilesResult, error) {
+	files := make([]*FileData, 0)
+	continuationToken := ""
+	for {
+		page, err := getStorage().ListFiles(ctx, bucket, prefix, pageSize, continuationToken)
+		if err != nil {
+			return nil, err // already wrapped
+		}
+
+		files = append(files, page.Files...)
+		if len(files) > maxFiles {
+			return &ListFilesResult{
+				Files:   files[:maxFiles],
+				HasMore: true,
+			}, nil
+		}
+
+		if !page.HasMore || page.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = page.NextContinuationToken
+	}
+
+	return &ListFilesResult{
+		Files:   files,
+		HasMore: false,
+	}, nil
+}
@@ -0,0 +1,266 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In-memory implementation of the storage, the notes are kept by the prefix and the file name, the bucket is ignored
+type memoryStorage struct {
+	mu    sync.Mutex
+	files map[string]*GetFileContentResult
+}
+
+func useMemoryStorage(t *testing.T) *memoryStorage {
+	storage := &memoryStorage{files: map[string]*GetFileContentResult{}}
+
+	original := getStorage()
+	SetStorage(storage)
+	t.Cleanup(func() {
+		SetStorage(original)
+	})
+	return storage
+}
+
+func (storage *memoryStorage) ListFiles(ctx context.Context, bucket string, prefix string, pageSize int, continuationToken string) (*ListFilesResult, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	keys := []string{}
+	for key := range storage.files {
+		if strings.HasPrefix(key, prefix) && key > prefix+continuationToken {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := &ListFilesResult{Files: []*FileData{}}
+	for _, key := range keys {
+		if len(result.Files) == pageSize {
+			result.HasMore = true
+			result.NextContinuationToken = result.Files[len(result.Files)-1].FileName
+			break
+		}
+		file := storage.files[key]
+		result.Files = append(result.Files, &FileData{
+			FileName:     strings.TrimPrefix(key, prefix),
+			LastModified: file.LastModified,
+			ETag:         file.ETag,
+			Size:         int64(len(file.Content)),
+		})
+	}
+	return result, nil
+}
+
+func (storage *memoryStorage) GetFileContent(ctx context.Context, bucket string, prefix string, fileName string, etag string) (*GetFileContentResult, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	file, ok := storage.files[prefix+fileName]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if etag != "" && etag == file.ETag {
+		return nil, ErrNotModified
+	}
+	return file, nil
+}
+
+func (storage *memoryStorage) GetFileInfo(ctx context.Context, bucket string, prefix string, fileName string) (*FileInfoResult, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	file, ok := storage.files[prefix+fileName]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &FileInfoResult{
+		ETag:         file.ETag,
+		ETagIsMd5:    true,
+		LastModified: file.LastModified,
+		Metadata:     file.Metadata,
+	}, nil
+}
+
+func (storage *memoryStorage) SaveFileContent(ctx context.Context, bucket string, prefix string, fileName string, content string, overwrite bool, meta *NoteMetadata) (*SaveFileContentResult, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if _, ok := storage.files[prefix+fileName]; ok && !overwrite {
+		return nil, ErrAlreadyExists
+	}
+	if meta == nil {
+		meta = &NoteMetadata{}
+	}
+	file := &GetFileContentResult{
+		Content:      content,
+		ETag:         fakeEtag([]byte(content)),
+		LastModified: time.Now().UTC(),
+		Metadata:     meta,
+	}
+	storage.files[prefix+fileName] = file
+	return &SaveFileContentResult{ETag: file.ETag}, nil
+}
+
+func (storage *memoryStorage) UpdateFileContent(ctx context.Context, bucket string, prefix string, fileName string, content string, etag string, meta *NoteMetadata) (*SaveFileContentResult, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	current, ok := storage.files[prefix+fileName]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if etag != current.ETag {
+		return nil, ErrPreconditionFailed
+	}
+	file := &GetFileContentResult{
+		Content:      content,
+		ETag:         fakeEtag([]byte(content)),
+		LastModified: time.Now().UTC(),
+		Metadata:     mergeNoteMetadata(current.Metadata, meta),
+	}
+	storage.files[prefix+fileName] = file
+	return &SaveFileContentResult{ETag: file.ETag}, nil
+}
+
+func (storage *memoryStorage) RenameFile(ctx context.Context, bucket string, prefix string, fileName string, newFileName string) (*RenameFileResult, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	file, ok := storage.files[prefix+fileName]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if _, ok := storage.files[prefix+newFileName]; ok {
+		return nil, ErrAlreadyExists
+	}
+	delete(storage.files, prefix+fileName)
+	storage.files[prefix+newFileName] = file
+	return &RenameFileResult{ETag: file.ETag}, nil
+}
+
+func (storage *memoryStorage) DeleteFile(ctx context.Context, bucket string, prefix string, fileName string, etag string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	file, ok := storage.files[prefix+fileName]
+	if !ok {
+		return nil
+	}
+	if etag != "" && etag != file.ETag {
+		return ErrPreconditionFailed
+	}
+	delete(storage.files, prefix+fileName)
+	return nil
+}
+
+func (storage *memoryStorage) DeleteAllFiles(ctx context.Context, bucket string, prefix string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for key := range storage.files {
+		if strings.HasPrefix(key, prefix) {
+			delete(storage.files, key)
+		}
+	}
+	return nil
+}
+
+func (storage *memoryStorage) count() int {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	return len(storage.files)
+}
+
+func TestHandlersUseStorage(t *testing.T) {
+	fake := useFakeS3(t)
+	storage := useMemoryStorage(t)
+	router := newAppRouter()
+
+	// save
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodPut, "/files/note.md", "content"))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on save, actual: %d", w.Code)
+	}
+
+	// read
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodGet, "/files/note.md", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on read, actual: %d", w.Code)
+	}
+	if w.Body.String() != "content" {
+		t.Errorf("Expected 'content', actual: '%s'", w.Body.String())
+	}
+
+	// rename
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodPost, "/rename", `{"fileName": "note.md", "newFileName": "renamed.md"}`))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on rename, actual: %d", w.Code)
+	}
+
+	// list
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodGet, "/files", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on list, actual: %d", w.Code)
+	}
+	var list getFilesDataOut
+	parseDataResponse(t, w, &list)
+	if len(list.Files) != 1 || list.Files[0].FileName != "renamed.md" {
+		t.Errorf("Expected only 'renamed.md', actual: %v", list.Files)
+	}
+
+	// delete
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodDelete, "/files/renamed.md", ""))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on delete, actual: %d", w.Code)
+	}
+	if storage.count() != 0 {
+		t.Errorf("Expected no notes left, actual: %d", storage.count())
+	}
+	if fake.count() != 0 {
+		t.Errorf("Expected nothing in S3, actual: %v", fake.snapshot())
+	}
+}
+
+func TestGetFileNotFoundInStorage(t *testing.T) {
+	useFakeS3(t)
+	useMemoryStorage(t)
+	router := newAppRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodGet, "/files/missing.md", ""))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, actual: %d", w.Code)
+	}
+}
+
+func TestDeleteAllFilesFromStorage(t *testing.T) {
+	useFakeS3(t)
+	storage := useMemoryStorage(t)
+	storage.SaveFileContent(context.Background(), getBucket(), "user1/", "a.md", "a", false, nil)
+	storage.SaveFileContent(context.Background(), getBucket(), "user1/", "b.md", "b", false, nil)
+	storage.SaveFileContent(context.Background(), getBucket(), "user2/", "c.md", "c", false, nil)
+	router := newAppRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newAuthenticatedRequest(t, http.MethodPost, "/deleteall?permanent=true", `{"confirm": "DELETE ALL"}`))
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if storage.count() != 1 {
+		t.Errorf("Expected only the note of user2 left, actual: %d", storage.count())
+	}
+}
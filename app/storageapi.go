@@ -2,58 +2,311 @@ package app
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
-var _bucket string
+// Set once on start, but read by every request, so guarded, in case it is ever set after the server is up
+var (
+	_bucket   string
+	_bucketMu sync.RWMutex
+)
+
+func getBucket() string {
+	_bucketMu.RLock()
+	defer _bucketMu.RUnlock()
+	return _bucket
+}
 
 func InitBucket(bucket string) error {
 	if bucket == "" {
 		return fmt.Errorf("empty value for the bucket")
 	}
 
+	_bucketMu.Lock()
+	defer _bucketMu.Unlock()
 	_bucket = bucket
 	return nil
 }
 
+// Makes sure the bucket exists and can be accessed with the current credentials,
+// so the misconfiguration is reported on start, instead of on the first request.
+func VerifyBucket(ctx context.Context) error {
+	bucket := getBucket()
+	err := checkBucket(ctx, bucket)
+	if err != nil {
+		if errors.Is(err, ErrBucketNotFound) {
+			return fmt.Errorf("bucket '%s' not found", bucket)
+		}
+		if errors.Is(err, ErrAccessDenied) {
+			return fmt.Errorf("access denied to bucket '%s', check the credentials and the bucket policy", bucket)
+		}
+		return fmt.Errorf("could not reach bucket '%s': %w", bucket, err)
+	}
+	return nil
+}
+
+var S3_MAX_KEYS = 1000 // S3 never returns more than 1000 objects per page
+
 var (
 	PAGE_SIZE_DEFAULT int = 100 // promote small pages to avoid loading too much into memory
+	PAGE_SIZE_MAX     int = S3_MAX_KEYS
+)
+
+func SetPageSizes(pageSizeDefault int, pageSizeMax int) error {
+	if pageSizeMax <= 0 || pageSizeMax > S3_MAX_KEYS {
+		return fmt.Errorf("invalid max page size %d, should be between 1 and %d", pageSizeMax, S3_MAX_KEYS)
+	}
+	if pageSizeDefault <= 0 || pageSizeDefault > pageSizeMax {
+		return fmt.Errorf("invalid default page size %d, should be between 1 and max page size %d", pageSizeDefault, pageSizeMax)
+	}
+
+	PAGE_SIZE_DEFAULT = pageSizeDefault
+	PAGE_SIZE_MAX = pageSizeMax
+	return nil
+}
+
+// The fields of the multipart/form-data submitted by the HTML forms
+var (
+	FORM_CONTENT_FIELD  = "content"
+	FORM_FILENAME_FIELD = "filename"
 )
 
+// The bigger form parts are buffered on disk, the content is validated for size after it is read anyway
+var MULTIPART_MAX_MEMORY int64 = 1 << 20
+
+// Empty notes are legit (e.g. the note with the title only), but usually the empty body on create is a client bug.
+// Only applies to the API, the internal code still creates empty files when needed, e.g. for rename.
+var REJECT_EMPTY_CONTENT = false
+
+func SetRejectEmptyContent(reject bool) {
+	REJECT_EMPTY_CONTENT = reject
+}
+
+// On by default, the notes are served with charset=UTF-8, so the invalid bytes would break the clients and the markdown rendering.
+// Can be turned off for the clients that store arbitrary bytes on purpose.
+var VALIDATE_UTF8 = true
+
+func SetValidateUtf8(validate bool) {
+	VALIDATE_UTF8 = validate
+}
+
+// The content of the note never changes for the same ETag, but the note does, so by default the clients always revalidate,
+// with If-None-Match, which is cheap, since it gives 304 without the content. Empty for no Cache-Control at all.
+var FILE_CACHE_CONTROL = "private, max-age=0, must-revalidate"
+
+func SetFileCacheControl(cacheControl string) error {
+	if strings.IndexFunc(cacheControl, unicode.IsControl) >= 0 {
+		return fmt.Errorf("invalid cache control '%s', should not contain control characters", cacheControl)
+	}
+	FILE_CACHE_CONTROL = cacheControl
+	return nil
+}
+
+// Off by default, the listing page comes with the weak ETag.
+// The shared caching proxies that only dedupe by the strong ETag can have it instead, since it is computed from the page contents.
+var LISTING_ETAG_STRONG = false
+
+func SetListingEtagStrong(strong bool) {
+	LISTING_ETAG_STRONG = strong
+}
+
+// The single source of truth for the user namespace, every key of the user starts with it.
+// The user id is expected to be validated with isUserIdValid, so it never contains "/".
+func userPrefix(c *gin.Context, userId string) string {
+	return getUserPrefix(c.GetString(TENANT_ID_KEY), userId)
+}
+
+// With the tenant, the users of the tenant are kept together, e.g. "tenants/tenant1/user1/", otherwise it's simply "user1/".
+// The tenants go under the reserved segment, not to share the key space with the users without the tenant,
+// e.g. the user "tenant1" can't reach the users of the tenant "tenant1" with ?folder=.
+func getUserPrefix(tenantId string, userId string) string {
+	if tenantId == "" {
+		return userId + "/"
+	}
+	return TENANTS_KEY_SEGMENT + "/" + tenantId + "/" + userId + "/"
+}
+
+// The folder is expected to be validated
+func getFolderPrefix(c *gin.Context, userId string, folder string) string {
+	if folder == "" {
+		return userPrefix(c, userId)
+	}
+	return userPrefix(c, userId) + folder + "/"
+}
+
+func getSubfolder(parent string, folder string) string {
+	if parent == "" {
+		return folder
+	}
+	return parent + "/" + folder
+}
+
+// The continuation token is exposed to the clients base64url-encoded, without padding,
+// so it can be passed in the query string as is, with no escaping ambiguity ('+', '/', '=', spaces).
+func encodeContinuationToken(token string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(token))
+}
+
+func decodeContinuationToken(token string) (string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+func getPageSizeOrDefault(pageSize int) int {
+	if pageSize == 0 {
+		return PAGE_SIZE_DEFAULT
+	}
+	return pageSize
+}
+
 type getFilesDataIn struct {
 	PageSize          int    `form:"pageSize"` // TODO: maybe rename to MaxPageSize, since can return less
 	ContinuationToken string `form:"continuationToken"`
+	WithCount         bool   `form:"withCount"`
+	Folder            string `form:"folder"`      // empty for the root
+	WithPreview       int    `form:"withPreview"` // the preview length in bytes, 0 for no preview
+	WithMetadata      bool   `form:"withMetadata"`
+	WithPinned        bool   `form:"withPinned"`
 }
 
 type getFilesDataOut struct {
 	Files                 []*FileDataOut `json:"files"`
 	HasMore               bool           `json:"hasMore"`
 	NextContinuationToken string         `json:"nextContinuationToken"`
+	TotalCount            *int           `json:"totalCount,omitempty"` // only when requested, approximate
 }
 
 type FileDataOut struct {
+	FileName     string     `json:"fileName"`
+	LastModified time.Time  `json:"lastModified"`
+	ETag         string     `json:"etag"`
+	Size         int64      `json:"size"` // in bytes, as stored
+	ContentType  string     `json:"contentType"`
+	Preview      string     `json:"preview,omitempty"` // only when requested
+	Title        string     `json:"title,omitempty"`   // only when requested, and only when set
+	Created      *time.Time `json:"created,omitempty"` // only when requested, and only when set
+	Pinned       *bool      `json:"pinned,omitempty"`  // only when requested
+}
+
+var MANIFEST_MAX_FILES = 10000 // keeps the response reasonable, the client can fall back to paging through GET /files
+
+type getManifestDataIn struct {
+	Folder string `form:"folder"` // empty for the root
+}
+
+type getManifestDataOut struct {
+	Files   []*manifestFileDataOut `json:"files"`
+	HasMore bool                   `json:"hasMore"` // true when there are more than MANIFEST_MAX_FILES files
+}
+
+type manifestFileDataOut struct {
 	FileName     string    `json:"fileName"`
-	LastModified time.Time `json:"lastModified"`
 	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"lastModified"`
+	Size         int64     `json:"size"` // in bytes, as stored
 }
 
 type getFileDataIn struct {
 	FileName string `uri:"filename" binding:"required"`
 }
 
+type getFileQueryDataIn struct {
+	Download bool `form:"download"` // as an attachment, so the browser saves it instead of showing
+}
+
+// Only with Accept: application/json, the raw content otherwise
+type getFileDataOut struct {
+	FileName     string    `json:"fileName"`
+	Content      string    `json:"content"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+type getChecksumDataIn struct {
+	FileName string `uri:"filename" binding:"required"`
+}
+
+type getChecksumDataOut struct {
+	ETag   string `json:"etag"`
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+type fileExistsDataIn struct {
+	FileName string `uri:"filename" binding:"required"`
+}
+
+type fileExistsDataOut struct {
+	Exists       bool       `json:"exists"`
+	ETag         string     `json:"etag,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+}
+
 type putFileDataIn struct {
 	FileName string `uri:"filename" binding:"required"`
 }
 
+type putFileQueryDataIn struct {
+	SaveConflict bool `form:"saveConflict"`
+}
+
+var CONFLICT_POLICY_HEADER = "X-Conflict-Policy"
+var NOTE_UNCHANGED_HEADER = "X-Note-Unchanged" // the content was the same, so nothing was written
+var IF_CHANGED_HEADER = "X-If-Changed"         // only write when the content differs, whatever the policy
+var IF_UNMODIFIED_SINCE_HEADER = "If-Unmodified-Since"
+
+var (
+	CONFLICT_POLICY_OVERWRITE   = "overwrite"   // last write wins
+	CONFLICT_POLICY_IF_MATCH    = "if-match"    // fails if the note was changed since retrieved
+	CONFLICT_POLICY_CREATE_ONLY = "create-only" // fails if the note already exists
+)
+
+type conflictDataOut struct {
+	ConflictFileName string `json:"conflictFileName"`
+}
+
+// The note that is already there, so the client can decide to overwrite or rename, without fetching it first
+type existingFileDataOut struct {
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"lastModified"`
+}
+
 type postFileDataIn struct {
 	FileName string `uri:"filename" binding:"required"`
 }
 
+type postFileQueryDataIn struct {
+	Unique bool `form:"unique"` // when the file name is taken, save under the unique one instead of the conflict
+}
+
+type postFileDataOut struct {
+	FileName string `json:"fileName"`
+	ETag     string `json:"etag"`
+}
+
 type deleteFileDataIn struct {
 	FileName string `uri:"filename" binding:"required"`
 }
@@ -63,118 +316,1373 @@ type renameFileDataIn struct {
 	NewFileName string `json:"newFileName" binding:"required"`
 }
 
-func handleGetFiles(c *gin.Context, userId string, email string) {
-	prefix := userId + "/"
+type renameAndSaveFileUriDataIn struct {
+	FileName string `uri:"filename" binding:"required"`
+}
+
+type renameAndSaveFileDataIn struct {
+	NewFileName string `json:"newFileName" binding:"required"`
+	Content     string `json:"content"`
+	Title       string `json:"title"` // empty to keep the current one
+}
+
+type getFoldersDataIn struct {
+	Parent string `form:"parent"` // empty for the root
+}
+
+type getFoldersDataOut struct {
+	Folders []string `json:"folders"` // sorted
+}
+
+type setSharingUriDataIn struct {
+	FileName string `uri:"filename" binding:"required"`
+}
+
+type setSharingDataIn struct {
+	Public *bool `json:"public" binding:"required"` // pointer, so false is not taken for missing
+}
+
+type setSharingDataOut struct {
+	Public bool   `json:"public"`
+	Url    string `json:"url,omitempty"` // only when public, absolute when behind the proxy that gives X-Forwarded-Host
+}
+
+type moveFileDataIn struct {
+	FileName   string `json:"fileName" binding:"required"`
+	FromFolder string `json:"fromFolder"` // empty for the root
+	ToFolder   string `json:"toFolder"`   // empty for the root
+}
+
+var BATCH_DELETE_MAX_FILES = 5000
+
+type batchDeleteFilesDataIn struct {
+	FileNames []string `json:"fileNames" binding:"required"`
+}
+
+type batchDeleteFilesDataOut struct {
+	Files []*deleteFileDataOut `json:"files"`
+}
+
+type deleteFileDataOut struct {
+	FileName string `json:"fileName"`
+	Deleted  bool   `json:"deleted"`
+	Error    string `json:"err,omitempty"`
+}
+
+var DELETE_ALL_CONFIRMATION = "DELETE ALL"
+
+type deleteAllFilesDataIn struct {
+	Confirm string `json:"confirm" binding:"required"`
+}
 
+type deleteAllFilesQueryDataIn struct {
+	Permanent bool `form:"permanent"`
+	DryRun    bool `form:"dryRun"`
+}
+
+type dryRunQueryDataIn struct {
+	DryRun bool `form:"dryRun"`
+}
+
+var (
+	DRY_RUN_ACTION_DELETE        = "delete"
+	DRY_RUN_ACTION_MOVE_TO_TRASH = "moveToTrash"
+	DRY_RUN_ACTION_RENAME        = "rename"
+	DRY_RUN_ACTION_MOVE          = "move"
+)
+
+// What the destructive operation would do, returned instead of doing it when called with dryRun=true
+type dryRunDataOut struct {
+	DryRun bool                 `json:"dryRun"` // always true, so the plan can't be mistaken for the result
+	Action string               `json:"action"`
+	Files  []*dryRunFileDataOut `json:"files"`
+	Count  int                  `json:"count"`
+}
+
+type dryRunFileDataOut struct {
+	FileName    string `json:"fileName"`              // including the folder, if any
+	NewFileName string `json:"newFileName,omitempty"` // including the folder, if any, when renamed or moved
+}
+
+var (
+	TRASH_PAGE_SIZE_DEFAULT int = 20 // every file requires an additional call to read the metadata
+	TRASH_PAGE_SIZE_MAX     int = 100
+)
+
+type getTrashedFilesDataOut struct {
+	Files                 []*trashedFileDataOut `json:"files"`
+	HasMore               bool                  `json:"hasMore"`
+	NextContinuationToken string                `json:"nextContinuationToken"`
+}
+
+type trashedFileDataOut struct {
+	FileName         string    `json:"fileName"`
+	OriginalFileName string    `json:"originalFileName"`
+	DeletedAt        time.Time `json:"deletedAt"`
+	ETag             string    `json:"etag"`
+}
+
+type emptyTrashDataOut struct {
+	Deleted int `json:"deleted"`
+	Failed  int `json:"failed"`
+}
+
+// The page comes with a weak ETag, and with If-None-Match matching it, the response is 304,
+// so the clients polling for changes don't download the same page again and again.
+//
+// With withPreview=N, every file comes with the preview made of the first N bytes of the content.
+// This takes an additional S3 call per file, so it makes the listing noticeably slower.
+// Same goes for withMetadata=true, which adds the title and the creation time of every note, when set.
+func handleGetFiles(c *gin.Context, userId string, email string) {
 	// get params from query string
 	var getFilesIn getFilesDataIn
 	if err := c.ShouldBindQuery(&getFilesIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get params from headers
+	ifNoneMatch := c.GetHeader("If-None-Match")
+
+	// sanitize
+	if !isFolderValid(getFilesIn.Folder) {
+		err := fmt.Errorf("invalid folder '%s', check the requirements", getFilesIn.Folder)
+		toBadRequest(c, err)
+		return
+	}
+	prefix := getFolderPrefix(c, userId, getFilesIn.Folder)
+	if !isPageSizeValid(getFilesIn.PageSize) {
+		err := fmt.Errorf("invalid pageSize '%d', should be between 0 and %d", getFilesIn.PageSize, PAGE_SIZE_MAX)
+		toBadRequest(c, err)
+		return
+	}
+	pageSize := getPageSizeOrDefault(getFilesIn.PageSize)
+	if getFilesIn.WithPreview < 0 || getFilesIn.WithPreview > PREVIEW_MAX_LENGTH {
+		err := fmt.Errorf("invalid withPreview '%d', should be between 0 and %d", getFilesIn.WithPreview, PREVIEW_MAX_LENGTH)
+		toBadRequest(c, err)
+		return
+	}
+	if !isContinuationTokenValid(getFilesIn.ContinuationToken) {
+		err := fmt.Errorf("invalid continuationToken '%s', should be less or equal than %d chars long", getFilesIn.ContinuationToken, getMaxContinuationTokenLength())
+		toBadRequest(c, err)
+		return
+	}
+	continuationToken, err := verifyContinuationToken(getFilesIn.ContinuationToken, prefix, time.Now())
+	if err != nil {
+		toContinuationTokenError(c, err)
+		return
+	}
+	// the previews, metadata, pins and the count come from S3 directly
+	if !isS3Storage() && (getFilesIn.WithPreview > 0 || getFilesIn.WithMetadata || getFilesIn.WithPinned || getFilesIn.WithCount) {
+		toNotSupportedByStorage(c)
+		return
+	}
+
+	// get files
+	result, err := getStorage().ListFiles(c.Request.Context(), getBucket(), prefix, pageSize, continuationToken)
+	if err != nil {
+		if errors.Is(err, ErrInvalidArgument) {
+			toBadRequest(c, err)
+			return
+		}
+
+		toInternalServerError(c, err.Error())
+		return
+	}
+
+	// pack result
+	files := make([]*FileDataOut, 0, len(result.Files))
+	for _, file := range result.Files {
+		if isFileNameValid(file.FileName) {
+			files = append(files, &FileDataOut{
+				FileName:     file.FileName,
+				LastModified: file.LastModified,
+				ETag:         file.ETag,
+				Size:         file.Size,
+				ContentType:  getContentType(file.FileName),
+			})
+		}
+	}
+	if getFilesIn.WithPreview > 0 {
+		fileNames := make([]string, 0, len(files))
+		for _, file := range files {
+			fileNames = append(fileNames, file.FileName)
+		}
+		previews := getFilePreviews(c.Request.Context(), getBucket(), prefix, fileNames, getFilesIn.WithPreview)
+		for i, file := range files {
+			file.Preview = previews[i]
+		}
+	}
+	if getFilesIn.WithMetadata {
+		fileNames := make([]string, 0, len(files))
+		for _, file := range files {
+			fileNames = append(fileNames, file.FileName)
+		}
+		metas := getNoteMetadatas(c.Request.Context(), getBucket(), prefix, fileNames)
+		for i, file := range files {
+			file.Title = metas[i].Title
+			if !metas[i].Created.IsZero() {
+				file.Created = &metas[i].Created
+			}
+		}
+	}
+	if getFilesIn.WithPinned {
+		fileNames := make([]string, 0, len(files))
+		for _, file := range files {
+			fileNames = append(fileNames, file.FileName)
+		}
+		pinned := getFilesPinned(c.Request.Context(), getBucket(), prefix, fileNames)
+		for i, file := range files {
+			file.Pinned = &pinned[i]
+		}
+	}
+	getFilesDataOut := &getFilesDataOut{
+		Files:                 files,
+		HasMore:               result.HasMore,
+		NextContinuationToken: signContinuationToken(result.NextContinuationToken, prefix, time.Now()),
+	}
+	if getFilesIn.WithCount {
+		totalCount, err := getFileCount(c.Request.Context(), getBucket(), prefix)
+		if err != nil {
+			toInternalServerError(c, err.Error())
+			return
+		}
+		getFilesDataOut.TotalCount = &totalCount
+	}
+	etag := getListingEtag(continuationToken, result.NextContinuationToken, getFilesDataOut, isPrettyJson(c))
+
+	// create response
+	if isEtagMatching(ifNoneMatch, etag) {
+		toNotModified(c, etag)
+		return
+	}
+	c.Header("ETag", etag)
+	toSuccess(c, getFilesDataOut)
+}
+
+// Computed from the page contents, field by field, with the files sorted by name, so the same page always gets the same ETag,
+// and it changes when any file does, e.g. its etag or lastModified.
+// The continuation tokens are included, so the different pages never get the same ETag. These are the S3 tokens, not the signed ones,
+// which carry the time they were issued, so the same page gets the same ETag whenever it is requested.
+// The indentation is included as well, so the strong ETag is only shared by the identical responses, up to the time in the signed token.
+func getListingEtag(continuationToken string, nextContinuationToken string, page *getFilesDataOut, pretty bool) string {
+	files := slices.Clone(page.Files)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FileName < files[j].FileName
+	})
+
+	hash := sha256.New()
+	writeField := func(value string) {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+	writeField(continuationToken)
+	writeField(strconv.FormatBool(pretty))
+	for _, file := range files {
+		writeField(file.FileName)
+		writeField(file.ETag)
+		writeField(file.LastModified.UTC().Format(time.RFC3339Nano))
+		writeField(strconv.FormatInt(file.Size, 10))
+		writeField(file.ContentType)
+		writeField(file.Preview)
+		writeField(file.Title)
+		if file.Created != nil {
+			writeField(file.Created.UTC().Format(time.RFC3339Nano))
+		} else {
+			writeField("")
+		}
+		if file.Pinned != nil {
+			writeField(strconv.FormatBool(*file.Pinned)) // the tags don't change the file etag
+		} else {
+			writeField("")
+		}
+	}
+	writeField(strconv.FormatBool(page.HasMore))
+	writeField(nextContinuationToken)
+	if page.TotalCount != nil {
+		writeField(strconv.Itoa(*page.TotalCount))
+	} else {
+		writeField("")
+	}
+
+	etag := "\"" + hex.EncodeToString(hash.Sum(nil)[:16]) + "\""
+	if !LISTING_ETAG_STRONG {
+		return "W/" + etag
+	}
+	return etag
+}
+
+// If-None-Match can list several ETags, and uses the weak comparison, so "W/" is ignored
+func isEtagMatching(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Lists all the files in one go, without the content, so the client can find what has changed since the last sync.
+// S3 pages are fetched one by one until MANIFEST_MAX_FILES is reached.
+// When the client accepts gzip, the response is gzipped, since the manifest of many files can get big.
+func handleGetManifest(c *gin.Context, userId string, email string) {
+	// get params from query string
+	var getManifestIn getManifestDataIn
+	if err := c.ShouldBindQuery(&getManifestIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// sanitize
+	if !isFolderValid(getManifestIn.Folder) {
+		err := fmt.Errorf("invalid folder '%s', check the requirements", getManifestIn.Folder)
 		toBadRequest(c, err)
 		return
 	}
+	prefix := getFolderPrefix(c, userId, getManifestIn.Folder)
+
+	// get files
+	result, err := listAllFiles(c.Request.Context(), getBucket(), prefix, S3_MAX_KEYS, MANIFEST_MAX_FILES)
+	if err != nil {
+		toInternalServerError(c, err.Error())
+		return
+	}
+
+	// pack result
+	files := make([]*manifestFileDataOut, 0, len(result.Files))
+	for _, file := range result.Files {
+		if isFileNameValid(file.FileName) {
+			files = append(files, &manifestFileDataOut{
+				FileName:     file.FileName,
+				ETag:         file.ETag,
+				LastModified: file.LastModified,
+				Size:         file.Size,
+			})
+		}
+	}
+	getManifestDataOut := &getManifestDataOut{
+		Files:   files,
+		HasMore: result.HasMore,
+	}
+
+	// create response
+	if !acceptsGzip(c.Request.Header) {
+		toSuccess(c, getManifestDataOut)
+		return
+	}
+	serialized, err := json.Marshal(gin.H{"data": getManifestDataOut})
+	if err != nil {
+		toInternalServerError(c, err.Error())
+		return
+	}
+	compressed, err := compress(string(serialized))
+	if err != nil {
+		toInternalServerError(c, err.Error())
+		return
+	}
+	c.Header("Content-Encoding", CONTENT_ENCODING_GZIP)
+	c.Header("Vary", "Accept-Encoding")
+	c.Data(http.StatusOK, "application/json; charset=utf-8", compressed)
+}
+
+// Good enough for the clients that simply list gzip, the quality values are not taken into account
+func acceptsGzip(header http.Header) bool {
+	for _, encoding := range strings.Split(header.Get("Accept-Encoding"), ",") {
+		name, _, _ := strings.Cut(encoding, ";")
+		if strings.TrimSpace(name) == CONTENT_ENCODING_GZIP {
+			return true
+		}
+	}
+	return false
+}
+
+// With download=true, the note comes as an attachment, so the browser saves it as a file, instead of showing it.
+// The note metadata, when set, comes in X-Note-Title and X-Note-Created headers.
+func handleGetFile(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+
+	// get params from url
+	var getFileIn getFileDataIn
+	if err := c.ShouldBindUri(&getFileIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get params from query string
+	var getFileQueryIn getFileQueryDataIn
+	if err := c.ShouldBindQuery(&getFileQueryIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get params from headers
+	ifNoneMatch := getIfNoneMatch(c.Request.Header)
+	asJson := isJsonContentAccepted(c)
+	c.Writer.Header().Add("Vary", "Accept") // the caches should keep both
+
+	// sanitize
+	if err := validateFileName(getFileIn.FileName); err != nil {
+		err := fmt.Errorf("invalid fileName '%s', %v", getFileIn.FileName, err)
+		toBadRequest(c, err)
+		return
+	}
+	fileName, err := url.PathUnescape(getFileIn.FileName)
+	if err != nil {
+		err := fmt.Errorf("invalid fileName '%s', could not decode", getFileIn.FileName)
+		toBadRequest(c, err)
+		return
+	}
+	if err := ifNoneMatch.validate(); err != nil {
+		toBadRequest(c, err)
+		return
+	}
+
+	// get file content
+	etag := ifNoneMatch.single()
+	result, err := getFileContentWithFailover(c.Request.Context(), getBucket(), prefix, fileName, etag)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			toNotFound(c)
+			return
+		}
+		if errors.Is(err, ErrNotModified) {
+			setFileCacheHeaders(c, etag)
+			toNotModified(c, etag)
+			return
+		}
+
+		toInternalServerError(c, err.Error())
+		return
+	}
+	if ifNoneMatch.matches(result.ETag) {
+		setFileCacheHeaders(c, result.ETag)
+		toNotModified(c, result.ETag)
+		return
+	}
+
+	setFileCacheHeaders(c, result.ETag)
+	setNoteMetadataHeaders(c, result.Metadata)
+	if getFileQueryIn.Download {
+		c.Header("Content-Disposition", getAttachmentContentDisposition(fileName))
+	}
+	if asJson {
+		toSuccess(c, &getFileDataOut{
+			FileName:     fileName,
+			Content:      result.Content,
+			ETag:         result.ETag,
+			LastModified: result.LastModified,
+		})
+		return
+	}
+	toTextWithEtag(c, result.Content, getContentType(fileName), result.ETag)
+}
+
+// The ETags from If-None-Match, normalized to compare with the ETags from S3, which are always strong
+type ifNoneMatchData struct {
+	etags []string
+	any   bool // "*", matches any ETag
+}
+
+// Parses If-None-Match, also the comma-separated list, or the header sent several times, e.g. by the caching proxy.
+// If-None-Match uses the weak comparison, so W/"abc" matches "abc", the W/ prefix is simply dropped.
+func getIfNoneMatch(header http.Header) *ifNoneMatchData {
+	ifNoneMatch := &ifNoneMatchData{etags: []string{}}
+	for _, value := range header.Values("If-None-Match") {
+		for _, etag := range strings.Split(value, ",") {
+			etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+			if etag == "" {
+				continue
+			}
+			if etag == "*" {
+				ifNoneMatch.any = true
+				continue
+			}
+			ifNoneMatch.etags = append(ifNoneMatch.etags, etag)
+		}
+	}
+	return ifNoneMatch
+}
+
+func (ifNoneMatch *ifNoneMatchData) validate() error {
+	for _, etag := range ifNoneMatch.etags {
+		if !isEtagValid(etag) {
+			return fmt.Errorf("invalid etag '%s', should be less than 100 chars long", etag)
+		}
+	}
+	return nil
+}
+
+// S3 takes a single ETag, so only the single one is sent along, and the rest is compared once the content is retrieved.
+// Returns empty when there is nothing to send.
+func (ifNoneMatch *ifNoneMatchData) single() string {
+	if ifNoneMatch.any || len(ifNoneMatch.etags) != 1 {
+		return ""
+	}
+	return ifNoneMatch.etags[0]
+}
+
+func (ifNoneMatch *ifNoneMatchData) matches(etag string) bool {
+	return ifNoneMatch.any || slices.Contains(ifNoneMatch.etags, etag)
+}
+
+// The raw content by default, the JSON envelope only when asked for, with Accept: application/json
+func isJsonContentAccepted(c *gin.Context) bool {
+	return c.NegotiateFormat(gin.MIMEPlain, gin.MIMEJSON) == gin.MIMEJSON
+}
+
+// Returns the SHA-256 of the note content, for the clients to verify what they have after the sync.
+// The ETag is not enough for that, since it is not the plain MD5 for every upload, e.g. multipart or compressed.
+//
+// With If-None-Match matching the current ETag, gives 304, the checksum the client has is still good.
+func handleGetChecksum(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+
+	// get params from url
+	var getChecksumIn getChecksumDataIn
+	if err := c.ShouldBindUri(&getChecksumIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get params from headers
+	ifNoneMatch := getIfNoneMatch(c.Request.Header)
+
+	// sanitize
+	if err := validateFileName(getChecksumIn.FileName); err != nil {
+		err := fmt.Errorf("invalid fileName '%s', %v", getChecksumIn.FileName, err)
+		toBadRequest(c, err)
+		return
+	}
+	fileName, err := url.PathUnescape(getChecksumIn.FileName)
+	if err != nil {
+		err := fmt.Errorf("invalid fileName '%s', could not decode", getChecksumIn.FileName)
+		toBadRequest(c, err)
+		return
+	}
+	if err := ifNoneMatch.validate(); err != nil {
+		toBadRequest(c, err)
+		return
+	}
+
+	// compute the checksum
+	etag := ifNoneMatch.single()
+	result, err := getFileChecksum(c.Request.Context(), getBucket(), prefix, fileName, etag)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			toNotFound(c)
+			return
+		}
+		if errors.Is(err, ErrNotModified) {
+			toNotModified(c, etag)
+			return
+		}
+
+		toInternalServerError(c, err.Error())
+		return
+	}
+	if ifNoneMatch.matches(result.ETag) {
+		toNotModified(c, result.ETag)
+		return
+	}
+
+	// create response
+	c.Header("ETag", result.ETag)
+	toSuccess(c, &getChecksumDataOut{
+		ETag:   result.ETag,
+		Sha256: result.Sha256,
+		Size:   result.Size,
+	})
+}
+
+// Tells whether the file name is taken, without creating anything.
+// Unlike GET, gives 200 in both cases, with the answer in the body.
+func handleFileExists(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+
+	// get params from url
+	var fileExistsIn fileExistsDataIn
+	if err := c.ShouldBindUri(&fileExistsIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// sanitize
+	if err := validateFileName(fileExistsIn.FileName); err != nil {
+		err := fmt.Errorf("invalid fileName '%s', %v", fileExistsIn.FileName, err)
+		toBadRequest(c, err)
+		return
+	}
+	fileName, err := url.PathUnescape(fileExistsIn.FileName)
+	if err != nil {
+		err := fmt.Errorf("invalid fileName '%s', could not decode", fileExistsIn.FileName)
+		toBadRequest(c, err)
+		return
+	}
+
+	// get file info
+	result, err := getStorage().GetFileInfo(c.Request.Context(), getBucket(), prefix, fileName)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			toSuccess(c, &fileExistsDataOut{
+				Exists: false,
+			})
+			return
+		}
+
+		toInternalServerError(c, err.Error())
+		return
+	}
+
+	// create response
+	toSuccess(c, &fileExistsDataOut{
+		Exists:       true,
+		ETag:         result.ETag,
+		LastModified: &result.LastModified,
+	})
+}
+
+// With If-Match, the content that is exactly the same as the current one is not written again,
+// and the response is 200 with X-Note-Unchanged: true and the current ETag, instead of 204.
+//
+// With If-Unmodified-Since, and no other conditional headers, the note is only overwritten when not modified after that time.
+//
+// The note metadata can be given in X-Note-Title and X-Note-Created headers, otherwise the current one is kept.
+func handlePutFile(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+
+	// get params from url
+	var putFileIn putFileDataIn
+	if err := c.ShouldBindUri(&putFileIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get params from query string
+	var putFileQueryIn putFileQueryDataIn
+	if err := c.ShouldBindQuery(&putFileQueryIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get params from headers
+	policy, etag, err := getConflictPolicy(c.Request.Header)
+	if err != nil {
+		toBadRequest(c, err)
+		return
+	}
+	meta, err := getNoteMetadataFromHeaders(c.Request.Header)
+	if err != nil {
+		toBadRequest(c, err)
+		return
+	}
+	ifChanged, err := getIfChanged(c.Request.Header)
+	if err != nil {
+		toBadRequest(c, err)
+		return
+	}
+	since := getIfUnmodifiedSince(c.Request.Header)
+
+	// read body
+	content, formFileName, err := readBody(c)
+	if err != nil {
+		toBadRequest(c, err)
+		return
+	}
+
+	// sanitize
+	if err := validateFileName(putFileIn.FileName); err != nil {
+		err := fmt.Errorf("invalid fileName '%s', %v", putFileIn.FileName, err)
+		toBadRequest(c, err)
+		return
+	}
+	fileName, err := url.PathUnescape(putFileIn.FileName)
+	if err != nil {
+		err := fmt.Errorf("invalid fileName '%s', could not decode", putFileIn.FileName)
+		toBadRequest(c, err)
+		return
+	}
+	if err := validateKeyLength(prefix, fileName); err != nil {
+		err := fmt.Errorf("invalid fileName '%s', %v", putFileIn.FileName, err)
+		toBadRequest(c, err)
+		return
+	}
+	if formFileName != "" && formFileName != fileName {
+		err := fmt.Errorf("invalid form filename '%s', should be the same as in the url", formFileName)
+		toBadRequest(c, err)
+		return
+	}
+	if !isEtagValid(etag) {
+		err := fmt.Errorf("invalid etag '%s', should be less than 100 chars long", etag)
+		toBadRequest(c, err)
+		return
+	}
+	content, err = sanitizeContent(fileName, content)
+	if err != nil {
+		toBadRequest(c, err)
+		return
+	}
+
+	// the check for the same content and the write go together, not interleaved with another save of the note
+	unlock := lockNote(prefix, fileName)
+	defer unlock()
+
+	// S3 can't check the time on write, so the time turns into the ETag to match
+	if policy == CONFLICT_POLICY_OVERWRITE && !since.IsZero() {
+		etag, err = getEtagIfUnmodifiedSince(c.Request.Context(), getBucket(), prefix, fileName, since)
+		switch {
+		case err == nil:
+			policy = CONFLICT_POLICY_IF_MATCH
+		case errors.Is(err, ErrNotFound):
+			policy = CONFLICT_POLICY_CREATE_ONLY // the note has no time to compare, but the one created meanwhile is newer
+		default:
+			toPutFileError(c, err, prefix, fileName, content, meta, putFileQueryIn.SaveConflict)
+			return
+		}
+	}
+
+	// skip writing the same content again, autosave clients send it all the time
+	if (policy == CONFLICT_POLICY_IF_MATCH || ifChanged) && policy != CONFLICT_POLICY_CREATE_ONLY && meta == nil {
+		isUnchanged := isFileContentUnchanged
+		if ifChanged {
+			isUnchanged = isFileContentUnchangedComparingContent
+		}
+		unchanged, currentEtag, err := isUnchanged(c.Request.Context(), getBucket(), prefix, fileName, content)
+		if err != nil {
+			toInternalServerError(c, err.Error())
+			return
+		}
+		if unchanged {
+			c.Header(NOTE_UNCHANGED_HEADER, "true")
+			c.Header("ETag", currentEtag)
+			c.Status(http.StatusOK)
+			return
+		}
+	}
+
+	// save file content, according to the policy
+	var result *SaveFileContentResult
+	switch policy {
+	case CONFLICT_POLICY_IF_MATCH:
+		result, err = getStorage().UpdateFileContent(c.Request.Context(), getBucket(), prefix, fileName, content, etag, meta)
+	case CONFLICT_POLICY_CREATE_ONLY:
+		result, err = getStorage().SaveFileContent(c.Request.Context(), getBucket(), prefix, fileName, content, false, meta)
+	default:
+		result, err = getStorage().SaveFileContent(c.Request.Context(), getBucket(), prefix, fileName, content, true, meta)
+	}
+	if err != nil {
+		toPutFileError(c, err, prefix, fileName, content, meta, putFileQueryIn.SaveConflict)
+		return
+	}
+
+	action := AUDIT_ACTION_UPDATE
+	if policy == CONFLICT_POLICY_CREATE_ONLY {
+		action = AUDIT_ACTION_CREATE
+	}
+	recordAudit(c, userId, &auditEntry{
+		Action:   action,
+		FileName: fileName,
+		ETag:     result.ETag,
+	})
+
+	toNoContentWithEtag(c, result.ETag)
+}
+
+// Responds to the failed save of the note. When the note was changed by someone else, and saveConflict is requested,
+// the rejected content is kept in the conflict copy, so no edits are lost.
+func toPutFileError(c *gin.Context, err error, prefix string, fileName string, content string, meta *NoteMetadata, saveConflict bool) {
+	if errors.Is(err, ErrNotFound) {
+		toNotFound(c)
+		return
+	}
+	if errors.Is(err, ErrPreconditionFailed) || errors.Is(err, ErrAlreadyExists) {
+		if !saveConflict {
+			toPreconditionFailed(c, ErrPreconditionFailed, nil)
+			return
+		}
+
+		// keep the rejected content, so no edits are lost
+		conflictFileName := getConflictFileName(fileName, time.Now())
+		_, saveErr := getStorage().SaveFileContent(c.Request.Context(), getBucket(), prefix, conflictFileName, content, false, meta)
+		if saveErr != nil {
+			toInternalServerError(c, saveErr.Error())
+			return
+		}
+
+		toPreconditionFailed(c, ErrPreconditionFailed, &conflictDataOut{
+			ConflictFileName: conflictFileName,
+		})
+		return
+	}
+
+	toInternalServerError(c, err.Error())
+}
+
+// Gives the time from If-Unmodified-Since, or zero time when not given.
+// As per RFC 9110, the invalid date is ignored, same as the header when sent together with If-Match.
+func getIfUnmodifiedSince(header http.Header) time.Time {
+	value := header.Get(IF_UNMODIFIED_SINCE_HEADER)
+	if value == "" || header.Get("If-Match") != "" {
+		return time.Time{}
+	}
+	since, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}
+	}
+	return since
+}
+
+// With X-If-Changed: true, the content is compared with the current one even when the ETag can't tell, and the write is skipped when the same.
+// The header is optional, and false when not given.
+func getIfChanged(header http.Header) (bool, error) {
+	value := header.Get(IF_CHANGED_HEADER)
+	if value == "" {
+		return false, nil
+	}
+	ifChanged, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s header '%s', should be 'true' or 'false'", IF_CHANGED_HEADER, value)
+	}
+	return ifChanged, nil
+}
+
+// Decides what to do when the note was changed (or created) by someone else, based on the request headers.
+// The policy can be given explicitly in X-Conflict-Policy, otherwise it follows from the conditional headers:
+// If-Match gives "if-match", If-None-Match: * gives "create-only", and without any, the note is simply overwritten.
+//
+// Returns the policy and the etag to match, when the policy is "if-match".
+func getConflictPolicy(header http.Header) (string, string, error) {
+	etag := header.Get("If-Match")
+	ifNoneMatch := header.Get("If-None-Match")
+	if ifNoneMatch != "" && ifNoneMatch != "*" {
+		return "", "", fmt.Errorf("invalid If-None-Match '%s', only '*' is supported", ifNoneMatch)
+	}
+	if etag != "" && ifNoneMatch != "" {
+		return "", "", fmt.Errorf("invalid headers, If-Match and If-None-Match can't be used together")
+	}
+
+	policy := header.Get(CONFLICT_POLICY_HEADER)
+	switch policy {
+	case "":
+		if etag != "" {
+			return CONFLICT_POLICY_IF_MATCH, etag, nil
+		}
+		if ifNoneMatch != "" {
+			return CONFLICT_POLICY_CREATE_ONLY, "", nil
+		}
+		return CONFLICT_POLICY_OVERWRITE, "", nil
+	case CONFLICT_POLICY_OVERWRITE:
+		if etag != "" || ifNoneMatch != "" {
+			return "", "", fmt.Errorf("invalid headers, policy '%s' can't be used with If-Match or If-None-Match", policy)
+		}
+		return policy, "", nil
+	case CONFLICT_POLICY_IF_MATCH:
+		if etag == "" {
+			return "", "", fmt.Errorf("invalid headers, policy '%s' requires If-Match", policy)
+		}
+		return policy, etag, nil
+	case CONFLICT_POLICY_CREATE_ONLY:
+		if etag != "" {
+			return "", "", fmt.Errorf("invalid headers, policy '%s' can't be used with If-Match", policy)
+		}
+		return policy, "", nil
+	default:
+		return "", "", fmt.Errorf("invalid %s '%s', should be one of '%s', '%s', '%s'",
+			CONFLICT_POLICY_HEADER, policy, CONFLICT_POLICY_OVERWRITE, CONFLICT_POLICY_IF_MATCH, CONFLICT_POLICY_CREATE_ONLY)
+	}
+}
+
+// The conflict copy is put next to the original file, e.g. "my file (conflict 2024-01-31 10-15-30.123).md".
+// The original file name is expected to be valid, and the conflict file name is guaranteed to be valid as well.
+func getConflictFileName(fileName string, now time.Time) string {
+	ext := path.Ext(fileName)
+	base := strings.TrimSuffix(fileName, ext)
+	suffix := " (conflict " + now.UTC().Format("2006-01-02 15-04-05.000") + ")" + ext
+
+	maxBaseLength := max(MAX_FILE_NAME_LENGTH-len(suffix), 0)
+	if len(base) > maxBaseLength {
+		base = strings.ToValidUTF8(base[:maxBaseLength], "")
+	}
+	return base + suffix
+}
+
+// With Idempotency-Key header, the retried request gets the result of the original one,
+// instead of failing with conflict, as long as the original request succeeded within IDEMPOTENCY_KEY_TTL.
+//
+// The conflict with the existing note comes with its etag and lastModified.
+//
+// The note metadata can be given in X-Note-Title and X-Note-Created headers, created defaults to now.
+func handlePostFile(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+
+	// get params from url
+	var postFileIn postFileDataIn
+	if err := c.ShouldBindUri(&postFileIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get params from query string
+	var postFileQueryIn postFileQueryDataIn
+	if err := c.ShouldBindQuery(&postFileQueryIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get params from headers
+	idempotencyKey := c.GetHeader(IDEMPOTENCY_KEY_HEADER)
+	meta, err := getNoteMetadataFromHeaders(c.Request.Header)
+	if err != nil {
+		toBadRequest(c, err)
+		return
+	}
+
+	// read body
+	content, formFileName, err := readBody(c)
+	if err != nil {
+		toBadRequest(c, err)
+		return
+	}
+
+	// sanitize
+	if err := validateFileName(postFileIn.FileName); err != nil {
+		err := fmt.Errorf("invalid fileName '%s', %v", postFileIn.FileName, err)
+		toBadRequest(c, err)
+		return
+	}
+	fileName, err := url.PathUnescape(postFileIn.FileName)
+	if err != nil {
+		err := fmt.Errorf("invalid fileName '%s', could not decode", postFileIn.FileName)
+		toBadRequest(c, err)
+		return
+	}
+	if err := validateKeyLength(prefix, fileName); err != nil {
+		err := fmt.Errorf("invalid fileName '%s', %v", postFileIn.FileName, err)
+		toBadRequest(c, err)
+		return
+	}
+	if formFileName != "" && formFileName != fileName {
+		err := fmt.Errorf("invalid form filename '%s', should be the same as in the url", formFileName)
+		toBadRequest(c, err)
+		return
+	}
+	content, err = sanitizeContent(fileName, content)
+	if err != nil {
+		toBadRequest(c, err)
+		return
+	}
+	if REJECT_EMPTY_CONTENT && content == "" {
+		err := fmt.Errorf("invalid content, should not be empty")
+		toBadRequest(c, err)
+		return
+	}
+	if len(idempotencyKey) > IDEMPOTENCY_KEY_MAX_LENGTH {
+		err := fmt.Errorf("invalid %s, should be less or equal than %d chars long", IDEMPOTENCY_KEY_HEADER, IDEMPOTENCY_KEY_MAX_LENGTH)
+		toBadRequest(c, err)
+		return
+	}
+
+	// replay the result, if the same request was already handled
+	if idempotencyKey != "" {
+		replayed, err := beginIdempotentRequest(prefix, idempotencyKey, fileName)
+		if err != nil {
+			if errors.Is(err, ErrIdempotencyKeyReused) {
+				toJSON(c, http.StatusUnprocessableEntity, gin.H{"err": err.Error()})
+				return
+			}
+
+			toConflict(c, err, nil)
+			return
+		}
+		if replayed != nil {
+			c.Header(IDEMPOTENCY_REPLAYED_HEADER, "true")
+			toCreatedWithEtag(c, &postFileDataOut{
+				FileName: replayed.fileName,
+				ETag:     replayed.etag,
+			}, replayed.etag)
+			return
+		}
+	}
+
+	// not interleaved with another save of the note
+	unlock := lockNote(prefix, fileName)
+	defer unlock()
+
+	// save file content, under the unique file name, if asked
+	savedFileName := fileName
+	var result *SaveFileContentResult
+	if postFileQueryIn.Unique {
+		savedFileName, result, err = saveFileContentUnique(c.Request.Context(), getBucket(), prefix, fileName, content, meta)
+	} else {
+		result, err = getStorage().SaveFileContent(c.Request.Context(), getBucket(), prefix, fileName, content, false, meta)
+	}
+	if idempotencyKey != "" {
+		if err != nil {
+			abandonIdempotentRequest(prefix, idempotencyKey)
+		} else {
+			completeIdempotentRequest(prefix, idempotencyKey, &idempotentResult{
+				fileName: savedFileName,
+				etag:     result.ETag,
+			})
+		}
+	}
+	if err != nil {
+		if errors.Is(err, ErrAlreadyExists) {
+			existing := getExistingFile(c.Request.Context(), prefix, fileName)
+			if existing == nil {
+				toConflict(c, err, nil)
+				return
+			}
+			toConflict(c, err, existing)
+			return
+		}
+
+		toInternalServerError(c, err.Error())
+		return
+	}
+
+	recordAudit(c, userId, &auditEntry{
+		Action:   AUDIT_ACTION_CREATE,
+		FileName: savedFileName,
+		ETag:     result.ETag,
+	})
+
+	toCreatedWithEtag(c, &postFileDataOut{
+		FileName: savedFileName,
+		ETag:     result.ETag,
+	}, result.ETag)
+}
+
+// Returns nil when the note can't be retrieved, e.g. it was deleted right after the conflict,
+// then the conflict is reported without it, same as before
+func getExistingFile(ctx context.Context, prefix string, fileName string) *existingFileDataOut {
+	info, err := getStorage().GetFileInfo(ctx, getBucket(), prefix, fileName)
+	if err != nil {
+		return nil // already logged
+	}
+	return &existingFileDataOut{
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+	}
+}
+
+func handleDeleteFile(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+
+	// get params from url
+	var deleteFileIn deleteFileDataIn
+	if err := c.ShouldBindUri(&deleteFileIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// sanitize
+	if err := validateFileName(deleteFileIn.FileName); err != nil {
+		err := fmt.Errorf("invalid fileName '%s', %v", deleteFileIn.FileName, err)
+		toBadRequest(c, err)
+		return
+	}
+	fileName, err := url.PathUnescape(deleteFileIn.FileName)
+	if err != nil {
+		err := fmt.Errorf("invalid fileName '%s', could not decode", deleteFileIn.FileName)
+		toBadRequest(c, err)
+		return
+	}
+
+	// get params from headers
+	since := getIfUnmodifiedSince(c.Request.Header)
+
+	unlock := lockNote(prefix, fileName)
+	defer unlock()
+
+	// S3 can't check the time on delete, so the time turns into the ETag to match
+	etag := ""
+	if !since.IsZero() {
+		etag, err = getEtagIfUnmodifiedSince(c.Request.Context(), getBucket(), prefix, fileName, since)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				toNoContent(c) // nothing to delete, same as without the header
+				return
+			}
+			if errors.Is(err, ErrPreconditionFailed) {
+				toPreconditionFailed(c, ErrPreconditionFailed, nil)
+				return
+			}
+
+			toInternalServerError(c, err.Error())
+			return
+		}
+	}
+
+	// delete file
+	err = getStorage().DeleteFile(c.Request.Context(), getBucket(), prefix, fileName, etag)
+	if err != nil {
+		if errors.Is(err, ErrPreconditionFailed) {
+			toPreconditionFailed(c, ErrPreconditionFailed, nil)
+			return
+		}
+
+		toInternalServerError(c, err.Error())
+		return
+	}
+
+	recordAudit(c, userId, &auditEntry{
+		Action:   AUDIT_ACTION_DELETE,
+		FileName: fileName,
+	})
+
+	toNoContent(c)
+}
+
+func handleBatchDeleteFiles(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+
+	// get params from query string
+	var dryRunIn dryRunQueryDataIn
+	if err := c.ShouldBindQuery(&dryRunIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get app data from the POST body
+	var batchDeleteFilesIn batchDeleteFilesDataIn
+	if err := c.ShouldBindJSON(&batchDeleteFilesIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// sanitize
+	if len(batchDeleteFilesIn.FileNames) > BATCH_DELETE_MAX_FILES {
+		err := fmt.Errorf("too many fileNames, should be less or equal than %d", BATCH_DELETE_MAX_FILES)
+		toBadRequest(c, err)
+		return
+	}
+	fileNames := make([]string, 0, len(batchDeleteFilesIn.FileNames))
+	for _, fileNameIn := range batchDeleteFilesIn.FileNames {
+		if err := validateFileName(fileNameIn); err != nil {
+			err := fmt.Errorf("invalid fileName '%s', %v", fileNameIn, err)
+			toBadRequest(c, err)
+			return
+		}
+		fileName, err := url.PathUnescape(fileNameIn)
+		if err != nil {
+			err := fmt.Errorf("invalid fileName '%s', could not decode", fileNameIn)
+			toBadRequest(c, err)
+			return
+		}
+		fileNames = append(fileNames, fileName)
+	}
+
+	// only report the files that would be deleted, the ones that don't exist are skipped
+	if dryRunIn.DryRun {
+		exist, err := checkFilesExist(c.Request.Context(), getBucket(), prefix, fileNames)
+		if err != nil {
+			toInternalServerError(c, err.Error())
+			return
+		}
+
+		files := make([]*dryRunFileDataOut, 0, len(fileNames))
+		for i, fileName := range fileNames {
+			if exist[i] {
+				files = append(files, &dryRunFileDataOut{FileName: fileName})
+			}
+		}
+		toDryRun(c, DRY_RUN_ACTION_DELETE, files)
+		return
+	}
+
+	// delete the files
+	results, err := deleteFiles(c.Request.Context(), getBucket(), prefix, fileNames)
+	if err != nil {
+		toInternalServerError(c, err.Error())
+		return
+	}
+
+	// pack result
+	files := make([]*deleteFileDataOut, 0, len(results))
+	for _, result := range results {
+		files = append(files, &deleteFileDataOut{
+			FileName: result.FileName,
+			Deleted:  result.Deleted,
+			Error:    result.Error,
+		})
+		if result.Deleted {
+			recordAudit(c, userId, &auditEntry{
+				Action:   AUDIT_ACTION_DELETE,
+				FileName: result.FileName,
+			})
+		}
+	}
+
+	toSuccess(c, &batchDeleteFilesDataOut{Files: files})
+}
+
+func handleRenameFile(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+
+	// get params from query string
+	var dryRunIn dryRunQueryDataIn
+	if err := c.ShouldBindQuery(&dryRunIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get app data from the POST body
+	var renameFileIn renameFileDataIn
+	if err := c.ShouldBindJSON(&renameFileIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
 
 	// sanitize
-	pageSize := getFilesIn.PageSize
-	if !isPageSizeValid(getFilesIn.PageSize) {
-		err := fmt.Errorf("invalid pageSize '%d', should be less or equal than 1000", pageSize)
+	if err := validateFileName(renameFileIn.FileName); err != nil {
+		err := fmt.Errorf("invalid fileName '%s', %v", renameFileIn.FileName, err)
 		toBadRequest(c, err)
 		return
 	}
-	if pageSize == 0 {
-		pageSize = PAGE_SIZE_DEFAULT
+	fileName, err := url.PathUnescape(renameFileIn.FileName)
+	if err != nil {
+		err := fmt.Errorf("invalid fileName '%s', could not decode", renameFileIn.FileName)
+		toBadRequest(c, err)
+		return
 	}
-	if !isContinuationTokenValid(getFilesIn.ContinuationToken) {
-		err := fmt.Errorf("invalid continuationToken '%s', should be less than 1000 chars long", getFilesIn.ContinuationToken)
+	if err := validateFileName(renameFileIn.NewFileName); err != nil {
+		err := fmt.Errorf("invalid new fileName '%s', %v", renameFileIn.NewFileName, err)
 		toBadRequest(c, err)
 		return
 	}
-	// In theory, we should use QueryUnescape, but it unescapes '+' to ' ' (space).
-	// PathUnescape is identical to QueryUnescape except that it does not unescape '+' to ' ' (space).
-	continuationToken, err := url.PathUnescape(getFilesIn.ContinuationToken)
+	newFileName, err := url.PathUnescape(renameFileIn.NewFileName)
 	if err != nil {
-		err := fmt.Errorf("invalid continuationToken '%s'", getFilesIn.ContinuationToken)
+		err := fmt.Errorf("invalid new fileName '%s', could not decode", renameFileIn.NewFileName)
+		toBadRequest(c, err)
+		return
+	}
+	if err := validateKeyLength(prefix, newFileName); err != nil {
+		err := fmt.Errorf("invalid new fileName '%s', %v", renameFileIn.NewFileName, err)
 		toBadRequest(c, err)
 		return
 	}
 
-	// get files
-	result, err := listFiles(_bucket, prefix, pageSize, continuationToken)
-	if err != nil {
-		if errors.Is(err, ErrInvalidArgument) {
-			toBadRequest(c, err)
+	// only check the file can be renamed
+	if dryRunIn.DryRun {
+		err := checkFileCanBeMoved(c.Request.Context(), getBucket(), prefix, fileName, prefix, newFileName)
+		if err != nil {
+			toMoveError(c, err)
 			return
 		}
 
-		toInternalServerError(c, err.Error())
+		toDryRun(c, DRY_RUN_ACTION_RENAME, []*dryRunFileDataOut{{
+			FileName:    fileName,
+			NewFileName: newFileName,
+		}})
 		return
 	}
 
-	// pack result
-	files := make([]*FileDataOut, 0, len(result.Files))
-	for _, file := range result.Files {
-		if isFileNameValid(file.FileName) {
-			files = append(files, &FileDataOut{
-				FileName:     file.FileName,
-				LastModified: file.LastModified,
-				ETag:         file.ETag,
-			})
+	// rename the file
+	result, err := getStorage().RenameFile(c.Request.Context(), getBucket(), prefix, fileName, newFileName)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			toNotFound(c)
+			return
 		}
-	}
-	getFilesDataOut := &getFilesDataOut{
-		Files:   files,
-		HasMore: result.HasMore,
-		// Since the continuation token comes in the query param, we use QueryEscape
-		NextContinuationToken: url.QueryEscape(result.NextContinuationToken),
+		if errors.Is(err, ErrAlreadyExists) {
+			toConflict(c, err, nil)
+			return
+		}
+
+		toInternalServerError(c, err.Error())
+		return
 	}
 
-	// create response
-	toSuccess(c, getFilesDataOut)
+	recordAudit(c, userId, &auditEntry{
+		Action:      AUDIT_ACTION_RENAME,
+		FileName:    fileName,
+		NewFileName: newFileName,
+		ETag:        result.ETag,
+	})
+
+	toNoContentWithEtag(c, result.ETag)
 }
 
-func handleGetFile(c *gin.Context, userId string, email string) {
-	prefix := userId + "/"
+func handleRenameAndSaveFile(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
 
 	// get params from url
-	var getFileIn getFileDataIn
-	if err := c.ShouldBindUri(&getFileIn); err != nil {
-		toBadRequest(c, err)
+	var renameAndSaveFileUriIn renameAndSaveFileUriDataIn
+	if err := c.ShouldBindUri(&renameAndSaveFileUriIn); err != nil {
+		toBindingError(c, err)
 		return
 	}
 
-	// get params from headers
-	etag := ""
-	ifNoneMatch := c.Request.Header["If-None-Match"]
-	if len(ifNoneMatch) > 0 {
-		etag = ifNoneMatch[0]
+	// get app data from the POST body
+	var renameAndSaveFileIn renameAndSaveFileDataIn
+	if err := c.ShouldBindBodyWith(&renameAndSaveFileIn, binding.JSON); err != nil {
+		toBindingError(c, err)
+		return
 	}
 
 	// sanitize
-	if !isFileNameValid(getFileIn.FileName) {
-		err := fmt.Errorf("invalid fileName '%s', check the requirements", getFileIn.FileName)
+	if err := validateFileName(renameAndSaveFileUriIn.FileName); err != nil {
+		err := fmt.Errorf("invalid fileName '%s', %v", renameAndSaveFileUriIn.FileName, err)
 		toBadRequest(c, err)
 		return
 	}
-	fileName, err := url.PathUnescape(getFileIn.FileName)
+	fileName, err := url.PathUnescape(renameAndSaveFileUriIn.FileName)
 	if err != nil {
-		err := fmt.Errorf("invalid fileName '%s', could not decode", getFileIn.FileName)
+		err := fmt.Errorf("invalid fileName '%s', could not decode", renameAndSaveFileUriIn.FileName)
 		toBadRequest(c, err)
 		return
 	}
-	if !isEtagValid(etag) {
-		err := fmt.Errorf("invalid etag '%s', should be less than 100 chars long", etag)
+	if err := validateFileName(renameAndSaveFileIn.NewFileName); err != nil {
+		err := fmt.Errorf("invalid new fileName '%s', %v", renameAndSaveFileIn.NewFileName, err)
+		toBadRequest(c, err)
+		return
+	}
+	newFileName, err := url.PathUnescape(renameAndSaveFileIn.NewFileName)
+	if err != nil {
+		err := fmt.Errorf("invalid new fileName '%s', could not decode", renameAndSaveFileIn.NewFileName)
+		toBadRequest(c, err)
+		return
+	}
+	if err := validateKeyLength(prefix, newFileName); err != nil {
+		err := fmt.Errorf("invalid new fileName '%s', %v", renameAndSaveFileIn.NewFileName, err)
+		toBadRequest(c, err)
+		return
+	}
+	// the JSON decoder quietly replaces the invalid bytes with U+FFFD, so check the body as sent
+	if VALIDATE_UTF8 && !utf8.Valid(c.MustGet(gin.BodyBytesKey).([]byte)) {
+		err := fmt.Errorf("invalid content, should be valid UTF-8")
+		toBadRequest(c, err)
+		return
+	}
+	content, err := sanitizeContent(newFileName, renameAndSaveFileIn.Content)
+	if err != nil {
+		toBadRequest(c, err)
+		return
+	}
+	if !isTitleValid(renameAndSaveFileIn.Title) {
+		err := fmt.Errorf("invalid title, should be less or equal than %d bytes long", MAX_TITLE_LENGTH)
 		toBadRequest(c, err)
 		return
 	}
+	meta := &NoteMetadata{Title: renameAndSaveFileIn.Title}
 
-	// get file content
-	result, err := getFileContent(_bucket, prefix, fileName, etag)
+	// not interleaved with another save of either note
+	unlock := lockNotes(prefix, fileName, newFileName)
+	defer unlock()
+
+	// rename the file, replacing the content
+	result, err := renameAndSaveFile(c.Request.Context(), getBucket(), prefix, fileName, newFileName, content, meta)
 	if err != nil {
 		if errors.Is(err, ErrNotFound) {
 			toNotFound(c)
 			return
 		}
-		if errors.Is(err, ErrNotModified) {
-			toNotModified(c)
+		if errors.Is(err, ErrAlreadyExists) {
+			toConflict(c, err, nil)
 			return
 		}
 
@@ -182,87 +1690,208 @@ func handleGetFile(c *gin.Context, userId string, email string) {
 		return
 	}
 
-	// technically speaking, this should be "text/markdown; charset=UTF-8" for markdown files
-	toPlainTextWithEtag(c, result.Content, result.ETag)
+	recordAudit(c, userId, &auditEntry{
+		Action:      AUDIT_ACTION_RENAME,
+		FileName:    fileName,
+		NewFileName: newFileName,
+		ETag:        result.ETag,
+	})
+
+	toNoContentWithEtag(c, result.ETag)
 }
 
-func handlePutFile(c *gin.Context, userId string, email string) {
-	prefix := userId + "/"
+func handleSetSharing(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
 
 	// get params from url
-	var putFileIn putFileDataIn
-	if err := c.ShouldBindUri(&putFileIn); err != nil {
-		toBadRequest(c, err)
+	var setSharingUriIn setSharingUriDataIn
+	if err := c.ShouldBindUri(&setSharingUriIn); err != nil {
+		toBindingError(c, err)
 		return
 	}
 
-	// read body
-	content := readBody(c)
+	// get app data from the PUT body
+	var setSharingIn setSharingDataIn
+	if err := c.ShouldBindJSON(&setSharingIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
 
 	// sanitize
-	if !isFileNameValid(putFileIn.FileName) {
-		err := fmt.Errorf("invalid fileName '%s', check the requirements", putFileIn.FileName)
+	if err := validateFileName(setSharingUriIn.FileName); err != nil {
+		err := fmt.Errorf("invalid fileName '%s', %v", setSharingUriIn.FileName, err)
 		toBadRequest(c, err)
 		return
 	}
-	fileName, err := url.PathUnescape(putFileIn.FileName)
+	fileName, err := url.PathUnescape(setSharingUriIn.FileName)
 	if err != nil {
-		err := fmt.Errorf("invalid fileName '%s', could not decode", putFileIn.FileName)
+		err := fmt.Errorf("invalid fileName '%s', could not decode", setSharingUriIn.FileName)
 		toBadRequest(c, err)
 		return
 	}
-	if !isContentValid(content) {
-		err := fmt.Errorf("invalid content, should be less or equal than 100KB")
+	public := *setSharingIn.Public
+
+	// share or stop sharing
+	err = setFilePublic(c.Request.Context(), getBucket(), prefix, fileName, public)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			toNotFound(c)
+			return
+		}
+
+		toInternalServerError(c, err.Error())
+		return
+	}
+
+	// pack result
+	setSharingDataOut := &setSharingDataOut{
+		Public: public,
+	}
+	if public {
+		setSharingDataOut.Url = getPublicFileUrl(c.Request.Header, c.GetString(TENANT_ID_KEY), userId, fileName)
+	}
+
+	// create response
+	toSuccess(c, setSharingDataOut)
+}
+
+// The link includes the base path, and is absolute when the proxy tells where the service is reachable from,
+// otherwise it is relative to the host, since the service can't know its own address.
+// The tenant, if any, goes to the query string, so the links of the users without the tenant stay the same.
+func getPublicFileUrl(header http.Header, tenantId string, userId string, fileName string) string {
+	path := BASE_PATH + "/public/" + url.PathEscape(userId) + "/" + url.PathEscape(fileName)
+	if tenantId != "" {
+		path += "?tenant=" + url.QueryEscape(tenantId)
+	}
+
+	// with several proxies in a row, the first one is the closest to the client
+	host, _, _ := strings.Cut(header.Get("X-Forwarded-Host"), ",")
+	host = strings.TrimSpace(host)
+	if host == "" {
+		return path
+	}
+	proto, _, _ := strings.Cut(header.Get("X-Forwarded-Proto"), ",")
+	proto = strings.TrimSpace(proto)
+	if proto != "http" && proto != "https" {
+		proto = "https"
+	}
+	return proto + "://" + host + path
+}
+
+func handleListFolders(c *gin.Context, userId string, email string) {
+	// get params from query string
+	var getFoldersIn getFoldersDataIn
+	if err := c.ShouldBindQuery(&getFoldersIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// sanitize
+	if !isFolderValid(getFoldersIn.Parent) {
+		err := fmt.Errorf("invalid parent '%s', check the requirements", getFoldersIn.Parent)
 		toBadRequest(c, err)
 		return
 	}
+	prefix := getFolderPrefix(c, userId, getFoldersIn.Parent)
 
-	// save file content
-	result, err := saveFileContent(_bucket, prefix, fileName, content, true)
+	// get folders
+	result, err := listFolders(c.Request.Context(), getBucket(), prefix)
 	if err != nil {
 		toInternalServerError(c, err.Error())
 		return
 	}
 
-	toNoContentWithEtag(c, result.ETag)
-}
+	// pack result
+	folders := make([]string, 0, len(result))
+	for _, folder := range result {
+		// also skips the trash and whatever can't be used as a folder
+		if folder != "" && isFolderValid(getSubfolder(getFoldersIn.Parent, folder)) {
+			folders = append(folders, folder)
+		}
+	}
+	sort.Strings(folders)
 
-func handlePostFile(c *gin.Context, userId string, email string) {
-	prefix := userId + "/"
+	// create response
+	toSuccess(c, &getFoldersDataOut{
+		Folders: folders,
+	})
+}
 
-	// get params from url
-	var postFileIn postFileDataIn
-	if err := c.ShouldBindUri(&postFileIn); err != nil {
-		toBadRequest(c, err)
+func handleMoveFile(c *gin.Context, userId string, email string) {
+	// get params from query string
+	var dryRunIn dryRunQueryDataIn
+	if err := c.ShouldBindQuery(&dryRunIn); err != nil {
+		toBindingError(c, err)
 		return
 	}
 
-	// read body
-	content := readBody(c)
+	// get app data from the POST body
+	var moveFileIn moveFileDataIn
+	if err := c.ShouldBindJSON(&moveFileIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
 
 	// sanitize
-	if !isFileNameValid(postFileIn.FileName) {
-		err := fmt.Errorf("invalid fileName '%s', check the requirements", postFileIn.FileName)
+	if err := validateFileName(moveFileIn.FileName); err != nil {
+		err := fmt.Errorf("invalid fileName '%s', %v", moveFileIn.FileName, err)
 		toBadRequest(c, err)
 		return
 	}
-	fileName, err := url.PathUnescape(postFileIn.FileName)
+	fileName, err := url.PathUnescape(moveFileIn.FileName)
 	if err != nil {
-		err := fmt.Errorf("invalid fileName '%s', could not decode", postFileIn.FileName)
+		err := fmt.Errorf("invalid fileName '%s', could not decode", moveFileIn.FileName)
+		toBadRequest(c, err)
+		return
+	}
+	if !isFolderValid(moveFileIn.FromFolder) {
+		err := fmt.Errorf("invalid fromFolder '%s', check the requirements", moveFileIn.FromFolder)
 		toBadRequest(c, err)
 		return
 	}
-	if !isContentValid(content) {
-		err := fmt.Errorf("invalid content, should be less or equal than 100KB")
+	if !isFolderValid(moveFileIn.ToFolder) {
+		err := fmt.Errorf("invalid toFolder '%s', check the requirements", moveFileIn.ToFolder)
 		toBadRequest(c, err)
 		return
 	}
+	if moveFileIn.FromFolder == moveFileIn.ToFolder {
+		err := fmt.Errorf("invalid toFolder '%s', should be different from fromFolder", moveFileIn.ToFolder)
+		toBadRequest(c, err)
+		return
+	}
+
+	fromPrefix := getFolderPrefix(c, userId, moveFileIn.FromFolder)
+	toPrefix := getFolderPrefix(c, userId, moveFileIn.ToFolder)
+	if err := validateKeyLength(toPrefix, fileName); err != nil {
+		err := fmt.Errorf("invalid toFolder '%s' for fileName '%s', %v", moveFileIn.ToFolder, moveFileIn.FileName, err)
+		toBadRequest(c, err)
+		return
+	}
+
+	// only check the file can be moved
+	if dryRunIn.DryRun {
+		err := checkFileCanBeMoved(c.Request.Context(), getBucket(), fromPrefix, fileName, toPrefix, fileName)
+		if err != nil {
+			toMoveError(c, err)
+			return
+		}
+
+		toDryRun(c, DRY_RUN_ACTION_MOVE, []*dryRunFileDataOut{{
+			FileName:    getSubfolder(moveFileIn.FromFolder, fileName),
+			NewFileName: getSubfolder(moveFileIn.ToFolder, fileName),
+		}})
+		return
+	}
 
-	// save file content
-	result, err := saveFileContent(_bucket, prefix, fileName, content, false)
+	// move the file
+	result, err := moveFile(c.Request.Context(), getBucket(), fromPrefix, toPrefix, fileName)
 	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			toNotFound(c)
+			return
+		}
 		if errors.Is(err, ErrAlreadyExists) {
-			toConflict(c, err)
+			toConflict(c, err, nil)
 			return
 		}
 
@@ -270,34 +1899,75 @@ func handlePostFile(c *gin.Context, userId string, email string) {
 		return
 	}
 
+	recordAudit(c, userId, &auditEntry{
+		Action:      AUDIT_ACTION_MOVE,
+		FileName:    getSubfolder(moveFileIn.FromFolder, fileName),
+		NewFileName: getSubfolder(moveFileIn.ToFolder, fileName),
+		ETag:        result.ETag,
+	})
+
 	toNoContentWithEtag(c, result.ETag)
 }
 
-func handleDeleteFile(c *gin.Context, userId string, email string) {
-	prefix := userId + "/"
+// By default, moves all the files into the trash, so the user can still recover them.
+// With permanent=true, deletes all the files permanently, including the ones in the trash.
+// With dryRun=true, only lists the files that would be affected.
+func handleDeleteAllFiles(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
 
-	// get params from url
-	var deleteFileIn deleteFileDataIn
-	if err := c.ShouldBindUri(&deleteFileIn); err != nil {
-		toBadRequest(c, err)
+	// get params from query string
+	var deleteAllFilesQueryIn deleteAllFilesQueryDataIn
+	if err := c.ShouldBindQuery(&deleteAllFilesQueryIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get app data from the POST body
+	var deleteAllFilesIn deleteAllFilesDataIn
+	if err := c.ShouldBindJSON(&deleteAllFilesIn); err != nil {
+		toBindingError(c, err)
 		return
 	}
 
 	// sanitize
-	if !isFileNameValid(deleteFileIn.FileName) {
-		err := fmt.Errorf("invalid fileName '%s', check the requirements", deleteFileIn.FileName)
+	// this affects all the files, so make sure the client really means it
+	if deleteAllFilesIn.Confirm != DELETE_ALL_CONFIRMATION {
+		err := fmt.Errorf("invalid confirm '%s', should be '%s'", deleteAllFilesIn.Confirm, DELETE_ALL_CONFIRMATION)
 		toBadRequest(c, err)
 		return
 	}
-	fileName, err := url.PathUnescape(deleteFileIn.FileName)
-	if err != nil {
-		err := fmt.Errorf("invalid fileName '%s', could not decode", deleteFileIn.FileName)
-		toBadRequest(c, err)
+	// only the permanent delete goes through the storage, the trash and the dry run listing are in S3
+	if !isS3Storage() && (!deleteAllFilesQueryIn.Permanent || deleteAllFilesQueryIn.DryRun) {
+		toNotSupportedByStorage(c)
 		return
 	}
 
-	// get file content
-	err = deleteFile(_bucket, prefix, fileName)
+	// only report the files that would be affected
+	if deleteAllFilesQueryIn.DryRun {
+		fileNames, err := listAllFileNames(c.Request.Context(), getBucket(), prefix, deleteAllFilesQueryIn.Permanent)
+		if err != nil {
+			toInternalServerError(c, err.Error())
+			return
+		}
+
+		action := DRY_RUN_ACTION_MOVE_TO_TRASH
+		if deleteAllFilesQueryIn.Permanent {
+			action = DRY_RUN_ACTION_DELETE
+		}
+		files := make([]*dryRunFileDataOut, 0, len(fileNames))
+		for _, fileName := range fileNames {
+			files = append(files, &dryRunFileDataOut{FileName: fileName})
+		}
+		toDryRun(c, action, files)
+		return
+	}
+
+	var err error
+	if deleteAllFilesQueryIn.Permanent {
+		err = getStorage().DeleteAllFiles(c.Request.Context(), getBucket(), prefix)
+	} else {
+		err = moveAllFilesToTrash(c.Request.Context(), getBucket(), prefix)
+	}
 	if err != nil {
 		toInternalServerError(c, err.Error())
 		return
@@ -306,49 +1976,42 @@ func handleDeleteFile(c *gin.Context, userId string, email string) {
 	toNoContent(c)
 }
 
-func handleRenameFile(c *gin.Context, userId string, email string) {
-	prefix := userId + "/"
+func handleListTrash(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
 
-	// get app data from the POST body
-	var renameFileIn renameFileDataIn
-	if err := c.ShouldBindJSON(&renameFileIn); err != nil {
-		toBadRequest(c, err)
+	// get params from query string
+	var getFilesIn getFilesDataIn
+	if err := c.ShouldBindQuery(&getFilesIn); err != nil {
+		toBindingError(c, err)
 		return
 	}
 
 	// sanitize
-	if !isFileNameValid(renameFileIn.FileName) {
-		err := fmt.Errorf("invalid fileName '%s', check the requirements", renameFileIn.FileName)
+	pageSize := getFilesIn.PageSize
+	if pageSize < 0 || pageSize > TRASH_PAGE_SIZE_MAX {
+		err := fmt.Errorf("invalid pageSize '%d', should be between 0 and %d", pageSize, TRASH_PAGE_SIZE_MAX)
 		toBadRequest(c, err)
 		return
 	}
-	fileName, err := url.PathUnescape(renameFileIn.FileName)
-	if err != nil {
-		err := fmt.Errorf("invalid fileName '%s', could not decode", renameFileIn.FileName)
-		toBadRequest(c, err)
-		return
+	if pageSize == 0 {
+		pageSize = TRASH_PAGE_SIZE_DEFAULT
 	}
-	if !isFileNameValid(renameFileIn.NewFileName) {
-		err := fmt.Errorf("invalid new fileName '%s', check the requirements", renameFileIn.NewFileName)
+	if !isContinuationTokenValid(getFilesIn.ContinuationToken) {
+		err := fmt.Errorf("invalid continuationToken '%s', should be less or equal than %d chars long", getFilesIn.ContinuationToken, getMaxContinuationTokenLength())
 		toBadRequest(c, err)
 		return
 	}
-	newFileName, err := url.PathUnescape(renameFileIn.NewFileName)
+	continuationToken, err := verifyContinuationToken(getFilesIn.ContinuationToken, prefix, time.Now())
 	if err != nil {
-		err := fmt.Errorf("invalid new fileName '%s', could not decode", renameFileIn.NewFileName)
-		toBadRequest(c, err)
+		toContinuationTokenError(c, err)
 		return
 	}
 
-	// rename the file
-	result, err := renameFile(_bucket, prefix, fileName, newFileName)
+	// get files
+	result, err := listTrashedFiles(c.Request.Context(), getBucket(), prefix, pageSize, continuationToken)
 	if err != nil {
-		if errors.Is(err, ErrNotFound) {
-			toNotFound(c)
-			return
-		}
-		if errors.Is(err, ErrAlreadyExists) {
-			toConflict(c, err)
+		if errors.Is(err, ErrInvalidArgument) {
+			toBadRequest(c, err)
 			return
 		}
 
@@ -356,23 +2019,138 @@ func handleRenameFile(c *gin.Context, userId string, email string) {
 		return
 	}
 
-	toNoContentWithEtag(c, result.ETag)
+	// pack result
+	files := make([]*trashedFileDataOut, 0, len(result.Files))
+	for _, file := range result.Files {
+		files = append(files, &trashedFileDataOut{
+			FileName:         file.FileName,
+			OriginalFileName: file.OriginalFileName,
+			DeletedAt:        file.DeletedAt,
+			ETag:             file.ETag,
+		})
+	}
+	getTrashedFilesDataOut := &getTrashedFilesDataOut{
+		Files:                 files,
+		HasMore:               result.HasMore,
+		NextContinuationToken: signContinuationToken(result.NextContinuationToken, prefix, time.Now()),
+	}
+
+	// create response
+	toSuccess(c, getTrashedFilesDataOut)
 }
 
-func handleDeleteAllFiles(c *gin.Context, userId string, email string) {
-	prefix := userId + "/"
+func handleEmptyTrash(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
 
-	err := deleteAllFiles(_bucket, prefix)
+	deleted, failed, err := emptyTrash(c.Request.Context(), getBucket(), prefix)
 	if err != nil {
 		toInternalServerError(c, err.Error())
 		return
 	}
 
-	toNoContent(c)
+	toSuccess(c, &emptyTrashDataOut{
+		Deleted: deleted,
+		Failed:  failed,
+	})
 }
 
-func readBody(c *gin.Context) string {
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(c.Request.Body)
-	return buf.String()
+func setFileCacheHeaders(c *gin.Context, etag string) {
+	c.Header("ETag", etag)
+	if FILE_CACHE_CONTROL != "" {
+		c.Header("Cache-Control", FILE_CACHE_CONTROL)
+	}
+}
+
+func setNoteMetadataHeaders(c *gin.Context, meta *NoteMetadata) {
+	if meta.Title != "" {
+		c.Header(NOTE_TITLE_HEADER, url.PathEscape(meta.Title))
+	}
+	if !meta.Created.IsZero() {
+		c.Header(NOTE_CREATED_HEADER, meta.Created.UTC().Format(time.RFC3339))
+	}
+}
+
+// The plain filename is for the old browsers, with everything but the printable ASCII replaced by "_",
+// the modern ones take filename* with the exact name, encoded as UTF-8 according to RFC 5987.
+func getAttachmentContentDisposition(fileName string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, fileName)
+
+	var encoded strings.Builder
+	for _, b := range []byte(fileName) {
+		if isRfc5987AttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return "attachment; filename=\"" + fallback + "\"; filename*=UTF-8''" + encoded.String()
+}
+
+func isRfc5987AttrChar(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') ||
+		strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// The HTML forms submit the note as multipart/form-data, with the content in the "content" field, either text or file,
+// and, optionally, the file name in the "filename" field. Any other body is the content as is.
+//
+// Returns the content and the file name from the form, empty when not given.
+func readBody(c *gin.Context) (string, string, error) {
+	if c.ContentType() != gin.MIMEMultipartPOSTForm {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(c.Request.Body)
+		return buf.String(), "", nil
+	}
+
+	if err := c.Request.ParseMultipartForm(MULTIPART_MAX_MEMORY); err != nil {
+		return "", "", fmt.Errorf("invalid multipart form: %w", err)
+	}
+	form := c.Request.MultipartForm
+	fileName := ""
+	if values := form.Value[FORM_FILENAME_FIELD]; len(values) > 0 {
+		fileName = values[0]
+	}
+	if values := form.Value[FORM_CONTENT_FIELD]; len(values) > 0 {
+		return values[0], fileName, nil
+	}
+	if files := form.File[FORM_CONTENT_FIELD]; len(files) > 0 {
+		file, err := files[0].Open()
+		if err != nil {
+			return "", "", fmt.Errorf("invalid multipart form: %w", err)
+		}
+		defer file.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(file)
+		return buf.String(), fileName, nil
+	}
+	return "", "", fmt.Errorf("invalid multipart form, '%s' field is missing", FORM_CONTENT_FIELD)
+}
+
+func toDryRun(c *gin.Context, action string, files []*dryRunFileDataOut) {
+	toSuccess(c, &dryRunDataOut{
+		DryRun: true,
+		Action: action,
+		Files:  files,
+		Count:  len(files),
+	})
+}
+
+// Same errors as the actual move or rename would give
+func toMoveError(c *gin.Context, err error) {
+	if errors.Is(err, ErrNotFound) {
+		toNotFound(c)
+		return
+	}
+	if errors.Is(err, ErrAlreadyExists) {
+		toConflict(c, err, nil)
+		return
+	}
+
+	toInternalServerError(c, err.Error())
 }
@@ -0,0 +1,2597 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	InitBucket("test-bucket")
+}
+
+func newTestContext(method string, target string, body string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	c.Request = httptest.NewRequest(method, target, reader)
+
+	return c, w
+}
+
+// Runs the handler as an authenticated user and flushes the response status
+func runAsUser(c *gin.Context, handler handlerFuncWithAuth, userId string) {
+	handler(c, userId, userId+"@example.com")
+	c.Writer.WriteHeaderNow()
+}
+
+func parseDataResponse(t *testing.T, w *httptest.ResponseRecorder, data interface{}) {
+	var response struct {
+		Data interface{} `json:"data"`
+	}
+	response.Data = data
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("Error parsing body: %s", err)
+	}
+}
+
+func resetFileCountCache() {
+	fileCountCacheLock.Lock()
+	fileCountCache = map[string]*fileCountData{}
+	fileCountCacheLock.Unlock()
+}
+
+func TestGetFilesWithCount(t *testing.T) {
+	fake := useFakeS3(t)
+	resetFileCountCache()
+	for i := 0; i < 5; i++ {
+		fake.seed(fmt.Sprintf("user1/note %d.md", i), "content")
+	}
+	fake.seed("user2/note.md", "someone else's note")
+
+	c, w := newTestContext("GET", "/files?pageSize=2&withCount=true", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getFilesDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 2 {
+		t.Errorf("Expected 2 files, actual: %d", len(out.Files))
+	}
+	if out.TotalCount == nil || *out.TotalCount != 5 {
+		t.Errorf("Expected totalCount 5, actual: %v", out.TotalCount)
+	}
+}
+
+func TestGetFilesWithoutCount(t *testing.T) {
+	fake := useFakeS3(t)
+	resetFileCountCache()
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("GET", "/files", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "totalCount") {
+		t.Errorf("Expected no totalCount, actual: %s", w.Body.String())
+	}
+}
+
+func TestFileCountGoesThroughAllPagesAndIsCached(t *testing.T) {
+	fake := useFakeS3(t)
+	resetFileCountCache()
+	for i := 0; i < 2500; i++ {
+		fake.seed(fmt.Sprintf("user1/note %d.txt", i), "")
+	}
+	fake.seed("user1/folder/note.txt", "")
+	fake.seed("user1/image.png", "")
+
+	count, err := getFileCount(context.Background(), getBucket(), "user1/")
+	if err != nil {
+		t.Fatalf("Error counting files: %s", err)
+	}
+	if count != 2500 {
+		t.Errorf("Expected 2500, actual: %d", count)
+	}
+
+	fake.seed("user1/one more.txt", "")
+	count, err = getFileCount(context.Background(), getBucket(), "user1/")
+	if err != nil {
+		t.Fatalf("Error counting files: %s", err)
+	}
+	if count != 2500 {
+		t.Errorf("Expected cached count 2500, actual: %d", count)
+	}
+}
+
+func TestGetFilesUsesDefaultPageSize(t *testing.T) {
+	fake := useFakeS3(t)
+	restorePageSizes(t)
+	err := SetPageSizes(3, 10)
+	if err != nil {
+		t.Fatalf("Error setting page sizes: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		fake.seed(fmt.Sprintf("user1/note %d.md", i), "content")
+	}
+
+	c, w := newTestContext("GET", "/files?pageSize=0", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getFilesDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 3 {
+		t.Errorf("Expected 3 files, actual: %d", len(out.Files))
+	}
+	if !out.HasMore {
+		t.Errorf("Expected hasMore")
+	}
+
+	c, w = newTestContext("GET", "/files?pageSize=11", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, actual: %d", w.Code)
+	}
+}
+
+func getFilesWithEtag(t *testing.T, target string, ifNoneMatch string) (int, string) {
+	c, w := newTestContext("GET", target, "")
+	if ifNoneMatch != "" {
+		c.Request.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	runAsUser(c, handleGetFiles, "user1")
+	return w.Code, w.Header().Get("ETag")
+}
+
+func TestGetFilesUnchangedListingIsNotModified(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/a.md", "content")
+	fake.seed("user1/b.md", "content")
+
+	code, etag := getFilesWithEtag(t, "/files", "")
+	if code != 200 || !strings.HasPrefix(etag, "W/") {
+		t.Fatalf("Expected 200 with weak ETag, actual: %d '%s'", code, etag)
+	}
+
+	code, secondEtag := getFilesWithEtag(t, "/files", etag)
+	if code != 304 {
+		t.Errorf("Expected 304, actual: %d", code)
+	}
+	if secondEtag != etag {
+		t.Errorf("Expected the same ETag %s, actual: %s", etag, secondEtag)
+	}
+}
+
+func TestGetFilesChangedListingIsReturned(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/a.md", "content")
+
+	_, etag := getFilesWithEtag(t, "/files", "")
+
+	// changed content changes the file ETag
+	fake.seed("user1/a.md", "changed content")
+	code, changedEtag := getFilesWithEtag(t, "/files", etag)
+	if code != 200 || changedEtag == etag {
+		t.Errorf("Expected 200 with new ETag after the change, actual: %d '%s'", code, changedEtag)
+	}
+
+	// new file
+	fake.seed("user1/b.md", "content")
+	code, addedEtag := getFilesWithEtag(t, "/files", changedEtag)
+	if code != 200 || addedEtag == changedEtag {
+		t.Errorf("Expected 200 with new ETag after adding the file, actual: %d '%s'", code, addedEtag)
+	}
+}
+
+func TestGetFilesStrongEtagIsStable(t *testing.T) {
+	fake := useFakeS3(t)
+	original := LISTING_ETAG_STRONG
+	SetListingEtagStrong(true)
+	t.Cleanup(func() {
+		LISTING_ETAG_STRONG = original
+	})
+	fake.seed("user1/a.md", "content")
+	fake.seed("user1/b.md", "content")
+
+	code, etag := getFilesWithEtag(t, "/files", "")
+	if code != 200 || etag == "" || strings.HasPrefix(etag, "W/") {
+		t.Fatalf("Expected 200 with strong ETag, actual: %d '%s'", code, etag)
+	}
+	code, secondEtag := getFilesWithEtag(t, "/files", "")
+	if code != 200 || secondEtag != etag {
+		t.Errorf("Expected the same ETag %s, actual: %d '%s'", etag, code, secondEtag)
+	}
+
+	code, _ = getFilesWithEtag(t, "/files", etag)
+	if code != 304 {
+		t.Errorf("Expected 304, actual: %d", code)
+	}
+}
+
+func TestListingEtagIgnoresFileOrderAndTracksChanges(t *testing.T) {
+	now := time.Now()
+	a := &FileDataOut{FileName: "a.md", ETag: "\"1\"", LastModified: now}
+	b := &FileDataOut{FileName: "b.md", ETag: "\"2\"", LastModified: now}
+
+	etag := getListingEtag("", "", &getFilesDataOut{Files: []*FileDataOut{a, b}}, false)
+	if reordered := getListingEtag("", "", &getFilesDataOut{Files: []*FileDataOut{b, a}}, false); reordered != etag {
+		t.Errorf("Expected the same ETag for the reordered page, actual: %s and %s", etag, reordered)
+	}
+
+	modified := *b
+	modified.LastModified = now.Add(time.Second)
+	if changed := getListingEtag("", "", &getFilesDataOut{Files: []*FileDataOut{a, &modified}}, false); changed == etag {
+		t.Errorf("Expected another ETag when lastModified changes")
+	}
+	modified = *b
+	modified.ETag = "\"3\""
+	if changed := getListingEtag("", "", &getFilesDataOut{Files: []*FileDataOut{a, &modified}}, false); changed == etag {
+		t.Errorf("Expected another ETag when etag changes")
+	}
+	if pretty := getListingEtag("", "", &getFilesDataOut{Files: []*FileDataOut{a, b}}, true); pretty == etag {
+		t.Errorf("Expected another ETag for the indented response")
+	}
+}
+
+func TestGetFilesDifferentPagesHaveDifferentEtags(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/a.md", "content")
+	fake.seed("user1/b.md", "content")
+	fake.seed("user1/c.md", "content")
+
+	c, w := newTestContext("GET", "/files?pageSize=1", "")
+	runAsUser(c, handleGetFiles, "user1")
+	var out getFilesDataOut
+	parseDataResponse(t, w, &out)
+	firstEtag := w.Header().Get("ETag")
+
+	code, secondEtag := getFilesWithEtag(t, "/files?pageSize=1&continuationToken="+out.NextContinuationToken, firstEtag)
+	if code != 200 || secondEtag == firstEtag {
+		t.Errorf("Expected 200 with a different ETag for the second page, actual: %d '%s'", code, secondEtag)
+	}
+}
+
+func TestIsEtagMatching(t *testing.T) {
+	cases := []struct {
+		ifNoneMatch string
+		matching    bool
+	}{
+		{"", false},
+		{`W/"abc"`, true},
+		{`"abc"`, true},
+		{`W/"def", W/"abc"`, true},
+		{`W/"def"`, false},
+		{"*", true},
+	}
+
+	for _, tc := range cases {
+		matching := isEtagMatching(tc.ifNoneMatch, `W/"abc"`)
+		if matching != tc.matching {
+			t.Errorf("Expected isEtagMatching(%q) to be %v, actual: %v", tc.ifNoneMatch, tc.matching, matching)
+		}
+	}
+}
+
+func TestContinuationTokenRoundTrip(t *testing.T) {
+	tokens := []string{"", "user1/a+b=c.md", "1NbUxI1wspHIRjwI+/==", "with space"}
+	for _, token := range tokens {
+		encoded := encodeContinuationToken(token)
+		if strings.ContainsAny(encoded, "+/= %") {
+			t.Errorf("Expected '%s' to be encoded url-safe, actual: '%s'", token, encoded)
+		}
+		decoded, err := decodeContinuationToken(encoded)
+		if err != nil {
+			t.Fatalf("Error decoding '%s': %s", encoded, err)
+		}
+		if decoded != token {
+			t.Errorf("Expected '%s', actual: '%s'", token, decoded)
+		}
+	}
+}
+
+func TestGetFilesPageWithMoreHasSameEtagOverTime(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/a.md", "content")
+	fake.seed("user1/b.md", "content")
+
+	c, w := newTestContext("GET", "/files?pageSize=1", "")
+	runAsUser(c, handleGetFiles, "user1")
+	var out getFilesDataOut
+	parseDataResponse(t, w, &out)
+	if !out.HasMore {
+		t.Fatalf("Expected hasMore")
+	}
+	etag := w.Header().Get("ETag")
+
+	time.Sleep(time.Second) // the next token is issued at another time
+
+	code, secondEtag := getFilesWithEtag(t, "/files?pageSize=1", "")
+	if code != 200 || secondEtag != etag {
+		t.Errorf("Expected the same ETag %s, actual: %d '%s'", etag, code, secondEtag)
+	}
+	code, _ = getFilesWithEtag(t, "/files?pageSize=1", etag)
+	if code != 304 {
+		t.Errorf("Expected 304, actual: %d", code)
+	}
+}
+
+func TestGetFilesContinuationTokenRoundTrip(t *testing.T) {
+	fake := useFakeS3(t)
+	// the fake uses the last key as a continuation token, so it contains '+', '/' and '='
+	fake.seed("user1/a+b=c.md", "first")
+	fake.seed("user1/z.md", "second")
+
+	c, w := newTestContext("GET", "/files?pageSize=1", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getFilesDataOut
+	parseDataResponse(t, w, &out)
+	if !out.HasMore || out.NextContinuationToken == "" {
+		t.Fatalf("Expected hasMore with continuation token")
+	}
+
+	// the token is passed back as is, without any escaping
+	c, w = newTestContext("GET", "/files?pageSize=1&continuationToken="+out.NextContinuationToken, "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	out = getFilesDataOut{}
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 1 || out.Files[0].FileName != "z.md" {
+		t.Errorf("Expected z.md on the second page, actual: %v", out.Files)
+	}
+}
+
+func TestGetFilesRejectsMalformedContinuationToken(t *testing.T) {
+	useFakeS3(t)
+
+	c, w := newTestContext("GET", "/files?continuationToken=not+base64url%3D", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, actual: %d", w.Code)
+	}
+}
+
+func TestGetFilesRejectsTamperedContinuationToken(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/a.md", "first")
+	fake.seed("user1/z.md", "second")
+
+	signed := signContinuationToken("user1/a.md", "user1/", time.Now())
+	payload, signature, _ := strings.Cut(signed, ".")
+	tampered := base64.RawURLEncoding.EncodeToString([]byte(`{"t":"user1/0.md","p":"user1/","iat":` + strconv.FormatInt(time.Now().Unix(), 10) + `}`))
+	if tampered == payload {
+		t.Fatalf("Expected the payload to change")
+	}
+
+	c, w := newTestContext("GET", "/files?continuationToken="+tampered+"."+signature, "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, actual: %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), ERROR_CODE_CONTINUATION_TOKEN_EXPIRED) {
+		t.Errorf("Expected no expired code for the tampered token, actual: %s", w.Body.String())
+	}
+}
+
+func TestGetFilesRejectsContinuationTokenOfAnotherFolder(t *testing.T) {
+	useFakeS3(t)
+
+	signed := signContinuationToken("user1/work/a.md", "user1/work/", time.Now())
+	c, w := newTestContext("GET", "/files?continuationToken="+signed, "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 400 {
+		t.Errorf("Expected 400, actual: %d", w.Code)
+	}
+}
+
+func TestGetFilesRejectsExpiredContinuationToken(t *testing.T) {
+	useFakeS3(t)
+
+	signed := signContinuationToken("user1/a.md", "user1/", time.Now().Add(-CONTINUATION_TOKEN_TTL-time.Minute))
+	c, w := newTestContext("GET", "/files?continuationToken="+signed, "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), ERROR_CODE_CONTINUATION_TOKEN_EXPIRED) {
+		t.Errorf("Expected the expired code, actual: %s", w.Body.String())
+	}
+}
+
+func TestContinuationTokenWithinTTL(t *testing.T) {
+	now := time.Now()
+	signed := signContinuationToken("token", "user1/", now.Add(-CONTINUATION_TOKEN_TTL+time.Minute))
+
+	token, err := verifyContinuationToken(signed, "user1/", now)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "token" {
+		t.Errorf("Expected 'token', actual: '%s'", token)
+	}
+}
+
+func TestContinuationTokenForMaxLengthPrefix(t *testing.T) {
+	// the tenant and the user id of the max length, and the folder taking the rest of the key, but the file name
+	userPrefix := getUserPrefix(strings.Repeat("t", MAX_USER_ID_LENGTH), strings.Repeat("u", MAX_USER_ID_LENGTH))
+	folder := strings.Repeat("<&>", (S3_MAX_KEY_LENGTH-len(userPrefix)-MAX_FILE_NAME_LENGTH)/3)
+	prefix := userPrefix + folder[:len(folder)-1] + "/"
+	key := prefix + strings.Repeat("a", S3_MAX_KEY_LENGTH-len(prefix)-3) + ".md"
+	// S3 gives the opaque token, longer than the key it continues from
+	token := base64.StdEncoding.EncodeToString([]byte(key + key[:len(key)/2]))
+
+	signed := signContinuationToken(token, prefix, time.Now())
+
+	if !isContinuationTokenValid(signed) {
+		t.Fatalf("Expected the token to be valid, %d chars long, max: %d", len(signed), getMaxContinuationTokenLength())
+	}
+	actual, err := verifyContinuationToken(signed, prefix, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != token {
+		t.Errorf("Expected the token to round trip")
+	}
+}
+
+func TestRenameAndSaveFile(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/old.md", "old content")
+
+	c, w := newTestContext("POST", "/files/old.md/renameAndSave", `{"newFileName": "new.md", "content": "new content"}`)
+	c.Params = gin.Params{{Key: "filename", Value: "old.md"}}
+	runAsUser(c, handleRenameAndSaveFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("user1/old.md"); ok {
+		t.Errorf("Expected old file to be deleted")
+	}
+	obj, ok := fake.get("user1/new.md")
+	if !ok {
+		t.Fatalf("Expected new file to be created")
+	}
+	if string(obj.content) != "new content" {
+		t.Errorf("Expected 'new content', actual: '%s'", string(obj.content))
+	}
+	if w.Header().Get("ETag") != obj.etag {
+		t.Errorf("Expected ETag %s, actual: %s", obj.etag, w.Header().Get("ETag"))
+	}
+}
+
+func TestRenameAndSaveFileToExistingName(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/old.md", "old content")
+	fake.seed("user1/new.md", "existing content")
+
+	c, w := newTestContext("POST", "/files/old.md/renameAndSave", `{"newFileName": "new.md", "content": "new content"}`)
+	c.Params = gin.Params{{Key: "filename", Value: "old.md"}}
+	runAsUser(c, handleRenameAndSaveFile, "user1")
+
+	if w.Code != 409 {
+		t.Fatalf("Expected 409, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/new.md"); string(obj.content) != "existing content" {
+		t.Errorf("Expected existing file to be intact")
+	}
+	if _, ok := fake.get("user1/old.md"); !ok {
+		t.Errorf("Expected old file to be intact")
+	}
+}
+
+func TestRenameAndSaveMissingFile(t *testing.T) {
+	fake := useFakeS3(t)
+
+	c, w := newTestContext("POST", "/files/old.md/renameAndSave", `{"newFileName": "new.md", "content": "new content"}`)
+	c.Params = gin.Params{{Key: "filename", Value: "old.md"}}
+	runAsUser(c, handleRenameAndSaveFile, "user1")
+
+	if w.Code != 404 {
+		t.Fatalf("Expected 404, actual: %d", w.Code)
+	}
+	if fake.count() != 0 {
+		t.Errorf("Expected nothing to be written")
+	}
+}
+
+func TestBatchDeleteFiles(t *testing.T) {
+	fake := useFakeS3(t)
+	for i := 1; i <= 5; i++ {
+		fake.seed(fmt.Sprintf("user1/note %d.md", i), "content")
+	}
+	fake.seed("user2/note 1.md", "someone else's note")
+
+	c, w := newTestContext("POST", "/files/batch/delete", `{"fileNames": ["note 1.md", "note 3.md", "note 5.md"]}`)
+	runAsUser(c, handleBatchDeleteFiles, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out batchDeleteFilesDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 3 {
+		t.Fatalf("Expected 3 results, actual: %d", len(out.Files))
+	}
+	for _, file := range out.Files {
+		if !file.Deleted {
+			t.Errorf("Expected %s to be deleted", file.FileName)
+		}
+	}
+	for _, key := range []string{"user1/note 1.md", "user1/note 3.md", "user1/note 5.md"} {
+		if _, ok := fake.get(key); ok {
+			t.Errorf("Expected %s to be deleted", key)
+		}
+	}
+	for _, key := range []string{"user1/note 2.md", "user1/note 4.md", "user2/note 1.md"} {
+		if _, ok := fake.get(key); !ok {
+			t.Errorf("Expected %s to be intact", key)
+		}
+	}
+}
+
+func TestBatchDeleteFilesRejectsInvalidFileName(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("POST", "/files/batch/delete", `{"fileNames": ["note.md", "../user2/note.md"]}`)
+	runAsUser(c, handleBatchDeleteFiles, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+	if fake.count() != 1 {
+		t.Errorf("Expected nothing to be deleted")
+	}
+}
+
+func TestDeleteAllFilesRequiresConfirmation(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note 1.md", "content")
+	fake.seed("user1/note 2.md", "content")
+
+	for _, body := range []string{"", `{}`, `{"confirm": "yes"}`, `{"confirm": "delete all"}`} {
+		c, w := newTestContext("POST", "/deleteall", body)
+		runAsUser(c, handleDeleteAllFiles, "user1")
+
+		if w.Code != 400 {
+			t.Errorf("Expected 400 for body '%s', actual: %d", body, w.Code)
+		}
+		if fake.count() != 2 {
+			t.Fatalf("Expected nothing to be deleted for body '%s'", body)
+		}
+	}
+}
+
+func TestDeleteAllFilesWithConfirmation(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note 1.md", "content")
+	fake.seed("user1/note 2.md", "content")
+	fake.seed("user2/note 1.md", "content")
+
+	c, w := newTestContext("POST", "/deleteall?permanent=true", `{"confirm": "DELETE ALL"}`)
+	runAsUser(c, handleDeleteAllFiles, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if fake.count() != 1 {
+		t.Errorf("Expected only the other user's note to remain, actual: %d", fake.count())
+	}
+}
+
+func TestDeleteAllFilesMovesToTrash(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note 1.md", "content 1")
+	fake.seed("user1/note 2.txt", "content 2")
+	fake.seed("user1/.trash/old.md", "deleted long ago")
+	fake.seed("user2/note 1.md", "content")
+
+	c, w := newTestContext("POST", "/deleteall", `{"confirm": "DELETE ALL"}`)
+	runAsUser(c, handleDeleteAllFiles, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if fake.count() != 4 {
+		t.Errorf("Expected 4 objects, actual: %d", fake.count())
+	}
+	for _, key := range []string{"user1/note 1.md", "user1/note 2.txt"} {
+		if _, ok := fake.get(key); ok {
+			t.Errorf("Expected %s to be moved", key)
+		}
+	}
+	obj, ok := fake.get("user1/.trash/note 1.md")
+	if !ok {
+		t.Fatalf("Expected note 1.md to be in the trash")
+	}
+	if string(obj.content) != "content 1" {
+		t.Errorf("Expected content to be preserved, actual: '%s'", string(obj.content))
+	}
+	if obj.metadata[TRASH_META_ORIGINAL_NAME] != "note%201.md" {
+		t.Errorf("Expected original name in metadata, actual: '%s'", obj.metadata[TRASH_META_ORIGINAL_NAME])
+	}
+	if obj.metadata[TRASH_META_DELETED_AT] == "" {
+		t.Errorf("Expected deletion time in metadata")
+	}
+	if _, ok := fake.get("user1/.trash/old.md"); !ok {
+		t.Errorf("Expected the trash to be intact")
+	}
+}
+
+func TestDeleteAllFilesPermanentlyPurgesTrash(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note 1.md", "content 1")
+	fake.seed("user1/.trash/old.md", "deleted long ago")
+
+	c, w := newTestContext("POST", "/deleteall?permanent=true", `{"confirm": "DELETE ALL"}`)
+	runAsUser(c, handleDeleteAllFiles, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if fake.count() != 0 {
+		t.Errorf("Expected everything to be deleted, actual: %d", fake.count())
+	}
+}
+
+func TestListTrash(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note 1.md", "content 1")
+	fake.seed("user1/note 2.md", "content 2")
+	fake.seed("user1/.trash/old.md", "trashed without metadata")
+
+	c, w := newTestContext("POST", "/deleteall", `{"confirm": "DELETE ALL"}`)
+	runAsUser(c, handleDeleteAllFiles, "user1")
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+
+	c, w = newTestContext("GET", "/trash", "")
+	runAsUser(c, handleListTrash, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getTrashedFilesDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 3 {
+		t.Fatalf("Expected 3 files, actual: %d", len(out.Files))
+	}
+	for _, file := range out.Files {
+		if file.OriginalFileName != file.FileName {
+			t.Errorf("Expected original name '%s', actual: '%s'", file.FileName, file.OriginalFileName)
+		}
+		if file.DeletedAt.IsZero() {
+			t.Errorf("Expected deletion time for '%s'", file.FileName)
+		}
+	}
+}
+
+func TestEmptyTrash(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+	fake.seed("user1/.trash/old 1.md", "trashed")
+	fake.seed("user1/.trash/old 2.md", "trashed")
+	fake.seed("user2/.trash/old 1.md", "someone else's trash")
+
+	c, w := newTestContext("POST", "/trash/empty", "")
+	runAsUser(c, handleEmptyTrash, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out emptyTrashDataOut
+	parseDataResponse(t, w, &out)
+	if out.Deleted != 2 || out.Failed != 0 {
+		t.Errorf("Expected 2 deleted and 0 failed, actual: %d and %d", out.Deleted, out.Failed)
+	}
+	for _, key := range []string{"user1/note.md", "user2/.trash/old 1.md"} {
+		if _, ok := fake.get(key); !ok {
+			t.Errorf("Expected %s to be intact", key)
+		}
+	}
+	if fake.count() != 2 {
+		t.Errorf("Expected 2 objects to remain, actual: %d", fake.count())
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("POST", "/move", `{"fileName": "note.md", "fromFolder": "", "toFolder": "work/projects"}`)
+	runAsUser(c, handleMoveFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("user1/note.md"); ok {
+		t.Errorf("Expected source file to be deleted")
+	}
+	obj, ok := fake.get("user1/work/projects/note.md")
+	if !ok {
+		t.Fatalf("Expected file to be moved")
+	}
+	if string(obj.content) != "content" {
+		t.Errorf("Expected 'content', actual: '%s'", string(obj.content))
+	}
+}
+
+func TestMoveFileBackToRoot(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/work/note.md", "content")
+
+	c, w := newTestContext("POST", "/move", `{"fileName": "note.md", "fromFolder": "work"}`)
+	runAsUser(c, handleMoveFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("user1/note.md"); !ok {
+		t.Errorf("Expected file to be moved to the root")
+	}
+}
+
+func TestMoveFileToExistingName(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+	fake.seed("user1/work/note.md", "existing content")
+
+	c, w := newTestContext("POST", "/move", `{"fileName": "note.md", "toFolder": "work"}`)
+	runAsUser(c, handleMoveFile, "user1")
+
+	if w.Code != 409 {
+		t.Fatalf("Expected 409, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/work/note.md"); string(obj.content) != "existing content" {
+		t.Errorf("Expected existing file to be intact")
+	}
+	if _, ok := fake.get("user1/note.md"); !ok {
+		t.Errorf("Expected source file to be intact")
+	}
+}
+
+func TestMoveMissingFile(t *testing.T) {
+	fake := useFakeS3(t)
+
+	c, w := newTestContext("POST", "/move", `{"fileName": "note.md", "toFolder": "work"}`)
+	runAsUser(c, handleMoveFile, "user1")
+
+	if w.Code != 404 {
+		t.Fatalf("Expected 404, actual: %d", w.Code)
+	}
+	if fake.count() != 0 {
+		t.Errorf("Expected nothing to be written")
+	}
+}
+
+func TestMoveFileRejectsTraversal(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("POST", "/move", `{"fileName": "note.md", "toFolder": "../user2"}`)
+	runAsUser(c, handleMoveFile, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("user1/note.md"); !ok {
+		t.Errorf("Expected source file to be intact")
+	}
+}
+
+func TestGetFilesInRootSkipsFolders(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/root note.md", "content")
+	fake.seed("user1/work/work note.md", "content")
+	fake.seed("user1/work/projects/project note.md", "content")
+
+	c, w := newTestContext("GET", "/files", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getFilesDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 1 || out.Files[0].FileName != "root note.md" {
+		t.Errorf("Expected only 'root note.md', actual: %v", out.Files)
+	}
+}
+
+func TestGetFilesInFolder(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/root note.md", "content")
+	fake.seed("user1/work/work note.md", "content")
+	fake.seed("user1/work/projects/project note.md", "content")
+
+	c, w := newTestContext("GET", "/files?folder=work", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getFilesDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 1 || out.Files[0].FileName != "work note.md" {
+		t.Errorf("Expected only 'work note.md', actual: %v", out.Files)
+	}
+
+	c, w = newTestContext("GET", "/files?folder=work%2Fprojects", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 1 || out.Files[0].FileName != "project note.md" {
+		t.Errorf("Expected only 'project note.md', actual: %v", out.Files)
+	}
+}
+
+func TestGetFilesRejectsFolderTraversal(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user2/note.md", "someone else's note")
+
+	c, w := newTestContext("GET", "/files?folder=..%2Fuser2", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+}
+
+func TestListFolders(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/root note.md", "content")
+	fake.seed("user1/work/note 1.md", "content")
+	fake.seed("user1/work/note 2.md", "content")
+	fake.seed("user1/work/projects/note.md", "content")
+	fake.seed("user1/personal/note.md", "content")
+	fake.seed("user1/"+TRASH_FOLDER+"deleted.md", "content")
+	fake.seed("user2/other/note.md", "someone else's note")
+
+	c, w := newTestContext("GET", "/folders", "")
+	runAsUser(c, handleListFolders, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getFoldersDataOut
+	parseDataResponse(t, w, &out)
+	if strings.Join(out.Folders, ",") != "personal,work" {
+		t.Errorf("Expected 'personal,work', actual: %v", out.Folders)
+	}
+
+	c, w = newTestContext("GET", "/folders?parent=work", "")
+	runAsUser(c, handleListFolders, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	parseDataResponse(t, w, &out)
+	if strings.Join(out.Folders, ",") != "projects" {
+		t.Errorf("Expected 'projects', actual: %v", out.Folders)
+	}
+}
+
+func TestListFoldersRejectsTraversal(t *testing.T) {
+	useFakeS3(t)
+
+	c, w := newTestContext("GET", "/folders?parent=..", "")
+	runAsUser(c, handleListFolders, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+}
+
+func TestPutFileIfMatch(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "original content")
+	original, _ := fake.get("user1/note.md")
+
+	c, w := newTestContext("PUT", "/files/note.md", "new content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-Match", original.etag)
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "new content" {
+		t.Errorf("Expected 'new content', actual: '%s'", string(obj.content))
+	}
+}
+
+func TestPutFileIfMatchUnchangedContentIsNotWritten(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "same content")
+	original, _ := fake.get("user1/note.md")
+
+	c, w := newTestContext("PUT", "/files/note.md", "same content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-Match", original.etag)
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	if w.Header().Get(NOTE_UNCHANGED_HEADER) != "true" {
+		t.Errorf("Expected %s: true", NOTE_UNCHANGED_HEADER)
+	}
+	if w.Header().Get("ETag") != original.etag {
+		t.Errorf("Expected ETag %s, actual: %s", original.etag, w.Header().Get("ETag"))
+	}
+	if obj, _ := fake.get("user1/note.md"); obj != original {
+		t.Errorf("Expected the file not to be written")
+	}
+}
+
+func TestPutFileIfMatchChangedContentIsWritten(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "same content")
+	original, _ := fake.get("user1/note.md")
+
+	c, w := newTestContext("PUT", "/files/note.md", "changed content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-Match", original.etag)
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if w.Header().Get(NOTE_UNCHANGED_HEADER) != "" {
+		t.Errorf("Expected no %s", NOTE_UNCHANGED_HEADER)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "changed content" {
+		t.Errorf("Expected 'changed content', actual: '%s'", string(obj.content))
+	}
+}
+
+func TestPutFileIfMatchUnchangedCompressedContentIsNotWritten(t *testing.T) {
+	fake := useFakeS3(t)
+	useCompressAtRest(t, 10)
+	content := strings.Repeat("long enough to be compressed ", 10)
+
+	c, w := newTestContext("PUT", "/files/note.md", content)
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+	original, _ := fake.get("user1/note.md")
+
+	c, w = newTestContext("PUT", "/files/note.md", content)
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-Match", original.etag)
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 200 || w.Header().Get(NOTE_UNCHANGED_HEADER) != "true" {
+		t.Fatalf("Expected 200 with %s: true, actual: %d", NOTE_UNCHANGED_HEADER, w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); obj != original {
+		t.Errorf("Expected the file not to be written")
+	}
+}
+
+func TestPutFileIfChangedUnchangedContentIsNotWritten(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "same content")
+	original, _ := fake.get("user1/note.md")
+
+	c, w := newTestContext("PUT", "/files/note.md", "same content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set(IF_CHANGED_HEADER, "true")
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 200 || w.Header().Get(NOTE_UNCHANGED_HEADER) != "true" {
+		t.Fatalf("Expected 200 with %s: true, actual: %d", NOTE_UNCHANGED_HEADER, w.Code)
+	}
+	if w.Header().Get("ETag") != original.etag {
+		t.Errorf("Expected ETag %s, actual: %s", original.etag, w.Header().Get("ETag"))
+	}
+	if obj, _ := fake.get("user1/note.md"); obj != original {
+		t.Errorf("Expected the file not to be written")
+	}
+}
+
+func TestPutFileIfChangedChangedContentIsWritten(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "same content")
+
+	c, w := newTestContext("PUT", "/files/note.md", "changed content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set(IF_CHANGED_HEADER, "true")
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if w.Header().Get(NOTE_UNCHANGED_HEADER) != "" {
+		t.Errorf("Expected no %s", NOTE_UNCHANGED_HEADER)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "changed content" {
+		t.Errorf("Expected 'changed content', actual: '%s'", string(obj.content))
+	}
+}
+
+func TestPutFileIfChangedNewFileIsWritten(t *testing.T) {
+	fake := useFakeS3(t)
+
+	c, w := newTestContext("PUT", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set(IF_CHANGED_HEADER, "true")
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if obj, ok := fake.get("user1/note.md"); !ok || string(obj.content) != "content" {
+		t.Errorf("Expected the file to be written")
+	}
+}
+
+func TestPutFileIfChangedComparesContentWhenEtagIsNotMd5(t *testing.T) {
+	for _, tc := range []struct {
+		content   string
+		unchanged bool
+	}{
+		{"same content", true},
+		{"same content, longer", false},
+		{"same", false},
+		{"fake content", false},
+	} {
+		fake := useFakeS3(t)
+		fake.seed("user1/note.md", "same content")
+		original, _ := fake.get("user1/note.md")
+		original.etag = "\"0123456789abcdef0123456789abcdef-2\"" // multipart upload
+
+		c, w := newTestContext("PUT", "/files/note.md", tc.content)
+		c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+		c.Request.Header.Set(IF_CHANGED_HEADER, "true")
+		runAsUser(c, handlePutFile, "user1")
+
+		if tc.unchanged {
+			if w.Code != 200 || w.Header().Get(NOTE_UNCHANGED_HEADER) != "true" {
+				t.Errorf("Expected 200 with %s: true for '%s', actual: %d", NOTE_UNCHANGED_HEADER, tc.content, w.Code)
+			}
+			if w.Header().Get("ETag") != original.etag {
+				t.Errorf("Expected ETag %s, actual: %s", original.etag, w.Header().Get("ETag"))
+			}
+		} else {
+			if w.Code != 204 {
+				t.Errorf("Expected 204 for '%s', actual: %d", tc.content, w.Code)
+			}
+			if obj, _ := fake.get("user1/note.md"); string(obj.content) != tc.content {
+				t.Errorf("Expected '%s', actual: '%s'", tc.content, string(obj.content))
+			}
+		}
+	}
+}
+
+func TestPutFileIfChangedUnchangedCompressedContentIsNotWritten(t *testing.T) {
+	fake := useFakeS3(t)
+	useCompressAtRest(t, 10)
+	content := strings.Repeat("long enough to be compressed ", 10)
+
+	c, _ := newTestContext("PUT", "/files/note.md", content)
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+	original, _ := fake.get("user1/note.md")
+	original.etag = "\"0123456789abcdef0123456789abcdef-2\"" // multipart upload, so the content is decompressed and compared
+
+	c, w := newTestContext("PUT", "/files/note.md", content)
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set(IF_CHANGED_HEADER, "true")
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 200 || w.Header().Get(NOTE_UNCHANGED_HEADER) != "true" {
+		t.Fatalf("Expected 200 with %s: true, actual: %d", NOTE_UNCHANGED_HEADER, w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); obj != original {
+		t.Errorf("Expected the file not to be written")
+	}
+}
+
+func TestPutFileIfChangedInvalidHeader(t *testing.T) {
+	useFakeS3(t)
+
+	c, w := newTestContext("PUT", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set(IF_CHANGED_HEADER, "maybe")
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+}
+
+func TestIsReaderEqual(t *testing.T) {
+	long := strings.Repeat("0123456789", 10000) // more than one chunk
+	for _, tc := range []struct {
+		read    string
+		content string
+		equal   bool
+	}{
+		{"", "", true},
+		{"abc", "abc", true},
+		{"abc", "abd", false},
+		{"abc", "ab", false},
+		{"ab", "abc", false},
+		{long, long, true},
+		{long, long + "x", false},
+		{long + "x", long, false},
+		{long[:50000] + "x" + long[50001:], long, false},
+	} {
+		equal, err := isReaderEqual(strings.NewReader(tc.read), tc.content)
+		if err != nil {
+			t.Fatalf("Expected no error, actual: %v", err)
+		}
+		if equal != tc.equal {
+			t.Errorf("Expected %v for %d and %d chars long, actual: %v", tc.equal, len(tc.read), len(tc.content), equal)
+		}
+	}
+}
+
+func TestPutFileIfMatchChangedFile(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "changed by someone else")
+
+	c, w := newTestContext("PUT", "/files/note.md", "new content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-Match", fakeEtag([]byte("original content")))
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 412 {
+		t.Fatalf("Expected 412, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "changed by someone else" {
+		t.Errorf("Expected the file to be intact")
+	}
+	if fake.count() != 1 {
+		t.Errorf("Expected no conflict copy, actual: %d files", fake.count())
+	}
+}
+
+func TestPutFileIfMatchSavesConflictCopy(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "changed by someone else")
+
+	c, w := newTestContext("PUT", "/files/note.md?saveConflict=true", "new content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-Match", fakeEtag([]byte("original content")))
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 412 {
+		t.Fatalf("Expected 412, actual: %d", w.Code)
+	}
+	var out conflictDataOut
+	parseDataResponse(t, w, &out)
+	if !strings.HasPrefix(out.ConflictFileName, "note (conflict ") || !isFileNameValid(out.ConflictFileName) {
+		t.Fatalf("Expected valid conflict file name, actual: '%s'", out.ConflictFileName)
+	}
+	obj, ok := fake.get("user1/" + out.ConflictFileName)
+	if !ok {
+		t.Fatalf("Expected conflict copy to be created")
+	}
+	if string(obj.content) != "new content" {
+		t.Errorf("Expected 'new content', actual: '%s'", string(obj.content))
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "changed by someone else" {
+		t.Errorf("Expected the file to be intact")
+	}
+}
+
+func TestPutFileSavesConflictCopyWithMinFileNameLength(t *testing.T) {
+	fake := useFakeS3(t)
+	useMaxFileNameLength(t, MIN_FILE_NAME_LENGTH)
+	fileName := strings.Repeat("a", MIN_FILE_NAME_LENGTH-4) + ".txt"
+	fake.seed("user1/"+fileName, "changed by someone else")
+
+	c, w := newTestContext("PUT", "/files/"+fileName+"?saveConflict=true", "new content")
+	c.Params = gin.Params{{Key: "filename", Value: fileName}}
+	c.Request.Header.Set("If-Match", fakeEtag([]byte("original content")))
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 412 {
+		t.Fatalf("Expected 412, actual: %d", w.Code)
+	}
+	var out conflictDataOut
+	parseDataResponse(t, w, &out)
+	if !isFileNameValid(out.ConflictFileName) {
+		t.Fatalf("Expected valid conflict file name, actual: '%s'", out.ConflictFileName)
+	}
+	if _, ok := fake.get("user1/" + out.ConflictFileName); !ok {
+		t.Errorf("Expected conflict copy to be created")
+	}
+}
+
+func TestPostFileUniqueWithMinFileNameLength(t *testing.T) {
+	fake := useFakeS3(t)
+	useMaxFileNameLength(t, MIN_FILE_NAME_LENGTH)
+	fileName := strings.Repeat("a", MIN_FILE_NAME_LENGTH-4) + ".txt"
+	fake.seed("user1/"+fileName, "existing")
+
+	c, w := newTestContext("POST", "/files/"+fileName+"?unique=true", "content")
+	c.Params = gin.Params{{Key: "filename", Value: fileName}}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+	var out postFileDataOut
+	parseDataResponse(t, w, &out)
+	if out.FileName == fileName || !isFileNameValid(out.FileName) {
+		t.Errorf("Expected valid unique file name, actual: '%s'", out.FileName)
+	}
+}
+
+func TestPutFileWithoutTenant(t *testing.T) {
+	fake := useFakeS3(t)
+
+	c, w := newTestContext("PUT", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("user1/note.md"); !ok {
+		t.Errorf("Expected the file under 'user1/'")
+	}
+}
+
+func TestPutFileWithTenant(t *testing.T) {
+	fake := useFakeS3(t)
+
+	c, w := newTestContext("PUT", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Set(TENANT_ID_KEY, "tenant1")
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("tenants/tenant1/user1/note.md"); !ok {
+		t.Errorf("Expected the file under 'tenants/tenant1/user1/'")
+	}
+	if _, ok := fake.get("user1/note.md"); ok {
+		t.Errorf("Expected no file under 'user1/'")
+	}
+}
+
+func TestUserNamedAsTenantCantReachTenantUsers(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("tenants/acme/user2/secret.md", "secret")
+
+	c, w := newTestContext("GET", "/files?folder=user2", "")
+	runAsUser(c, handleGetFiles, "acme")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getFilesDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 0 {
+		t.Errorf("Expected nothing of the tenant, actual: %v", out.Files)
+	}
+
+	c, w = newTestContext("POST", "/deleteall?permanent=true", `{"confirm": "DELETE ALL"}`)
+	runAsUser(c, handleDeleteAllFiles, "acme")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("tenants/acme/user2/secret.md"); !ok {
+		t.Errorf("Expected the note of the tenant to stay")
+	}
+}
+
+func TestPutFileIfUnmodifiedSinceStaleTime(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "changed by someone else")
+	original, _ := fake.get("user1/note.md")
+
+	c, w := newTestContext("PUT", "/files/note.md", "new content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-Unmodified-Since", original.lastModified.Add(-time.Hour).UTC().Format(http.TimeFormat))
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 412 {
+		t.Fatalf("Expected 412, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "changed by someone else" {
+		t.Errorf("Expected the file to be intact")
+	}
+}
+
+func TestPutFileIfUnmodifiedSinceCurrentTime(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "original content")
+	original, _ := fake.get("user1/note.md")
+
+	c, w := newTestContext("PUT", "/files/note.md", "new content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-Unmodified-Since", original.lastModified.Add(time.Second).UTC().Format(http.TimeFormat))
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "new content" {
+		t.Errorf("Expected 'new content', actual: '%s'", string(obj.content))
+	}
+}
+
+func TestDeleteFileIfUnmodifiedSinceStaleTime(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "changed by someone else")
+	original, _ := fake.get("user1/note.md")
+
+	c, w := newTestContext("DELETE", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-Unmodified-Since", original.lastModified.Add(-time.Hour).UTC().Format(http.TimeFormat))
+	runAsUser(c, handleDeleteFile, "user1")
+
+	if w.Code != 412 {
+		t.Fatalf("Expected 412, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("user1/note.md"); !ok {
+		t.Errorf("Expected the file to be intact")
+	}
+}
+
+func TestDeleteFileIfUnmodifiedSinceCurrentTime(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "original content")
+	original, _ := fake.get("user1/note.md")
+
+	c, w := newTestContext("DELETE", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-Unmodified-Since", original.lastModified.Add(time.Second).UTC().Format(http.TimeFormat))
+	runAsUser(c, handleDeleteFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("user1/note.md"); ok {
+		t.Errorf("Expected the file to be deleted")
+	}
+}
+
+func TestConflictFileNameIsValid(t *testing.T) {
+	now := time.Date(2024, 1, 31, 10, 15, 30, 123000000, time.UTC)
+
+	name := getConflictFileName("note.md", now)
+	if name != "note (conflict 2024-01-31 10-15-30.123).md" {
+		t.Errorf("Expected 'note (conflict 2024-01-31 10-15-30.123).md', actual: '%s'", name)
+	}
+
+	name = getConflictFileName(strings.Repeat("a", 197)+".txt", now)
+	if !isFileNameValid(name) || !strings.HasSuffix(name, ").txt") {
+		t.Errorf("Expected valid conflict file name, actual: '%s'", name)
+	}
+}
+
+func useRejectEmptyContent(t *testing.T, reject bool) {
+	original := REJECT_EMPTY_CONTENT
+	t.Cleanup(func() {
+		REJECT_EMPTY_CONTENT = original
+	})
+
+	SetRejectEmptyContent(reject)
+}
+
+func TestPostEmptyFileAllowedByDefault(t *testing.T) {
+	fake := useFakeS3(t)
+	useRejectEmptyContent(t, false)
+
+	c, w := newTestContext("POST", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("user1/note.md"); !ok {
+		t.Errorf("Expected empty file to be created")
+	}
+}
+
+func TestPostEmptyFileRejectedWhenStrict(t *testing.T) {
+	fake := useFakeS3(t)
+	useRejectEmptyContent(t, true)
+
+	c, w := newTestContext("POST", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+	if fake.count() != 0 {
+		t.Errorf("Expected nothing to be written")
+	}
+}
+
+func useValidateUtf8(t *testing.T, validate bool) {
+	original := VALIDATE_UTF8
+	t.Cleanup(func() {
+		VALIDATE_UTF8 = original
+	})
+
+	SetValidateUtf8(validate)
+}
+
+func TestPutFileWithValidUtf8(t *testing.T) {
+	fake := useFakeS3(t)
+	useValidateUtf8(t, true)
+
+	c, w := newTestContext("PUT", "/files/note.md", "Café ñ 日本 🙂")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "Café ñ 日本 🙂" {
+		t.Errorf("Expected 'Café ñ 日本 🙂', actual: '%s'", string(obj.content))
+	}
+}
+
+func TestPutFileWithInvalidUtf8IsRejected(t *testing.T) {
+	fake := useFakeS3(t)
+	useValidateUtf8(t, true)
+
+	for _, content := range []string{"\xff\xfe", "caf\xe9", "truncated \xe6\x97", "overlong \xc0\xaf"} {
+		c, w := newTestContext("PUT", "/files/note.md", content)
+		c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+		runAsUser(c, handlePutFile, "user1")
+
+		if w.Code != 400 {
+			t.Fatalf("Expected 400 for %q, actual: %d", content, w.Code)
+		}
+	}
+	if fake.count() != 0 {
+		t.Errorf("Expected nothing to be written")
+	}
+}
+
+func TestPostFileWithInvalidUtf8IsRejected(t *testing.T) {
+	fake := useFakeS3(t)
+	useValidateUtf8(t, true)
+
+	c, w := newTestContext("POST", "/files/note.md", "caf\xe9")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+	if fake.count() != 0 {
+		t.Errorf("Expected nothing to be written")
+	}
+}
+
+func TestRenameAndSaveFileWithInvalidUtf8IsRejected(t *testing.T) {
+	fake := useFakeS3(t)
+	useValidateUtf8(t, true)
+	fake.seed("user1/old.md", "old content")
+
+	c, w := newTestContext("POST", "/files/old.md/renameAndSave", "{\"newFileName\": \"new.md\", \"content\": \"caf\xe9\"}")
+	c.Params = gin.Params{{Key: "filename", Value: "old.md"}}
+	runAsUser(c, handleRenameAndSaveFile, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+	if _, ok := fake.get("user1/new.md"); ok {
+		t.Errorf("Expected nothing to be written")
+	}
+	if obj, _ := fake.get("user1/old.md"); string(obj.content) != "old content" {
+		t.Errorf("Expected old file to be intact")
+	}
+}
+
+func TestPostFileWithInvalidUtf8AllowedWhenNotValidating(t *testing.T) {
+	fake := useFakeS3(t)
+	useValidateUtf8(t, false)
+
+	c, w := newTestContext("POST", "/files/note.txt", "caf\xe9")
+	c.Params = gin.Params{{Key: "filename", Value: "note.txt"}}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.txt"); string(obj.content) != "caf\xe9" {
+		t.Errorf("Expected the bytes stored as is, actual: %q", string(obj.content))
+	}
+}
+
+func TestGetFileAsDownload(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/Café \"ñ\" 100%.md", "content")
+
+	c, w := newTestContext("GET", "/files/x?download=true", "")
+	c.Params = gin.Params{{Key: "filename", Value: url.PathEscape("Café \"ñ\" 100%.md")}}
+	runAsUser(c, handleGetFile, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	expected := `attachment; filename="Caf_ ___ 100%.md"; filename*=UTF-8''Caf%C3%A9%20%22%C3%B1%22%20100%25.md`
+	if w.Header().Get("Content-Disposition") != expected {
+		t.Errorf("Expected '%s', actual: '%s'", expected, w.Header().Get("Content-Disposition"))
+	}
+	if w.Body.String() != "content" {
+		t.Errorf("Expected 'content', actual: '%s'", w.Body.String())
+	}
+}
+
+func TestGetFileHasCacheHeaders(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+	obj, _ := fake.get("user1/note.md")
+
+	c, w := newTestContext("GET", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleGetFile, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	if w.Header().Get("Cache-Control") != "private, max-age=0, must-revalidate" {
+		t.Errorf("Expected 'private, max-age=0, must-revalidate', actual: '%s'", w.Header().Get("Cache-Control"))
+	}
+	if w.Header().Get("ETag") != obj.etag {
+		t.Errorf("Expected ETag %s, actual: %s", obj.etag, w.Header().Get("ETag"))
+	}
+
+	c, w = newTestContext("GET", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-None-Match", obj.etag)
+	runAsUser(c, handleGetFile, "user1")
+
+	if w.Code != 304 {
+		t.Fatalf("Expected 304, actual: %d", w.Code)
+	}
+	if w.Header().Get("Cache-Control") == "" || w.Header().Get("ETag") != obj.etag {
+		t.Errorf("Expected the cache headers on 304, actual: '%s' %s", w.Header().Get("Cache-Control"), w.Header().Get("ETag"))
+	}
+}
+
+func TestGetFileNotModifiedHasNoBody(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+	obj, _ := fake.get("user1/note.md")
+
+	c, w := newTestContext("GET", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-None-Match", obj.etag)
+	runAsUser(c, handleGetFile, "user1")
+
+	if w.Code != 304 {
+		t.Fatalf("Expected 304, actual: %d", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected no body, actual: '%s'", w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "" {
+		t.Errorf("Expected no Content-Type, actual: '%s'", w.Header().Get("Content-Type"))
+	}
+	if w.Header().Get("ETag") != obj.etag {
+		t.Errorf("Expected ETag %s, actual: %s", obj.etag, w.Header().Get("ETag"))
+	}
+}
+
+func TestGetFileWeakEtagIsNotModified(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+	obj, _ := fake.get("user1/note.md")
+
+	c, w := newTestContext("GET", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-None-Match", "W/"+obj.etag)
+	runAsUser(c, handleGetFile, "user1")
+
+	if w.Code != 304 {
+		t.Fatalf("Expected 304, actual: %d", w.Code)
+	}
+	if w.Header().Get("ETag") != obj.etag {
+		t.Errorf("Expected ETag %s, actual: %s", obj.etag, w.Header().Get("ETag"))
+	}
+}
+
+func TestGetFileEtagListIsNotModified(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+	obj, _ := fake.get("user1/note.md")
+
+	cases := []http.Header{
+		{"If-None-Match": {`"old-etag", ` + obj.etag}},
+		{"If-None-Match": {`W/"old-etag",W/` + obj.etag}},
+		{"If-None-Match": {`"old-etag"`, obj.etag}}, // the header sent twice
+		{"If-None-Match": {"*"}},
+	}
+	for _, header := range cases {
+		c, w := newTestContext("GET", "/files/note.md", "")
+		c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+		c.Request.Header = header
+		runAsUser(c, handleGetFile, "user1")
+
+		if w.Code != 304 {
+			t.Fatalf("Expected 304 for %v, actual: %d", header, w.Code)
+		}
+		if w.Header().Get("ETag") != obj.etag {
+			t.Errorf("Expected ETag %s for %v, actual: %s", obj.etag, header, w.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestGetFileEtagListWithoutCurrentIsModified(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("GET", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-None-Match", `"old-etag", W/"older-etag"`)
+	runAsUser(c, handleGetFile, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	if w.Body.String() != "content" {
+		t.Errorf("Expected 'content', actual: '%s'", w.Body.String())
+	}
+}
+
+func TestGetFileIsInlineByDefault(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("GET", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleGetFile, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	if w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("Expected no Content-Disposition, actual: '%s'", w.Header().Get("Content-Disposition"))
+	}
+}
+
+func TestGetFileAsJson(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/my note.md", "content")
+	obj, _ := fake.get("user1/my note.md")
+
+	c, w := newTestContext("GET", "/files/my%20note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "my%20note.md"}}
+	c.Request.Header.Set("Accept", "application/json")
+	runAsUser(c, handleGetFile, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("Expected JSON, actual: '%s'", w.Header().Get("Content-Type"))
+	}
+	var out getFileDataOut
+	parseDataResponse(t, w, &out)
+	if out.FileName != "my note.md" || out.Content != "content" || out.ETag != obj.etag {
+		t.Errorf("Expected 'my note.md', 'content', %s, actual: '%s', '%s', %s", obj.etag, out.FileName, out.Content, out.ETag)
+	}
+	if !out.LastModified.Equal(obj.lastModified) {
+		t.Errorf("Expected lastModified %v, actual: %v", obj.lastModified, out.LastModified)
+	}
+	if w.Header().Get("ETag") != obj.etag {
+		t.Errorf("Expected ETag %s, actual: %s", obj.etag, w.Header().Get("ETag"))
+	}
+	if w.Header().Get("Vary") != "Accept" {
+		t.Errorf("Expected Vary: Accept, actual: '%s'", w.Header().Get("Vary"))
+	}
+}
+
+func TestGetFileIsRawByDefault(t *testing.T) {
+	for _, accept := range []string{"", "*/*", "text/plain", "text/plain, application/json"} {
+		fake := useFakeS3(t)
+		fake.seed("user1/note.md", "content")
+
+		c, w := newTestContext("GET", "/files/note.md", "")
+		c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+		if accept != "" {
+			c.Request.Header.Set("Accept", accept)
+		}
+		runAsUser(c, handleGetFile, "user1")
+
+		if w.Code != 200 {
+			t.Fatalf("Expected 200, actual: %d", w.Code)
+		}
+		if w.Body.String() != "content" {
+			t.Errorf("Expected the raw content for Accept '%s', actual: '%s'", accept, w.Body.String())
+		}
+		if w.Header().Get("Content-Type") != getContentType("note.md") {
+			t.Errorf("Expected '%s' for Accept '%s', actual: '%s'", getContentType("note.md"), accept, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestGetFileAsJsonNotModified(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+	obj, _ := fake.get("user1/note.md")
+
+	c, w := newTestContext("GET", "/files/note.md", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("Accept", "application/json")
+	c.Request.Header.Set("If-None-Match", obj.etag)
+	runAsUser(c, handleGetFile, "user1")
+
+	if w.Code != 304 {
+		t.Fatalf("Expected 304, actual: %d", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected no body, actual: '%s'", w.Body.String())
+	}
+}
+
+func TestPostExistingFileGivesExistingEtag(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "existing content")
+	existing, _ := fake.get("user1/note.md")
+
+	c, w := newTestContext("POST", "/files/note.md", "new content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 409 {
+		t.Fatalf("Expected 409, actual: %d", w.Code)
+	}
+	var out existingFileDataOut
+	parseDataResponse(t, w, &out)
+	if out.ETag != existing.etag {
+		t.Errorf("Expected etag %s, actual: %s", existing.etag, out.ETag)
+	}
+	if !out.LastModified.Equal(existing.lastModified) {
+		t.Errorf("Expected lastModified %v, actual: %v", existing.lastModified, out.LastModified)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "existing content" {
+		t.Errorf("Expected existing file to be intact")
+	}
+}
+
+func TestRenameStillWorksWhenStrict(t *testing.T) {
+	fake := useFakeS3(t)
+	useRejectEmptyContent(t, true)
+	fake.seed("user1/old.md", "content")
+
+	c, w := newTestContext("POST", "/rename", `{"fileName": "old.md", "newFileName": "new.md"}`)
+	runAsUser(c, handleRenameFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/new.md"); string(obj.content) != "content" {
+		t.Errorf("Expected file to be renamed")
+	}
+}
+
+func TestPostFileReturnsCreated(t *testing.T) {
+	fake := useFakeS3(t)
+
+	c, w := newTestContext("POST", "/files/new%20note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "new%20note.md"}}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+	obj, ok := fake.get("user1/new note.md")
+	if !ok {
+		t.Fatalf("Expected file to be created")
+	}
+	if w.Header().Get("ETag") != obj.etag {
+		t.Errorf("Expected ETag %s, actual: %s", obj.etag, w.Header().Get("ETag"))
+	}
+	var out postFileDataOut
+	parseDataResponse(t, w, &out)
+	if out.FileName != "new note.md" || out.ETag != obj.etag {
+		t.Errorf("Expected 'new note.md' with ETag %s, actual: '%s' with ETag %s", obj.etag, out.FileName, out.ETag)
+	}
+}
+
+func TestPutFileReturnsNoContent(t *testing.T) {
+	useFakeS3(t)
+
+	c, w := newTestContext("PUT", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+}
+
+func TestPutFileIfNoneMatchCreatesNewFile(t *testing.T) {
+	fake := useFakeS3(t)
+
+	c, w := newTestContext("PUT", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-None-Match", "*")
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); obj == nil || string(obj.content) != "content" {
+		t.Errorf("Expected file to be created")
+	}
+}
+
+func TestPutFileIfNoneMatchExistingFile(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "existing content")
+
+	c, w := newTestContext("PUT", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-None-Match", "*")
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 412 {
+		t.Fatalf("Expected 412, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "existing content" {
+		t.Errorf("Expected existing file to be intact")
+	}
+}
+
+func TestPutFileWithoutIfNoneMatchOverwrites(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "existing content")
+
+	c, w := newTestContext("PUT", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "content" {
+		t.Errorf("Expected existing file to be overwritten")
+	}
+}
+
+func TestPutFileIfNoneMatchOnlySupportsAsterisk(t *testing.T) {
+	useFakeS3(t)
+
+	c, w := newTestContext("PUT", "/files/note.md", "content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-None-Match", `"some-etag"`)
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+}
+
+func TestGetConflictPolicy(t *testing.T) {
+	cases := []struct {
+		policy      string
+		ifMatch     string
+		ifNoneMatch string
+		expected    string
+		valid       bool
+	}{
+		{"", "", "", CONFLICT_POLICY_OVERWRITE, true},
+		{"", `"etag"`, "", CONFLICT_POLICY_IF_MATCH, true},
+		{"", "", "*", CONFLICT_POLICY_CREATE_ONLY, true},
+		{"overwrite", "", "", CONFLICT_POLICY_OVERWRITE, true},
+		{"if-match", `"etag"`, "", CONFLICT_POLICY_IF_MATCH, true},
+		{"create-only", "", "", CONFLICT_POLICY_CREATE_ONLY, true},
+		{"create-only", "", "*", CONFLICT_POLICY_CREATE_ONLY, true},
+		{"if-match", "", "", "", false},
+		{"overwrite", `"etag"`, "", "", false},
+		{"create-only", `"etag"`, "", "", false},
+		{"", `"etag"`, "*", "", false},
+		{"", "", `"etag"`, "", false},
+		{"merge", "", "", "", false},
+	}
+
+	for _, tc := range cases {
+		header := http.Header{}
+		if tc.policy != "" {
+			header.Set("X-Conflict-Policy", tc.policy)
+		}
+		if tc.ifMatch != "" {
+			header.Set("If-Match", tc.ifMatch)
+		}
+		if tc.ifNoneMatch != "" {
+			header.Set("If-None-Match", tc.ifNoneMatch)
+		}
+
+		policy, _, err := getConflictPolicy(header)
+		if tc.valid && (err != nil || policy != tc.expected) {
+			t.Errorf("Expected '%s' for %+v, actual: '%s', %v", tc.expected, tc, policy, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("Expected %+v to be invalid", tc)
+		}
+	}
+}
+
+func putFileWithPolicy(fake *fakeS3, policy string, etag string) int {
+	c, w := newTestContext("PUT", "/files/note.md", "new content")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("X-Conflict-Policy", policy)
+	if etag != "" {
+		c.Request.Header.Set("If-Match", etag)
+	}
+	runAsUser(c, handlePutFile, "user1")
+	return w.Code
+}
+
+func TestPutFileWithOverwritePolicy(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "existing content")
+
+	if code := putFileWithPolicy(fake, "overwrite", ""); code != 204 {
+		t.Fatalf("Expected 204, actual: %d", code)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "new content" {
+		t.Errorf("Expected file to be overwritten")
+	}
+}
+
+func TestPutFileWithIfMatchPolicy(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "existing content")
+	existing, _ := fake.get("user1/note.md")
+
+	if code := putFileWithPolicy(fake, "if-match", fakeEtag([]byte("outdated content"))); code != 412 {
+		t.Fatalf("Expected 412, actual: %d", code)
+	}
+	if code := putFileWithPolicy(fake, "if-match", existing.etag); code != 204 {
+		t.Fatalf("Expected 204, actual: %d", code)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "new content" {
+		t.Errorf("Expected file to be updated")
+	}
+}
+
+func TestPutFileWithCreateOnlyPolicy(t *testing.T) {
+	fake := useFakeS3(t)
+
+	if code := putFileWithPolicy(fake, "create-only", ""); code != 204 {
+		t.Fatalf("Expected 204, actual: %d", code)
+	}
+	if code := putFileWithPolicy(fake, "create-only", ""); code != 412 {
+		t.Fatalf("Expected 412, actual: %d", code)
+	}
+}
+
+func TestPutFileWithUnknownPolicy(t *testing.T) {
+	fake := useFakeS3(t)
+
+	if code := putFileWithPolicy(fake, "merge", ""); code != 400 {
+		t.Fatalf("Expected 400, actual: %d", code)
+	}
+	if fake.count() != 0 {
+		t.Errorf("Expected nothing to be written")
+	}
+}
+
+func TestGetFilesReturnsSizeAndContentType(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "12345")
+	fake.seed("user1/note.txt", "1234567890")
+
+	c, w := newTestContext("GET", "/files", "")
+	runAsUser(c, handleGetFiles, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getFilesDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 2 {
+		t.Fatalf("Expected 2 files, actual: %d", len(out.Files))
+	}
+	for _, file := range out.Files {
+		switch file.FileName {
+		case "note.md":
+			if file.Size != 5 || file.ContentType != "text/markdown; charset=UTF-8" {
+				t.Errorf("Expected 5 bytes of markdown, actual: %d bytes of '%s'", file.Size, file.ContentType)
+			}
+		case "note.txt":
+			if file.Size != 10 || file.ContentType != "text/plain; charset=UTF-8" {
+				t.Errorf("Expected 10 bytes of text, actual: %d bytes of '%s'", file.Size, file.ContentType)
+			}
+		default:
+			t.Errorf("Unexpected file '%s'", file.FileName)
+		}
+	}
+}
+
+func TestFileExists(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/taken.md", "content")
+	obj, _ := fake.get("user1/taken.md")
+
+	c, w := newTestContext("GET", "/files/taken.md/exists", "")
+	c.Params = gin.Params{{Key: "filename", Value: "taken.md"}}
+	runAsUser(c, handleFileExists, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out fileExistsDataOut
+	parseDataResponse(t, w, &out)
+	if !out.Exists || out.ETag != obj.etag || out.LastModified == nil {
+		t.Errorf("Expected the file to exist with ETag %s, actual: %+v", obj.etag, out)
+	}
+}
+
+func TestFileDoesNotExist(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user2/free.md", "someone else's note")
+
+	c, w := newTestContext("GET", "/files/free.md/exists", "")
+	c.Params = gin.Params{{Key: "filename", Value: "free.md"}}
+	runAsUser(c, handleFileExists, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	if w.Body.String() != `{"data":{"exists":false}}` {
+		t.Errorf("Expected only exists false, actual: %s", w.Body.String())
+	}
+	if fake.count() != 1 {
+		t.Errorf("Expected nothing to be created")
+	}
+}
+
+func assertNothingChanged(t *testing.T, fake *fakeS3, before map[string]string) {
+	after := fake.snapshot()
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("Expected nothing to change, before: %v, after: %v", before, after)
+	}
+}
+
+func TestBatchDeleteFilesDryRun(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note 1.md", "content")
+	fake.seed("user1/note 2.md", "content")
+	before := fake.snapshot()
+
+	c, w := newTestContext("POST", "/files/batch/delete?dryRun=true", `{"fileNames": ["note 1.md", "missing.md", "note 2.md"]}`)
+	runAsUser(c, handleBatchDeleteFiles, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out dryRunDataOut
+	parseDataResponse(t, w, &out)
+	if !out.DryRun || out.Action != DRY_RUN_ACTION_DELETE || out.Count != 2 {
+		t.Errorf("Expected dry run deleting 2 files, actual: %v %s %d", out.DryRun, out.Action, out.Count)
+	}
+	if len(out.Files) != 2 || out.Files[0].FileName != "note 1.md" || out.Files[1].FileName != "note 2.md" {
+		t.Errorf("Expected the existing files in the request order, actual: %v", out.Files)
+	}
+	assertNothingChanged(t, fake, before)
+}
+
+func TestBatchDeleteFilesDryRunStillValidates(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("POST", "/files/batch/delete?dryRun=true", `{"fileNames": ["../user2/note.md"]}`)
+	runAsUser(c, handleBatchDeleteFiles, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+}
+
+func TestDeleteAllFilesDryRun(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note 1.md", "content")
+	fake.seed("user1/work/note 2.md", "content")
+	fake.seed("user1/.trash/old.md", "content")
+	fake.seed("user2/note.md", "someone else's note")
+	before := fake.snapshot()
+
+	c, w := newTestContext("POST", "/deleteall?dryRun=true", `{"confirm": "DELETE ALL"}`)
+	runAsUser(c, handleDeleteAllFiles, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out dryRunDataOut
+	parseDataResponse(t, w, &out)
+	if out.Action != DRY_RUN_ACTION_MOVE_TO_TRASH || out.Count != 2 {
+		t.Errorf("Expected 2 files moved to trash, actual: %s %d", out.Action, out.Count)
+	}
+	assertNothingChanged(t, fake, before)
+
+	c, w = newTestContext("POST", "/deleteall?dryRun=true&permanent=true", `{"confirm": "DELETE ALL"}`)
+	runAsUser(c, handleDeleteAllFiles, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	out = dryRunDataOut{}
+	parseDataResponse(t, w, &out)
+	if out.Action != DRY_RUN_ACTION_DELETE || out.Count != 3 {
+		t.Errorf("Expected 3 files deleted, including the trash, actual: %s %d", out.Action, out.Count)
+	}
+	assertNothingChanged(t, fake, before)
+}
+
+func TestDeleteAllFilesDryRunRequiresConfirmation(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("POST", "/deleteall?dryRun=true", `{"confirm": "yes"}`)
+	runAsUser(c, handleDeleteAllFiles, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+}
+
+func TestRenameFileDryRun(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/old.md", "content")
+	fake.seed("user1/taken.md", "content")
+	before := fake.snapshot()
+
+	c, w := newTestContext("POST", "/rename?dryRun=true", `{"fileName": "old.md", "newFileName": "new.md"}`)
+	runAsUser(c, handleRenameFile, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out dryRunDataOut
+	parseDataResponse(t, w, &out)
+	if out.Action != DRY_RUN_ACTION_RENAME || out.Count != 1 || out.Files[0].FileName != "old.md" || out.Files[0].NewFileName != "new.md" {
+		t.Errorf("Expected old.md to be renamed to new.md, actual: %s %v", out.Action, out.Files)
+	}
+	assertNothingChanged(t, fake, before)
+
+	c, w = newTestContext("POST", "/rename?dryRun=true", `{"fileName": "old.md", "newFileName": "taken.md"}`)
+	runAsUser(c, handleRenameFile, "user1")
+
+	if w.Code != 409 {
+		t.Errorf("Expected 409, actual: %d", w.Code)
+	}
+
+	c, w = newTestContext("POST", "/rename?dryRun=true", `{"fileName": "missing.md", "newFileName": "new.md"}`)
+	runAsUser(c, handleRenameFile, "user1")
+
+	if w.Code != 404 {
+		t.Errorf("Expected 404, actual: %d", w.Code)
+	}
+	assertNothingChanged(t, fake, before)
+}
+
+func TestMoveFileDryRun(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/work/note.md", "content")
+	before := fake.snapshot()
+
+	c, w := newTestContext("POST", "/move?dryRun=true", `{"fileName": "note.md", "fromFolder": "work", "toFolder": ""}`)
+	runAsUser(c, handleMoveFile, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out dryRunDataOut
+	parseDataResponse(t, w, &out)
+	if out.Action != DRY_RUN_ACTION_MOVE || out.Count != 1 || out.Files[0].FileName != "work/note.md" || out.Files[0].NewFileName != "note.md" {
+		t.Errorf("Expected work/note.md to be moved to note.md, actual: %s %v", out.Action, out.Files)
+	}
+	assertNothingChanged(t, fake, before)
+}
+
+func usePageSize(t *testing.T, pageSize int) {
+	maxKeys := S3_MAX_KEYS
+	t.Cleanup(func() {
+		S3_MAX_KEYS = maxKeys
+	})
+	S3_MAX_KEYS = pageSize
+}
+
+func TestGetManifestGoesThroughAllPages(t *testing.T) {
+	fake := useFakeS3(t)
+	usePageSize(t, 2)
+	for i := 0; i < 5; i++ {
+		fake.seed(fmt.Sprintf("user1/note%d.md", i), fmt.Sprintf("content %d", i))
+	}
+	fake.seed("user1/work/nested.md", "not in the root")
+	fake.seed("user2/other.md", "not mine")
+
+	c, w := newTestContext("GET", "/manifest", "")
+	runAsUser(c, handleGetManifest, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var out getManifestDataOut
+	parseDataResponse(t, w, &out)
+	if out.HasMore {
+		t.Errorf("Expected no more files")
+	}
+	if len(out.Files) != 5 {
+		t.Fatalf("Expected 5 files, actual: %d", len(out.Files))
+	}
+	for i, file := range out.Files {
+		obj, _ := fake.get("user1/" + file.FileName)
+		if file.FileName != fmt.Sprintf("note%d.md", i) || file.ETag != obj.etag || file.Size != int64(len(obj.content)) {
+			t.Errorf("Unexpected file %d: %+v", i, file)
+		}
+	}
+}
+
+func TestGetManifestIsCapped(t *testing.T) {
+	fake := useFakeS3(t)
+	usePageSize(t, 2)
+	maxFiles := MANIFEST_MAX_FILES
+	t.Cleanup(func() {
+		MANIFEST_MAX_FILES = maxFiles
+	})
+	MANIFEST_MAX_FILES = 3
+	for i := 0; i < 5; i++ {
+		fake.seed(fmt.Sprintf("user1/note%d.md", i), "content")
+	}
+
+	c, w := newTestContext("GET", "/manifest", "")
+	runAsUser(c, handleGetManifest, "user1")
+
+	var out getManifestDataOut
+	parseDataResponse(t, w, &out)
+	if !out.HasMore || len(out.Files) != 3 {
+		t.Errorf("Expected 3 files and more, actual: %d %v", len(out.Files), out.HasMore)
+	}
+}
+
+func TestGetManifestGzipped(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "content")
+
+	c, w := newTestContext("GET", "/manifest", "")
+	c.Request.Header.Set("Accept-Encoding", "deflate, gzip;q=0.9")
+	runAsUser(c, handleGetManifest, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected gzipped response, actual: '%s'", w.Header().Get("Content-Encoding"))
+	}
+	body, err := decompress(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Error decompressing: %s", err)
+	}
+	var response struct {
+		Data getManifestDataOut `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatalf("Error parsing body: %s", err)
+	}
+	if len(response.Data.Files) != 1 || response.Data.Files[0].FileName != "note.md" {
+		t.Errorf("Expected note.md, actual: %+v", response.Data.Files)
+	}
+}
+
+func TestGetChecksum(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "hello world")
+	obj, _ := fake.get("user1/note.md")
+
+	c, w := newTestContext("GET", "/files/note.md/checksum", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleGetChecksum, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var checksum getChecksumDataOut
+	parseDataResponse(t, w, &checksum)
+	if checksum.Sha256 != "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9" {
+		t.Errorf("Expected sha256 of 'hello world', actual: %s", checksum.Sha256)
+	}
+	if checksum.Size != 11 {
+		t.Errorf("Expected size 11, actual: %d", checksum.Size)
+	}
+	if checksum.ETag != obj.etag {
+		t.Errorf("Expected etag %s, actual: %s", obj.etag, checksum.ETag)
+	}
+
+	c, w = newTestContext("GET", "/files/note.md/checksum", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-None-Match", obj.etag)
+	runAsUser(c, handleGetChecksum, "user1")
+
+	if w.Code != 304 {
+		t.Errorf("Expected 304, actual: %d", w.Code)
+	}
+}
+
+func TestGetChecksumWithWeakOrListedIfNoneMatch(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "hello world")
+	obj, _ := fake.get("user1/note.md")
+
+	for _, ifNoneMatch := range []string{"W/" + obj.etag, `"other", ` + obj.etag, "*"} {
+		c, w := newTestContext("GET", "/files/note.md/checksum", "")
+		c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+		c.Request.Header.Set("If-None-Match", ifNoneMatch)
+		runAsUser(c, handleGetChecksum, "user1")
+
+		if w.Code != 304 {
+			t.Errorf("Expected 304 for '%s', actual: %d", ifNoneMatch, w.Code)
+		}
+	}
+
+	c, w := newTestContext("GET", "/files/note.md/checksum", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	c.Request.Header.Set("If-None-Match", `"other"`)
+	runAsUser(c, handleGetChecksum, "user1")
+
+	if w.Code != 200 {
+		t.Errorf("Expected 200 for another etag, actual: %d", w.Code)
+	}
+}
+
+func TestGetChecksumOfCompressedFile(t *testing.T) {
+	fake := useFakeS3(t)
+	useCompressAtRest(t, 0)
+	c, w := newTestContext("POST", "/files/note.md", "hello world")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePostFile, "user1")
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); obj.encoding != CONTENT_ENCODING_GZIP {
+		t.Fatalf("Expected the note to be compressed")
+	}
+
+	c, w = newTestContext("GET", "/files/note.md/checksum", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleGetChecksum, "user1")
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var checksum getChecksumDataOut
+	parseDataResponse(t, w, &checksum)
+	if checksum.Sha256 != "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9" || checksum.Size != 11 {
+		t.Errorf("Expected the checksum of the decompressed content, actual: %s, %d", checksum.Sha256, checksum.Size)
+	}
+}
+
+func TestGetChecksumOfMissingFile(t *testing.T) {
+	useFakeS3(t)
+
+	c, w := newTestContext("GET", "/files/note.md/checksum", "")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handleGetChecksum, "user1")
+
+	if w.Code != 404 {
+		t.Errorf("Expected 404, actual: %d", w.Code)
+	}
+}
+
+// The fields are written in order, the "file:" prefix in the name makes it the file part
+func newMultipartTestContext(t *testing.T, method string, target string, fields [][2]string) (*gin.Context, *httptest.ResponseRecorder) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, field := range fields {
+		if name := strings.TrimPrefix(field[0], "file:"); name != field[0] {
+			part, err := mw.CreateFormFile(name, "note.md")
+			if err != nil {
+				t.Fatal(err)
+			}
+			part.Write([]byte(field[1]))
+			continue
+		}
+		mw.WriteField(field[0], field[1])
+	}
+	mw.Close()
+
+	c, w := newTestContext(method, target, body.String())
+	c.Request.Header.Set("Content-Type", mw.FormDataContentType())
+	return c, w
+}
+
+func TestPostFileAsRawBody(t *testing.T) {
+	fake := useFakeS3(t)
+
+	c, w := newTestContext("POST", "/files/note.md", "content=not a form")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "content=not a form" {
+		t.Errorf("Expected the body as is, actual: '%s'", string(obj.content))
+	}
+}
+
+func TestPostFileAsMultipartForm(t *testing.T) {
+	fake := useFakeS3(t)
+
+	c, w := newMultipartTestContext(t, "POST", "/files/note.md", [][2]string{{"filename", "note.md"}, {"content", "# From the form"}})
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "# From the form" {
+		t.Errorf("Expected the content field, actual: '%s'", string(obj.content))
+	}
+}
+
+func TestPutFileAsMultipartFormFile(t *testing.T) {
+	fake := useFakeS3(t)
+
+	c, w := newMultipartTestContext(t, "PUT", "/files/note.md", [][2]string{{"file:content", "# From the file"}})
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+	if obj, _ := fake.get("user1/note.md"); string(obj.content) != "# From the file" {
+		t.Errorf("Expected the content file, actual: '%s'", string(obj.content))
+	}
+}
+
+func TestMultipartFormIsValidated(t *testing.T) {
+	fake := useFakeS3(t)
+
+	cases := [][][2]string{
+		{{"content", strings.Repeat("a", 102401)}},
+		{{"filename", "other.md"}, {"content", "content"}},
+		{{"title", "no content"}},
+	}
+	for _, fields := range cases {
+		c, w := newMultipartTestContext(t, "POST", "/files/note.md", fields)
+		c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+		runAsUser(c, handlePostFile, "user1")
+
+		if w.Code != 400 {
+			t.Errorf("Expected 400, actual: %d", w.Code)
+		}
+	}
+	if fake.count() != 0 {
+		t.Errorf("Expected nothing to be saved, actual: %d objects", fake.count())
+	}
+}
+
+func TestPostFileUniqueSavesUnderUniqueFileName(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "existing")
+
+	c, w := newTestContext("POST", "/files/note.md?unique=true", "new")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+	var postFileOut postFileDataOut
+	parseDataResponse(t, w, &postFileOut)
+	if !strings.HasPrefix(postFileOut.FileName, "note~~") {
+		t.Errorf("Expected the unique file name, actual: '%s'", postFileOut.FileName)
+	}
+	if obj, ok := fake.get("user1/" + postFileOut.FileName); !ok || string(obj.content) != "new" {
+		t.Errorf("Expected the note under the unique file name")
+	}
+}
+
+func TestPostFileWithKeyTooLongGivesBadRequest(t *testing.T) {
+	fake := useFakeS3(t)
+	useMaxFileNameLength(t, S3_MAX_KEY_LENGTH)
+	fileName := strings.Repeat("a", S3_MAX_KEY_LENGTH-3) + ".md"
+
+	c, w := newTestContext("POST", "/files/"+fileName, "content")
+	c.Params = gin.Params{{Key: "filename", Value: fileName}}
+	runAsUser(c, handlePostFile, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "too long for the storage") {
+		t.Errorf("Expected the key limit error, actual: %s", w.Body.String())
+	}
+	if fake.count() != 0 {
+		t.Errorf("Expected nothing to be saved, actual: %d objects", fake.count())
+	}
+}
+
+// Only proves anything under the race detector, go test -race
+func TestHandlersAreSafeForConcurrentUse(t *testing.T) {
+	fake := useFakeS3(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			fileName := fmt.Sprintf("note%d.md", i)
+			c, w := newTestContext("PUT", "/files/"+fileName, "content")
+			c.Params = gin.Params{{Key: "filename", Value: fileName}}
+			runAsUser(c, handlePutFile, "user1")
+			if w.Code != 204 {
+				t.Errorf("Expected 204 saving %s, actual: %d", fileName, w.Code)
+			}
+
+			c, w = newTestContext("GET", "/files/"+fileName, "")
+			c.Params = gin.Params{{Key: "filename", Value: fileName}}
+			runAsUser(c, handleGetFile, "user1")
+			if w.Code != 200 {
+				t.Errorf("Expected 200 reading %s, actual: %d", fileName, w.Code)
+			}
+
+			c, w = newTestContext("GET", "/files", "")
+			runAsUser(c, handleGetFiles, "user1")
+			if w.Code != 200 {
+				t.Errorf("Expected 200 listing, actual: %d", w.Code)
+			}
+		}(i)
+
+		// set on start only, but should be fine anytime
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			InitBucket("test-bucket")
+		}()
+	}
+	wg.Wait()
+
+	if fake.count() != 20 {
+		t.Errorf("Expected 20 files, actual: %d", fake.count())
+	}
+}
@@ -0,0 +1,152 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+var APPLY_TAGS_MAX_FILES = 1000 // every file takes 2 S3 calls
+
+type applyTagsDataIn struct {
+	FileNames  []string `json:"fileNames" binding:"required"`
+	AddTags    []string `json:"addTags"`
+	RemoveTags []string `json:"removeTags"`
+}
+
+type applyTagsDataOut struct {
+	Files []*applyTagsFileDataOut `json:"files"`
+}
+
+type applyTagsFileDataOut struct {
+	FileName string   `json:"fileName"`
+	Applied  bool     `json:"applied"`
+	Tags     []string `json:"tags,omitempty"` // all the tags of the file after the change, sorted
+	Error    string   `json:"err,omitempty"`
+}
+
+type ApplyTagsResult struct {
+	FileName string
+	Tags     []string
+	Err      error
+}
+
+// Applies the same tag changes to every file, concurrently, within the limit shared by all the fan-out operations.
+//
+// Returns the results in the same order as the files.
+// One failing file doesn't stop the others, its error is in the result.
+func applyTagsToFiles(ctx context.Context, bucket string, prefix string, fileNames []string, addTags []string, removeTags []string) []*ApplyTagsResult {
+	results := make([]*ApplyTagsResult, len(fileNames))
+	for i, fileName := range fileNames {
+		results[i] = &ApplyTagsResult{
+			FileName: fileName,
+			Err:      ErrServiceUnavailable, // until applied
+		}
+	}
+
+	limiter := _s3Limiter
+	var wg sync.WaitGroup
+	for i, fileName := range fileNames {
+		if err := limiter.Acquire(ctx); err != nil {
+			log.Printf("%v", err)
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, fileName string) {
+			defer wg.Done()
+			defer limiter.Release()
+
+			tags, err := applyFileTags(ctx, bucket, prefix, fileName, addTags, removeTags)
+			results[i].Tags = tags
+			results[i].Err = err
+		}(i, fileName)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// Adds and removes the tags on many notes at once, e.g. to organize a batch of notes.
+// The existing tags of every note are kept, unless removed explicitly.
+//
+// The response has the result for every file, in the same order, with all the tags of the file after the change.
+// The file that doesn't exist, or would end up with too many tags, is left as it is, and reported with the error.
+func handleApplyTags(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+
+	// get app data from the POST body
+	var applyTagsIn applyTagsDataIn
+	if err := c.ShouldBindJSON(&applyTagsIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// sanitize
+	if len(applyTagsIn.FileNames) > APPLY_TAGS_MAX_FILES {
+		err := fmt.Errorf("too many fileNames, should be less or equal than %d", APPLY_TAGS_MAX_FILES)
+		toBadRequest(c, err)
+		return
+	}
+	if len(applyTagsIn.AddTags) == 0 && len(applyTagsIn.RemoveTags) == 0 {
+		err := fmt.Errorf("invalid tags, either addTags or removeTags should be given")
+		toBadRequest(c, err)
+		return
+	}
+	if len(applyTagsIn.AddTags) > MAX_NOTE_TAGS || len(applyTagsIn.RemoveTags) > MAX_NOTE_TAGS {
+		err := fmt.Errorf("too many tags, should be less or equal than %d", MAX_NOTE_TAGS)
+		toBadRequest(c, err)
+		return
+	}
+	for _, tags := range [][]string{applyTagsIn.AddTags, applyTagsIn.RemoveTags} {
+		for _, tag := range tags {
+			if !isTagValid(tag) {
+				err := fmt.Errorf("invalid tag '%s', should be up to %d letters, digits, spaces or any of '+-=._:@'", tag, MAX_TAG_LENGTH)
+				toBadRequest(c, err)
+				return
+			}
+		}
+	}
+	fileNames := make([]string, 0, len(applyTagsIn.FileNames))
+	for _, fileNameIn := range applyTagsIn.FileNames {
+		if err := validateFileName(fileNameIn); err != nil {
+			err := fmt.Errorf("invalid fileName '%s', %v", fileNameIn, err)
+			toBadRequest(c, err)
+			return
+		}
+		fileName, err := url.PathUnescape(fileNameIn)
+		if err != nil {
+			err := fmt.Errorf("invalid fileName '%s', could not decode", fileNameIn)
+			toBadRequest(c, err)
+			return
+		}
+		fileNames = append(fileNames, fileName)
+	}
+
+	// apply the tags
+	results := applyTagsToFiles(c.Request.Context(), getBucket(), prefix, fileNames, applyTagsIn.AddTags, applyTagsIn.RemoveTags)
+
+	// pack result
+	files := make([]*applyTagsFileDataOut, 0, len(results))
+	for _, result := range results {
+		file := &applyTagsFileDataOut{
+			FileName: result.FileName,
+			Applied:  result.Err == nil,
+			Tags:     result.Tags,
+		}
+		if result.Err != nil {
+			file.Error = result.Err.Error()
+			if errors.Is(result.Err, ErrTooManyTags) {
+				file.Error = fmt.Sprintf("%v, should be less or equal than %d", result.Err, MAX_NOTE_TAGS)
+			}
+		}
+		files = append(files, file)
+	}
+
+	toSuccess(c, &applyTagsDataOut{Files: files})
+}
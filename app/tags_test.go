@@ -0,0 +1,153 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+func TestApplyTagsToSeveralNotes(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/a.md", "a")
+	fake.seed("user1/b.md", "b")
+	fake.seed("user1/c.md", "c")
+
+	c, w := newTestContext("PUT", "/files/a.md/sharing", `{"public": true}`)
+	c.Params = gin.Params{{Key: "filename", Value: "a.md"}}
+	runAsUser(c, handleSetSharing, "user1")
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+
+	c, w = newTestContext("POST", "/tags/apply", `{"fileNames": ["a.md", "b.md"], "addTags": ["work"]}`)
+	runAsUser(c, handleApplyTags, "user1")
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+
+	c, w = newTestContext("POST", "/tags/apply", `{"fileNames": ["b.md", "missing.md"], "addTags": ["urgent"], "removeTags": ["work"]}`)
+	runAsUser(c, handleApplyTags, "user1")
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+
+	var out applyTagsDataOut
+	parseDataResponse(t, w, &out)
+	if len(out.Files) != 2 {
+		t.Fatalf("Expected 2 files, actual: %d", len(out.Files))
+	}
+	if !out.Files[0].Applied || !reflect.DeepEqual(out.Files[0].Tags, []string{"urgent"}) {
+		t.Errorf("Expected b.md to have only 'urgent', actual: %+v", out.Files[0])
+	}
+	if out.Files[1].Applied || out.Files[1].Error == "" {
+		t.Errorf("Expected missing.md to fail, actual: %+v", out.Files[1])
+	}
+
+	tags, _ := getFileTags(context.Background(), getBucket(), "user1/", "a.md")
+	if !isTaggedPublic(tags) || !reflect.DeepEqual(getNoteTags(tags), []string{"work"}) {
+		t.Errorf("Expected a.md to stay public and have 'work', actual: %v", tags)
+	}
+	if obj, _ := fake.get("user1/c.md"); len(obj.tags) != 0 {
+		t.Errorf("Expected c.md to be untouched")
+	}
+}
+
+func TestSavingNoteKeepsTags(t *testing.T) {
+	useFakeS3(t)
+	postTestNote(t, "note.md", "", "")
+
+	_, err := applyFileTags(context.Background(), getBucket(), "user1/", "note.md", []string{"work"}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, actual: '%v'", err)
+	}
+
+	c, w := newTestContext("PUT", "/files/note.md", "updated")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+
+	tags, _ := getFileTags(context.Background(), getBucket(), "user1/", "note.md")
+	if !reflect.DeepEqual(getNoteTags(tags), []string{"work"}) {
+		t.Errorf("Expected the tags to be kept, actual: %v", tags)
+	}
+}
+
+func TestSavingEmptyNoteKeepsTags(t *testing.T) {
+	fake := useFakeS3(t)
+	fake.seed("user1/note.md", "")
+
+	_, err := applyFileTags(context.Background(), getBucket(), "user1/", "note.md", []string{"work"}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, actual: '%v'", err)
+	}
+
+	c, w := newTestContext("PUT", "/files/note.md", "updated")
+	c.Params = gin.Params{{Key: "filename", Value: "note.md"}}
+	runAsUser(c, handlePutFile, "user1")
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, actual: %d", w.Code)
+	}
+
+	tags, _ := getFileTags(context.Background(), getBucket(), "user1/", "note.md")
+	if !reflect.DeepEqual(getNoteTags(tags), []string{"work"}) {
+		t.Errorf("Expected the tags to be kept, actual: %v", tags)
+	}
+}
+
+// Counts the calls for the tags and the metadata
+type stateCountingS3 struct {
+	*fakeS3
+	mu              sync.Mutex
+	taggingCalls    int
+	headObjectCalls int
+}
+
+func (fake *stateCountingS3) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	fake.mu.Lock()
+	fake.taggingCalls++
+	fake.mu.Unlock()
+	return fake.fakeS3.GetObjectTagging(ctx, params, optFns...)
+}
+
+func (fake *stateCountingS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	fake.mu.Lock()
+	fake.headObjectCalls++
+	fake.mu.Unlock()
+	return fake.fakeS3.HeadObject(ctx, params, optFns...)
+}
+
+func TestSavingUntaggedNoteDoesNotFetchTags(t *testing.T) {
+	fake := &stateCountingS3{fakeS3: useFakeS3(t)}
+	newS3Client = func() (s3Client, error) { return fake, nil }
+	fake.seed("user1/note.md", "content")
+
+	_, err := saveFileContent(context.Background(), getBucket(), "user1/", "note.md", "updated", true, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, actual: '%v'", err)
+	}
+
+	if fake.taggingCalls != 0 || fake.headObjectCalls != 0 {
+		t.Errorf("Expected only the one-byte read before the write, actual: %d tagging and %d head calls", fake.taggingCalls, fake.headObjectCalls)
+	}
+}
+
+func TestApplyTagsRejectsTooManyTags(t *testing.T) {
+	useFakeS3(t)
+	postTestNote(t, "note.md", "", "")
+
+	_, err := applyFileTags(context.Background(), getBucket(), "user1/", "note.md", []string{"1", "2", "3", "4", "5", "6", "7", "8"}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, actual: '%v'", err)
+	}
+	_, err = applyFileTags(context.Background(), getBucket(), "user1/", "note.md", []string{"9"}, nil)
+	if !errors.Is(err, ErrTooManyTags) {
+		t.Errorf("Expected too many tags, actual: '%v'", err)
+	}
+}
@@ -0,0 +1,129 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The note with the empty title is stored as the prefix followed by the timestamp, i.e. "~~1426963430173.txt"
+var UNTITLED_FILE_NAME_PREFIX = "~~"
+
+var UNTITLED_MAX_ATTEMPTS = 5 // every attempt takes the next millisecond
+
+func SetUntitledFileNamePrefix(prefix string) error {
+	if !isFileNameValid(getUntitledFileName(prefix, time.Now(), ".txt")) {
+		return fmt.Errorf("invalid untitled file name prefix '%s', should make the valid file name, check the requirements", prefix)
+	}
+	UNTITLED_FILE_NAME_PREFIX = prefix
+	return nil
+}
+
+type createUntitledDataIn struct {
+	Ext string `form:"ext"`
+}
+
+func getUntitledFileName(prefix string, t time.Time, ext string) string {
+	return prefix + strconv.FormatInt(t.UnixMilli(), 10) + ext
+}
+
+// The extension from the query wins, e.g. "md" or ".md", then the one of the content type, ".txt" by default
+func getUntitledExtension(ext string, contentType string) (string, error) {
+	if ext != "" {
+		ext = "." + strings.TrimPrefix(ext, ".")
+		if ext != ".md" && ext != ".txt" {
+			return "", fmt.Errorf("invalid ext '%s', should be 'md' or 'txt'", ext)
+		}
+		return ext, nil
+	}
+	if contentType == "text/markdown" {
+		return ".md", nil
+	}
+	return ".txt", nil
+}
+
+// Creates the note with the empty title, under the file name generated from the timestamp, so the clients don't have to.
+// When the file name is taken, e.g. two notes created within the same millisecond, the next millisecond is tried.
+//
+// The response has the generated file name and the etag, same as POST /files/:filename.
+// The note metadata can be given in X-Note-Title and X-Note-Created headers, created defaults to now.
+func handleCreateUntitled(c *gin.Context, userId string, email string) {
+	prefix := userPrefix(c, userId)
+
+	// get params from query string
+	var createUntitledIn createUntitledDataIn
+	if err := c.ShouldBindQuery(&createUntitledIn); err != nil {
+		toBindingError(c, err)
+		return
+	}
+
+	// get params from headers
+	meta, err := getNoteMetadataFromHeaders(c.Request.Header)
+	if err != nil {
+		toBadRequest(c, err)
+		return
+	}
+
+	// read body
+	content, formFileName, err := readBody(c)
+	if err != nil {
+		toBadRequest(c, err)
+		return
+	}
+
+	// sanitize
+	ext, err := getUntitledExtension(createUntitledIn.Ext, c.ContentType())
+	if err != nil {
+		toBadRequest(c, err)
+		return
+	}
+	if formFileName != "" {
+		err := fmt.Errorf("invalid form filename '%s', the file name is generated", formFileName)
+		toBadRequest(c, err)
+		return
+	}
+	content, err = sanitizeContent(ext, content) // the file name is not generated yet, only the extension matters
+	if err != nil {
+		toBadRequest(c, err)
+		return
+	}
+	if REJECT_EMPTY_CONTENT && content == "" {
+		err := fmt.Errorf("invalid content, should not be empty")
+		toBadRequest(c, err)
+		return
+	}
+
+	// save file content, under the first free file name
+	now := time.Now()
+	for attempt := 0; attempt < UNTITLED_MAX_ATTEMPTS; attempt++ {
+		fileName := getUntitledFileName(UNTITLED_FILE_NAME_PREFIX, now.Add(time.Duration(attempt)*time.Millisecond), ext)
+		result, err := getStorage().SaveFileContent(c.Request.Context(), getBucket(), prefix, fileName, content, false, meta)
+		if err != nil {
+			if errors.Is(err, ErrAlreadyExists) {
+				continue
+			}
+
+			toInternalServerError(c, err.Error())
+			return
+		}
+
+		recordAudit(c, userId, &auditEntry{
+			Action:   AUDIT_ACTION_CREATE,
+			FileName: fileName,
+			ETag:     result.ETag,
+		})
+
+		toCreatedWithEtag(c, &postFileDataOut{
+			FileName: fileName,
+			ETag:     result.ETag,
+		}, result.ETag)
+		return
+	}
+
+	err = fmt.Errorf("%w, could not find the free file name in %d attempts", ErrAlreadyExists, UNTITLED_MAX_ATTEMPTS)
+	toConflict(c, err, nil)
+}
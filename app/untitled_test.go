@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Another note shows up under the same file name right before every create, as many times as given
+type collidingS3 struct {
+	*fakeS3
+	collisions int
+}
+
+func (fake *collidingS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if params.IfNoneMatch != nil && fake.collisions > 0 {
+		fake.collisions--
+		fake.seed(aws.ToString(params.Key), "created concurrently")
+	}
+	return fake.fakeS3.PutObject(ctx, params, optFns...)
+}
+
+func TestGetUntitledExtension(t *testing.T) {
+	cases := []struct {
+		ext         string
+		contentType string
+		expected    string
+	}{
+		{"md", "", ".md"},
+		{".txt", "text/markdown", ".txt"},
+		{"", "text/markdown", ".md"},
+		{"", "text/plain", ".txt"},
+		{"", "", ".txt"},
+	}
+
+	for _, tc := range cases {
+		actual, err := getUntitledExtension(tc.ext, tc.contentType)
+		if err != nil {
+			t.Errorf("Unexpected error for '%s': %v", tc.ext, err)
+		}
+		if actual != tc.expected {
+			t.Errorf("Expected '%s' for '%s' and '%s', actual: '%s'", tc.expected, tc.ext, tc.contentType, actual)
+		}
+	}
+
+	if _, err := getUntitledExtension("json", ""); err == nil {
+		t.Errorf("Expected error for 'json'")
+	}
+}
+
+func TestCreateUntitled(t *testing.T) {
+	fake := useFakeS3(t)
+
+	c, w := newTestContext("POST", "/files?ext=md", "# Note")
+	runAsUser(c, handleCreateUntitled, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+	var postFileOut postFileDataOut
+	parseDataResponse(t, w, &postFileOut)
+	if !strings.HasPrefix(postFileOut.FileName, "~~") || !strings.HasSuffix(postFileOut.FileName, ".md") {
+		t.Errorf("Expected the generated file name, actual: '%s'", postFileOut.FileName)
+	}
+	obj, ok := fake.get("user1/" + postFileOut.FileName)
+	if !ok {
+		t.Fatalf("Expected the note to be saved")
+	}
+	if obj.etag != postFileOut.ETag || w.Header().Get("ETag") != postFileOut.ETag {
+		t.Errorf("Expected the etag of the saved note")
+	}
+}
+
+func TestCreateUntitledIsUniqueOnCollision(t *testing.T) {
+	fake := &collidingS3{fakeS3: useFakeS3(t), collisions: 2}
+	newS3Client = func() (s3Client, error) { return fake, nil }
+
+	c, w := newTestContext("POST", "/files", "my note")
+	runAsUser(c, handleCreateUntitled, "user1")
+
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, actual: %d", w.Code)
+	}
+	var postFileOut postFileDataOut
+	parseDataResponse(t, w, &postFileOut)
+	if fake.count() != 3 {
+		t.Errorf("Expected 2 colliding notes and the new one, actual: %d objects", fake.count())
+	}
+	if obj, _ := fake.get("user1/" + postFileOut.FileName); string(obj.content) != "my note" {
+		t.Errorf("Expected the note under the free file name, actual: '%s'", string(obj.content))
+	}
+	for key, obj := range fake.objects {
+		if key != "user1/"+postFileOut.FileName && string(obj.content) != "created concurrently" {
+			t.Errorf("Expected the colliding note '%s' to be kept", key)
+		}
+	}
+}
+
+func TestCreateUntitledGivesConflictWhenNoFreeFileName(t *testing.T) {
+	fake := &collidingS3{fakeS3: useFakeS3(t), collisions: UNTITLED_MAX_ATTEMPTS}
+	newS3Client = func() (s3Client, error) { return fake, nil }
+
+	c, w := newTestContext("POST", "/files", "my note")
+	runAsUser(c, handleCreateUntitled, "user1")
+
+	if w.Code != 409 {
+		t.Fatalf("Expected 409, actual: %d", w.Code)
+	}
+}
+
+func TestCreateUntitledWithInvalidExtGivesBadRequest(t *testing.T) {
+	fake := useFakeS3(t)
+
+	c, w := newTestContext("POST", "/files?ext=json", "{}")
+	runAsUser(c, handleCreateUntitled, "user1")
+
+	if w.Code != 400 {
+		t.Fatalf("Expected 400, actual: %d", w.Code)
+	}
+	if fake.count() != 0 {
+		t.Errorf("Expected nothing to be saved, actual: %d objects", fake.count())
+	}
+}
@@ -3,30 +3,156 @@ package app
 import (
 	"context"
 	"fmt"
-	"log"
+	"net/url"
 	"slices"
+	"sync"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/lestrrat-go/jwx/jwk"
+	log "github.com/sirupsen/logrus"
 )
 
-var cognitoKeysUrl = "https://cognito-idp.us-east-1.amazonaws.com/us-east-1_oDBGh8hef/.well-known/jwks.json"
-var tokenIssuer = "https://cognito-idp.us-east-1.amazonaws.com/us-east-1_oDBGh8hef"
-var tokenAudiences = []string{"171uojgfrbv775ultuqk12os85", "7e381s8r9gd2dntnuchems6epv"}
+var TOKEN_ISSUERS = []string{"https://cognito-idp.us-east-1.amazonaws.com/us-east-1_oDBGh8hef"}
+var TOKEN_AUDIENCES = []string{"171uojgfrbv775ultuqk12os85", "7e381s8r9gd2dntnuchems6epv"}
 
-var keySet jwk.Set
+var (
+	JWKS_REFRESH_INTERVAL time.Duration = time.Duration(1) * time.Hour
+	JWKS_RETRY_INTERVAL   time.Duration = time.Duration(1) * time.Minute
+	JWKS_STALE_AFTER      time.Duration = time.Duration(3) * time.Hour // several refreshes in a row have failed
+)
+
+// The keys used to validate id tokens of a single issuer,
+// refreshed in the background, so the key rotation is picked up
+type keySetCache struct {
+	url         string
+	lock        sync.RWMutex
+	keySet      jwk.Set // nil until loaded for the first time
+	lastRefresh time.Time
+	lastErr     error // the error of the last refresh, nil if the last refresh succeeded
+}
+
+// By issuer, set up once on start and never changed after
+var _keySetCaches = newKeySetCaches(TOKEN_ISSUERS)
+
+// Can be replaced in tests
+var fetchKeySet = func(ctx context.Context, url string) (jwk.Set, error) {
+	return jwk.Fetch(ctx, url)
+}
+
+func newKeySetCaches(issuers []string) map[string]*keySetCache {
+	caches := make(map[string]*keySetCache, len(issuers))
+	for _, issuer := range issuers {
+		// Cognito publishes the keys of the user pool at the well-known address
+		caches[issuer] = &keySetCache{url: issuer + "/.well-known/jwks.json"}
+	}
+	return caches
+}
 
-func init() {
-	var err error
-	keySet, err = jwk.Fetch(context.Background(), cognitoKeysUrl)
+// Issuers are the user pools the tokens are accepted from, e.g. several pools during a migration.
+// Audiences are the app client ids the tokens are accepted for, from any of the user pools.
+func SetTokenIssuersAndAudiences(issuers []string, audiences []string) error {
+	if len(issuers) == 0 {
+		return fmt.Errorf("empty list of token issuers")
+	}
+	if len(audiences) == 0 {
+		return fmt.Errorf("empty list of token audiences")
+	}
+	for _, issuer := range issuers {
+		if _, err := url.ParseRequestURI(issuer); err != nil {
+			return fmt.Errorf("invalid token issuer '%s': %w", issuer, err)
+		}
+	}
+
+	TOKEN_ISSUERS = issuers
+	TOKEN_AUDIENCES = audiences
+	_keySetCaches = newKeySetCaches(issuers)
+	return nil
+}
+
+func (cache *keySetCache) refresh(ctx context.Context) error {
+	keySet, err := fetchKeySet(ctx, cache.url)
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
 	if err != nil {
-		log.Fatalf("Could not retrieve Cognito keys")
+		// keep using the keys loaded before, if any
+		cache.lastErr = err
+		return err
+	}
+	cache.keySet = keySet
+	cache.lastRefresh = time.Now()
+	cache.lastErr = nil
+	return nil
+}
+
+func (cache *keySetCache) get() jwk.Set {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	return cache.keySet
+}
+
+func (cache *keySetCache) hasFailed() bool {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	return cache.lastErr != nil
+}
+
+// Loads the keys of every issuer, reports the first error, but still tries all of them
+func InitKeySet() error {
+	var firstErr error
+	for issuer, cache := range _keySetCaches {
+		err := cache.refresh(context.Background())
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("could not retrieve Cognito keys for '%s': %w", issuer, err)
+		}
+	}
+	return firstErr
+}
+
+// Refreshes the keys of every issuer every JWKS_REFRESH_INTERVAL until the context is done.
+// After a failed refresh, retries sooner, every JWKS_RETRY_INTERVAL.
+func StartKeySetRefresh(ctx context.Context) {
+	for issuer, cache := range _keySetCaches {
+		go cache.keepRefreshing(ctx, issuer)
+	}
+}
+
+func (cache *keySetCache) keepRefreshing(ctx context.Context, issuer string) {
+	for {
+		interval := JWKS_REFRESH_INTERVAL
+		if cache.hasFailed() {
+			interval = JWKS_RETRY_INTERVAL
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+
+		err := cache.refresh(ctx)
+		if err != nil {
+			log.Printf("could not refresh Cognito keys for '%s': %v", issuer, err)
+		}
 	}
 }
 
+// Not set by default, so all the users are kept in one layout, "userId/".
+// With the claim set, e.g. "custom:tenant", the users of every tenant are kept under "tenant/userId/",
+// the users whose token has no such claim stay in the single-tenant layout.
+var TENANT_CLAIM = ""
+
+func SetTenantClaim(claim string) {
+	TENANT_CLAIM = claim
+}
+
 type parsedTokenData struct {
-	UserId string
-	EMail  string
+	UserId    string
+	EMail     string
+	TenantId  string // empty without the tenant
+	ExpiresAt time.Time
+	TokenUse  string
 }
 
 type cognitoIdTokenClaims struct {
@@ -49,11 +175,12 @@ func parseAndValidateIdToken(idToken string) (*parsedTokenData, error) {
 	}
 
 	// The audience (aud) claim should match the app client ID that was created in the Amazon Cognito user pool
-	if !slices.Contains(tokenAudiences, claims.Audience) {
+	if !slices.Contains(TOKEN_AUDIENCES, claims.Audience) {
 		return nil, fmt.Errorf("wrong value of audience: %s", claims.Audience)
 	}
 	// The issuer (iss) claim should match your user pool
-	if claims.Issuer != tokenIssuer {
+	// (already checked when selecting the key, but better be explicit)
+	if !slices.Contains(TOKEN_ISSUERS, claims.Issuer) {
 		return nil, fmt.Errorf("wrong value of issuer: %s", claims.Issuer)
 	}
 	// Check the token_use claim, if you are only using the ID token, its value must be id
@@ -69,14 +196,43 @@ func parseAndValidateIdToken(idToken string) (*parsedTokenData, error) {
 	if email == "" {
 		return nil, fmt.Errorf("email id not found in claims")
 	}
+	tenantId, err := getTenantIdFromToken(idToken)
+	if err != nil {
+		return nil, err
+	}
 
 	parsedToken := &parsedTokenData{
-		UserId: userId,
-		EMail:  email,
+		UserId:    userId,
+		EMail:     email,
+		TenantId:  tenantId,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+		TokenUse:  claims.TokenUse,
 	}
 	return parsedToken, nil
 }
 
+// The claim name is configurable, so it can't be a field of the claims struct, the token is parsed again into the map.
+// Only called on the token that is already validated.
+func getTenantIdFromToken(idToken string) (string, error) {
+	if TENANT_CLAIM == "" {
+		return "", nil
+	}
+	claims := jwt.MapClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(idToken, claims)
+	if err != nil {
+		return "", err
+	}
+	value, ok := claims[TENANT_CLAIM]
+	if !ok {
+		return "", nil
+	}
+	tenantId, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("wrong type of %s: %T", TENANT_CLAIM, value)
+	}
+	return tenantId, nil
+}
+
 func keyFunc(token *jwt.Token) (interface{}, error) {
 	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
 		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
@@ -85,6 +241,19 @@ func keyFunc(token *jwt.Token) (interface{}, error) {
 	if !ok {
 		return nil, fmt.Errorf("could not find value for the property 'kid' in header")
 	}
+	// the claims are already parsed, but not validated yet, the key is selected by the issuer
+	claims, ok := token.Claims.(*cognitoIdTokenClaims)
+	if !ok {
+		return nil, fmt.Errorf("could not retrieve standard claims")
+	}
+	cache, ok := _keySetCaches[claims.Issuer]
+	if !ok {
+		return nil, fmt.Errorf("wrong value of issuer: %s", claims.Issuer)
+	}
+	keySet := cache.get()
+	if keySet == nil {
+		return nil, fmt.Errorf("Cognito keys are not loaded for '%s'", claims.Issuer)
+	}
 	key, ok := keySet.LookupKeyID(kid)
 	if !ok {
 		return nil, fmt.Errorf("could not find key matching 'kid' '%v' in header", kid)
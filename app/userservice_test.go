@@ -0,0 +1,365 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+func useTokenIssuersAndAudiences(t *testing.T, issuers []string, audiences []string) {
+	tokenIssuers, tokenAudiences, keySetCaches := TOKEN_ISSUERS, TOKEN_AUDIENCES, _keySetCaches
+	t.Cleanup(func() {
+		TOKEN_ISSUERS, TOKEN_AUDIENCES, _keySetCaches = tokenIssuers, tokenAudiences, keySetCaches
+	})
+	err := SetTokenIssuersAndAudiences(issuers, audiences)
+	if err != nil {
+		t.Fatalf("Error setting issuers and audiences: %s", err)
+	}
+}
+
+// Generates the signing key and makes it available as the only key of the issuer
+func useIssuerKey(t *testing.T, issuer string, kid string) *rsa.PrivateKey {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating the key: %s", err)
+	}
+	key, err := jwk.New(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Error creating the key: %s", err)
+	}
+	key.Set(jwk.KeyIDKey, kid)
+	keySet := jwk.NewSet()
+	keySet.Add(key)
+
+	cache := _keySetCaches[issuer]
+	cache.keySet = keySet
+	cache.lastRefresh = time.Now()
+	return privateKey
+}
+
+func newIdToken(t *testing.T, privateKey *rsa.PrivateKey, kid string, issuer string, audience string) string {
+	return newIdTokenExpiringAt(t, privateKey, kid, issuer, audience, time.Now().Add(time.Hour))
+}
+
+func newIdTokenExpiringAt(t *testing.T, privateKey *rsa.PrivateKey, kid string, issuer string, audience string, expiresAt time.Time) string {
+	claims := &cognitoIdTokenClaims{
+		TokenUse: "id",
+		Email:    "user1@example.com",
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "user1",
+			Issuer:    issuer,
+			Audience:  audience,
+			ExpiresAt: expiresAt.Unix(),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	idToken, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatalf("Error signing the token: %s", err)
+	}
+	return idToken
+}
+
+func useTenantClaim(t *testing.T, claim string) {
+	original := TENANT_CLAIM
+	t.Cleanup(func() {
+		TENANT_CLAIM = original
+	})
+	SetTenantClaim(claim)
+}
+
+type tenantIdTokenClaims struct {
+	Tenant string `json:"custom:tenant,omitempty"`
+	cognitoIdTokenClaims
+}
+
+func newIdTokenWithTenant(t *testing.T, privateKey *rsa.PrivateKey, kid string, issuer string, audience string, tenant string) string {
+	claims := &tenantIdTokenClaims{
+		Tenant: tenant,
+		cognitoIdTokenClaims: cognitoIdTokenClaims{
+			TokenUse: "id",
+			Email:    "user1@example.com",
+			StandardClaims: jwt.StandardClaims{
+				Subject:   "user1",
+				Issuer:    issuer,
+				Audience:  audience,
+				ExpiresAt: time.Now().Add(time.Hour).Unix(),
+			},
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	idToken, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatalf("Error signing the token: %s", err)
+	}
+	return idToken
+}
+
+func TestTenantIsTakenFromTheConfiguredClaim(t *testing.T) {
+	issuers := []string{"https://example.com/pool1"}
+	useTokenIssuersAndAudiences(t, issuers, []string{"client1"})
+	useTenantClaim(t, "custom:tenant")
+	key1 := useIssuerKey(t, issuers[0], "kid1")
+
+	parsedToken, err := parseAndValidateIdToken(newIdTokenWithTenant(t, key1, "kid1", issuers[0], "client1", "tenant1"))
+	if err != nil {
+		t.Fatalf("Expected the token to be valid, got: %s", err)
+	}
+	if parsedToken.TenantId != "tenant1" {
+		t.Errorf("Expected 'tenant1', actual: '%s'", parsedToken.TenantId)
+	}
+
+	// the token without the claim stays in the single-tenant layout
+	parsedToken, err = parseAndValidateIdToken(newIdTokenWithTenant(t, key1, "kid1", issuers[0], "client1", ""))
+	if err != nil {
+		t.Fatalf("Expected the token to be valid, got: %s", err)
+	}
+	if parsedToken.TenantId != "" {
+		t.Errorf("Expected no tenant, actual: '%s'", parsedToken.TenantId)
+	}
+}
+
+func TestTenantIsIgnoredWhenClaimIsNotConfigured(t *testing.T) {
+	issuers := []string{"https://example.com/pool1"}
+	useTokenIssuersAndAudiences(t, issuers, []string{"client1"})
+	useTenantClaim(t, "")
+	key1 := useIssuerKey(t, issuers[0], "kid1")
+
+	parsedToken, err := parseAndValidateIdToken(newIdTokenWithTenant(t, key1, "kid1", issuers[0], "client1", "tenant1"))
+	if err != nil {
+		t.Fatalf("Expected the token to be valid, got: %s", err)
+	}
+	if parsedToken.TenantId != "" {
+		t.Errorf("Expected no tenant, actual: '%s'", parsedToken.TenantId)
+	}
+}
+
+func TestTokensFromEveryIssuerAreValid(t *testing.T) {
+	issuers := []string{"https://example.com/pool1", "https://example.com/pool2"}
+	useTokenIssuersAndAudiences(t, issuers, []string{"client1", "client2"})
+	key1 := useIssuerKey(t, issuers[0], "kid1")
+	key2 := useIssuerKey(t, issuers[1], "kid2")
+
+	tokens := []string{
+		newIdToken(t, key1, "kid1", issuers[0], "client1"),
+		newIdToken(t, key2, "kid2", issuers[1], "client2"),
+	}
+	for i, idToken := range tokens {
+		parsedToken, err := parseAndValidateIdToken(idToken)
+		if err != nil {
+			t.Fatalf("Expected the token from '%s' to be valid, got: %s", issuers[i], err)
+		}
+		if parsedToken.UserId != "user1" || parsedToken.EMail != "user1@example.com" {
+			t.Errorf("Expected user1, actual: '%s' '%s'", parsedToken.UserId, parsedToken.EMail)
+		}
+	}
+}
+
+func TestTokenIsValidatedWithTheKeysOfItsIssuer(t *testing.T) {
+	issuers := []string{"https://example.com/pool1", "https://example.com/pool2"}
+	useTokenIssuersAndAudiences(t, issuers, []string{"client1"})
+	key1 := useIssuerKey(t, issuers[0], "kid1")
+	useIssuerKey(t, issuers[1], "kid2")
+
+	// signed by the key of pool1, but claims to come from pool2
+	idToken := newIdToken(t, key1, "kid1", issuers[1], "client1")
+
+	_, err := parseAndValidateIdToken(idToken)
+	if err == nil {
+		t.Fatalf("Expected the token to be rejected")
+	}
+}
+
+func TestTokenFromUnknownIssuerIsRejected(t *testing.T) {
+	issuers := []string{"https://example.com/pool1"}
+	useTokenIssuersAndAudiences(t, issuers, []string{"client1"})
+	key1 := useIssuerKey(t, issuers[0], "kid1")
+
+	idToken := newIdToken(t, key1, "kid1", "https://example.com/other", "client1")
+
+	_, err := parseAndValidateIdToken(idToken)
+	if err == nil {
+		t.Fatalf("Expected the token to be rejected")
+	}
+}
+
+func TestTokenForUnknownAudienceIsRejected(t *testing.T) {
+	issuers := []string{"https://example.com/pool1"}
+	useTokenIssuersAndAudiences(t, issuers, []string{"client1"})
+	key1 := useIssuerKey(t, issuers[0], "kid1")
+
+	idToken := newIdToken(t, key1, "kid1", issuers[0], "client2")
+
+	_, err := parseAndValidateIdToken(idToken)
+	if err == nil {
+		t.Fatalf("Expected the token to be rejected")
+	}
+}
+
+func TestSetTokenIssuersAndAudiencesValidates(t *testing.T) {
+	useTokenIssuersAndAudiences(t, TOKEN_ISSUERS, TOKEN_AUDIENCES)
+
+	if err := SetTokenIssuersAndAudiences([]string{}, []string{"client1"}); err == nil {
+		t.Errorf("Expected error for no issuers")
+	}
+	if err := SetTokenIssuersAndAudiences([]string{"https://example.com/pool1"}, []string{}); err == nil {
+		t.Errorf("Expected error for no audiences")
+	}
+	if err := SetTokenIssuersAndAudiences([]string{"not a url"}, []string{"client1"}); err == nil {
+		t.Errorf("Expected error for invalid issuer")
+	}
+}
+
+func runMe(idToken string) *httptest.ResponseRecorder {
+	c, w := newTestContext("GET", "/me", "")
+	c.Request.Header.Set("Authorization", "Bearer "+idToken)
+	handleMe(c)
+	return w
+}
+
+func TestMeReturnsTheClaimsOfValidToken(t *testing.T) {
+	issuers := []string{"https://example.com/pool1"}
+	useTokenIssuersAndAudiences(t, issuers, []string{"client1"})
+	key1 := useIssuerKey(t, issuers[0], "kid1")
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+
+	w := runMe(newIdTokenExpiringAt(t, key1, "kid1", issuers[0], "client1", expiresAt))
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var me meDataOut
+	parseDataResponse(t, w, &me)
+	if me.UserId != "user1" || me.Email != "user1@example.com" || me.TokenUse != "id" {
+		t.Errorf("Expected user1 id token, actual: %+v", me)
+	}
+	if !me.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("Expected to expire at %v, actual: %v", expiresAt, me.ExpiresAt)
+	}
+}
+
+func TestMeRejectsExpiredToken(t *testing.T) {
+	issuers := []string{"https://example.com/pool1"}
+	useTokenIssuersAndAudiences(t, issuers, []string{"client1"})
+	key1 := useIssuerKey(t, issuers[0], "kid1")
+
+	w := runMe(newIdTokenExpiringAt(t, key1, "kid1", issuers[0], "client1", time.Now().Add(-time.Minute)))
+
+	if w.Code != 401 {
+		t.Errorf("Expected 401, actual: %d", w.Code)
+	}
+}
+
+func TestMeRequiresBearerToken(t *testing.T) {
+	c, w := newTestContext("GET", "/me", "")
+	handleMe(c)
+
+	if w.Code != 401 {
+		t.Errorf("Expected 401, actual: %d", w.Code)
+	}
+}
+
+func useSessionCookieEnabled(t *testing.T, enabled bool) {
+	original := SESSION_COOKIE_ENABLED
+	SetSessionCookieEnabled(enabled)
+	t.Cleanup(func() {
+		SESSION_COOKIE_ENABLED = original
+	})
+}
+
+func runSignIn(idToken string) *httptest.ResponseRecorder {
+	c, w := newTestContext("POST", "/signin", `{"id_token": "`+idToken+`"}`)
+	handleSignIn(c)
+	return w
+}
+
+func TestSignInReturnsSession(t *testing.T) {
+	issuers := []string{"https://example.com/pool1"}
+	useTokenIssuersAndAudiences(t, issuers, []string{"client1"})
+	key1 := useIssuerKey(t, issuers[0], "kid1")
+	useSessionCookieEnabled(t, false)
+	SetEncryptionPassphrase("test passphrase")
+
+	w := runSignIn(newIdToken(t, key1, "kid1", issuers[0], "client1"))
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var signIn signInDataOut
+	parseDataResponse(t, w, &signIn)
+	if signIn.UserId != "user1" || signIn.Email != "user1@example.com" {
+		t.Errorf("Expected user1, actual: '%s' '%s'", signIn.UserId, signIn.Email)
+	}
+	if signIn.ExpiresAt.Before(time.Now().Add(SESSION_DURATION - time.Minute)) {
+		t.Errorf("Expected to expire in %v, actual: %v", SESSION_DURATION, signIn.ExpiresAt)
+	}
+	session, err := parseEncryptedSession(signIn.Session)
+	if err != nil {
+		t.Fatalf("Expected the session to be valid, got: %v", err)
+	}
+	if session.UserId != "user1" {
+		t.Errorf("Expected the session of user1, actual: '%s'", session.UserId)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("Expected no cookie")
+	}
+}
+
+func TestSignInSetsSessionCookie(t *testing.T) {
+	issuers := []string{"https://example.com/pool1"}
+	useTokenIssuersAndAudiences(t, issuers, []string{"client1"})
+	key1 := useIssuerKey(t, issuers[0], "kid1")
+	useSessionCookieEnabled(t, true)
+	SetEncryptionPassphrase("test passphrase")
+
+	w := runSignIn(newIdToken(t, key1, "kid1", issuers[0], "client1"))
+
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, actual: %d", w.Code)
+	}
+	var signIn signInDataOut
+	parseDataResponse(t, w, &signIn)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected 1 cookie, actual: %d", len(cookies))
+	}
+	cookie := cookies[0]
+	if cookie.Name != SESSION_COOKIE_NAME || !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("Expected HttpOnly, Secure, Lax session cookie, actual: %+v", cookie)
+	}
+	if cookie.Value != base64.RawURLEncoding.EncodeToString(signIn.Session) {
+		t.Errorf("Expected the cookie to hold the session")
+	}
+}
+
+func TestSignInRejectsInvalidToken(t *testing.T) {
+	issuers := []string{"https://example.com/pool1"}
+	useTokenIssuersAndAudiences(t, issuers, []string{"client1"})
+	key1 := useIssuerKey(t, issuers[0], "kid1")
+	useSessionCookieEnabled(t, true)
+
+	tokens := []string{
+		newIdTokenExpiringAt(t, key1, "kid1", issuers[0], "client1", time.Now().Add(-time.Minute)),
+		newIdToken(t, key1, "kid1", issuers[0], "client2"),
+		"not a token",
+	}
+	for _, idToken := range tokens {
+		w := runSignIn(idToken)
+
+		if w.Code != 401 {
+			t.Errorf("Expected 401, actual: %d", w.Code)
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Errorf("Expected no cookie")
+		}
+	}
+}
@@ -1,9 +1,36 @@
 package app
 
-import "strings"
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
 
+var MAX_USER_ID_LENGTH = 128 // Cognito sub is a UUID, but the api keys can map to any user id
+
+// The first segment of the keys of all the tenants, so it can't be the user id
+var TENANTS_KEY_SEGMENT = "tenants"
+
+// The user id is the first segment of every key, so it must not be able to escape the user namespace,
+// e.g. with "/" or "..", or break the key otherwise.
 func isUserIdValid(userId string) bool {
-	return userId != ""
+	if userId == "" || len(userId) > MAX_USER_ID_LENGTH {
+		return false
+	}
+	if userId == "." || userId == ".." || userId == TENANTS_KEY_SEGMENT {
+		return false
+	}
+	return !strings.ContainsFunc(userId, func(r rune) bool {
+		return r == '/' || r == '\\' || unicode.IsControl(r)
+	})
+}
+
+// The tenant id goes before the user id in every key, so the same rules apply
+func isTenantIdValid(tenantId string) bool {
+	return isUserIdValid(tenantId)
 }
 
 func isEmailValid(email string) bool {
@@ -12,18 +39,63 @@ func isEmailValid(email string) bool {
 }
 
 func isPageSizeValid(pageSize int) bool {
-	return pageSize <= 1000
+	return pageSize >= 0 && pageSize <= PAGE_SIZE_MAX
 }
 
 func isContinuationTokenValid(continuationToken string) bool {
-	return len(continuationToken) <= 1000
+	return len(continuationToken) <= getMaxContinuationTokenLength()
+}
+
+// The signed token carries the S3 token and the prefix, see signContinuationToken, so the max follows from the key length.
+// The S3 token encodes the key it continues from, which takes up to twice the key, and the prefix is part of the key,
+// but JSON can escape one byte into as many as 6, e.g. "<" into "\u003c".
+func getMaxContinuationTokenLength() int {
+	payloadLength := len(`{"t":"","p":"","iat":}`) + len("-9223372036854775808") + 2*S3_MAX_KEY_LENGTH + 6*S3_MAX_KEY_LENGTH
+	return base64.RawURLEncoding.EncodedLen(payloadLength) + len(".") + base64.RawURLEncoding.EncodedLen(sha256.Size)
+}
+
+// In bytes, not characters, so the multibyte names are shorter
+var MAX_FILE_NAME_LENGTH = 200
+
+// In bytes, of the whole key, including the user namespace and the folder
+var S3_MAX_KEY_LENGTH = 1024
+
+// The conflict copy and the unique file name put the suffix after the name, e.g. " (conflict 2024-01-31 10-15-30.123).txt",
+// so the max has to leave room for the longest of them, with at least one byte of the name
+var MIN_FILE_NAME_LENGTH = len(" (conflict 2024-01-31 10-15-30.123).txt") + 1
+
+func SetMaxFileNameLength(length int) error {
+	if length < MIN_FILE_NAME_LENGTH || length > S3_MAX_KEY_LENGTH {
+		return fmt.Errorf("invalid max file name length %d, should be between %d and %d", length, MIN_FILE_NAME_LENGTH, S3_MAX_KEY_LENGTH)
+	}
+	MAX_FILE_NAME_LENGTH = length
+	return nil
 }
 
 func isFileNameValid(fileName string) bool {
-	return len(fileName) <= 200 &&
-		((strings.HasSuffix(fileName, ".txt") && len(fileName) > 4) ||
-			(strings.HasSuffix(fileName, ".md") && len(fileName) > 3)) &&
-		!strings.Contains(fileName, "/")
+	return validateFileName(fileName) == nil
+}
+
+// Tells which requirement the file name doesn't meet
+func validateFileName(fileName string) error {
+	if len(fileName) > MAX_FILE_NAME_LENGTH {
+		return fmt.Errorf("too long, %d bytes, should be less or equal than %d bytes", len(fileName), MAX_FILE_NAME_LENGTH)
+	}
+	if !(strings.HasSuffix(fileName, ".txt") && len(fileName) > 4) && !(strings.HasSuffix(fileName, ".md") && len(fileName) > 3) {
+		return fmt.Errorf("should be the non-empty name ending with '.md' or '.txt'")
+	}
+	if strings.Contains(fileName, "/") {
+		return fmt.Errorf("should not contain '/'")
+	}
+	return nil
+}
+
+// The S3 key is the prefix followed by the file name, and S3 refuses the keys longer than S3_MAX_KEY_LENGTH bytes
+func validateKeyLength(prefix string, fileName string) error {
+	if len(prefix)+len(fileName) > S3_MAX_KEY_LENGTH {
+		return fmt.Errorf("too long for the storage, the key would be %d bytes, should be less or equal than %d bytes", len(prefix)+len(fileName), S3_MAX_KEY_LENGTH)
+	}
+	return nil
 }
 
 func isEtagValid(etag string) bool {
@@ -33,3 +105,65 @@ func isEtagValid(etag string) bool {
 func isContentValid(content string) bool {
 	return len(content) <= 102400
 }
+
+// Normalizes the content of the note, when enabled, and tells which requirement it doesn't meet.
+// The same for every request that writes the note content, so none of them skips a check.
+// The checks that depend on the file type go by the file name, e.g. the front-matter is only checked in ".md".
+func sanitizeContent(fileName string, content string) (string, error) {
+	if NORMALIZE_CONTENT && isNormalizable(fileName) {
+		content = normalizeContent(content, NORMALIZE_CONTENT_TRIM_TRAILING_SPACES)
+	}
+	if !isContentValid(content) {
+		return "", fmt.Errorf("invalid content, should be less or equal than 100KB")
+	}
+	if VALIDATE_UTF8 && !utf8.ValidString(content) {
+		return "", fmt.Errorf("invalid content, should be valid UTF-8")
+	}
+	if VALIDATE_FRONTMATTER && isMarkdown(fileName) {
+		if err := validateFrontmatter(content); err != nil {
+			return "", err
+		}
+	}
+	return content, nil
+}
+
+func isSearchQueryValid(query string) bool {
+	return len(query) > 0 && len(query) <= 200
+}
+
+// Folders are nested using "/", e.g. "work/projects", the empty folder is the root.
+// The trash and the audit log are reserved, so they can't be reached as regular folders.
+func isFolderValid(folder string) bool {
+	if folder == "" {
+		return true
+	}
+	if len(folder) > 200 {
+		return false
+	}
+	if strings.IndexFunc(folder, unicode.IsControl) >= 0 {
+		return false
+	}
+	segments := strings.Split(folder, "/")
+	for _, segment := range segments {
+		// also rejects leading, trailing and double slashes
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return segments[0]+"/" != TRASH_FOLDER && segments[0]+"/" != AUDIT_FOLDER
+}
+
+var MAX_TAG_LENGTH = 64 // S3 allows 128 chars in the tag key, including the prefix
+
+// Only what S3 accepts in the tag key, except "/", so the tag never looks like a path
+func isTagValid(tag string) bool {
+	if tag == "" || utf8.RuneCountInString(tag) > MAX_TAG_LENGTH {
+		return false
+	}
+	if strings.TrimSpace(tag) != tag {
+		return false
+	}
+	return !strings.ContainsFunc(tag, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" +-=._:@", r)
+	})
+}
@@ -0,0 +1,223 @@
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+func restorePageSizes(t *testing.T) {
+	pageSizeDefault, pageSizeMax := PAGE_SIZE_DEFAULT, PAGE_SIZE_MAX
+	t.Cleanup(func() {
+		PAGE_SIZE_DEFAULT, PAGE_SIZE_MAX = pageSizeDefault, pageSizeMax
+	})
+}
+
+func TestSetPageSizes(t *testing.T) {
+	restorePageSizes(t)
+
+	cases := []struct {
+		pageSizeDefault int
+		pageSizeMax     int
+		valid           bool
+	}{
+		{100, 1000, true},
+		{50, 50, true},
+		{1, 1, true},
+		{100, 50, false},
+		{0, 100, false},
+		{100, 0, false},
+		{100, 1001, false},
+		{-1, 100, false},
+	}
+
+	for _, tc := range cases {
+		err := SetPageSizes(tc.pageSizeDefault, tc.pageSizeMax)
+		if tc.valid && err != nil {
+			t.Errorf("Expected default %d and max %d to be valid, got: %s", tc.pageSizeDefault, tc.pageSizeMax, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("Expected default %d and max %d to be invalid", tc.pageSizeDefault, tc.pageSizeMax)
+		}
+	}
+}
+
+func TestIsPageSizeValidUsesConfiguredMax(t *testing.T) {
+	restorePageSizes(t)
+
+	err := SetPageSizes(10, 50)
+	if err != nil {
+		t.Fatalf("Error setting page sizes: %s", err)
+	}
+
+	if !isPageSizeValid(0) {
+		t.Errorf("Expected 0 to be valid")
+	}
+	if !isPageSizeValid(50) {
+		t.Errorf("Expected 50 to be valid")
+	}
+	if isPageSizeValid(51) {
+		t.Errorf("Expected 51 to be invalid")
+	}
+	if isPageSizeValid(-1) {
+		t.Errorf("Expected -1 to be invalid")
+	}
+}
+
+func TestIsFolderValid(t *testing.T) {
+	cases := []struct {
+		folder string
+		valid  bool
+	}{
+		{"", true},
+		{"work", true},
+		{"work/projects", true},
+		{"my notes", true},
+		{"..", false},
+		{"work/..", false},
+		{"../user2", false},
+		{"work/./projects", false},
+		{"/work", false},
+		{"work/", false},
+		{"work//projects", false},
+		{"work\nprojects", false},
+		{"work\x00", false},
+		{".trash", false},
+		{".trash/old", false},
+		{".audit", false},
+		{strings.Repeat("a", 201), false},
+	}
+
+	for _, tc := range cases {
+		valid := isFolderValid(tc.folder)
+		if valid != tc.valid {
+			t.Errorf("Expected isFolderValid(%q) to be %v, actual: %v", tc.folder, tc.valid, valid)
+		}
+	}
+}
+
+func TestIsUserIdValid(t *testing.T) {
+	cases := []struct {
+		userId string
+		valid  bool
+	}{
+		{"f8e7a1b2-3c4d-4e5f-8a9b-0c1d2e3f4a5b", true},
+		{"user1", true},
+		{"", false},
+		{"..", false},
+		{".", false},
+		{"../user2", false},
+		{"user1/../user2", false},
+		{"user2/", false},
+		{"user1\\user2", false},
+		{"user1\nuser2", false},
+		{"user1\x00", false},
+		{TENANTS_KEY_SEGMENT, false},
+		{strings.Repeat("a", 129), false},
+	}
+
+	for _, tc := range cases {
+		valid := isUserIdValid(tc.userId)
+		if valid != tc.valid {
+			t.Errorf("Expected isUserIdValid(%q) to be %v, actual: %v", tc.userId, tc.valid, valid)
+		}
+	}
+}
+
+func TestIsTagValid(t *testing.T) {
+	cases := []struct {
+		tag   string
+		valid bool
+	}{
+		{"work", true},
+		{"to do", true},
+		{"été", true},
+		{"a+b=c.d_e:f@g-h", true},
+		{"", false},
+		{" work", false},
+		{"work/home", false},
+		{"work\n", false},
+		{"#work", false},
+		{strings.Repeat("a", 65), false},
+	}
+
+	for _, tc := range cases {
+		valid := isTagValid(tc.tag)
+		if valid != tc.valid {
+			t.Errorf("Expected isTagValid(%q) to be %v, actual: %v", tc.tag, tc.valid, valid)
+		}
+	}
+}
+
+func useMaxFileNameLength(t *testing.T, length int) {
+	original := MAX_FILE_NAME_LENGTH
+	if err := SetMaxFileNameLength(length); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() {
+		MAX_FILE_NAME_LENGTH = original
+	})
+}
+
+func TestSetMaxFileNameLength(t *testing.T) {
+	for _, length := range []int{0, 4, MIN_FILE_NAME_LENGTH - 1, S3_MAX_KEY_LENGTH + 1} {
+		if err := SetMaxFileNameLength(length); err == nil {
+			t.Errorf("Expected error for %d", length)
+		}
+	}
+}
+
+func TestValidateFileNameLongAsciiName(t *testing.T) {
+	fileName := strings.Repeat("a", MAX_FILE_NAME_LENGTH-3) + ".md"
+	if err := validateFileName(fileName); err != nil {
+		t.Errorf("Expected the name of %d bytes to be valid, got: %v", len(fileName), err)
+	}
+
+	fileName = "a" + fileName
+	err := validateFileName(fileName)
+	if err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Errorf("Expected the name of %d bytes to be too long, got: %v", len(fileName), err)
+	}
+}
+
+func TestValidateFileNameLongMultibyteName(t *testing.T) {
+	useMaxFileNameLength(t, 40)
+
+	// 13 characters, but 42 bytes
+	fileName := strings.Repeat("笔", 13) + ".md"
+	err := validateFileName(fileName)
+	if err == nil || !strings.Contains(err.Error(), "42 bytes, should be less or equal than 40 bytes") {
+		t.Errorf("Expected the name to be measured in bytes, got: %v", err)
+	}
+
+	if err := validateFileName(strings.Repeat("笔", 12) + ".md"); err != nil {
+		t.Errorf("Expected the name of 39 bytes to be valid, got: %v", err)
+	}
+}
+
+func TestValidateFileNameTellsRequirement(t *testing.T) {
+	if err := validateFileName("note.json"); err == nil || !strings.Contains(err.Error(), "'.md' or '.txt'") {
+		t.Errorf("Expected the extension error, got: %v", err)
+	}
+	if err := validateFileName("work/note.md"); err == nil || !strings.Contains(err.Error(), "'/'") {
+		t.Errorf("Expected the slash error, got: %v", err)
+	}
+}
+
+func TestValidateKeyLength(t *testing.T) {
+	useMaxFileNameLength(t, S3_MAX_KEY_LENGTH)
+	prefix := "user1/" + strings.Repeat("f", 100) + "/"
+
+	fileName := strings.Repeat("笔", (S3_MAX_KEY_LENGTH-len(prefix)-3)/3) + ".md"
+	if err := validateKeyLength(prefix, fileName); err != nil {
+		t.Errorf("Expected the key of %d bytes to be valid, got: %v", len(prefix)+len(fileName), err)
+	}
+
+	fileName = strings.Repeat("笔", (S3_MAX_KEY_LENGTH-len(prefix))/3) + ".md"
+	err := validateKeyLength(prefix, fileName)
+	if err == nil || !strings.Contains(err.Error(), "too long for the storage") {
+		t.Errorf("Expected the key of %d bytes to be too long, got: %v", len(prefix)+len(fileName), err)
+	}
+	if _, err := buildKey(prefix, fileName); err == nil {
+		t.Errorf("Expected buildKey to refuse the key of %d bytes", len(prefix)+len(fileName))
+	}
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+var _version = ""
+var _buildTime = "" // RFC3339, empty when unknown
+
+type getVersionDataOut struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	BuildTime string `json:"buildTime,omitempty"`
+}
+
+// The build time, when not given, is the time of the commit the binary was built from, if recorded by the go build
+func SetVersion(version string, buildTime string) {
+	_version = version
+	_buildTime = buildTime
+	if _buildTime == "" {
+		_buildTime = getVcsTime()
+	}
+}
+
+func getVcsTime() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.time" {
+			return setting.Value
+		}
+	}
+	return ""
+}
+
+// Tells which build is deployed, no authentication, no S3 calls
+func handleGetVersion(c *gin.Context) {
+	toSuccess(c, &getVersionDataOut{
+		Version:   _version,
+		GoVersion: runtime.Version(),
+		BuildTime: _buildTime,
+	})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 	log "github.com/sirupsen/logrus"
@@ -45,3 +46,52 @@ func GetBoolean(key string) bool {
 
 	return val
 }
+
+func GetOptionalBoolean(key string, def bool) bool {
+	text := os.Getenv(key)
+	if text == "" {
+		log.Printf("Could not find the value for the key '%s'. Using default value '%t'", key, def)
+		return def
+	}
+
+	val, err := strconv.ParseBool(text)
+	if err != nil {
+		log.Fatalf("Could not parse value '%s' as boolean", text)
+	}
+
+	return val
+}
+
+func GetOptionalInt(key string, def int) int {
+	text := os.Getenv(key)
+	if text == "" {
+		log.Printf("Could not find the value for the key '%s'. Using default value '%d'", key, def)
+		return def
+	}
+
+	val, err := strconv.Atoi(text)
+	if err != nil {
+		log.Fatalf("Could not parse value '%s' as integer", text)
+	}
+
+	return val
+}
+
+// Comma-separated list, e.g. "a,b,c", the items are trimmed and the empty items are skipped
+func GetOptionalList(key string, def []string) []string {
+	text := os.Getenv(key)
+	if text == "" {
+		log.Printf("Could not find the value for the key '%s'. Using default value '%s'", key, strings.Join(def, ","))
+		return def
+	}
+
+	val := []string{}
+	for _, item := range strings.Split(text, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			val = append(val, item)
+		}
+	}
+
+	return val
+}
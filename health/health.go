@@ -2,6 +2,8 @@ package health
 
 import (
 	"net/http"
+	"sort"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -9,8 +11,31 @@ import (
 var isAlive = true
 var isReady = false
 
+var version = ""
+var started = time.Now()
+
+// Reports the status of a single component, the result is serialized to JSON as is
+type ComponentStatusFunc func() interface{}
+
+var components = map[string]ComponentStatusFunc{}
+
+// Tells whether a single component is ready to serve requests, should be fast
+type ReadinessCheckFunc func() bool
+
+var readinessChecks = map[string]ReadinessCheckFunc{}
+
+// Reports the version, uptime and the status of every registered component.
+// Checking the components may take time, orchestrators should use liveness and readiness instead.
 func HandleHealthCheck(c *gin.Context) {
-	c.Status(http.StatusOK)
+	result := gin.H{
+		"version": version,
+		"uptime":  time.Since(started).Round(time.Second).String(),
+	}
+	for name, getStatus := range components {
+		result[name] = getStatus()
+	}
+
+	c.JSON(http.StatusOK, result)
 }
 
 func HandleLivenessCheck(c *gin.Context) {
@@ -21,12 +46,26 @@ func HandleLivenessCheck(c *gin.Context) {
 	}
 }
 
+// Ready once the server is set up and every registered component is ready.
+// When not ready, the components that are not ready are listed in the response.
 func HandleReadinessCheck(c *gin.Context) {
-	if isReady {
-		c.Status(http.StatusOK)
-	} else {
+	if !isReady {
 		c.Status(http.StatusServiceUnavailable)
+		return
 	}
+
+	notReady := []string{}
+	for name, check := range readinessChecks {
+		if !check() {
+			notReady = append(notReady, name)
+		}
+	}
+	if len(notReady) > 0 {
+		sort.Strings(notReady)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"notReady": notReady})
+		return
+	}
+	c.Status(http.StatusOK)
 }
 
 func SetIsReadyGlobally() {
@@ -36,3 +75,17 @@ func SetIsReadyGlobally() {
 func SetLivenessGlobally(val bool) {
 	isAlive = val
 }
+
+func SetVersion(v string) {
+	version = v
+}
+
+// Should be called before the server starts serving requests
+func RegisterComponent(name string, getStatus ComponentStatusFunc) {
+	components[name] = getStatus
+}
+
+// Should be called before the server starts serving requests
+func RegisterReadinessCheck(name string, check ReadinessCheckFunc) {
+	readinessChecks[name] = check
+}
@@ -0,0 +1,49 @@
+package fanout
+
+import (
+	"context"
+	"fmt"
+)
+
+// Limits the number of operations running at the same time.
+// Shared by all the code paths that fan out, so the limit holds across all the concurrent requests.
+type Limiter struct {
+	slots chan struct{}
+}
+
+func NewLimiter(limit int) (*Limiter, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid concurrency limit %d, should be positive", limit)
+	}
+	return &Limiter{slots: make(chan struct{}, limit)}, nil
+}
+
+// Blocks until a slot is free or the context is done.
+// On success, the caller must call Release once the operation is complete.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Takes a slot only if one is free right away, never blocks.
+// On success, the caller must call Release once the operation is complete.
+func (l *Limiter) TryAcquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Limiter) Release() {
+	<-l.slots
+}
+
+func (l *Limiter) Limit() int {
+	return cap(l.slots)
+}
@@ -0,0 +1,89 @@
+package fanout
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiterRespectsLimit(t *testing.T) {
+	limiter, err := NewLimiter(3)
+	if err != nil {
+		t.Fatalf("Error creating limiter: %s", err)
+	}
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := limiter.Acquire(context.Background()); err != nil {
+				t.Errorf("Error acquiring: %s", err)
+				return
+			}
+			defer limiter.Release()
+
+			current := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning > 3 {
+		t.Errorf("Expected at most 3 running at the same time, actual: %d", maxRunning)
+	}
+	if maxRunning < 1 {
+		t.Errorf("Expected at least 1 running, actual: %d", maxRunning)
+	}
+}
+
+func TestLimiterAcquireStopsWhenContextIsDone(t *testing.T) {
+	limiter, _ := NewLimiter(1)
+	if err := limiter.Acquire(context.Background()); err != nil {
+		t.Fatalf("Error acquiring: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.Acquire(ctx); err == nil {
+		t.Fatalf("Expected error when all slots are taken and the context is done")
+	}
+
+	limiter.Release()
+	if err := limiter.Acquire(context.Background()); err != nil {
+		t.Fatalf("Expected the released slot to be available, got: %s", err)
+	}
+}
+
+func TestLimiterTryAcquireDoesNotBlock(t *testing.T) {
+	limiter, _ := NewLimiter(1)
+	if !limiter.TryAcquire() {
+		t.Fatalf("Expected the free slot to be taken")
+	}
+	if limiter.TryAcquire() {
+		t.Fatalf("Expected no slot when all slots are taken")
+	}
+
+	limiter.Release()
+	if !limiter.TryAcquire() {
+		t.Fatalf("Expected the released slot to be available")
+	}
+}
+
+func TestNewLimiterRejectsInvalidLimit(t *testing.T) {
+	for _, limit := range []int{0, -1} {
+		if _, err := NewLimiter(limit); err == nil {
+			t.Errorf("Expected error for limit %d", limit)
+		}
+	}
+}
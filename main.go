@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -13,6 +14,7 @@ import (
 )
 
 var version = "1.2"
+var buildTime = "" // set at build time, e.g. go build -ldflags "-X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
 
 func main() {
 	// setup logging
@@ -30,14 +32,227 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// the notes are kept in S3, or, for development, in the local directory
+	storage := GetOptionalString("NOTEDOK_STORAGE", app.STORAGE_S3)
+	switch storage {
+	case app.STORAGE_S3:
+		app.SetStorage(app.NewS3Storage())
+	case app.STORAGE_LOCAL:
+		localStorage, err := app.NewLocalStorage(GetMandatoryString("NOTEDOK_LOCAL_STORAGE_DIR"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.SetStorage(localStorage)
+	default:
+		log.Fatalf("invalid storage '%s', should be '%s' or '%s'", storage, app.STORAGE_S3, app.STORAGE_LOCAL)
+	}
+
+	// read the secondary bucket, if any, to fall back to when the primary one is unavailable
+	err = app.SetSecondaryBucket(
+		GetOptionalString("NOTEDOK_BUCKET_SECONDARY", ""),
+		GetOptionalString("NOTEDOK_BUCKET_SECONDARY_REGION", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.SetMirrorWrites(GetBoolean("NOTEDOK_MIRROR_WRITES"))
+
+	// configure the explicit AWS credentials, if any, otherwise the default chain is used
+	err = app.SetAwsCredentials(
+		GetOptionalString("NOTEDOK_AWS_ACCESS_KEY_ID", ""),
+		GetOptionalString("NOTEDOK_AWS_SECRET_ACCESS_KEY", ""),
+		GetOptionalString("NOTEDOK_AWS_SESSION_TOKEN", ""),
+		GetOptionalString("NOTEDOK_AWS_REGION", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// make sure the bucket can be used, before accepting any traffic
+	if storage == app.STORAGE_S3 && GetOptionalBoolean("NOTEDOK_VERIFY_BUCKET", true) {
+		err = app.VerifyBucket(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// configure page sizes
+	pageSizeDefault := GetOptionalInt("NOTEDOK_PAGE_SIZE_DEFAULT", app.PAGE_SIZE_DEFAULT)
+	pageSizeMax := GetOptionalInt("NOTEDOK_PAGE_SIZE_MAX", app.PAGE_SIZE_MAX)
+	err = app.SetPageSizes(pageSizeDefault, pageSizeMax)
+	if err != nil {
+		log.Fatal(err)
+	}
+	continuationTokenTTL := GetOptionalInt("NOTEDOK_CONTINUATION_TOKEN_TTL_SECONDS", int(app.CONTINUATION_TOKEN_TTL.Seconds()))
+	err = app.SetContinuationTokenTTL(time.Duration(continuationTokenTTL) * time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// configure the content types of the notes, by extension
+	err = app.SetContentTypes(GetOptionalString("NOTEDOK_CONTENT_TYPES", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// configure how long the file names can be
+	err = app.SetMaxFileNameLength(GetOptionalInt("NOTEDOK_MAX_FILENAME_LEN", app.MAX_FILE_NAME_LENGTH))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// configure the file names of the notes with the empty title
+	err = app.SetUntitledFileNamePrefix(GetOptionalString("NOTEDOK_UNTITLED_FILE_NAME_PREFIX", app.UNTITLED_FILE_NAME_PREFIX))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// configure how the clients cache the notes
+	err = app.SetFileCacheControl(GetOptionalString("NOTEDOK_FILE_CACHE_CONTROL", app.FILE_CACHE_CONTROL))
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.SetListingEtagStrong(GetBoolean("NOTEDOK_LISTING_ETAG_STRONG"))
+
+	// configure content validation
+	app.SetRejectEmptyContent(GetBoolean("NOTEDOK_REJECT_EMPTY_CONTENT"))
+	app.SetValidateUtf8(GetOptionalBoolean("NOTEDOK_VALIDATE_UTF8", app.VALIDATE_UTF8))
+	app.SetValidateFrontmatter(GetBoolean("NOTEDOK_VALIDATE_FRONTMATTER"))
+	app.SetNormalizeContent(GetBoolean("NOTEDOK_NORMALIZE_CONTENT"), GetBoolean("NOTEDOK_NORMALIZE_CONTENT_TRIM_TRAILING_SPACES"))
+
+	// configure whether the saves of the same note wait for each other
+	app.SetLockNoteWrites(GetOptionalBoolean("NOTEDOK_LOCK_NOTE_WRITES", app.LOCK_NOTE_WRITES))
+
+	// configure compression at rest
+	compressAtRest := GetBoolean("NOTEDOK_COMPRESS_AT_REST")
+	compressAtRestThreshold := GetOptionalInt("NOTEDOK_COMPRESS_AT_REST_THRESHOLD", app.COMPRESS_AT_REST_THRESHOLD)
+	err = app.SetCompressAtRest(compressAtRest, compressAtRestThreshold)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// configure where the audit log goes, the audit log in S3 needs S3
+	auditSink := app.AUDIT_SINK
+	if storage != app.STORAGE_S3 {
+		auditSink = app.AUDIT_SINK_LOG
+	}
+	err = app.SetAuditSink(GetOptionalString("NOTEDOK_AUDIT_SINK", auditSink))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if storage != app.STORAGE_S3 && app.AUDIT_SINK == app.AUDIT_SINK_S3 {
+		log.Fatalf("invalid audit sink '%s' with storage '%s', should be '%s' or '%s'", app.AUDIT_SINK, storage, app.AUDIT_SINK_LOG, app.AUDIT_SINK_OFF)
+	}
+
+	// configure api keys for machine clients
+	err = app.SetApiKeys(GetOptionalString("NOTEDOK_API_KEYS", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// start in the read-only mode, e.g. during the migration
+	app.SetReadOnly(GetBoolean("NOTEDOK_READ_ONLY"))
+
+	// configure admin endpoints
+	app.SetAdminToken(GetOptionalString("NOTEDOK_ADMIN_TOKEN", ""))
+	adminUsageCacheTTL := GetOptionalInt("NOTEDOK_ADMIN_USAGE_CACHE_TTL_SECONDS", int(app.ADMIN_USAGE_CACHE_TTL.Seconds()))
+	err = app.SetAdminUsageCacheTTL(time.Duration(adminUsageCacheTTL) * time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// configure the cleanup of the rename placeholders left behind
+	cleanupOrphansInterval := GetOptionalInt("NOTEDOK_CLEANUP_ORPHANS_INTERVAL_SECONDS", int(app.CLEANUP_ORPHANS_INTERVAL.Seconds()))
+	cleanupOrphansMinAge := GetOptionalInt("NOTEDOK_CLEANUP_ORPHANS_MIN_AGE_SECONDS", int(app.CLEANUP_ORPHANS_MIN_AGE.Seconds()))
+	err = app.SetCleanupOrphans(
+		GetBoolean("NOTEDOK_CLEANUP_ORPHANS"),
+		time.Duration(cleanupOrphansInterval)*time.Second,
+		time.Duration(cleanupOrphansMinAge)*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.StartOrphanCleanup(context.Background())
+
+	// configure the S3 call timings, logged at debug level
+	logS3Timings := GetBoolean("NOTEDOK_LOG_S3_TIMINGS")
+	app.SetLogS3Timings(logS3Timings)
+	if logS3Timings {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	// configure how many of the successful requests are logged
+	err = app.SetLogSampleN(GetOptionalInt("NOTEDOK_LOG_SAMPLE_N", app.LOG_SAMPLE_N))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// configure load shedding
+	err = app.SetMaxInflight(GetOptionalInt("NOTEDOK_MAX_INFLIGHT", app.MAX_INFLIGHT))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = app.SetMaxChangesPolls(GetOptionalInt("NOTEDOK_MAX_CHANGES_POLLS", app.MAX_CHANGES_POLLS))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// configure the limit for the fan-out operations
+	err = app.SetMaxS3Concurrency(GetOptionalInt("NOTEDOK_MAX_S3_CONCURRENCY", app.MAX_S3_CONCURRENCY))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// configure the user pools the id tokens are accepted from
+	tokenIssuers := GetOptionalList("NOTEDOK_TOKEN_ISSUERS", app.TOKEN_ISSUERS)
+	tokenAudiences := GetOptionalList("NOTEDOK_TOKEN_AUDIENCES", app.TOKEN_AUDIENCES)
+	err = app.SetTokenIssuersAndAudiences(tokenIssuers, tokenAudiences)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.SetTenantClaim(GetOptionalString("NOTEDOK_TENANT_CLAIM", ""))
+
+	// retrieve the keys for validating id tokens, and keep them fresh
+	// when the keys can't be retrieved, the service is not ready until the background refresh succeeds
+	err = app.InitKeySet()
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	app.StartKeySetRefresh(context.Background())
+
 	// initialize session encryption key
 	sessionEncryptionPassphrase := GetMandatoryString("NOTEDOK_SESSION_ENCRYPTION_PASSPHRASE")
 	app.SetEncryptionPassphrase(sessionEncryptionPassphrase)
+	app.SetSessionCookieEnabled(GetBoolean("NOTEDOK_SESSION_COOKIE"))
 
 	// initialize REST stats
 	reststats.Initialize(version)
 
+	// initialize version endpoint
+	app.SetVersion(version, buildTime)
+
+	// initialize health check
+	err = app.SetHealthTimeout(time.Duration(GetOptionalInt("NOTEDOK_HEALTH_TIMEOUT_MS", int(app.HEALTH_TIMEOUT.Milliseconds()))) * time.Millisecond)
+	if err != nil {
+		log.Fatal(err)
+	}
+	health.SetVersion(version)
+	health.RegisterComponent("s3", app.GetS3Status)
+	health.RegisterComponent("jwks", app.GetKeySetStatus)
+	health.RegisterComponent("stats", reststats.GetStatsSummary)
+	health.RegisterReadinessCheck("jwks", app.IsKeySetReady)
+	health.RegisterReadinessCheck("s3", app.IsS3Ready)
+
+	// configure the load balancers the client IP is taken from
+	err = app.SetTrustedProxies(GetOptionalList("NOTEDOK_TRUSTED_PROXIES", app.TRUSTED_PROXIES))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// configure router
+	app.SetFaviconPath(GetOptionalString("NOTEDOK_FAVICON_PATH", app.FAVICON_PATH))
+	err = app.SetBasePath(GetOptionalString("NOTEDOK_BASE_PATH", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.SetPrettyJson(GetBoolean("NOTEDOK_PRETTY_JSON"))
 	allowedOrigin := GetMandatoryString("NOTEDOK_ALLOW_ORIGIN")
 	router := gin.New()
 	app.SetupRouter(router, allowedOrigin)
@@ -46,15 +261,31 @@ func main() {
 	useTls := GetBoolean("NOTEDOK_TLS")
 	certFile := ""
 	keyFile := ""
+	var tlsMinVersion uint16
+	var tlsCipherSuites []uint16
+	httpRedirectPort := ""
 	if useTls {
 		certFile = GetMandatoryString("NOTEDOK_CERT_FILE")
 		keyFile = GetMandatoryString("NOTEDOK_KEY_FILE")
+
+		tlsMinVersion, err = server.ParseTlsVersion(GetOptionalString("NOTEDOK_TLS_MIN_VERSION", "1.2"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsCipherSuites, err = server.ParseTlsCipherSuites(GetOptionalList("NOTEDOK_TLS_CIPHER_SUITES", []string{}))
+		if err != nil {
+			log.Fatal(err)
+		}
+		httpRedirectPort = GetOptionalString("NOTEDOK_HTTP_REDIRECT_PORT", "")
 	}
 
 	serverConfig := &server.ServerConfiguration{
-		UseTls:   useTls,
-		CertFile: certFile,
-		KeyFile:  keyFile,
+		UseTls:           useTls,
+		CertFile:         certFile,
+		KeyFile:          keyFile,
+		TlsMinVersion:    tlsMinVersion,
+		TlsCipherSuites:  tlsCipherSuites,
+		HttpRedirectPort: httpRedirectPort,
 	}
 
 	// determine port
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -35,6 +36,7 @@ func HandleEndpointWithStats(handler gin.HandlerFunc) gin.HandlerFunc {
 		responseStats := &responseStatsData{
 			time:       start,
 			url:        c.Request.RequestURI,
+			route:      c.FullPath(),
 			statusCode: c.Writer.Status(),
 			duration:   duration,
 		}
@@ -51,6 +53,7 @@ func HandleWithStats(handler gin.HandlerFunc) gin.HandlerFunc {
 		responseStats := &responseStatsData{
 			time:       start,
 			url:        c.Request.RequestURI,
+			route:      c.FullPath(),
 			statusCode: c.Writer.Status(),
 			duration:   duration,
 		}
@@ -58,10 +61,12 @@ func HandleWithStats(handler gin.HandlerFunc) gin.HandlerFunc {
 	}
 }
 
-func UpdateResponseStatsOnRecover(start time.Time, url string, statusCode int) {
+// The route is the path as registered, e.g. "/files/:filename", empty when no route matched
+func UpdateResponseStatsOnRecover(start time.Time, url string, route string, statusCode int) {
 	responseStats := &responseStatsData{
 		time:       start,
 		url:        url,
+		route:      route,
 		statusCode: statusCode,
 		duration:   0,
 	}
@@ -75,18 +80,31 @@ func RequestCounter() gin.HandlerFunc {
 }
 
 type statsResult struct {
-	Version                             string                `json:"version"`
-	Uptime                              string                `json:"uptime"`
-	RequestsTotal                       int                   `json:"requests_total"`
-	TimeSinceLastRequest                string                `json:"time_since_last_request"`
-	RequestsByEndpoint                  map[string]int        `json:"requests_by_endpoint"`
-	Last1000Requests                    *last1000RequestsData `json:"last_1000_requests"`
-	ShortestInterval100RequestsReceived string                `json:"shortest_interval_100_requests_received"`
-	ResponsesAll                        map[string]int        `json:"responses_all"`
-	ResponsesLast1000                   map[string]int        `json:"responses_last_1000"`
-	RequestsLast10                      []*requestStatsData   `json:"requests_last_10"`
-	FailedRequestsLast10                []*requestStatsData   `json:"failed_requests_last_10"`
-	SlowRequestsLast10                  []*requestStatsData   `json:"slow_requests_last_10"`
+	Version                             string                            `json:"version"`
+	Uptime                              string                            `json:"uptime"`
+	RequestsTotal                       int                               `json:"requests_total"`
+	TimeSinceLastRequest                string                            `json:"time_since_last_request"`
+	RequestsByEndpoint                  map[string]int                    `json:"requests_by_endpoint"`
+	Last1000Requests                    *last1000RequestsData             `json:"last_1000_requests"`
+	ShortestInterval100RequestsReceived string                            `json:"shortest_interval_100_requests_received"`
+	ResponsesAll                        map[string]int                    `json:"responses_all"`
+	ResponsesLast1000                   map[string]int                    `json:"responses_last_1000"`
+	ResponsesByEndpoint                 map[string]*endpointResponsesData `json:"responses_by_endpoint"`
+	RequestsLast10                      []*requestStatsData               `json:"requests_last_10"`
+	FailedRequestsLast10                []*requestStatsData               `json:"failed_requests_last_10"`
+	SlowRequestsLast10                  []*requestStatsData               `json:"slow_requests_last_10"`
+	S3Operations                        map[string]map[string]int         `json:"s3_operations"` // by operation, then by outcome
+}
+
+// By route, e.g. "/files/:filename", so the same endpoint is counted together for every file
+type endpointResponsesData struct {
+	ResponsesAll map[string]int    `json:"responses_all"`
+	TopErrors    []*errorCountData `json:"top_errors"` // the most frequent error status codes, the most frequent first
+}
+
+type errorCountData struct {
+	StatusCode int `json:"statusCode"`
+	Count      int `json:"count"`
 }
 
 type requestStatsData struct {
@@ -121,14 +139,33 @@ func HandleGetStats(c *gin.Context) {
 		ShortestInterval100RequestsReceived: getTimeIntervalFormatted(stats.shortestSequenceDuration),
 		ResponsesAll:                        stats.responseStats,
 		ResponsesLast1000:                   responsesHistory,
+		ResponsesByEndpoint:                 getResponsesByEndpoint(stats.responsesByEndpoint),
 		RequestsLast10:                      requestsLast10,
 		FailedRequestsLast10:                failedRequestsLast10,
 		SlowRequestsLast10:                  slowRequestsLast10,
+		S3Operations:                        GetS3OperationCounts(),
 	}
 
 	c.JSON(http.StatusOK, result)
 }
 
+type statsSummaryResult struct {
+	RequestsTotal        int            `json:"requests_total"`
+	TimeSinceLastRequest string         `json:"time_since_last_request"`
+	ResponsesAll         map[string]int `json:"responses_all"`
+}
+
+// Returns the short version of the stats, to be included in the health check
+func GetStatsSummary() interface{} {
+	stats = getStats()
+
+	return &statsSummaryResult{
+		RequestsTotal:        stats.requestTotal,
+		TimeSinceLastRequest: getTimeDiffFormatted(stats.previousRequestTime, time.Now()),
+		ResponsesAll:         stats.responseStats,
+	}
+}
+
 func getTimeDiffFormatted(start time.Time, end time.Time) string {
 	return getTimeIntervalFormatted(end.Sub(start))
 }
@@ -162,6 +199,31 @@ func getResponseHistory(history []*responseStatsData) map[string]int {
 	return responsesHistory
 }
 
+func getResponsesByEndpoint(responsesByEndpoint map[string]*endpointStatsData) map[string]*endpointResponsesData {
+	result := make(map[string]*endpointResponsesData, len(responsesByEndpoint))
+	for route, endpointStats := range responsesByEndpoint {
+		topErrors := make([]*errorCountData, 0, len(endpointStats.errorCounts))
+		for statusCode, count := range endpointStats.errorCounts {
+			topErrors = append(topErrors, &errorCountData{StatusCode: statusCode, Count: count})
+		}
+		sort.Slice(topErrors, func(i, j int) bool {
+			if topErrors[i].Count != topErrors[j].Count {
+				return topErrors[i].Count > topErrors[j].Count
+			}
+			return topErrors[i].StatusCode < topErrors[j].StatusCode
+		})
+		if len(topErrors) > TOP_ERRORS {
+			topErrors = topErrors[:TOP_ERRORS]
+		}
+
+		result[route] = &endpointResponsesData{
+			ResponsesAll: endpointStats.responseStats,
+			TopErrors:    topErrors,
+		}
+	}
+	return result
+}
+
 func getLast10Requests(history []*responseStatsData) []*requestStatsData {
 	requestsLast10 := make([]*requestStatsData, 0, 10)
 	if len(history) > 0 {
@@ -0,0 +1,79 @@
+package reststats
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func useFreshStats(t *testing.T) {
+	original := stats
+	stats = newStats()
+	t.Cleanup(func() {
+		stats = original
+	})
+}
+
+func TestResponsesByEndpoint(t *testing.T) {
+	useFreshStats(t)
+	statusCodes := map[string][]int{
+		"/files/:filename": {200, 200, 304, 404, 404, 500, 409, 409, 409},
+		"/files":           {200},
+		"":                 {404}, // no route matched
+	}
+	for route, codes := range statusCodes {
+		for _, statusCode := range codes {
+			recordResponseStats(&responseStatsData{time: time.Now(), route: route, statusCode: statusCode})
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	HandleGetStats(c)
+
+	var result statsResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Could not parse the stats: %v", err)
+	}
+	if len(result.ResponsesByEndpoint) != 2 {
+		t.Fatalf("Expected 2 endpoints, actual: %d", len(result.ResponsesByEndpoint))
+	}
+
+	files := result.ResponsesByEndpoint["/files/:filename"]
+	expected := map[string]int{"1XX": 0, "2XX": 2, "3XX": 1, "4XX": 5, "5XX": 1}
+	for class, count := range expected {
+		if files.ResponsesAll[class] != count {
+			t.Errorf("Expected %d %s, actual: %d", count, class, files.ResponsesAll[class])
+		}
+	}
+	expectedErrors := []errorCountData{{409, 3}, {404, 2}, {500, 1}}
+	if len(files.TopErrors) != len(expectedErrors) {
+		t.Fatalf("Expected %d top errors, actual: %d", len(expectedErrors), len(files.TopErrors))
+	}
+	for i, expectedError := range expectedErrors {
+		if *files.TopErrors[i] != expectedError {
+			t.Errorf("Expected %+v at %d, actual: %+v", expectedError, i, *files.TopErrors[i])
+		}
+	}
+
+	if len(result.ResponsesByEndpoint["/files"].TopErrors) != 0 {
+		t.Errorf("Expected no errors for /files")
+	}
+}
+
+func TestTopErrorsAreLimited(t *testing.T) {
+	useFreshStats(t)
+	for statusCode := 400; statusCode < 400+TOP_ERRORS+3; statusCode++ {
+		recordResponseStats(&responseStatsData{time: time.Now(), route: "/files", statusCode: statusCode})
+	}
+
+	responses := getResponsesByEndpoint(stats.responsesByEndpoint)
+
+	if len(responses["/files"].TopErrors) != TOP_ERRORS {
+		t.Errorf("Expected %d top errors, actual: %d", TOP_ERRORS, len(responses["/files"].TopErrors))
+	}
+}
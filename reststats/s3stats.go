@@ -0,0 +1,39 @@
+package reststats
+
+var (
+	S3_OUTCOME_SUCCESS      = "success"
+	S3_OUTCOME_NOT_FOUND    = "not_found"
+	S3_OUTCOME_NOT_MODIFIED = "not_modified"
+	S3_OUTCOME_CONFLICT     = "conflict"
+	S3_OUTCOME_THROTTLED    = "throttled"
+	S3_OUTCOME_ERROR        = "error"
+)
+
+// Counts the S3 call by the operation, e.g. "GetObject", and the outcome, e.g. "success" or "throttled".
+// Called from the request handlers directly, not through the channels, so it works whether the stats are initialized or not.
+func CountS3Operation(operation string, outcome string) {
+	stats.s3OperationsLock.Lock()
+	defer stats.s3OperationsLock.Unlock()
+
+	outcomes, ok := stats.s3Operations[operation]
+	if !ok {
+		outcomes = map[string]int{}
+		stats.s3Operations[operation] = outcomes
+	}
+	outcomes[outcome]++
+}
+
+// Returns the copy of the counts by the operation and the outcome
+func GetS3OperationCounts() map[string]map[string]int {
+	stats.s3OperationsLock.Lock()
+	defer stats.s3OperationsLock.Unlock()
+
+	result := make(map[string]map[string]int, len(stats.s3Operations))
+	for operation, outcomes := range stats.s3Operations {
+		result[operation] = make(map[string]int, len(outcomes))
+		for outcome, count := range outcomes {
+			result[operation][outcome] = count
+		}
+	}
+	return result
+}
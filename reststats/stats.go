@@ -1,44 +1,63 @@
 package reststats
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 var CURIOSITY = 1000
 var CURIOSITY_FAILED = 100
 var CURIOSITY_SLOW = 100
 var SLOW_MS = 100
 var QUICK_SEQUENCE_SIZE = 100
+var TOP_ERRORS = 5
 
 type statsData struct {
 	started                  time.Time
 	requestTotal             int
 	requestsByEndpoint       map[string]int
 	responseStats            map[string]int
+	responsesByEndpoint      map[string]*endpointStatsData
 	currentRequestTime       time.Time
 	previousRequestTime      time.Time
 	history                  []*responseStatsData
 	historyOfFailed          []*responseStatsData
 	historyOfSlow            []*responseStatsData
 	shortestSequenceDuration time.Duration
+	s3Operations             map[string]map[string]int // by operation, then by outcome
+	s3OperationsLock         sync.Mutex
+}
+
+type endpointStatsData struct {
+	responseStats map[string]int
+	errorCounts   map[int]int // by status code, 4XX and 5XX only
 }
 
 type responseStatsData struct {
 	time       time.Time
 	url        string
+	route      string
 	statusCode int
 	duration   time.Duration
 }
 
-var stats = &statsData{
-	started:                  time.Now(),
-	requestTotal:             0,
-	requestsByEndpoint:       map[string]int{},
-	responseStats:            getEmptyCountsByStatusCodeMap(),
-	currentRequestTime:       time.Now(),
-	previousRequestTime:      time.Now(),
-	history:                  make([]*responseStatsData, 0, CURIOSITY),
-	historyOfFailed:          make([]*responseStatsData, 0, CURIOSITY_FAILED),
-	historyOfSlow:            make([]*responseStatsData, 0, CURIOSITY_SLOW),
-	shortestSequenceDuration: -1,
+var stats = newStats()
+
+func newStats() *statsData {
+	return &statsData{
+		started:                  time.Now(),
+		requestTotal:             0,
+		requestsByEndpoint:       map[string]int{},
+		responseStats:            getEmptyCountsByStatusCodeMap(),
+		responsesByEndpoint:      map[string]*endpointStatsData{},
+		currentRequestTime:       time.Now(),
+		previousRequestTime:      time.Now(),
+		history:                  make([]*responseStatsData, 0, CURIOSITY),
+		historyOfFailed:          make([]*responseStatsData, 0, CURIOSITY_FAILED),
+		historyOfSlow:            make([]*responseStatsData, 0, CURIOSITY_SLOW),
+		shortestSequenceDuration: -1,
+		s3Operations:             map[string]map[string]int{},
+	}
 }
 
 func getStats() *statsData {
@@ -80,23 +99,47 @@ func countRequestsByEndpoint(ch <-chan string) {
 func updateResponseStats(ch <-chan *responseStatsData) {
 	for {
 		responseStats := <-ch
-		stats.history = shiftAndPush(stats.history, responseStats, CURIOSITY)
-		if responseStats.statusCode >= 400 {
-			stats.historyOfFailed = shiftAndPush(stats.historyOfFailed, responseStats, CURIOSITY_FAILED)
-		}
-		if responseStats.duration >= time.Duration(SLOW_MS)*time.Millisecond {
-			stats.historyOfSlow = shiftAndPush(stats.historyOfSlow, responseStats, CURIOSITY_SLOW)
-		}
+		recordResponseStats(responseStats)
+	}
+}
+
+func recordResponseStats(responseStats *responseStatsData) {
+	stats.history = shiftAndPush(stats.history, responseStats, CURIOSITY)
+	if responseStats.statusCode >= 400 {
+		stats.historyOfFailed = shiftAndPush(stats.historyOfFailed, responseStats, CURIOSITY_FAILED)
+	}
+	if responseStats.duration >= time.Duration(SLOW_MS)*time.Millisecond {
+		stats.historyOfSlow = shiftAndPush(stats.historyOfSlow, responseStats, CURIOSITY_SLOW)
+	}
 
-		updateCountsByStatusCodeMap(stats.responseStats, responseStats.statusCode)
+	updateCountsByStatusCodeMap(stats.responseStats, responseStats.statusCode)
+	updateEndpointStats(responseStats.route, responseStats.statusCode)
+
+	if len(stats.history) >= QUICK_SEQUENCE_SIZE {
+		lastSequenceDuration := stats.history[len(stats.history)-1].time.Sub(
+			stats.history[len(stats.history)-QUICK_SEQUENCE_SIZE].time)
+		if stats.shortestSequenceDuration == -1 || stats.shortestSequenceDuration > lastSequenceDuration {
+			stats.shortestSequenceDuration = lastSequenceDuration
+		}
+	}
+}
 
-		if len(stats.history) >= QUICK_SEQUENCE_SIZE {
-			lastSequenceDuration := stats.history[len(stats.history)-1].time.Sub(
-				stats.history[len(stats.history)-QUICK_SEQUENCE_SIZE].time)
-			if stats.shortestSequenceDuration == -1 || stats.shortestSequenceDuration > lastSequenceDuration {
-				stats.shortestSequenceDuration = lastSequenceDuration
-			}
+// The responses that didn't match any route, e.g. 404, are only counted in total
+func updateEndpointStats(route string, statusCode int) {
+	if route == "" {
+		return
+	}
+	endpointStats, ok := stats.responsesByEndpoint[route]
+	if !ok {
+		endpointStats = &endpointStatsData{
+			responseStats: getEmptyCountsByStatusCodeMap(),
+			errorCounts:   map[int]int{},
 		}
+		stats.responsesByEndpoint[route] = endpointStats
+	}
+	updateCountsByStatusCodeMap(endpointStats.responseStats, statusCode)
+	if statusCode >= 400 {
+		endpointStats.errorCounts[statusCode]++
 	}
 }
 
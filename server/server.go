@@ -2,6 +2,9 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
 	"net/http"
 	"os/signal"
 	"syscall"
@@ -16,6 +19,62 @@ type ServerConfiguration struct {
 	UseTls   bool
 	CertFile string
 	KeyFile  string
+	// 0 means TLS 1.2, the older versions are not allowed unless set explicitly
+	TlsMinVersion uint16
+	// empty means the Go defaults, only applies to TLS 1.2, the TLS 1.3 suites are not configurable
+	TlsCipherSuites []uint16
+	// in Gin format, e.g. ":8080", empty means no redirect, only used with TLS
+	HttpRedirectPort string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Parses the TLS version given as "1.2" or "1.3"
+func ParseTlsVersion(version string) (uint16, error) {
+	val, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("invalid TLS version '%s', should be one of '1.0', '1.1', '1.2', '1.3'", version)
+	}
+	return val, nil
+}
+
+// Parses the cipher suites given by their standard names, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+// Only the suites Go considers secure are accepted.
+func ParseTlsCipherSuites(names []string) ([]uint16, error) {
+	suites := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+
+	ids := []uint16{}
+	for _, name := range names {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid or insecure TLS cipher suite '%s'", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func newTlsConfig(config *ServerConfiguration) *tls.Config {
+	minVersion := config.TlsMinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: minVersion,
+	}
+	if len(config.TlsCipherSuites) > 0 {
+		tlsConfig.CipherSuites = config.TlsCipherSuites
+	}
+	return tlsConfig
 }
 
 // Starts serving requests on a specified port with graceful shutdown support
@@ -33,14 +92,17 @@ func Serve(router *gin.Engine, port string, config *ServerConfiguration, callbac
 	ctx, restoreInterrupt := getNotifyContextForInterruptSignals()
 	defer restoreInterrupt()
 
-	httpServer := startServingAsync(router, port, config)
+	httpServers := []*http.Server{startServingAsync(router, port, config)}
+	if config.UseTls && config.HttpRedirectPort != "" {
+		httpServers = append(httpServers, startRedirectingAsync(config.HttpRedirectPort, port))
+	}
 	if callback != nil {
 		callback()
 	}
 
 	waitForInterruptSignal(ctx)
 	restoreInterrupt()
-	shutDownWithTimeout(httpServer, 5*time.Second)
+	shutDownWithTimeout(5*time.Second, httpServers...)
 }
 
 func getNotifyContextForInterruptSignals() (context.Context, context.CancelFunc) {
@@ -60,6 +122,7 @@ func startServingAsync(router *gin.Engine, port string, config *ServerConfigurat
 	}
 
 	if config.UseTls {
+		httpServer.TLSConfig = newTlsConfig(config)
 		go listenAndServeTLS(httpServer, config.CertFile, config.KeyFile)
 	} else {
 		go listenAndServe(httpServer)
@@ -68,6 +131,39 @@ func startServingAsync(router *gin.Engine, port string, config *ServerConfigurat
 	return httpServer
 }
 
+// Starts the plain HTTP listener that only redirects every request to the same URL on HTTPS, served on tlsPort
+func startRedirectingAsync(port string, tlsPort string) *http.Server {
+	log.Printf("Starting redirect to HTTPS on port %s", port)
+
+	httpServer := &http.Server{
+		Addr:    port,
+		Handler: newRedirectHandler(tlsPort),
+	}
+
+	go listenAndServe(httpServer)
+
+	return httpServer
+}
+
+// Redirects to the same host and path on HTTPS, the port is left out when it is the default 443
+func newRedirectHandler(tlsPort string) http.Handler {
+	_, portNumber, err := net.SplitHostPort(tlsPort)
+	if err != nil || portNumber == "443" {
+		portNumber = ""
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host // no port in the Host header
+		}
+		if portNumber != "" {
+			host = net.JoinHostPort(host, portNumber)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
 func listenAndServe(httpServer *http.Server) {
 	err := httpServer.ListenAndServe()
 	if err != nil && err != http.ErrServerClosed {
@@ -82,13 +178,15 @@ func listenAndServeTLS(httpServer *http.Server, certFile string, keyFile string)
 	}
 }
 
-func shutDownWithTimeout(httpServer *http.Server, timeout time.Duration) {
+func shutDownWithTimeout(timeout time.Duration, httpServers ...*http.Server) {
 	log.Println("Shutting down gracefully, press Ctrl+C again to force")
 
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	if err := httpServer.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown: ", err)
+	for _, httpServer := range httpServers {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Fatal("Server forced to shutdown: ", err)
+		}
 	}
 
 	log.Println("Server exiting")
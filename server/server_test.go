@@ -0,0 +1,104 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestNewTlsConfigDefaultsToTls12(t *testing.T) {
+	config := &ServerConfiguration{UseTls: true, CertFile: "cert.pem", KeyFile: "key.pem"}
+
+	tlsConfig := newTlsConfig(config)
+
+	if tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Expected MinVersion TLS 1.2, actual: %x", tlsConfig.MinVersion)
+	}
+	if tlsConfig.CipherSuites != nil {
+		t.Errorf("Expected default cipher suites, actual: %v", tlsConfig.CipherSuites)
+	}
+}
+
+func TestNewTlsConfigWithMinVersionAndCipherSuites(t *testing.T) {
+	minVersion, err := ParseTlsVersion("1.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherSuites, err := ParseTlsCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ServerConfiguration{UseTls: true, TlsMinVersion: minVersion, TlsCipherSuites: cipherSuites}
+
+	tlsConfig := newTlsConfig(config)
+
+	if tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("Expected MinVersion TLS 1.3, actual: %x", tlsConfig.MinVersion)
+	}
+	expected := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	if !slices.Equal(tlsConfig.CipherSuites, expected) {
+		t.Errorf("Expected cipher suites %v, actual: %v", expected, tlsConfig.CipherSuites)
+	}
+}
+
+func TestParseTlsVersionInvalid(t *testing.T) {
+	_, err := ParseTlsVersion("TLS1.2")
+
+	if err == nil {
+		t.Errorf("Expected error for invalid TLS version")
+	}
+}
+
+func TestParseTlsCipherSuitesRejectsInsecure(t *testing.T) {
+	_, err := ParseTlsCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+
+	if err == nil {
+		t.Errorf("Expected error for insecure cipher suite")
+	}
+}
+
+func TestRedirectListenerRedirectsToHttps(t *testing.T) {
+	listener := httptest.NewServer(newRedirectHandler(":8700"))
+	defer listener.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, listener.URL+"/files/note.md?x=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "notes.example.com"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("Expected 301, actual: %d", resp.StatusCode)
+	}
+	expected := "https://notes.example.com:8700/files/note.md?x=1"
+	if location := resp.Header.Get("Location"); location != expected {
+		t.Errorf("Expected Location '%s', actual: '%s'", expected, location)
+	}
+}
+
+func TestRedirectLeavesOutDefaultHttpsPort(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://notes.example.com:80/signin", nil)
+	w := httptest.NewRecorder()
+
+	newRedirectHandler(":443").ServeHTTP(w, req)
+
+	if w.Code != http.StatusMovedPermanently {
+		t.Fatalf("Expected 301, actual: %d", w.Code)
+	}
+	expected := "https://notes.example.com/signin"
+	if location := w.Header().Get("Location"); location != expected {
+		t.Errorf("Expected Location '%s', actual: '%s'", expected, location)
+	}
+}